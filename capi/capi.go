@@ -0,0 +1,269 @@
+// capi exports the packetforward client as a C shared library. See
+// packetforward.h for the API and memory ownership rules.
+package main
+
+/*
+#include <stdlib.h>
+#include "packetforward.h"
+
+// pf_delivering is the client whose callback is running on this thread, if any
+static __thread pf_client pf_delivering = 0;
+
+static void pf_deliver(pf_client client, pf_packet_callback callback, void *ctx, uint8_t *packet, int32_t len) {
+	pf_delivering = client;
+	callback(ctx, packet, len);
+	pf_delivering = 0;
+}
+
+static pf_client pf_delivering_client() {
+	return pf_delivering;
+}
+
+static void pf_log(pf_log_callback callback, void *ctx, int32_t level, char *message) {
+	callback(ctx, level, message);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/packetforward"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+var log = golog.LoggerFor("packetforward.capi")
+
+const (
+	defaultIdleTimeout = 70 * time.Second
+
+	// maxPacketSize bounds the length of packets accepted from C
+	maxPacketSize = 1 << 16
+)
+
+var (
+	clients    = make(map[int64]*client)
+	nextHandle int64
+	clientsMx  sync.Mutex
+)
+
+type client struct {
+	packetsUp   uint64
+	bytesUp     uint64
+	packetsDown uint64
+	bytesDown   uint64
+	writeErrors uint64
+	handle      C.pf_client
+	pf          io.WriteCloser
+	callback    C.pf_packet_callback
+	ctx         unsafe.Pointer
+	closed      bool
+	log         logging.Logger
+	mx          sync.RWMutex
+}
+
+// Write implements io.Writer and delivers downstream packets to the callback.
+func (c *client) Write(b []byte) (int, error) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	if c.closed || len(b) == 0 {
+		return len(b), nil
+	}
+	atomic.AddUint64(&c.packetsDown, 1)
+	atomic.AddUint64(&c.bytesDown, uint64(len(b)))
+	C.pf_deliver(c.handle, c.callback, c.ctx, (*C.uint8_t)(unsafe.Pointer(&b[0])), C.int32_t(len(b)))
+	return len(b), nil
+}
+
+//export pf_client_new
+func pf_client_new(opts *C.pf_options, callback C.pf_packet_callback, ctx unsafe.Pointer) C.pf_client {
+	if opts == nil || opts.server_addr == nil || callback == nil {
+		return C.PF_ERR_INVALID_ARGUMENT
+	}
+	serverAddr := C.GoString(opts.server_addr)
+	idleTimeout := time.Duration(opts.idle_timeout_ms) * time.Millisecond
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	pfOpts := &packetforward.Opts{
+		ID:          goStringOrEmpty(opts.id),
+		IdleTimeout: idleTimeout,
+		DialServer: func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", serverAddr)
+		},
+		Username: goStringOrEmpty(opts.username),
+		Password: goStringOrEmpty(opts.password),
+	}
+	logger := logging.FromGolog(log)
+	if opts.log != nil {
+		logger = &cLogger{callback: opts.log, ctx: ctx}
+		pfOpts.Logger = logger
+	}
+	if opts.ethernet != 0 {
+		pfOpts.Mode = protocol.ModeEthernet
+	}
+	if pfOpts.ID != "" && len(pfOpts.ID) != protocol.IDLength {
+		logger.Errorf("Client ID must be %d characters long", protocol.IDLength)
+		return C.PF_ERR_INVALID_ARGUMENT
+	}
+
+	clientsMx.Lock()
+	nextHandle++
+	handle := nextHandle
+	clientsMx.Unlock()
+
+	c := &client{
+		handle:   C.pf_client(handle),
+		callback: callback,
+		ctx:      ctx,
+		log:      logger,
+	}
+	c.pf = packetforward.NewClient(c, pfOpts)
+
+	clientsMx.Lock()
+	clients[handle] = c
+	clientsMx.Unlock()
+	return C.pf_client(handle)
+}
+
+func goStringOrEmpty(s *C.char) string {
+	if s == nil {
+		return ""
+	}
+	return C.GoString(s)
+}
+
+// cLogger is a logging.Logger that passes lines to a pf_log_callback.
+type cLogger struct {
+	callback C.pf_log_callback
+	ctx      unsafe.Pointer
+	prefix   string
+}
+
+func (l *cLogger) Debugf(format string, args ...interface{}) {
+	l.log(C.PF_LOG_DEBUG, format, args...)
+}
+
+func (l *cLogger) Errorf(format string, args ...interface{}) {
+	l.log(C.PF_LOG_ERROR, format, args...)
+}
+
+func (l *cLogger) With(keyvals ...interface{}) logging.Logger {
+	prefix := l.prefix
+	for i := 0; i < len(keyvals); i += 2 {
+		var value interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		prefix += fmt.Sprintf("%v=%v ", keyvals[i], value)
+	}
+	return &cLogger{callback: l.callback, ctx: l.ctx, prefix: prefix}
+}
+
+func (l *cLogger) log(level C.int32_t, format string, args ...interface{}) {
+	message := C.CString(l.prefix + fmt.Sprintf(format, args...))
+	defer C.free(unsafe.Pointer(message))
+	C.pf_log(l.callback, l.ctx, level, message)
+}
+
+func getClient(handle C.pf_client) *client {
+	clientsMx.Lock()
+	defer clientsMx.Unlock()
+	return clients[int64(handle)]
+}
+
+//export pf_client_write
+func pf_client_write(handle C.pf_client, packet *C.uint8_t, length C.int32_t) C.int32_t {
+	c := getClient(handle)
+	if c == nil {
+		return C.PF_ERR_INVALID_HANDLE
+	}
+	if packet == nil || length <= 0 || length > maxPacketSize {
+		return C.PF_ERR_INVALID_ARGUMENT
+	}
+	// the packet stays in C memory, the client doesn't retain it past the call
+	b := (*[maxPacketSize]byte)(unsafe.Pointer(packet))[:length:length]
+	if _, err := c.pf.Write(b); err != nil {
+		atomic.AddUint64(&c.writeErrors, 1)
+		c.log.Debugf("Unable to write packet: %v", err)
+		return errorCode(err)
+	}
+	atomic.AddUint64(&c.packetsUp, 1)
+	atomic.AddUint64(&c.bytesUp, uint64(length))
+	return C.PF_OK
+}
+
+// errorCode maps a write error to the most specific error code
+func errorCode(err error) C.int32_t {
+	switch {
+	case errors.Is(err, packetforward.ErrClosed):
+		return C.PF_ERR_CLOSED
+	case errors.Is(err, packetforward.ErrAuthRejected):
+		return C.PF_ERR_AUTH_REJECTED
+	case errors.Is(err, packetforward.ErrServerUnreachable):
+		return C.PF_ERR_SERVER_UNREACHABLE
+	case errors.Is(err, packetforward.ErrAuthUnavailable):
+		return C.PF_ERR_AUTH_UNAVAILABLE
+	case errors.Is(err, packetforward.ErrHandshakeFailed):
+		return C.PF_ERR_HANDSHAKE_FAILED
+	case errors.Is(err, packetforward.ErrSessionEvicted):
+		return C.PF_ERR_SESSION_EVICTED
+	case errors.Is(err, packetforward.ErrQuotaExceeded):
+		return C.PF_ERR_QUOTA_EXCEEDED
+	case errors.Is(err, packetforward.ErrPolicyDenied):
+		return C.PF_ERR_POLICY_DENIED
+	default:
+		return C.PF_ERR_WRITE
+	}
+}
+
+//export pf_client_stats
+func pf_client_stats(handle C.pf_client, stats *C.pf_stats) C.int32_t {
+	c := getClient(handle)
+	if c == nil {
+		return C.PF_ERR_INVALID_HANDLE
+	}
+	if stats == nil {
+		return C.PF_ERR_INVALID_ARGUMENT
+	}
+	stats.packets_up = C.uint64_t(atomic.LoadUint64(&c.packetsUp))
+	stats.bytes_up = C.uint64_t(atomic.LoadUint64(&c.bytesUp))
+	stats.packets_down = C.uint64_t(atomic.LoadUint64(&c.packetsDown))
+	stats.bytes_down = C.uint64_t(atomic.LoadUint64(&c.bytesDown))
+	stats.write_errors = C.uint64_t(atomic.LoadUint64(&c.writeErrors))
+	return C.PF_OK
+}
+
+//export pf_client_close
+func pf_client_close(handle C.pf_client) C.int32_t {
+	if C.pf_delivering_client() == handle {
+		// closing waits for the callback to return, so it would never finish
+		return C.PF_ERR_IN_CALLBACK
+	}
+	clientsMx.Lock()
+	c := clients[int64(handle)]
+	delete(clients, int64(handle))
+	clientsMx.Unlock()
+	if c == nil {
+		return C.PF_ERR_INVALID_HANDLE
+	}
+	c.pf.Close()
+	// wait for any in-progress callback and prevent further ones
+	c.mx.Lock()
+	c.closed = true
+	c.mx.Unlock()
+	return C.PF_OK
+}
+
+func main() {}
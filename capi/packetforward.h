@@ -0,0 +1,127 @@
+/*
+ * C API for the packetforward client.
+ *
+ * Build the shared library with "go build -buildmode=c-shared" (see Makefile).
+ *
+ * Memory ownership:
+ *
+ * - Packets passed to pf_client_write remain owned by the caller. The library
+ *   doesn't retain them, so they may be reused as soon as the call returns.
+ * - Packets passed to the pf_packet_callback are owned by the library and are
+ *   only valid for the duration of the callback. Callbacks that need the packet
+ *   afterwards must copy it.
+ * - Strings in pf_options are copied by pf_client_new and may be freed after it
+ *   returns.
+ * - Messages passed to the pf_log_callback are owned by the library and are
+ *   only valid for the duration of the callback.
+ * - The ctx pointer is passed through to callbacks untouched. It must remain
+ *   valid until pf_client_close returns.
+ */
+#ifndef PACKETFORWARD_H
+#define PACKETFORWARD_H
+
+#include <stdint.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+/* Handle for a client. Valid handles are positive. */
+typedef int64_t pf_client;
+
+/* Error codes returned by the functions below. */
+#define PF_OK 0
+#define PF_ERR_INVALID_HANDLE -1
+#define PF_ERR_INVALID_ARGUMENT -2
+#define PF_ERR_WRITE -3
+#define PF_ERR_CLOSED -4
+#define PF_ERR_AUTH_REJECTED -5
+#define PF_ERR_SERVER_UNREACHABLE -6
+#define PF_ERR_HANDSHAKE_FAILED -7
+#define PF_ERR_SESSION_EVICTED -8
+#define PF_ERR_QUOTA_EXCEEDED -9
+#define PF_ERR_POLICY_DENIED -10
+#define PF_ERR_AUTH_UNAVAILABLE -11
+#define PF_ERR_IN_CALLBACK -12
+
+/*
+ * Called with every packet received from the server. It's called from a thread
+ * owned by the library, one packet at a time, and must not block for long.
+ * It must not call pf_client_close for its own client.
+ */
+typedef void (*pf_packet_callback)(void *ctx, uint8_t *packet, int32_t len);
+
+/* Log levels passed to the pf_log_callback. */
+#define PF_LOG_DEBUG 0
+#define PF_LOG_ERROR 1
+
+/*
+ * Called with every line that the library logs for a client, with one of the
+ * PF_LOG_* levels. It may be called from any thread, concurrently, and must not
+ * block for long.
+ */
+typedef void (*pf_log_callback)(void *ctx, int32_t level, const char *message);
+
+typedef struct {
+	/* Address (host:port) of the packetforward server, dialed over TCP. Required. */
+	char *server_addr;
+
+	/* Client ID, a 36 character string formatted UUID. If NULL, a random ID is used. */
+	char *id;
+
+	/* Credentials sent to the server during the handshake. May be NULL. */
+	char *username;
+	char *password;
+
+	/* Idle timeout in milliseconds. If 0, defaults to 70 seconds. */
+	int32_t idle_timeout_ms;
+
+	/* If nonzero, forward Ethernet frames instead of IP packets. */
+	int32_t ethernet;
+
+	/*
+	 * Receives the client's log lines, with the ctx passed to pf_client_new. If
+	 * NULL, the library logs to stderr.
+	 */
+	pf_log_callback log;
+} pf_options;
+
+typedef struct {
+	uint64_t packets_up;
+	uint64_t bytes_up;
+	uint64_t packets_down;
+	uint64_t bytes_down;
+	uint64_t write_errors;
+} pf_stats;
+
+/*
+ * Creates a client. Returns a handle, or a negative error code. The client
+ * connects to the server when the first packet is written.
+ */
+pf_client pf_client_new(pf_options *opts, pf_packet_callback callback, void *ctx);
+
+/*
+ * Writes a single packet to the server. Blocks while (re)connecting to the
+ * server. Returns PF_OK or a negative error code. PF_ERR_WRITE is returned for
+ * errors that don't have a more specific code. Must not be called concurrently
+ * for the same client.
+ */
+int32_t pf_client_write(pf_client client, uint8_t *packet, int32_t len);
+
+/* Fills in stats for the client. Returns PF_OK or a negative error code. */
+int32_t pf_client_stats(pf_client client, pf_stats *stats);
+
+/*
+ * Closes the client and releases its resources. Once it returns, no more
+ * callbacks are made. Must not be called concurrently with pf_client_write for
+ * the same client. Must not be called from the client's own callback, since it
+ * waits for the callback to return; such calls fail with PF_ERR_IN_CALLBACK and
+ * leave the client open. Returns PF_OK or a negative error code.
+ */
+int32_t pf_client_close(pf_client client);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* PACKETFORWARD_H */
@@ -0,0 +1,111 @@
+/*
+ * Smoke test for the packetforward C API. Sends a DNS query for example.com
+ * from 10.0.0.2 to 8.8.8.8 through a packetforward server and waits for the
+ * response.
+ *
+ * Usage: pftest <server host:port>
+ */
+#include <stdio.h>
+#include <string.h>
+#include <unistd.h>
+
+#include "packetforward.h"
+
+static volatile int received = 0;
+
+static void on_packet(void *ctx, uint8_t *packet, int32_t len) {
+	const char *name = ctx;
+	printf("%s: received %d byte packet\n", name, len);
+	received++;
+}
+
+static void on_log(void *ctx, int32_t level, const char *message) {
+	const char *name = ctx;
+	fprintf(stderr, "%s: %s %s\n", name, level == PF_LOG_ERROR ? "ERROR" : "DEBUG", message);
+}
+
+static uint16_t checksum(const uint8_t *b, int len) {
+	uint32_t sum = 0;
+	for (int i = 0; i + 1 < len; i += 2) {
+		sum += (b[i] << 8) | b[i + 1];
+	}
+	while (sum > 0xffff) {
+		sum = (sum >> 16) + (sum & 0xffff);
+	}
+	return ~sum;
+}
+
+/* builds an IPv4 UDP DNS query, leaving the UDP checksum empty */
+static int build_query(uint8_t *pkt) {
+	static const uint8_t dns[] = {
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0x00, 0x01, 0x00, 0x01,
+	};
+	int udp_len = 8 + sizeof(dns);
+	int len = 20 + udp_len;
+	memset(pkt, 0, len);
+	pkt[0] = 0x45;
+	pkt[2] = len >> 8;
+	pkt[3] = len & 0xff;
+	pkt[8] = 64;
+	pkt[9] = 17;
+	memcpy(pkt + 12, (uint8_t[]){10, 0, 0, 2}, 4);
+	memcpy(pkt + 16, (uint8_t[]){8, 8, 8, 8}, 4);
+	uint16_t ip_sum = checksum(pkt, 20);
+	pkt[10] = ip_sum >> 8;
+	pkt[11] = ip_sum & 0xff;
+	pkt[20] = 0xc3;
+	pkt[21] = 0x50;
+	pkt[23] = 53;
+	pkt[24] = udp_len >> 8;
+	pkt[25] = udp_len & 0xff;
+	memcpy(pkt + 28, dns, sizeof(dns));
+	return len;
+}
+
+int main(int argc, char **argv) {
+	if (argc != 2) {
+		fprintf(stderr, "usage: %s <server host:port>\n", argv[0]);
+		return 2;
+	}
+
+	pf_options opts = {0};
+	opts.server_addr = argv[1];
+	opts.idle_timeout_ms = 5000;
+	opts.log = on_log;
+	pf_client client = pf_client_new(&opts, on_packet, "pftest");
+	if (client <= 0) {
+		fprintf(stderr, "pf_client_new failed: %lld\n", (long long)client);
+		return 1;
+	}
+
+	uint8_t pkt[128];
+	int len = build_query(pkt);
+	int32_t result = pf_client_write(client, pkt, len);
+	if (result != PF_OK) {
+		fprintf(stderr, "pf_client_write failed: %d\n", result);
+		return 1;
+	}
+
+	for (int i = 0; i < 50 && !received; i++) {
+		usleep(100000);
+	}
+
+	pf_stats stats;
+	pf_client_stats(client, &stats);
+	printf("up: %llu packets, %llu bytes; down: %llu packets, %llu bytes; write errors: %llu\n",
+		(unsigned long long)stats.packets_up, (unsigned long long)stats.bytes_up,
+		(unsigned long long)stats.packets_down, (unsigned long long)stats.bytes_down,
+		(unsigned long long)stats.write_errors);
+
+	if (pf_client_close(client) != PF_OK) {
+		fprintf(stderr, "pf_client_close failed\n");
+		return 1;
+	}
+	if (pf_client_close(client) != PF_ERR_INVALID_HANDLE) {
+		fprintf(stderr, "closing twice should fail\n");
+		return 1;
+	}
+	return received ? 0 : 1;
+}
@@ -14,14 +14,19 @@ import (
 	"io"
 	"math"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/getlantern/errors"
 	"github.com/getlantern/framed"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/gonat"
 	"github.com/getlantern/idletiming"
 	"github.com/getlantern/ops"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/pferrors"
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/protocol"
 	"github.com/getlantern/uuid"
 )
 
@@ -35,14 +40,93 @@ const (
 // in the provided Context.
 type DialFunc func(ctx context.Context) (net.Conn, error)
 
+// Opts configures a packetforward client.
+type Opts struct {
+	// ID, if specified, identifies this client to the server, which allows the server to track
+	// usage across restarts of the client. It must be a 36 character string formatted UUID. If
+	// not specified, a random ID is generated.
+	ID string
+
+	// IdleTimeout specifies a timeout for idle clients. When the client to server connection
+	// remains idle for longer than IdleTimeout, it is automatically closed.
+	IdleTimeout time.Duration
+
+	// DialServer configures how to connect to the packetforward server.
+	DialServer DialFunc
+
+	// ReconnectTimeout, if specified, limits how long Write keeps trying to connect to the
+	// server before giving up with ErrServerUnreachable. By default, Write keeps trying
+	// indefinitely.
+	ReconnectTimeout time.Duration
+
+	// Username and Password, if specified, are sent to the server during the handshake so
+	// that the server can authenticate the client.
+	Username string
+	Password string
+
+	// Mode determines what kind of traffic the client forwards. By default, clients forward IP
+	// packets (for example from a TUN device). With protocol.ModeEthernet, clients forward
+	// Ethernet frames (for example from a TAP device), which the server bridges into a local
+	// network. The server must support the requested mode.
+	Mode protocol.Mode
+
+	// RedundantDialServer, if specified, configures how to connect a secondary path to the
+	// server, typically over a different network (for example cellular in addition to WiFi).
+	// Packets selected by Redundant are sent over both paths and the receiving side uses
+	// whichever copy arrives first, which hides loss on either link at the cost of extra
+	// bandwidth. The server likewise duplicates its redundant packets over both paths.
+	RedundantDialServer DialFunc
+
+	// Logger, if specified, is used for logging instead of the default golog logger. Every line
+	// is tagged with the client's ID as "session".
+	Logger logging.Logger
+
+	// Redundant selects which packets to send over both paths. If not specified, defaults to
+	// protocol.RealTime (protocol.RealTimeFrame in Ethernet mode), which duplicates
+	// real-time traffic like VoIP and gaming while keeping bulk transfers off the secondary
+	// path.
+	Redundant func(pkt []byte) bool
+
+	// TrafficBreakdown, if positive, makes the client track which destination IPs, ports and
+	// protocols use the most traffic, reporting the top TrafficBreakdown of each through
+	// Forwarder.Traffic. Tracking costs some CPU for every packet.
+	TrafficBreakdown int
+
+	// ReverseDNS, if true, labels destinations in the traffic breakdown with the names that
+	// resolved to them, as learned from DNS responses passing through the client.
+	ReverseDNS bool
+
+	// Pipeline, if specified, runs every packet written to the client and every packet received
+	// from the server through a chain of handlers, which can drop or rewrite them. Responses to
+	// packets written to the client are delivered downstream and responses to packets from the
+	// server are sent back to the server.
+	Pipeline *pipeline.Chain
+}
+
 type forwarder struct {
+	stats                 clientStats
 	id                    string
 	downstream            io.Writer
+	log                   logging.Logger
 	idleTimeout           time.Duration
 	dialServer            DialFunc
+	reconnectTimeout      time.Duration
+	handshake             *protocol.Handshake
 	upstreamConn          net.Conn
+	upstreamLog           logging.Logger
 	upstream              io.ReadWriteCloser
 	copyToDownstreamError chan error
+	copying               bool
+	fatalErr              error
+	redundant             func([]byte) bool
+	secondary             *secondaryPath
+	traffic               *trafficTracker
+	pipeline              *pipeline.Chain
+	sequence              uint64
+	dedup                 protocol.Deduplicator
+	downstreamMx          sync.Mutex
+	upstreamMx            sync.Mutex
+	closed                int32
 }
 
 // Client creates a new packetforward client and returns a WriteCloser. Consumers of packetforward
@@ -52,31 +136,99 @@ type forwarder struct {
 // closed. dialServer configures how to connect to the packetforward server. When packetforwarding is
 // no longer needed, consumers should Close the returned WriteCloser to clean up any outstanding resources.
 func Client(downstream io.Writer, idleTimeout time.Duration, dialServer DialFunc) io.WriteCloser {
-	id := uuid.New().String()
-	return &forwarder{
+	return NewClient(downstream, &Opts{
+		IdleTimeout: idleTimeout,
+		DialServer:  dialServer,
+	})
+}
+
+// NewClient is like Client but allows specifying additional options. The
+// returned Forwarder also provides statistics.
+func NewClient(downstream io.Writer, opts *Opts) Forwarder {
+	id := opts.ID
+	if id == "" {
+		id = uuid.New().String()
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = logging.FromGolog(log)
+	}
+	f := &forwarder{
 		id:                    id,
 		downstream:            downstream,
-		idleTimeout:           idleTimeout,
-		dialServer:            dialServer,
+		log:                   logger.With("session", id),
+		idleTimeout:           opts.IdleTimeout,
+		dialServer:            opts.DialServer,
+		reconnectTimeout:      opts.ReconnectTimeout,
+		pipeline:              opts.Pipeline,
 		copyToDownstreamError: make(chan error, 1),
 	}
+	records := opts.RedundantDialServer != nil
+	if opts.Username != "" || opts.Password != "" || opts.Mode != protocol.ModeIP || records {
+		f.handshake = &protocol.Handshake{
+			Username: opts.Username,
+			Password: opts.Password,
+			Mode:     opts.Mode,
+			Records:  records,
+		}
+	}
+	if opts.TrafficBreakdown > 0 {
+		f.traffic = newTrafficTracker(opts.TrafficBreakdown, opts.Mode == protocol.ModeEthernet, opts.ReverseDNS)
+	}
+	if records {
+		f.redundant = opts.Redundant
+		if f.redundant == nil {
+			f.redundant = protocol.RealTime
+			if opts.Mode == protocol.ModeEthernet {
+				f.redundant = protocol.RealTimeFrame
+			}
+		}
+		f.secondary = &secondaryPath{f: f, dial: opts.RedundantDialServer}
+	}
+	return f
 }
 
 func (f *forwarder) Write(b []byte) (int, error) {
-	writeErr := f.writeToUpstream(b)
+	if atomic.LoadInt32(&f.closed) == 1 {
+		f.stats.droppedPacket()
+		return 0, ErrClosed
+	}
+	n := len(b)
+	if f.pipeline != nil {
+		var ok bool
+		b, ok = f.processUpstream(b)
+		if !ok {
+			return n, nil
+		}
+	}
+	record := b
+	if f.handshake != nil && f.handshake.Records {
+		record = f.encodeRecord(b)
+	}
+	writeErr := f.writeToUpstream(record)
 	if writeErr != nil {
+		f.stats.droppedPacket()
 		return 0, writeErr
 	}
-	return len(b), nil
+	f.stats.wroteUpstream(len(b))
+	if f.traffic != nil {
+		f.traffic.upstream(b)
+	}
+	return n, nil
 }
 
 func (f *forwarder) writeToUpstream(b []byte) error {
+	if f.fatalErr != nil {
+		// the server won't accept us, no point in retrying
+		return f.fatalErr
+	}
+
 	// Keep trying to transmit the client packet
 	priorAttempts := float64(-1)
 	sleepTime := 50 * time.Millisecond
 	maxSleepTime := f.idleTimeout
 
-	firstDial := true
+	var failingSince time.Time
 	for {
 		if priorAttempts > -1 {
 			sleepTime := time.Duration(math.Pow(2, priorAttempts)) * sleepTime
@@ -88,23 +240,34 @@ func (f *forwarder) writeToUpstream(b []byte) error {
 		priorAttempts++
 
 		if f.upstreamConn == nil {
-			if !firstDial {
-				// wait for copying to downstream to finish
-				<-f.copyToDownstreamError
-			}
+			f.waitForCopyToDownstream()
 			if err := f.dialUpstream(); err != nil {
-				log.Error(err)
+				if f.fatalErr != nil {
+					return f.fatalErr
+				}
+				f.log.Errorf("%v", err)
+				if failingSince.IsZero() {
+					failingSince = time.Now()
+				} else if f.reconnectTimeout > 0 && time.Since(failingSince) > f.reconnectTimeout {
+					// keep rejections by the server, like ErrQuotaExceeded, as they are
+					if pferrors.Kind(err) == ErrHandshakeFailed {
+						err = pferrors.New(ErrServerUnreachable, "", err)
+					}
+					return err
+				}
 				continue
 			}
-			firstDial = false
 		}
 
 		priorAttempts = -1
 
+		f.upstreamMx.Lock()
 		_, writeErr := f.upstream.Write(b)
+		f.upstreamMx.Unlock()
 		if writeErr != nil {
+			f.upstreamLog.Errorf("Unexpected error writing to upstream: %v", writeErr)
+			f.stats.outageBegan()
 			f.closeUpstream()
-			log.Errorf("Unexpected error writing to upstream: %v", writeErr)
 			continue
 		}
 
@@ -113,12 +276,36 @@ func (f *forwarder) writeToUpstream(b []byte) error {
 }
 
 func (f *forwarder) dialUpstream() error {
-	log.Debug("Dialing upstream")
+	f.log.Debugf("Dialing upstream")
+	f.stats.dialing()
+	upstreamConn, upstream, rejected, err := f.connect(f.dialServer, f.handshake)
+	if rejected {
+		f.fatalErr = err
+	}
+	if err != nil {
+		f.stats.dialFailed()
+		return err
+	}
+	f.upstreamConn, f.upstream = upstreamConn, upstream
+	f.upstreamLog = f.log.With("remote", upstreamConn.RemoteAddr())
+	// the server may have started a new session whose sequence starts over
+	f.dedup.Reset()
+	f.stats.connected(upstreamConn.RemoteAddr().String())
+	f.copying = true
+	ops.Go(func() {
+		f.copyToDownstream(upstreamConn, upstream)
+	})
+	return nil
+}
+
+// connect dials the server and performs the handshake, reporting whether the
+// server rejected the handshake.
+func (f *forwarder) connect(dial DialFunc, hs *protocol.Handshake) (net.Conn, io.ReadWriteCloser, bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), f.idleTimeout)
-	upstreamConn, dialErr := f.dialServer(ctx)
+	upstreamConn, dialErr := dial(ctx)
 	cancel()
 	if dialErr != nil {
-		return errors.New("Error dialing upstream, will retry: %v", dialErr)
+		return nil, nil, false, pferrors.New(ErrServerUnreachable, "error dialing upstream, will retry", dialErr)
 	}
 	upstreamConn = idletiming.Conn(upstreamConn, f.idleTimeout, nil)
 	rwc := framed.NewReadWriteCloser(upstreamConn)
@@ -126,46 +313,106 @@ func (f *forwarder) dialUpstream() error {
 	rwc.EnableBuffering(gonat.MaximumIPPacketSize)
 	rwc.DisableThreadSafety()
 	upstream := rwc
-	if _, err := upstream.Write([]byte(f.id)); err != nil {
-		return errors.New("Error sending client ID to upstream, will retry: %v", err)
+	hello, err := protocol.EncodeHello(f.id, hs)
+	if err != nil {
+		upstream.Close()
+		return nil, nil, true, pferrors.New(ErrHandshakeFailed, "unable to encode hello", err)
 	}
-	f.upstreamConn, f.upstream = upstreamConn, upstream
-	ops.Go(func() {
-		f.copyToDownstream(upstreamConn, upstream)
-	})
-	return nil
+	if _, err := upstream.Write(hello); err != nil {
+		upstream.Close()
+		return nil, nil, false, pferrors.New(ErrServerUnreachable, "error sending client ID to upstream, will retry", err)
+	}
+	if hs != nil {
+		if rejected, err := f.readHandshakeResponse(upstreamConn, upstream); err != nil {
+			upstream.Close()
+			return nil, nil, rejected, err
+		}
+	}
+	return upstreamConn, upstream, false, nil
+}
+
+func (f *forwarder) readHandshakeResponse(upstreamConn net.Conn, upstream io.Reader) (bool, error) {
+	upstreamConn.SetReadDeadline(time.Now().Add(f.idleTimeout))
+	b := make([]byte, protocol.MaxHelloSize)
+	n, err := upstream.Read(b)
+	if err != nil {
+		return false, pferrors.New(ErrHandshakeFailed, "error reading handshake response, will retry", err)
+	}
+	upstreamConn.SetReadDeadline(time.Time{})
+	resp, err := protocol.DecodeHandshakeResponse(b[:n])
+	if err != nil {
+		return false, pferrors.New(ErrHandshakeFailed, "invalid handshake response, will retry", err)
+	}
+	if !resp.OK {
+		err := pferrors.FromCode(resp.Code, resp.Error)
+		return permanent(err), err
+	}
+	return false, nil
+}
+
+// permanent determines whether the server's rejection of the handshake would
+// be the same if the client tried again.
+func permanent(err error) bool {
+	kind := pferrors.Kind(err)
+	return kind == ErrAuthRejected || kind == ErrPolicyDenied
 }
 
 func (f *forwarder) copyToDownstream(upstreamConn net.Conn, upstream io.ReadWriteCloser) {
-	b := make([]byte, gonat.MaximumIPPacketSize)
+	b := make([]byte, gonat.MaximumIPPacketSize+protocol.MaxRecordOverhead)
 	for {
 		n, readErr := upstream.Read(b)
 		if n > 0 {
-			_, writeErr := f.downstream.Write(b[:n])
+			writeErr := f.writeToDownstream(upstream, b[:n])
 			if writeErr != nil {
+				f.stats.droppedPacket()
 				upstream.Close()
+				f.stats.disconnected()
 				f.copyToDownstreamError <- writeErr
 				return
 			}
 		}
 		if readErr != nil {
+			if readErr == io.EOF {
+				// we didn't close the connection, so the server ended the session
+				readErr = pferrors.New(ErrSessionEvicted, "server closed the connection", readErr)
+				f.log.Debugf("%v", readErr)
+				f.stats.evicted(readErr)
+				f.stats.outageBegan()
+			}
 			upstream.Close()
+			f.stats.disconnected()
 			f.copyToDownstreamError <- readErr
 			return
 		}
 	}
 }
 
+// waitForCopyToDownstream waits for the goroutine copying from the last
+// connection to finish, if there is one.
+func (f *forwarder) waitForCopyToDownstream() {
+	if f.copying {
+		<-f.copyToDownstreamError
+		f.copying = false
+	}
+}
+
 func (f *forwarder) closeUpstream() {
 	if f.upstream != nil {
 		f.upstream.Close()
 		f.upstream = nil
 		f.upstreamConn = nil
+		f.stats.disconnected()
 	}
 }
 
 func (f *forwarder) Close() error {
+	if !atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		return nil
+	}
+	if f.secondary != nil {
+		f.secondary.close()
+	}
 	f.closeUpstream()
-	<-f.copyToDownstreamError
+	f.waitForCopyToDownstream()
 	return nil
 }
@@ -0,0 +1,221 @@
+// decoder decodes captured packetforward transport connections. It takes the
+// two byte streams of a connection between client and server, either
+// reassembled from a pcap capture or dumped raw, parses the hello, handshake
+// and framed records and extracts the IP packets (or Ethernet frames) that the
+// connection carried. The packets can be written to a pcapng file annotated
+// with the client's ID (which identifies its session) and their direction.
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/gonat"
+	"github.com/getlantern/packetforward/pcapng"
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+// maxFrameSize is the size of the largest frame that clients and servers exchange
+const maxFrameSize = gonat.MaximumIPPacketSize + protocol.MaxRecordOverhead
+
+// Segment is a piece of a transport stream along with the time at which it
+// was captured.
+type Segment struct {
+	Time time.Time
+	Data []byte
+}
+
+// Packet is a packet carried by a transport connection.
+type Packet struct {
+	// Time is the time at which the last segment of the frame carrying the packet was captured
+	Time      time.Time
+	Direction pipeline.Direction
+	Data      []byte
+}
+
+// Session is a decoded transport connection.
+type Session struct {
+	// Client and Server are the addresses of the connection's endpoints, if known
+	Client string
+	Server string
+
+	// ClientID identifies the client and its session
+	ClientID string
+
+	// Handshake is the handshake that the client sent with its hello, if any
+	Handshake *protocol.Handshake
+
+	// Response is the server's response to the Handshake, if captured
+	Response *protocol.HandshakeResponse
+
+	// Packets are the packets that the connection carried in both directions, ordered by time
+	Packets []*Packet
+
+	// Records counts control records that don't carry packets, like pings and speed test
+	// data
+	Records int
+
+	// Err, if not nil, is the first error that stopped decoding one of the streams, for example
+	// because the capture ends in the middle of a frame
+	Err error
+}
+
+// Mode returns the kind of traffic that the session carries.
+func (s *Session) Mode() protocol.Mode {
+	if s.Handshake == nil {
+		return protocol.ModeIP
+	}
+	return s.Handshake.Mode
+}
+
+// DecodeSession decodes the upstream (client to server) and downstream
+// (server to client) streams of a connection. Either may be empty, but the
+// downstream stream can only be decoded along with the upstream one, which
+// determines its framing.
+func DecodeSession(upstream, downstream []Segment) *Session {
+	s := &Session{}
+	if len(upstream) == 0 {
+		s.Err = errors.New("no upstream data")
+		return s
+	}
+	up := newStreamReader(upstream)
+	b := make([]byte, maxFrameSize)
+	n, err := up.Read(b)
+	if err != nil {
+		s.Err = fmt.Errorf("unable to read hello: %v", err)
+		return s
+	}
+	s.ClientID, s.Handshake, err = protocol.DecodeHello(b[:n])
+	if err != nil {
+		s.Err = err
+		return s
+	}
+	s.decodePackets(up, pipeline.Upstream)
+
+	if len(downstream) > 0 {
+		down := newStreamReader(downstream)
+		if s.Handshake != nil {
+			if n, err = down.Read(b); err != nil {
+				s.fail(fmt.Errorf("unable to read handshake response: %v", err))
+				return s
+			}
+			if s.Response, err = protocol.DecodeHandshakeResponse(b[:n]); err != nil {
+				s.fail(err)
+				return s
+			}
+		}
+		s.decodePackets(down, pipeline.Downstream)
+	}
+	sort.SliceStable(s.Packets, func(i, j int) bool {
+		return s.Packets[i].Time.Before(s.Packets[j].Time)
+	})
+	return s
+}
+
+func (s *Session) decodePackets(r *streamReader, direction pipeline.Direction) {
+	records := s.Handshake != nil && s.Handshake.Records
+	b := make([]byte, maxFrameSize)
+	for {
+		n, err := r.Read(b)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			s.fail(fmt.Errorf("unable to read %v frame: %v", direction, err))
+			return
+		}
+		data := b[:n]
+		if records {
+			record, err := protocol.DecodeRecord(data)
+			if err != nil {
+				s.fail(err)
+				return
+			}
+			if record.Type != protocol.RecordPacket && record.Type != protocol.RecordSequencedPacket {
+				s.Records++
+				continue
+			}
+			data = record.Payload
+		}
+		s.Packets = append(s.Packets, &Packet{
+			Time:      r.time,
+			Direction: direction,
+			Data:      append([]byte(nil), data...),
+		})
+	}
+}
+
+func (s *Session) fail(err error) {
+	if s.Err == nil {
+		s.Err = err
+	}
+}
+
+// WritePcapng writes the packets of the given sessions to w as a pcapng
+// capture.
+func WritePcapng(w io.Writer, sessions []*Session) error {
+	if _, err := w.Write(pcapng.AppendHeader(nil)); err != nil {
+		return err
+	}
+	var b []byte
+	for _, s := range sessions {
+		for _, pkt := range s.Packets {
+			b = pcapng.AppendPacket(b[:0], pkt.Time, &pipeline.Packet{
+				Direction: pkt.Direction,
+				ClientID:  s.ClientID,
+				Mode:      s.Mode(),
+				Data:      pkt.Data,
+			})
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// streamReader reads frames from a sequence of segments, keeping track of the
+// time at which the segment containing the end of the last frame was captured.
+type streamReader struct {
+	segments []Segment
+	offset   int
+	time     time.Time
+	framed   *framed.Reader
+}
+
+func newStreamReader(segments []Segment) *streamReader {
+	r := &streamReader{segments: segments}
+	r.framed = framed.NewReader(readerFunc(r.readBytes))
+	r.framed.EnableBigFrames()
+	return r
+}
+
+// Read reads the next frame into b.
+func (r *streamReader) Read(b []byte) (int, error) {
+	return r.framed.Read(b)
+}
+
+func (r *streamReader) readBytes(b []byte) (int, error) {
+	for len(r.segments) > 0 && r.offset == len(r.segments[0].Data) {
+		r.segments = r.segments[1:]
+		r.offset = 0
+	}
+	if len(r.segments) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, r.segments[0].Data[r.offset:])
+	r.offset += n
+	r.time = r.segments[0].Time
+	return n, nil
+}
+
+type readerFunc func(b []byte) (int, error)
+
+func (fn readerFunc) Read(b []byte) (int, error) {
+	return fn(b)
+}
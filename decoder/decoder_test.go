@@ -0,0 +1,155 @@
+package decoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward/packet"
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+const id = "00000000-0000-0000-0000-000000000001"
+
+type buffer struct {
+	bytes.Buffer
+}
+
+func (b *buffer) Close() error {
+	return nil
+}
+
+// stream frames the given frames like a client or server does.
+func stream(t *testing.T, frames ...[]byte) []byte {
+	var buf buffer
+	rwc := framed.NewReadWriteCloser(&buf)
+	rwc.EnableBigFrames()
+	for _, frame := range frames {
+		if _, err := rwc.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// tcpFrame builds an Ethernet frame containing a TCP segment.
+func tcpFrame(src, dst byte, srcPort, dstPort uint16, seq uint32, flags byte, payload []byte) []byte {
+	b := make([]byte, packet.EthernetHeaderSize+40+len(payload))
+	binary.BigEndian.PutUint16(b[12:], packet.EtherTypeIPv4)
+	ip := b[packet.EthernetHeaderSize:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)))
+	ip[8] = 64
+	ip[9] = packet.ProtocolTCP
+	copy(ip[12:], []byte{10, 0, 0, src})
+	copy(ip[16:], []byte{10, 0, 0, dst})
+	tcp := ip[20:]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	copy(tcp[20:], payload)
+	return b
+}
+
+func pcap(frames ...[]byte) []byte {
+	b := make([]byte, pcapHeaderSize)
+	binary.LittleEndian.PutUint32(b, pcapMagicMicros)
+	binary.LittleEndian.PutUint16(b[4:], 2)
+	binary.LittleEndian.PutUint16(b[6:], 4)
+	binary.LittleEndian.PutUint32(b[16:], 65535)
+	binary.LittleEndian.PutUint32(b[20:], linkTypeEthernet)
+	for i, frame := range frames {
+		record := make([]byte, pcapRecordHeaderSize)
+		binary.LittleEndian.PutUint32(record, 1000)
+		binary.LittleEndian.PutUint32(record[4:], uint32(i))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+		b = append(append(b, record...), frame...)
+	}
+	return b
+}
+
+func TestReadPcap(t *testing.T) {
+	hello, _ := protocol.EncodeHello(id, &protocol.Handshake{Records: true})
+	response, _ := protocol.EncodeHandshakeResponse(&protocol.HandshakeResponse{OK: true})
+	up := stream(t, hello, protocol.EncodePacket([]byte("upstream packet")), protocol.EncodePing(1))
+	down := stream(t, response, protocol.EncodePacket([]byte("downstream packet")))
+
+	const clientISN, serverISN = 1000, 5000
+	client := func(offset int, data []byte) []byte {
+		return tcpFrame(2, 1, 50000, 9780, clientISN+1+uint32(offset), packet.TCPFlagACK|packet.TCPFlagPSH, data)
+	}
+	server := func(offset int, data []byte) []byte {
+		return tcpFrame(1, 2, 9780, 50000, serverISN+1+uint32(offset), packet.TCPFlagACK|packet.TCPFlagPSH, data)
+	}
+	split := len(hello) + 10
+	capture := pcap(
+		tcpFrame(2, 1, 50000, 9780, clientISN, packet.TCPFlagSYN, nil),
+		tcpFrame(1, 2, 9780, 50000, serverISN, packet.TCPFlagSYN|packet.TCPFlagACK, nil),
+		// the second part of the upstream stream arrives first, then the first part, then
+		// a retransmission overlapping both
+		client(split, up[split:]),
+		client(0, up[:split]),
+		client(split-5, up[split-5:split+5]),
+		server(0, down),
+		tcpFrame(3, 4, 1, 2, 0, packet.TCPFlagSYN, nil),
+	)
+
+	sessions, err := ReadPcap(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+	s := sessions[0]
+	if s.Err != nil {
+		t.Fatal(s.Err)
+	}
+	if s.ClientID != id || s.Client != "10.0.0.2:50000" || s.Server != "10.0.0.1:9780" || !s.Handshake.Records || !s.Response.OK {
+		t.Errorf("Wrong session: %+v", s)
+	}
+	if len(s.Packets) != 2 || s.Records != 1 {
+		t.Fatalf("Expected 2 packets and 1 record, got %d and %d", len(s.Packets), s.Records)
+	}
+	if s.Packets[0].Direction != pipeline.Upstream || string(s.Packets[0].Data) != "upstream packet" {
+		t.Errorf("Wrong upstream packet: %+v", s.Packets[0])
+	}
+	if s.Packets[1].Direction != pipeline.Downstream || string(s.Packets[1].Data) != "downstream packet" {
+		t.Errorf("Wrong downstream packet: %+v", s.Packets[1])
+	}
+	if !s.Packets[0].Time.Equal(time.Unix(1000, 3000)) {
+		t.Errorf("Upstream packet should have the time of the segment that filled the gap in it, not %v", s.Packets[0].Time)
+	}
+	if sessions[1].Err == nil {
+		t.Error("Connection without data should have failed to decode")
+	}
+
+	var out bytes.Buffer
+	if err := WritePcapng(&out, sessions[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("client_id="+id+" direction=downstream")) || !bytes.Contains(out.Bytes(), []byte("upstream packet")) {
+		t.Error("Output is missing annotated packets")
+	}
+}
+
+func TestDecodeTruncatedStream(t *testing.T) {
+	hello, _ := protocol.EncodeHello(id, nil)
+	up := stream(t, hello, []byte("first packet"), []byte("second packet"))
+	s := DecodeSession([]Segment{{Data: up[:len(up)-3]}}, nil)
+	if s.ClientID != id || s.Handshake != nil {
+		t.Errorf("Wrong session: %+v", s)
+	}
+	if len(s.Packets) != 1 || string(s.Packets[0].Data) != "first packet" {
+		t.Errorf("Expected only the complete packet, got %d", len(s.Packets))
+	}
+	if s.Err == nil {
+		t.Error("Truncated stream should have been reported")
+	}
+}
@@ -0,0 +1,267 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/getlantern/packetforward/packet"
+)
+
+// pcap magic numbers and link types, see https://www.tcpdump.org/linktypes.html
+const (
+	pcapMagicMicros = 0xA1B2C3D4
+	pcapMagicNanos  = 0xA1B23C4D
+
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+
+	pcapHeaderSize       = 24
+	pcapRecordHeaderSize = 16
+	linuxSLLHeaderSize   = 16
+)
+
+// ReadPcap reads a capture in the classic pcap format (not pcapng), reassembles
+// the TCP connections in it and decodes each of them as a packetforward
+// transport connection. Connections that aren't packetforward connections are
+// returned with an Err. The capture must contain the beginning of a connection
+// for it to be decoded.
+func ReadPcap(r io.Reader) ([]*Session, error) {
+	header := make([]byte, pcapHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("unable to read pcap header: %v", err)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(header)
+	if magic != pcapMagicMicros && magic != pcapMagicNanos {
+		order = binary.BigEndian
+		magic = order.Uint32(header)
+	}
+	var unit time.Duration
+	switch magic {
+	case pcapMagicMicros:
+		unit = time.Microsecond
+	case pcapMagicNanos:
+		unit = time.Nanosecond
+	default:
+		return nil, errors.New("not a pcap capture, pcapng captures need to be converted first, for example with editcap -F pcap")
+	}
+	linkType := order.Uint32(header[20:]) & 0x0FFFFFFF
+
+	a := newAssembler()
+	record := make([]byte, pcapRecordHeaderSize)
+	var b []byte
+	for {
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("unable to read pcap record: %v", err)
+		}
+		ts := time.Unix(int64(order.Uint32(record)), int64(order.Uint32(record[4:]))*int64(unit))
+		length := int(order.Uint32(record[8:]))
+		if length > 1<<24 {
+			return nil, fmt.Errorf("pcap record too long: %d", length)
+		}
+		if cap(b) < length {
+			b = make([]byte, length)
+		}
+		b = b[:length]
+		if _, err := io.ReadFull(r, b); err != nil {
+			// captures that were cut off end with a partial record
+			break
+		}
+		if ip, ok := ipFrom(linkType, b, order); ok {
+			a.add(ts, ip)
+		}
+	}
+	return a.sessions(), nil
+}
+
+// ipFrom returns the IP packet in a captured frame of the given link type.
+func ipFrom(linkType uint32, frame []byte, order binary.ByteOrder) ([]byte, bool) {
+	switch linkType {
+	case linkTypeEthernet:
+		return packet.FromEthernet(frame)
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return frame, true
+	case linkTypeNull:
+		if len(frame) < 4 {
+			return nil, false
+		}
+		return frame[4:], true
+	case linkTypeLinuxSLL:
+		if len(frame) < linuxSLLHeaderSize {
+			return nil, false
+		}
+		switch binary.BigEndian.Uint16(frame[14:]) {
+		case packet.EtherTypeIPv4, packet.EtherTypeIPv6:
+			return frame[linuxSLLHeaderSize:], true
+		}
+	}
+	return nil, false
+}
+
+// assembler reassembles the TCP connections in a capture.
+type assembler struct {
+	flows map[string]*flow
+}
+
+func newAssembler() *assembler {
+	return &assembler{flows: make(map[string]*flow)}
+}
+
+// flow is a TCP connection, with a half for each direction.
+type flow struct {
+	first  time.Time
+	client string
+	halves map[string]*half
+}
+
+// half is one direction of a TCP connection.
+type half struct {
+	started  bool
+	next     uint32
+	pending  map[uint32][]byte
+	segments []Segment
+}
+
+func (a *assembler) add(ts time.Time, b []byte) {
+	ip, err := packet.ParseIP(b)
+	if err != nil || (ip.Version() == 4 && ip.IPv4().IsFragment()) {
+		return
+	}
+	proto, transport := ip.Transport()
+	if proto != packet.ProtocolTCP {
+		return
+	}
+	tcp, err := packet.ParseTCP(transport)
+	if err != nil {
+		return
+	}
+	src := endpoint(ip.Src(), tcp.SrcPort())
+	dst := endpoint(ip.Dst(), tcp.DstPort())
+	key := src + " " + dst
+	if dst < src {
+		key = dst + " " + src
+	}
+	f := a.flows[key]
+	if f == nil {
+		f = &flow{first: ts, halves: make(map[string]*half, 2)}
+		a.flows[key] = f
+	}
+	h := f.halves[src]
+	if h == nil {
+		h = &half{pending: make(map[uint32][]byte)}
+		f.halves[src] = h
+	}
+	syn := tcp.HasFlags(packet.TCPFlagSYN)
+	if syn && !tcp.HasFlags(packet.TCPFlagACK) {
+		f.client = src
+	}
+	payload := tcp.Payload()
+	if f.client == "" && len(payload) > 0 {
+		// without a SYN, assume that the client speaks first, which it does with its hello
+		f.client = src
+	}
+	h.add(ts, tcp.Seq(), syn, payload)
+}
+
+func (h *half) add(ts time.Time, seq uint32, syn bool, payload []byte) {
+	if syn {
+		h.started = true
+		h.next = seq + 1
+		return
+	}
+	if len(payload) == 0 {
+		return
+	}
+	if !h.started {
+		h.started = true
+		h.next = seq
+	}
+	if int32(seq-h.next) > 0 {
+		if existing, found := h.pending[seq]; !found || len(existing) < len(payload) {
+			h.pending[seq] = append([]byte(nil), payload...)
+		}
+		return
+	}
+	h.append(ts, seq, payload)
+	for progress := true; progress; {
+		progress = false
+		for pendingSeq, data := range h.pending {
+			if int32(pendingSeq-h.next) <= 0 {
+				// the data became available when the gap before it was filled
+				delete(h.pending, pendingSeq)
+				h.append(ts, pendingSeq, data)
+				progress = true
+			}
+		}
+	}
+}
+
+// append appends the part of the payload starting at seq that is beyond what
+// was already assembled.
+func (h *half) append(ts time.Time, seq uint32, payload []byte) {
+	overlap := int(h.next - seq)
+	if overlap >= len(payload) {
+		return
+	}
+	payload = payload[overlap:]
+	h.segments = append(h.segments, Segment{Time: ts, Data: append([]byte(nil), payload...)})
+	h.next += uint32(len(payload))
+}
+
+func (a *assembler) sessions() []*Session {
+	flows := make([]*flow, 0, len(a.flows))
+	for _, f := range a.flows {
+		if f.client != "" {
+			flows = append(flows, f)
+		}
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].first.Before(flows[j].first)
+	})
+
+	sessions := make([]*Session, 0, len(flows))
+	for _, f := range flows {
+		var server string
+		var upstream, downstream *half
+		for addr, h := range f.halves {
+			if addr == f.client {
+				upstream = h
+			} else {
+				server, downstream = addr, h
+			}
+		}
+		var up, down []Segment
+		if upstream != nil {
+			up = upstream.segments
+		}
+		if downstream != nil {
+			down = downstream.segments
+		}
+		s := DecodeSession(up, down)
+		s.Client, s.Server = f.client, server
+		for _, h := range []*half{upstream, downstream} {
+			if h != nil && len(h.pending) > 0 {
+				s.fail(errors.New("capture is missing segments"))
+			}
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func endpoint(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
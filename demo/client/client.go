@@ -15,6 +15,8 @@ import (
 	"github.com/getlantern/golog"
 	"github.com/getlantern/gonat"
 	"github.com/getlantern/packetforward"
+	"github.com/getlantern/packetforward/protocol"
+	"github.com/getlantern/packetforward/tap"
 )
 
 var (
@@ -26,9 +28,18 @@ var (
 	tunAddr   = flag.String("tun-address", "10.0.0.2", "tun device address")
 	tunMask   = flag.String("tun-mask", "255.255.255.0", "tun device netmask")
 	tunGW     = flag.String("tun-gw", "10.0.0.1", "tun device gateway")
+	tapDevice = flag.String("tap-device", "", "if specified, forward Ethernet frames from a tap device with this name instead of IP packets from a tun device")
 	mtu       = flag.Int("mtu", 1500, "maximum transmission unit for TUN device")
 	addr      = flag.String("addr", "127.0.0.1:9780", "address of server")
 	pprofAddr = flag.String("pprofaddr", "", "pprof address to listen on, not activate pprof if empty")
+	statsAddr = flag.String("stats-addr", "", "if specified, serve client stats as JSON at /stats on this address")
+	username  = flag.String("username", "", "username with which to authenticate to the server")
+	password  = flag.String("password", "", "password with which to authenticate to the server")
+
+	redundantAddr      = flag.String("redundant-addr", "", "if specified, connect a secondary path to the server at this address and send real-time packets over both paths")
+	redundantLocalAddr = flag.String("redundant-local-addr", "", "local IP address from which to dial the secondary path, for example the address of a cellular interface")
+
+	socksAddr = flag.String("socks-addr", "", "if specified, run a SOCKS5 proxy at this address instead of using a tun device, which doesn't require root")
 )
 
 func main() {
@@ -46,7 +57,22 @@ func main() {
 		}()
 	}
 
-	dev, err := gonat.TUNDevice(*tunDevice, *tunAddr, *tunMask, *mtu)
+	if *socksAddr != "" {
+		runSOCKS()
+		return
+	}
+
+	var dev io.ReadWriteCloser
+	var err error
+	mode := protocol.ModeIP
+	frameSize := *mtu
+	if *tapDevice != "" {
+		dev, err = tap.Open(*tapDevice, *mtu)
+		mode = protocol.ModeEthernet
+		frameSize += tap.EthernetHeaderSize
+	} else {
+		dev, err = gonat.TUNDevice(*tunDevice, *tunAddr, *tunMask, *mtu)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -66,14 +92,11 @@ func main() {
 		os.Exit(0)
 	}()
 
-	log.Debugf("Using packetforward server at %v", *addr)
-	var d net.Dialer
-	c := packetforward.Client(dev, 70*time.Second, func(ctx context.Context) (net.Conn, error) {
-		return d.DialContext(ctx, "tcp", *addr)
-	})
+	c := packetforward.NewClient(dev, clientOpts(mode))
+	serveStats(c)
 
 	log.Debug("Reading from TUN device")
-	b := make([]byte, *mtu)
+	b := make([]byte, frameSize)
 	for {
 		n, err := dev.Read(b)
 		if n > 0 {
@@ -87,3 +110,28 @@ func main() {
 		}
 	}
 }
+
+func clientOpts(mode protocol.Mode) *packetforward.Opts {
+	log.Debugf("Using packetforward server at %v", *addr)
+	var d net.Dialer
+	opts := &packetforward.Opts{
+		IdleTimeout: 70 * time.Second,
+		DialServer: func(ctx context.Context) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", *addr)
+		},
+		Username: *username,
+		Password: *password,
+		Mode:     mode,
+	}
+	if *redundantAddr != "" {
+		var rd net.Dialer
+		if *redundantLocalAddr != "" {
+			rd.LocalAddr = &net.TCPAddr{IP: net.ParseIP(*redundantLocalAddr)}
+		}
+		log.Debugf("Sending real-time packets redundantly via %v", *redundantAddr)
+		opts.RedundantDialServer = func(ctx context.Context) (net.Conn, error) {
+			return rd.DialContext(ctx, "tcp", *redundantAddr)
+		}
+	}
+	return opts
+}
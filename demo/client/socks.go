@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+
+	"github.com/getlantern/packetforward"
+	"github.com/getlantern/packetforward/protocol"
+	"github.com/getlantern/packetforward/socks"
+)
+
+func runSOCKS() {
+	s, err := socks.NewServer(&socks.Opts{
+		LocalIP: net.ParseIP(*tunAddr),
+		MTU:     *mtu,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	l, err := net.Listen("tcp", *socksAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := packetforward.NewClient(s, clientOpts(protocol.ModeIP))
+	serveStats(c)
+
+	log.Debugf("SOCKS5 proxy listening at %v", l.Addr())
+	if err := s.Serve(l, c); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/getlantern/packetforward"
+)
+
+// statsPayload is the JSON representation of packetforward.Stats
+type statsPayload struct {
+	SessionID                  string  `json:"session_id"`
+	ServerAddr                 string  `json:"server_addr,omitempty"`
+	PacketsUp                  int64   `json:"packets_up"`
+	BytesUp                    int64   `json:"bytes_up"`
+	PacketsDown                int64   `json:"packets_down"`
+	BytesDown                  int64   `json:"bytes_down"`
+	DialAttempts               int64   `json:"dial_attempts"`
+	DialFailures               int64   `json:"dial_failures"`
+	Reconnects                 int64   `json:"reconnects"`
+	OutageSeconds              float64 `json:"outage_seconds"`
+	SecondsSinceLastDownstream float64 `json:"seconds_since_last_downstream,omitempty"`
+	DroppedPackets             int64   `json:"dropped_packets"`
+}
+
+// statsHandler serves the client's stats as JSON
+func statsHandler(c packetforward.Forwarder) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		stats := c.Stats()
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(&statsPayload{
+			SessionID:                  stats.SessionID,
+			ServerAddr:                 stats.ServerAddr,
+			PacketsUp:                  stats.PacketsUp,
+			BytesUp:                    stats.BytesUp,
+			PacketsDown:                stats.PacketsDown,
+			BytesDown:                  stats.BytesDown,
+			DialAttempts:               stats.DialAttempts,
+			DialFailures:               stats.DialFailures,
+			Reconnects:                 stats.Reconnects,
+			OutageSeconds:              stats.Outage.Seconds(),
+			SecondsSinceLastDownstream: stats.SinceLastDownstream.Seconds(),
+			DroppedPackets:             stats.DroppedPackets,
+		})
+	})
+}
+
+// serveStats serves the client's stats at /stats on -stats-addr, if specified
+func serveStats(c packetforward.Forwarder) {
+	if *statsAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/stats", statsHandler(c))
+	go func() {
+		log.Debugf("Serving stats at http://%s/stats", *statsAddr)
+		if err := http.ListenAndServe(*statsAddr, mux); err != nil {
+			log.Error(err)
+		}
+	}()
+}
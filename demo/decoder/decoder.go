@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/packetforward/decoder"
+)
+
+var (
+	log = golog.LoggerFor("packetforward-demo-decoder")
+)
+
+var (
+	pcapFile     = flag.String("pcap", "", "pcap capture of transport connections between clients and servers")
+	clientStream = flag.String("client-stream", "", "raw bytes that a client sent to a server, used instead of -pcap")
+	serverStream = flag.String("server-stream", "", "raw bytes that a server sent to a client, used along with -client-stream")
+	serverPort   = flag.Int("server-port", 0, "if specified, only decode connections to servers on this port")
+	out          = flag.String("out", "packets.pcapng", "file to which to write the inner packets as pcapng")
+)
+
+func main() {
+	flag.Parse()
+
+	var sessions []*decoder.Session
+	switch {
+	case *pcapFile != "":
+		file, err := os.Open(*pcapFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		all, err := decoder.ReadPcap(file)
+		file.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range all {
+			if *serverPort != 0 {
+				if _, port, _ := net.SplitHostPort(s.Server); port != strconv.Itoa(*serverPort) {
+					continue
+				}
+			}
+			sessions = append(sessions, s)
+		}
+	case *clientStream != "":
+		upstream := readSegments(*clientStream)
+		var downstream []decoder.Segment
+		if *serverStream != "" {
+			downstream = readSegments(*serverStream)
+		}
+		sessions = append(sessions, decoder.DecodeSession(upstream, downstream))
+	default:
+		log.Fatal("Specify either -pcap or -client-stream")
+	}
+
+	for _, s := range sessions {
+		if s.Err != nil {
+			log.Errorf("Connection %v -> %v (session %v): %v", s.Client, s.Server, s.ClientID, s.Err)
+		}
+		log.Debugf("Connection %v -> %v (session %v): %d packets, %d control records", s.Client, s.Server, s.ClientID, len(s.Packets), s.Records)
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	if err := decoder.WritePcapng(file, sessions); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func readSegments(filename string) []decoder.Segment {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return []decoder.Segment{{Data: data}}
+}
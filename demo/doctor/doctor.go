@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/packetforward/doctor"
+)
+
+var (
+	log = golog.LoggerFor("packetforward-demo-doctor")
+)
+
+var (
+	addr      = flag.String("addr", "127.0.0.1:9780", "address of server")
+	username  = flag.String("username", "", "username with which to authenticate to the server")
+	password  = flag.String("password", "", "password with which to authenticate to the server")
+	timeout   = flag.Duration("timeout", doctor.DefaultTimeout, "timeout for each check")
+	pings     = flag.Int("pings", doctor.DefaultPings, "number of pings with which to measure round trip times")
+	mtu       = flag.Int("mtu", 1500, "MTU that the client is configured with")
+	dnsServer = flag.String("dns-server", "", "DNS server through which to resolve names, defaults to 8.8.8.8:53")
+	dnsNames  = flag.String("dns-names", strings.Join(doctor.DefaultDNSNames, ","), "comma separated names to resolve")
+	tcpDests  = flag.String("tcp-destinations", strings.Join(doctor.DefaultTCPDestinations, ","), "comma separated host:ports to which to connect with TCP")
+	udpDests  = flag.String("udp-destinations", strings.Join(doctor.DefaultUDPDestinations, ","), "comma separated DNS servers to query with UDP")
+	asJSON    = flag.Bool("json", false, "print the report as JSON")
+
+	speedTest         = flag.String("speed-test", "", "if specified, run a speed test instead of a diagnosis, one of upload, download or both")
+	speedTestDuration = flag.Duration("speed-test-duration", doctor.DefaultSpeedTestDuration, "how long to send test data")
+	speedTestSize     = flag.Int("speed-test-packet-size", doctor.DefaultSpeedTestPacketSize, "size of test data records")
+)
+
+// checkPayload is the JSON representation of a doctor.Check
+type checkPayload struct {
+	Target  string  `json:"target,omitempty"`
+	OK      bool    `json:"ok"`
+	Seconds float64 `json:"seconds"`
+	Result  string  `json:"result,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// reportPayload is the JSON representation of a doctor.Report
+type reportPayload struct {
+	Time       time.Time       `json:"time"`
+	ServerAddr string          `json:"server_addr,omitempty"`
+	OK         bool            `json:"ok"`
+	Dial       *checkPayload   `json:"dial,omitempty"`
+	Handshake  *checkPayload   `json:"handshake,omitempty"`
+	RTT        *rttPayload     `json:"rtt,omitempty"`
+	MTU        *mtuPayload     `json:"mtu,omitempty"`
+	DNS        []*checkPayload `json:"dns,omitempty"`
+	TCP        []*checkPayload `json:"tcp,omitempty"`
+	UDP        []*checkPayload `json:"udp,omitempty"`
+}
+
+// rttPayload is the JSON representation of a doctor.RTT
+type rttPayload struct {
+	Sent          int     `json:"sent"`
+	Received      int     `json:"received"`
+	MinSeconds    float64 `json:"min_seconds"`
+	AvgSeconds    float64 `json:"avg_seconds"`
+	MaxSeconds    float64 `json:"max_seconds"`
+	JitterSeconds float64 `json:"jitter_seconds"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// mtuPayload is the JSON representation of a doctor.MTU
+type mtuPayload struct {
+	Configured int `json:"configured"`
+	PathMSS    int `json:"path_mss,omitempty"`
+	Estimate   int `json:"estimate,omitempty"`
+}
+
+func main() {
+	flag.Parse()
+
+	if *speedTest != "" {
+		runSpeedTests()
+		return
+	}
+
+	report, err := doctor.Run(&doctor.Opts{
+		DialServer:      dialServer,
+		Username:        *username,
+		Password:        *password,
+		Timeout:         *timeout,
+		Pings:           *pings,
+		MTU:             *mtu,
+		DNSServer:       *dnsServer,
+		DNSNames:        split(*dnsNames),
+		TCPDestinations: split(*tcpDests),
+		UDPDestinations: split(*udpDests),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(toPayload(report))
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+func dialServer(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", *addr)
+}
+
+func split(list string) []string {
+	var result []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func toPayload(r *doctor.Report) *reportPayload {
+	payload := &reportPayload{
+		Time:       r.Time,
+		ServerAddr: r.ServerAddr,
+		OK:         r.OK(),
+		Dial:       toCheckPayload(r.Dial),
+		Handshake:  toCheckPayload(r.Handshake),
+		DNS:        toCheckPayloads(r.DNS),
+		TCP:        toCheckPayloads(r.TCP),
+		UDP:        toCheckPayloads(r.UDP),
+	}
+	if r.RTT != nil {
+		payload.RTT = &rttPayload{
+			Sent:          r.RTT.Sent,
+			Received:      r.RTT.Received,
+			MinSeconds:    r.RTT.Min.Seconds(),
+			AvgSeconds:    r.RTT.Avg.Seconds(),
+			MaxSeconds:    r.RTT.Max.Seconds(),
+			JitterSeconds: r.RTT.Jitter.Seconds(),
+			Error:         errorString(r.RTT.Err),
+		}
+	}
+	if r.MTU != nil {
+		payload.MTU = &mtuPayload{
+			Configured: r.MTU.Configured,
+			PathMSS:    r.MTU.PathMSS,
+			Estimate:   r.MTU.Estimate,
+		}
+	}
+	return payload
+}
+
+func toCheckPayloads(checks []*doctor.Check) []*checkPayload {
+	var payloads []*checkPayload
+	for _, check := range checks {
+		payloads = append(payloads, toCheckPayload(check))
+	}
+	return payloads
+}
+
+func toCheckPayload(check *doctor.Check) *checkPayload {
+	if check == nil {
+		return nil
+	}
+	return &checkPayload{
+		Target:  check.Target,
+		OK:      check.OK,
+		Seconds: check.Duration.Seconds(),
+		Result:  check.Result,
+		Error:   errorString(check.Err),
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
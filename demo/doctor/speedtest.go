@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/getlantern/packetforward/doctor"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+// speedTestPayload is the JSON representation of a doctor.SpeedTestResult
+type speedTestPayload struct {
+	Direction        protocol.SpeedTestDirection `json:"direction"`
+	Sent             *protocol.SpeedTestSummary  `json:"sent"`
+	Received         *protocol.SpeedTestSummary  `json:"received"`
+	ThroughputBits   float64                     `json:"throughput_bps"`
+	Loss             float64                     `json:"loss"`
+	IdleRTTSeconds   float64                     `json:"idle_rtt_seconds"`
+	LoadedRTTSeconds float64                     `json:"loaded_rtt_seconds"`
+}
+
+// runSpeedTests runs the speed tests selected by -speed-test
+func runSpeedTests() {
+	var directions []protocol.SpeedTestDirection
+	switch *speedTest {
+	case "upload":
+		directions = append(directions, protocol.SpeedTestUpload)
+	case "download":
+		directions = append(directions, protocol.SpeedTestDownload)
+	case "both":
+		directions = append(directions, protocol.SpeedTestUpload, protocol.SpeedTestDownload)
+	default:
+		log.Fatalf("Unknown speed test %v", *speedTest)
+	}
+
+	var payloads []*speedTestPayload
+	for _, direction := range directions {
+		result, err := doctor.SpeedTest(&doctor.SpeedTestOpts{
+			DialServer: dialServer,
+			Username:   *username,
+			Password:   *password,
+			Direction:  direction,
+			Duration:   *speedTestDuration,
+			PacketSize: *speedTestSize,
+			Pings:      *pings,
+			Timeout:    *timeout,
+		})
+		if err != nil {
+			log.Fatalf("Unable to run %v speed test: %v", direction, err)
+		}
+		if *asJSON {
+			payloads = append(payloads, &speedTestPayload{
+				Direction:        result.Direction,
+				Sent:             result.Sent,
+				Received:         result.Received,
+				ThroughputBits:   result.Throughput,
+				Loss:             result.Loss,
+				IdleRTTSeconds:   result.IdleRTT.Avg.Seconds(),
+				LoadedRTTSeconds: result.LoadedRTT.Avg.Seconds(),
+			})
+			continue
+		}
+		if err := result.WriteText(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write([]byte("\n"))
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(payloads); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
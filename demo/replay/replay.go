@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/packetforward/replay"
+)
+
+var (
+	log = golog.LoggerFor("packetforward-demo-replay")
+)
+
+var (
+	addr       = flag.String("addr", "127.0.0.1:9780", "address of server")
+	recordAddr = flag.String("record-addr", "", "if specified, record sessions of clients connecting to this address while forwarding them to the server")
+	dir        = flag.String("dir", "recordings", "directory in which to write recordings")
+	replayFile = flag.String("replay", "", "if specified, replay the recording in this file against the server")
+	speed      = flag.Float64("speed", 1, "factor by which to accelerate replays")
+	linger     = flag.Duration("linger", replay.DefaultLinger, "how long to wait for downstream packets after the recorded session ended")
+	exact      = flag.Bool("exact", false, "compare downstream packets exactly instead of ignoring fields that usually differ between runs")
+	password   = flag.String("password", "", "password to replay with, since recordings don't contain passwords")
+)
+
+func main() {
+	flag.Parse()
+
+	dialServer := func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", *addr)
+	}
+
+	switch {
+	case *recordAddr != "":
+		recorder, err := replay.NewRecorder(&replay.RecorderOpts{DialServer: dialServer, Dir: *dir})
+		if err != nil {
+			log.Fatal(err)
+		}
+		l, err := net.Listen("tcp", *recordAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Debugf("Recording sessions of clients connecting to %v in %v", l.Addr(), *dir)
+		log.Fatal(recorder.Serve(l))
+	case *replayFile != "":
+		file, err := os.Open(*replayFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r, err := replay.NewReader(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		frames, err := r.ReadAll()
+		file.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts := &replay.Opts{DialServer: dialServer, Speed: *speed, Linger: *linger, Password: *password}
+		if !*exact {
+			opts.Normalize = replay.IgnoreVolatile
+		}
+		result, err := replay.Replay(frames, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Sent %d frames, expected %d packets, received %d, matched %d, missing %d, unexpected %d\n",
+			result.Sent, result.Expected, result.Received, result.Matched, len(result.Missing), len(result.Unexpected))
+		if !result.OK() {
+			os.Exit(1)
+		}
+	default:
+		log.Fatal("Specify either -record-addr or -replay")
+	}
+}
@@ -7,26 +7,54 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/getlantern/golog"
 	"github.com/getlantern/gonat"
 	"github.com/getlantern/ops"
+	"github.com/getlantern/packetforward/mirror"
+	"github.com/getlantern/packetforward/pipeline"
 	pserver "github.com/getlantern/packetforward/server"
+	"github.com/getlantern/packetforward/server/radius"
+	"github.com/getlantern/packetforward/server/systemd"
+	"github.com/getlantern/packetforward/server/usage"
+	"github.com/getlantern/packetforward/server/webhook"
 )
 
 var (
-	log = golog.LoggerFor("packetforward-demo-client")
+	log = golog.LoggerFor("packetforward-demo-server")
 )
 
 var (
 	addr      = flag.String("addr", "127.0.0.1:9780", "address of server")
 	tunGW     = flag.String("tun-gw", "10.0.0.1", "tun device gateway")
 	ifOut     = flag.String("ifout", "", "name of interface to use for outbound connections")
+	bridge    = flag.String("bridge", "", "name of local bridge into which to bridge ethernet mode clients, ethernet mode is disabled if empty")
 	tcpDest   = flag.String("tcpdest", "80.249.99.148", "destination to which to connect all TCP traffic")
 	udpDest   = flag.String("udpdest", "8.8.8.8", "destination to which to connect all UDP traffic")
 	pprofAddr = flag.String("pprofaddr", "", "pprof address to listen on, not activate pprof if empty")
+
+	radiusAuthAddr = flag.String("radius-auth", "", "address of RADIUS authentication server, authentication is disabled if empty")
+	radiusAcctAddr = flag.String("radius-acct", "", "address of RADIUS accounting server, accounting is disabled if empty")
+	radiusSecret   = flag.String("radius-secret", "", "RADIUS shared secret")
+
+	webhookURLs   = flag.String("webhooks", "", "comma separated list of URLs to which to POST session events")
+	webhookSecret = flag.String("webhook-secret", "", "secret with which to sign webhook requests")
+	quota         = flag.Int64("quota", 0, "maximum number of bytes per quota period, unlimited if 0")
+	quotaPeriod   = flag.String("quota-period", "session", "period over which the quota applies, one of session, day or month")
+	usageJournal  = flag.String("usage-journal", "", "file in which to record per-client usage, not recorded if empty")
+
+	mirrorNetwork       = flag.String("mirror-network", "udp", "network of the collector to which to mirror traffic, one of unix, unixgram or udp")
+	mirrorAddr          = flag.String("mirror-addr", "", "address of the collector to which to mirror traffic, traffic isn't mirrored if empty")
+	mirrorEncapsulation = flag.String("mirror-encapsulation", "pcapng", "how to send mirrored traffic, pcapng or vxlan (udp only)")
+	mirrorSampleRate    = flag.Float64("mirror-sample-rate", 1, "fraction of flows to mirror")
+
+	maxSpeedTestDuration = flag.Duration("max-speed-test-duration", 0, "maximum duration of client speed tests, speed tests are disabled if 0")
+
+	healthAddr           = flag.String("health-addr", "", "address at which to serve liveness (/healthz) and readiness (/readyz) checks, not served if empty")
+	readinessMaxSessions = flag.Int("readiness-max-sessions", 0, "number of sessions at which the server reports that it isn't ready, unlimited if 0")
 )
 
 func main() {
@@ -44,12 +72,106 @@ func main() {
 		}()
 	}
 
-	l, err := net.Listen("tcp", *addr)
+	l := listen()
+	defer l.Close()
+	log.Debugf("Listening for packetforward connections at %v", l.Addr().String())
+
+	opts := &pserver.Opts{
+		Opts: gonat.Opts{
+			IFName:      *ifOut,
+			IdleTimeout: 70 * time.Second,
+			BufferDepth: 100000,
+			OnOutbound: func(pkt *gonat.IPPacket) {
+				pkt.SetDest(gonat.Addr{*tcpDest, pkt.FT().Dst.Port})
+			},
+			OnInbound: func(pkt *gonat.IPPacket, downFT gonat.FiveTuple) {
+				pkt.SetSource(gonat.Addr{*tunGW, downFT.Dst.Port})
+			},
+		},
+	}
+	if *radiusAuthAddr != "" || *radiusAcctAddr != "" {
+		rc := radius.New(&radius.Opts{
+			AuthAddr:      *radiusAuthAddr,
+			AcctAddr:      *radiusAcctAddr,
+			Secret:        *radiusSecret,
+			NASIdentifier: "packetforward-demo-server",
+		})
+		if *radiusAuthAddr != "" {
+			opts.Authenticator = rc
+		}
+		opts.Accountant = rc
+	}
+
+	opts.Bridge = *bridge
+	opts.MaxSpeedTestDuration = *maxSpeedTestDuration
+	opts.ReadinessMaxSessions = *readinessMaxSessions
+	opts.Quota = *quota
+	switch *quotaPeriod {
+	case "day":
+		opts.QuotaPeriod = usage.PeriodDay
+	case "month":
+		opts.QuotaPeriod = usage.PeriodMonth
+	}
+	if *usageJournal != "" {
+		journal, err := usage.OpenJournal(*usageJournal, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer journal.Close()
+		opts.UsageStore = journal
+	}
+	opts.QuotaThresholds = []float64{0.8}
+	if *webhookURLs != "" {
+		notifier := webhook.New(&webhook.Opts{
+			URLs:   strings.Split(*webhookURLs, ","),
+			Secret: *webhookSecret,
+		})
+		defer notifier.Close()
+		opts.OnSessionEvent = notifier.Notify
+	}
+	if *mirrorAddr != "" {
+		m, err := mirror.New(&mirror.Opts{
+			Network:       *mirrorNetwork,
+			Addr:          *mirrorAddr,
+			Encapsulation: *mirrorEncapsulation,
+			SampleRate:    *mirrorSampleRate,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer m.Close()
+		opts.Pipeline = pipeline.New().Use("mirror", m)
+	}
+
+	s, err := pserver.NewServer(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer l.Close()
-	log.Debugf("Listening for packetforward connections at %v", l.Addr().String())
+
+	if *healthAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", pserver.LivenessHandler(s))
+		mux.Handle("/readyz", pserver.ReadinessHandler(s))
+		go func() {
+			log.Debugf("Serving health checks at http://%s/healthz and http://%s/readyz", *healthAddr, *healthAddr)
+			if err := http.ListenAndServe(*healthAddr, mux); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	notifier, err := systemd.NewNotifier()
+	if err != nil {
+		log.Error(err)
+	}
+	defer notifier.Close()
+	watchdogInterval, err := systemd.WatchdogInterval()
+	if err != nil {
+		log.Error(err)
+	}
+	stop := make(chan struct{})
+	ops.Go(func() { notifier.RunStatus(s, 10*time.Second, stop) })
+	ops.Go(func() { notifier.RunWatchdog(watchdogInterval, func() bool { return s.Liveness().OK }, stop) })
 
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch,
@@ -59,27 +181,35 @@ func main() {
 		syscall.SIGQUIT)
 	ops.Go(func() {
 		<-ch
+		close(stop)
+		notifier.Stopping()
+		// closing the listener makes Serve close the server and return
 		log.Debug("Closing listener")
 		l.Close()
 		log.Debug("Closed listener")
-		os.Exit(0)
 	})
 
-	s, err := pserver.NewServer(&pserver.Opts{
-		Opts: gonat.Opts{
-			IFName:      *ifOut,
-			IdleTimeout: 70 * time.Second,
-			BufferDepth: 100000,
-			OnOutbound: func(pkt *gonat.IPPacket) {
-				pkt.SetDest(gonat.Addr{*tcpDest, pkt.FT().Dst.Port})
-			},
-			OnInbound: func(pkt *gonat.IPPacket, downFT gonat.FiveTuple) {
-				pkt.SetSource(gonat.Addr{*tunGW, downFT.Dst.Port})
-			},
-		},
-	})
+	notifier.Ready()
+	log.Debugf("Final result: %v", s.Serve(l))
+}
+
+// listen returns the listener passed by systemd socket activation, if any, or
+// listens on -addr.
+func listen() net.Listener {
+	listeners, err := systemd.Listeners()
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Debugf("Final result: %v", s.Serve(l))
+	if len(listeners) > 0 {
+		for _, extra := range listeners[1:] {
+			log.Errorf("Ignoring additional socket activated listener at %v", extra.Addr())
+			extra.Close()
+		}
+		return listeners[0]
+	}
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return l
 }
@@ -0,0 +1,538 @@
+// doctor diagnoses the connection between a packetforward client and server.
+// It connects to the server like a client and measures dial and handshake
+// times and the round trip time to the server using pings. Through the
+// tunnel, it then resolves names with DNS and connects to TCP and UDP test
+// destinations, estimating the MTU from the segment sizes that TCP destinations
+// advertise. The results are collected in a Report.
+package doctor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/gonat"
+	"github.com/getlantern/packetforward"
+	"github.com/getlantern/packetforward/pferrors"
+	"github.com/getlantern/packetforward/protocol"
+	"github.com/getlantern/packetforward/socks"
+	"github.com/getlantern/uuid"
+)
+
+const (
+	// DefaultTimeout is the default timeout for each check
+	DefaultTimeout = 5 * time.Second
+
+	// DefaultPings is the default number of pings
+	DefaultPings = 10
+
+	// DefaultPingInterval is the default interval between pings
+	DefaultPingInterval = 100 * time.Millisecond
+
+	// ipv4TCPHeaders is the size of IPv4 and TCP headers without options
+	ipv4TCPHeaders = 40
+)
+
+var (
+	// DefaultDNSNames are the default names to resolve
+	DefaultDNSNames = []string{"www.google.com", "www.cloudflare.com"}
+
+	// DefaultTCPDestinations are the default TCP destinations
+	DefaultTCPDestinations = []string{"1.1.1.1:443", "8.8.8.8:443"}
+
+	// DefaultUDPDestinations are the default UDP destinations
+	DefaultUDPDestinations = []string{"1.1.1.1:53", "8.8.8.8:53"}
+
+	errNoPongs = errors.New("no pongs received, the server may not support pings")
+)
+
+// Opts configures a diagnosis.
+type Opts struct {
+	// DialServer configures how to connect to the packetforward server
+	DialServer packetforward.DialFunc
+
+	// Username and Password, if specified, are used to authenticate to the server
+	Username string
+	Password string
+
+	// Timeout limits each check. If not specified, defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// Pings is the number of pings to send. If not specified, defaults to DefaultPings.
+	Pings int
+
+	// PingInterval is the interval between pings. If not specified, defaults to
+	// DefaultPingInterval.
+	PingInterval time.Duration
+
+	// MTU is the MTU that the client is configured with. If not specified, defaults to
+	// socks.DefaultMTU.
+	MTU int
+
+	// DNSServer is the DNS server (IP and port) to query through the tunnel. If not specified,
+	// defaults to socks.DefaultDNSServer.
+	DNSServer string
+
+	// DNSNames are the names to resolve. If not specified, defaults to DefaultDNSNames.
+	DNSNames []string
+
+	// TCPDestinations are the addresses to connect to with TCP. If not specified, defaults to
+	// DefaultTCPDestinations.
+	TCPDestinations []string
+
+	// UDPDestinations are IPv4 addresses and ports of DNS servers, to which UDP reachability
+	// is checked by sending a query and waiting for any response. If not specified, defaults
+	// to DefaultUDPDestinations.
+	UDPDestinations []string
+}
+
+// Check is the result of a single check.
+type Check struct {
+	// Target is what was checked, for example a name or an address
+	Target string
+
+	// OK indicates whether the check succeeded
+	OK bool
+
+	// Duration is how long the check took
+	Duration time.Duration
+
+	// Result describes what the check found, for example resolved addresses
+	Result string
+
+	// Err explains why the check failed
+	Err error
+}
+
+// RTT summarizes the round trip times of pings to the server.
+type RTT struct {
+	Sent     int
+	Received int
+	Min      time.Duration
+	Avg      time.Duration
+	Max      time.Duration
+
+	// Jitter is the mean difference between consecutive round trip times
+	Jitter time.Duration
+
+	// Err explains why no round trip times were measured
+	Err error
+}
+
+// MTU is a heuristic estimate of the path MTU. The tunnel doesn't forward
+// ICMP, so the path can't be probed. Instead, the estimate is derived from the
+// maximum segment size that TCP destinations advertise, which reflects their
+// own links and any MSS clamping along the way but not necessarily the
+// smallest MTU on the path.
+type MTU struct {
+	// Configured is the MTU that the client is configured with
+	Configured int
+
+	// PathMSS is the smallest maximum segment size that TCP destinations advertised, if any
+	PathMSS int
+
+	// Estimate is PathMSS plus the size of IPv4 and TCP headers, capped at Configured.
+	// It's 0 if no TCP destination was reachable.
+	Estimate int
+}
+
+// Report is the result of a diagnosis. Checks that weren't performed because
+// an earlier one failed are nil.
+type Report struct {
+	Time       time.Time
+	ServerAddr string
+	Dial       *Check
+	Handshake  *Check
+	RTT        *RTT
+	MTU        *MTU
+	DNS        []*Check
+	TCP        []*Check
+	UDP        []*Check
+}
+
+// Run runs a diagnosis. It only fails if opts are invalid; failed checks are
+// recorded in the Report.
+func Run(opts *Opts) (*Report, error) {
+	if opts.DialServer == nil {
+		return nil, errors.New("no DialServer specified")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Pings <= 0 {
+		opts.Pings = DefaultPings
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = DefaultPingInterval
+	}
+	if opts.MTU <= 0 {
+		opts.MTU = socks.DefaultMTU
+	}
+	if opts.DNSServer == "" {
+		opts.DNSServer = socks.DefaultDNSServer
+	}
+	if opts.DNSNames == nil {
+		opts.DNSNames = DefaultDNSNames
+	}
+	if opts.TCPDestinations == nil {
+		opts.TCPDestinations = DefaultTCPDestinations
+	}
+	if opts.UDPDestinations == nil {
+		opts.UDPDestinations = DefaultUDPDestinations
+	}
+
+	s, err := socks.NewServer(&socks.Opts{
+		MTU:            opts.MTU,
+		DNSServer:      opts.DNSServer,
+		ConnectTimeout: opts.Timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	r := &Report{Time: time.Now()}
+	d := &doctor{opts: opts, s: s, pongs: make(map[uint64]chan time.Time)}
+	r.Dial = d.dial()
+	if !r.Dial.OK {
+		return r, nil
+	}
+	defer d.conn.Close()
+	r.ServerAddr = r.Dial.Target
+	r.Handshake = d.handshake()
+	if !r.Handshake.OK {
+		return r, nil
+	}
+	go d.readRecords()
+	s.Start(d)
+
+	r.RTT = d.ping()
+	for _, name := range opts.DNSNames {
+		r.DNS = append(r.DNS, d.resolve(name))
+	}
+	r.MTU = &MTU{Configured: opts.MTU}
+	for _, addr := range opts.TCPDestinations {
+		check, mss := d.connectTCP(addr)
+		if mss > 0 && (r.MTU.PathMSS == 0 || mss < r.MTU.PathMSS) {
+			r.MTU.PathMSS = mss
+		}
+		r.TCP = append(r.TCP, check)
+	}
+	if r.MTU.PathMSS > 0 {
+		r.MTU.Estimate = r.MTU.PathMSS + ipv4TCPHeaders
+		if r.MTU.Estimate > opts.MTU {
+			r.MTU.Estimate = opts.MTU
+		}
+	}
+	for _, addr := range opts.UDPDestinations {
+		r.UDP = append(r.UDP, d.exchangeUDP(addr))
+	}
+	return r, nil
+}
+
+// doctor is a minimal packetforward client that, unlike the real client,
+// exposes the timing of each step.
+type doctor struct {
+	nextPing  uint64
+	opts      *Opts
+	speedTest *protocol.SpeedTest
+	conn      net.Conn
+	rwc       *framed.ReadWriteCloser
+	s         *socks.Server
+	pongs     map[uint64]chan time.Time
+	pongsMx   sync.Mutex
+
+	// received tracks test data received during download speed tests. It's
+	// only accessed by readRecords until the server's summary arrives on
+	// summaries.
+	received      protocol.SpeedTestSummary
+	firstReceived time.Time
+	lastReceived  time.Time
+	summaries     chan *protocol.SpeedTestSummary
+}
+
+func (d *doctor) dial() *Check {
+	ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := d.opts.DialServer(ctx)
+	check := &Check{Duration: time.Since(start), Err: err}
+	if err != nil {
+		return check
+	}
+	check.OK = true
+	check.Target = conn.RemoteAddr().String()
+	d.conn = conn
+	d.rwc = framed.NewReadWriteCloser(conn)
+	d.rwc.EnableBigFrames()
+	return check
+}
+
+func (d *doctor) handshake() *Check {
+	start := time.Now()
+	check := &Check{Target: d.conn.RemoteAddr().String()}
+	check.Err = d.doHandshake()
+	check.Duration = time.Since(start)
+	check.OK = check.Err == nil
+	return check
+}
+
+func (d *doctor) doHandshake() error {
+	hello, err := protocol.EncodeHello(uuid.New().String(), &protocol.Handshake{
+		Username:  d.opts.Username,
+		Password:  d.opts.Password,
+		Records:   true,
+		SpeedTest: d.speedTest,
+	})
+	if err != nil {
+		return err
+	}
+	d.conn.SetDeadline(time.Now().Add(d.opts.Timeout))
+	defer d.conn.SetDeadline(time.Time{})
+	if _, err := d.rwc.Write(hello); err != nil {
+		return err
+	}
+	b := make([]byte, protocol.MaxHelloSize)
+	n, err := d.rwc.Read(b)
+	if err != nil {
+		return err
+	}
+	resp, err := protocol.DecodeHandshakeResponse(b[:n])
+	if err != nil {
+		return err
+	}
+	if !resp.OK {
+		return pferrors.FromCode(resp.Code, resp.Error)
+	}
+	return nil
+}
+
+// Write implements io.Writer, sending packets from the socks stack to the
+// server.
+func (d *doctor) Write(pkt []byte) (int, error) {
+	if _, err := d.rwc.Write(protocol.EncodePacket(pkt)); err != nil {
+		return 0, err
+	}
+	return len(pkt), nil
+}
+
+// readRecords dispatches records from the server until the connection fails.
+func (d *doctor) readRecords() {
+	b := make([]byte, gonat.MaximumIPPacketSize+protocol.MaxRecordOverhead)
+	for {
+		n, err := d.rwc.Read(b)
+		if err != nil {
+			return
+		}
+		record, err := protocol.DecodeRecord(b[:n])
+		if err != nil {
+			continue
+		}
+		switch record.Type {
+		case protocol.RecordPacket, protocol.RecordSequencedPacket:
+			if d.s != nil {
+				d.s.Write(record.Payload)
+			}
+		case protocol.RecordTestData:
+			d.lastReceived = time.Now()
+			if d.received.Packets == 0 {
+				d.firstReceived = d.lastReceived
+			}
+			d.received.Packets++
+			d.received.Bytes += int64(n)
+		case protocol.RecordTestSummary:
+			summary, err := protocol.DecodeTestSummary(record.Payload)
+			if err == nil && d.summaries != nil {
+				select {
+				case d.summaries <- summary:
+				default:
+				}
+			}
+		case protocol.RecordPong:
+			received := time.Now()
+			d.pongsMx.Lock()
+			ch := d.pongs[record.Sequence]
+			d.pongsMx.Unlock()
+			if ch != nil {
+				select {
+				case ch <- received:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (d *doctor) ping() *RTT {
+	return d.pingUntil(d.opts.Pings, nil)
+}
+
+// pingUntil sends count pings, or if count is 0, pings until stop is closed.
+// Closing stop abandons the outstanding ping without counting it.
+func (d *doctor) pingUntil(count int, stop <-chan struct{}) *RTT {
+	rtt := &RTT{}
+	var total, totalJitter time.Duration
+	var previous time.Duration
+	for i := 0; count == 0 || i < count; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(d.opts.PingInterval):
+			case <-stop:
+			}
+		}
+		if stopped(stop) {
+			break
+		}
+		id := atomic.AddUint64(&d.nextPing, 1)
+		ch := make(chan time.Time, 1)
+		d.pongsMx.Lock()
+		d.pongs[id] = ch
+		d.pongsMx.Unlock()
+
+		sent := time.Now()
+		rtt.Sent++
+		_, err := d.rwc.Write(protocol.EncodePing(id))
+		if err != nil {
+			rtt.Err = err
+			break
+		}
+		timer := time.NewTimer(d.opts.Timeout)
+		select {
+		case received := <-ch:
+			timer.Stop()
+			sample := received.Sub(sent)
+			if rtt.Received == 0 || sample < rtt.Min {
+				rtt.Min = sample
+			}
+			if sample > rtt.Max {
+				rtt.Max = sample
+			}
+			if rtt.Received > 0 {
+				totalJitter += absDuration(sample - previous)
+			}
+			previous = sample
+			total += sample
+			rtt.Received++
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			rtt.Sent--
+		}
+
+		d.pongsMx.Lock()
+		delete(d.pongs, id)
+		d.pongsMx.Unlock()
+	}
+	if rtt.Received == 0 {
+		if rtt.Err == nil {
+			rtt.Err = errNoPongs
+		}
+		return rtt
+	}
+	rtt.Avg = total / time.Duration(rtt.Received)
+	if rtt.Received > 1 {
+		rtt.Jitter = totalJitter / time.Duration(rtt.Received-1)
+	}
+	return rtt
+}
+
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func (d *doctor) resolve(name string) *Check {
+	ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+	defer cancel()
+	start := time.Now()
+	addrs, err := d.s.Resolver().LookupIPAddr(ctx, name)
+	check := &Check{Target: name, Duration: time.Since(start), Err: err}
+	if err == nil {
+		check.OK = true
+		results := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			results = append(results, addr.String())
+		}
+		check.Result = strings.Join(results, ", ")
+	}
+	return check
+}
+
+// connectTCP connects to the given address and returns the connection's
+// maximum segment size.
+func (d *doctor) connectTCP(addr string) (*Check, int) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := d.s.Dial(ctx, addr)
+	check := &Check{Target: addr, Duration: time.Since(start), Err: err}
+	if err != nil {
+		return check, 0
+	}
+	defer conn.Close()
+	check.OK = true
+	mss := 0
+	if mc, ok := conn.(interface{ MSS() int }); ok {
+		mss = mc.MSS()
+	}
+	return check, mss
+}
+
+// exchangeUDP sends a DNS query to the given address and waits for a
+// response.
+func (d *doctor) exchangeUDP(addr string) *Check {
+	start := time.Now()
+	check := &Check{Target: addr}
+	check.Err = d.doExchangeUDP(addr)
+	check.Duration = time.Since(start)
+	check.OK = check.Err == nil
+	return check
+}
+
+func (d *doctor) doExchangeUDP(addr string) error {
+	conn, err := d.s.DialUDP(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(d.opts.Timeout))
+	if _, err := conn.Write(rootNSQuery()); err != nil {
+		return err
+	}
+	b := make([]byte, 512)
+	if _, err := conn.Read(b); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// rootNSQuery builds a DNS query for the NS records of the root zone.
+func rootNSQuery() []byte {
+	b := make([]byte, 17)
+	rand.Read(b[:2])
+	binary.BigEndian.PutUint16(b[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(b[4:], 1)      // one question
+	// b[12] is the empty root name
+	binary.BigEndian.PutUint16(b[13:], 2) // NS
+	binary.BigEndian.PutUint16(b[15:], 1) // IN
+	return b
+}
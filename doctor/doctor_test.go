@@ -0,0 +1,296 @@
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward/packet"
+	"github.com/getlantern/packetforward/pferrors"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+// fakeServer accepts a single client, answers pings, DNS queries for A records
+// and TCP SYNs with an MSS of 1360, runs speed tests and optionally rejects
+// the handshake.
+func fakeServer(t *testing.T, reject bool) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rwc := framed.NewReadWriteCloser(conn)
+		rwc.EnableBigFrames()
+		b := make([]byte, 65536)
+		n, err := rwc.Read(b)
+		if err != nil {
+			return
+		}
+		_, hs, err := protocol.DecodeHello(b[:n])
+		if err != nil {
+			return
+		}
+		resp := &protocol.HandshakeResponse{OK: !reject}
+		if reject {
+			resp.Error = "bad password"
+			resp.Code = pferrors.Code(pferrors.ErrAuthRejected)
+		}
+		encoded, _ := protocol.EncodeHandshakeResponse(resp)
+		rwc.Write(encoded)
+		if hs.SpeedTest != nil && hs.SpeedTest.Direction == protocol.SpeedTestDownload {
+			go func() {
+				sent := &protocol.SpeedTestSummary{Packets: 100, ElapsedMicros: 1000}
+				for i := uint64(1); i <= 100; i++ {
+					record := protocol.EncodeTestData(i, hs.SpeedTest.PacketSize)
+					rwc.Write(record)
+					sent.Bytes += int64(len(record))
+					time.Sleep(100 * time.Microsecond)
+				}
+				// pretend that one record was lost
+				sent.Packets++
+				summary, _ := protocol.EncodeTestSummary(sent)
+				rwc.Write(summary)
+			}()
+		}
+		received := &protocol.SpeedTestSummary{}
+		for {
+			n, err := rwc.Read(b)
+			if err != nil {
+				return
+			}
+			record, err := protocol.DecodeRecord(b[:n])
+			if err != nil {
+				return
+			}
+			switch record.Type {
+			case protocol.RecordPing:
+				rwc.Write(protocol.EncodePong(record.Sequence))
+			case protocol.RecordPacket:
+				if response := respond(record.Payload); response != nil {
+					rwc.Write(protocol.EncodePacket(response))
+				}
+			case protocol.RecordTestData:
+				received.Packets++
+				received.Bytes += int64(n)
+			case protocol.RecordTestSummary:
+				received.ElapsedMicros = 1000000
+				summary, _ := protocol.EncodeTestSummary(received)
+				rwc.Write(summary)
+			}
+		}
+	}()
+	return l
+}
+
+func respond(pkt []byte) []byte {
+	ip, err := packet.ParseIPv4(pkt)
+	if err != nil {
+		return nil
+	}
+	var l4 []byte
+	switch ip.Protocol() {
+	case packet.ProtocolTCP:
+		tcp, err := packet.ParseTCP(ip.Payload())
+		if err != nil || tcp.Flags() != packet.TCPFlagSYN {
+			return nil
+		}
+		l4 = make([]byte, 24)
+		binary.BigEndian.PutUint16(l4[0:], tcp.DstPort())
+		binary.BigEndian.PutUint16(l4[2:], tcp.SrcPort())
+		binary.BigEndian.PutUint32(l4[4:], 1000)
+		binary.BigEndian.PutUint32(l4[8:], tcp.Seq()+1)
+		l4[12] = 6 << 4
+		l4[13] = packet.TCPFlagSYN | packet.TCPFlagACK
+		binary.BigEndian.PutUint16(l4[14:], 65535)
+		l4[20], l4[21] = 2, 4
+		binary.BigEndian.PutUint16(l4[22:], 1360)
+	case packet.ProtocolUDP:
+		udp, err := packet.ParseUDP(ip.Payload())
+		if err != nil || udp.DstPort() != 53 {
+			return nil
+		}
+		dns := dnsResponse(udp.Payload())
+		l4 = make([]byte, 8+len(dns))
+		binary.BigEndian.PutUint16(l4[0:], udp.DstPort())
+		binary.BigEndian.PutUint16(l4[2:], udp.SrcPort())
+		binary.BigEndian.PutUint16(l4[4:], uint16(len(l4)))
+		copy(l4[8:], dns)
+	default:
+		return nil
+	}
+	response := make([]byte, 20+len(l4))
+	response[0] = 0x45
+	binary.BigEndian.PutUint16(response[2:], uint16(len(response)))
+	response[8] = 64
+	response[9] = ip.Protocol()
+	copy(response[12:], ip.Dst())
+	copy(response[16:], ip.Src())
+	copy(response[20:], l4)
+	return response
+}
+
+// dnsResponse answers A queries with 10.1.2.3 and other queries without
+// answers.
+func dnsResponse(query []byte) []byte {
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	resp := append([]byte{}, query[:end]...)
+	binary.BigEndian.PutUint16(resp[2:], 0x8180)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[8:], 0)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	if binary.BigEndian.Uint16(query[end-4:]) == 1 {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		resp = append(resp, 0xC0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10, 1, 2, 3)
+	}
+	return resp
+}
+
+func dialer(l net.Listener) func(ctx context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", l.Addr().String())
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	l := fakeServer(t, false)
+	defer l.Close()
+
+	r, err := Run(&Opts{
+		DialServer:      dialer(l),
+		Timeout:         2 * time.Second,
+		Pings:           3,
+		PingInterval:    time.Millisecond,
+		DNSServer:       "10.9.9.9:53",
+		DNSNames:        []string{"test.example"},
+		TCPDestinations: []string{"10.0.0.80:80"},
+		UDPDestinations: []string{"10.9.9.9:53"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() {
+		var buf bytes.Buffer
+		r.WriteText(&buf)
+		t.Fatalf("Expected all checks to succeed:\n%v", buf.String())
+	}
+	if r.ServerAddr != l.Addr().String() {
+		t.Errorf("Wrong server address %v", r.ServerAddr)
+	}
+	if r.RTT.Received != 3 || r.RTT.Min <= 0 || r.RTT.Min > r.RTT.Avg || r.RTT.Avg > r.RTT.Max {
+		t.Errorf("Wrong RTT: %+v", r.RTT)
+	}
+	if r.DNS[0].Result != "10.1.2.3" {
+		t.Errorf("Wrong DNS result %v", r.DNS[0].Result)
+	}
+	if r.MTU.PathMSS != 1360 || r.MTU.Estimate != 1400 {
+		t.Errorf("Wrong MTU: %+v", r.MTU)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Handshake", "3/3 pongs", "path MSS 1360", "10.0.0.80:80"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Report is missing %q:\n%v", expected, buf.String())
+		}
+	}
+}
+
+func TestDoctorRejected(t *testing.T) {
+	l := fakeServer(t, true)
+	defer l.Close()
+
+	r, err := Run(&Opts{DialServer: dialer(l), Timeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Dial.OK || r.Handshake.OK || !errors.Is(r.Handshake.Err, pferrors.ErrAuthRejected) {
+		t.Errorf("Handshake should have been rejected: %+v", r.Handshake)
+	}
+	if r.RTT != nil || r.DNS != nil || r.OK() {
+		t.Error("Checks after the handshake should have been skipped")
+	}
+}
+
+func TestSpeedTest(t *testing.T) {
+	upload := func() *SpeedTestResult {
+		l := fakeServer(t, false)
+		defer l.Close()
+		r, err := SpeedTest(&SpeedTestOpts{
+			DialServer:   dialer(l),
+			Direction:    protocol.SpeedTestUpload,
+			Duration:     50 * time.Millisecond,
+			PacketSize:   1000,
+			Pings:        2,
+			PingInterval: time.Millisecond,
+			Timeout:      2 * time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}()
+	if upload.Sent.Packets == 0 || upload.Received.Packets != upload.Sent.Packets || upload.Received.Bytes != upload.Sent.Packets*1000 {
+		t.Errorf("Wrong upload summaries: %+v %+v", upload.Sent, upload.Received)
+	}
+	if upload.Loss != 0 || upload.Throughput != float64(upload.Received.Bytes*8) {
+		t.Errorf("Wrong upload result: %+v", upload)
+	}
+	if upload.IdleRTT.Received != 2 || upload.LoadedRTT.Received == 0 {
+		t.Errorf("Missing RTTs: %+v %+v", upload.IdleRTT, upload.LoadedRTT)
+	}
+
+	l := fakeServer(t, false)
+	defer l.Close()
+	download, err := SpeedTest(&SpeedTestOpts{
+		DialServer:   dialer(l),
+		Direction:    protocol.SpeedTestDownload,
+		PacketSize:   500,
+		Pings:        2,
+		PingInterval: time.Millisecond,
+		Timeout:      2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if download.Sent.Packets != 101 || download.Received.Packets != 100 || download.Received.Bytes != 50000 {
+		t.Errorf("Wrong download summaries: %+v %+v", download.Sent, download.Received)
+	}
+	if download.Loss < 0.0098 || download.Loss > 0.0100 || download.Throughput <= 0 {
+		t.Errorf("Wrong download result: %+v", download)
+	}
+
+	var buf bytes.Buffer
+	if err := download.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"download", "100 packets, 50000 bytes", "Mbit/s", "0.99%", "Loaded RTT"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Result is missing %q:\n%v", expected, buf.String())
+		}
+	}
+
+	if _, err := SpeedTest(&SpeedTestOpts{DialServer: dialer(l), Direction: "sideways"}); err == nil {
+		t.Error("Unsupported direction should have been rejected")
+	}
+}
@@ -0,0 +1,71 @@
+package doctor
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// OK reports whether all checks in the report succeeded.
+func (r *Report) OK() bool {
+	if r.Dial == nil || !r.Dial.OK || r.Handshake == nil || !r.Handshake.OK || r.RTT == nil || r.RTT.Received < r.RTT.Sent {
+		return false
+	}
+	for _, checks := range [][]*Check{r.DNS, r.TCP, r.UDP} {
+		for _, check := range checks {
+			if !check.OK {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// WriteText writes the report as a table.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Time\t\t%v\n", r.Time.Format(time.RFC3339))
+	writeCheck(tw, "Dial", r.Dial)
+	writeCheck(tw, "Handshake", r.Handshake)
+	if r.RTT != nil {
+		if r.RTT.Received == 0 {
+			fmt.Fprintf(tw, "RTT\t\tFAIL\t\t%v\n", r.RTT.Err)
+		} else {
+			fmt.Fprintf(tw, "RTT\t%d/%d pongs\tOK\t%v\tmin %v, max %v, jitter %v\n", r.RTT.Received, r.RTT.Sent, round(r.RTT.Avg), round(r.RTT.Min), round(r.RTT.Max), round(r.RTT.Jitter))
+		}
+	}
+	if r.MTU != nil {
+		if r.MTU.Estimate == 0 {
+			fmt.Fprintf(tw, "MTU\tconfigured %d\tunknown\t\tno TCP destination reachable\n", r.MTU.Configured)
+		} else {
+			fmt.Fprintf(tw, "MTU\tconfigured %d\t~%d\t\testimated from path MSS %d\n", r.MTU.Configured, r.MTU.Estimate, r.MTU.PathMSS)
+		}
+	}
+	for _, check := range r.DNS {
+		writeCheck(tw, "DNS", check)
+	}
+	for _, check := range r.TCP {
+		writeCheck(tw, "TCP", check)
+	}
+	for _, check := range r.UDP {
+		writeCheck(tw, "UDP", check)
+	}
+	return tw.Flush()
+}
+
+func writeCheck(w io.Writer, name string, check *Check) {
+	if check == nil {
+		fmt.Fprintf(w, "%v\t\tSKIPPED\t\t\n", name)
+		return
+	}
+	if !check.OK {
+		fmt.Fprintf(w, "%v\t%v\tFAIL\t%v\t%v\n", name, check.Target, round(check.Duration), check.Err)
+		return
+	}
+	fmt.Fprintf(w, "%v\t%v\tOK\t%v\t%v\n", name, check.Target, round(check.Duration), check.Result)
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
@@ -0,0 +1,252 @@
+package doctor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/getlantern/packetforward"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+const (
+	// DefaultSpeedTestDuration is 10 seconds
+	DefaultSpeedTestDuration = 10 * time.Second
+
+	// DefaultSpeedTestPacketSize is 1500 bytes
+	DefaultSpeedTestPacketSize = 1500
+)
+
+// SpeedTestOpts configures a speed test.
+type SpeedTestOpts struct {
+	// DialServer configures how to connect to the packetforward server
+	DialServer packetforward.DialFunc
+
+	// Username and Password, if specified, authenticate with the server
+	Username string
+	Password string
+
+	// Direction is the direction in which to send test data
+	Direction protocol.SpeedTestDirection
+
+	// Duration is how long to send test data. The server may limit the duration of download
+	// tests. If not specified, defaults to DefaultSpeedTestDuration.
+	Duration time.Duration
+
+	// PacketSize is the size of the test data records. If not specified, defaults to
+	// DefaultSpeedTestPacketSize.
+	PacketSize int
+
+	// Pings is the number of pings with which to measure the round trip time before sending
+	// test data. If not specified, defaults to DefaultPings.
+	Pings int
+
+	// PingInterval is the interval between pings, both before and while sending test data. If
+	// not specified, defaults to DefaultPingInterval.
+	PingInterval time.Duration
+
+	// Timeout limits dialing, the handshake, each ping and waiting for the server's summary
+	// after the test. If not specified, defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// SpeedTestResult is the result of a speed test.
+type SpeedTestResult struct {
+	Direction protocol.SpeedTestDirection
+
+	// Sent summarizes the test data that the sender sent
+	Sent *protocol.SpeedTestSummary
+
+	// Received summarizes the test data that the receiver received
+	Received *protocol.SpeedTestSummary
+
+	// Throughput is the rate at which the receiver received test data, in bits per second
+	Throughput float64
+
+	// Loss is the fraction of test data records that were sent but not received. Speed tests
+	// run over the client's TCP connection, which retransmits lost segments, so Loss isn't
+	// packet loss on the path. It's only non-zero if the test ended before all test data
+	// arrived, for example because the connection failed, and it's zero if the server ended the
+	// test early because the client's quota ran out (see QuotaExceeded).
+	Loss float64
+
+	// IdleRTT is the round trip time before sending test data
+	IdleRTT *RTT
+
+	// LoadedRTT is the round trip time while sending test data. The difference to IdleRTT
+	// shows how much latency queues along the path add under load.
+	LoadedRTT *RTT
+}
+
+// QuotaExceeded reports whether the server ended the test early because the
+// client's quota ran out.
+func (r *SpeedTestResult) QuotaExceeded() bool {
+	return r.Sent.QuotaExceeded || r.Received.QuotaExceeded
+}
+
+// SpeedTest measures the throughput between a client and the server, without
+// involving any origins, so that bottlenecks in the tunnel can be told apart
+// from bottlenecks beyond the server. The server must allow speed tests (see
+// server.Opts.MaxSpeedTestDuration).
+func SpeedTest(opts *SpeedTestOpts) (*SpeedTestResult, error) {
+	if opts.DialServer == nil {
+		return nil, errors.New("no DialServer specified")
+	}
+	if opts.Direction != protocol.SpeedTestUpload && opts.Direction != protocol.SpeedTestDownload {
+		return nil, fmt.Errorf("unsupported speed test direction %v", opts.Direction)
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = DefaultSpeedTestDuration
+	}
+	if opts.PacketSize <= 0 {
+		opts.PacketSize = DefaultSpeedTestPacketSize
+	}
+	if opts.Pings <= 0 {
+		opts.Pings = DefaultPings
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = DefaultPingInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	d := &doctor{
+		opts: &Opts{
+			DialServer:   opts.DialServer,
+			Username:     opts.Username,
+			Password:     opts.Password,
+			Timeout:      opts.Timeout,
+			Pings:        opts.Pings,
+			PingInterval: opts.PingInterval,
+		},
+		speedTest: &protocol.SpeedTest{
+			Direction:      opts.Direction,
+			DurationMillis: int64(opts.Duration / time.Millisecond),
+			PacketSize:     opts.PacketSize,
+		},
+		pongs:     make(map[uint64]chan time.Time),
+		summaries: make(chan *protocol.SpeedTestSummary, 1),
+	}
+	if check := d.dial(); !check.OK {
+		return nil, check.Err
+	}
+	defer d.conn.Close()
+	if check := d.handshake(); !check.OK {
+		return nil, check.Err
+	}
+	go d.readRecords()
+
+	r := &SpeedTestResult{Direction: opts.Direction}
+	r.IdleRTT = d.ping()
+	stop := make(chan struct{})
+	loaded := make(chan *RTT, 1)
+	go func() {
+		loaded <- d.pingUntil(0, stop)
+	}()
+	var err error
+	if opts.Direction == protocol.SpeedTestUpload {
+		err = d.upload(r, opts)
+	} else {
+		err = d.download(r, opts)
+	}
+	close(stop)
+	r.LoadedRTT = <-loaded
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Received.ElapsedMicros > 0 {
+		r.Throughput = float64(r.Received.Bytes*8) / (float64(r.Received.ElapsedMicros) / 1e6)
+	}
+	if r.Sent.Packets > 0 && r.Received.Packets < r.Sent.Packets && !r.QuotaExceeded() {
+		r.Loss = 1 - float64(r.Received.Packets)/float64(r.Sent.Packets)
+	}
+	return r, nil
+}
+
+func (d *doctor) upload(r *SpeedTestResult, opts *SpeedTestOpts) error {
+	r.Sent = &protocol.SpeedTestSummary{}
+	record := protocol.EncodeTestData(0, opts.PacketSize)
+	start := time.Now()
+	for seq := uint64(1); time.Since(start) < opts.Duration; seq++ {
+		select {
+		case summary := <-d.summaries:
+			// the server ended the test early because the quota ran out
+			r.Sent.ElapsedMicros = int64(time.Since(start) / time.Microsecond)
+			r.Received = summary
+			return nil
+		default:
+		}
+		binary.BigEndian.PutUint64(record[1:], seq)
+		if _, err := d.rwc.Write(record); err != nil {
+			return err
+		}
+		r.Sent.Packets++
+		r.Sent.Bytes += int64(len(record))
+	}
+	r.Sent.ElapsedMicros = int64(time.Since(start) / time.Microsecond)
+	summary, err := protocol.EncodeTestSummary(r.Sent)
+	if err != nil {
+		return err
+	}
+	if _, err := d.rwc.Write(summary); err != nil {
+		return err
+	}
+	r.Received, err = d.awaitSummary(opts.Timeout)
+	return err
+}
+
+func (d *doctor) download(r *SpeedTestResult, opts *SpeedTestOpts) error {
+	var err error
+	r.Sent, err = d.awaitSummary(opts.Duration + opts.Timeout)
+	if err != nil {
+		return err
+	}
+	received := d.received
+	received.ElapsedMicros = int64(d.lastReceived.Sub(d.firstReceived) / time.Microsecond)
+	r.Received = &received
+	return nil
+}
+
+func (d *doctor) awaitSummary(timeout time.Duration) (*protocol.SpeedTestSummary, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case summary := <-d.summaries:
+		return summary, nil
+	case <-timer.C:
+		return nil, errors.New("timed out waiting for speed test summary")
+	}
+}
+
+// WriteText writes the result as a table.
+func (r *SpeedTestResult) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Direction\t%v\n", r.Direction)
+	fmt.Fprintf(tw, "Sent\t%d packets, %d bytes in %v\n", r.Sent.Packets, r.Sent.Bytes, micros(r.Sent.ElapsedMicros))
+	fmt.Fprintf(tw, "Received\t%d packets, %d bytes in %v\n", r.Received.Packets, r.Received.Bytes, micros(r.Received.ElapsedMicros))
+	fmt.Fprintf(tw, "Throughput\t%.2f Mbit/s\n", r.Throughput/1e6)
+	fmt.Fprintf(tw, "Loss\t%.2f%%\n", r.Loss*100)
+	if r.QuotaExceeded() {
+		fmt.Fprintf(tw, "Quota\tExceeded, test ended early\n")
+	}
+	writeRTT(tw, "Idle RTT", r.IdleRTT)
+	writeRTT(tw, "Loaded RTT", r.LoadedRTT)
+	return tw.Flush()
+}
+
+func writeRTT(w io.Writer, name string, rtt *RTT) {
+	if rtt.Received == 0 {
+		fmt.Fprintf(w, "%v\tFAIL %v\n", name, rtt.Err)
+		return
+	}
+	fmt.Fprintf(w, "%v\t%v (min %v, max %v, jitter %v, %d/%d pongs)\n", name, round(rtt.Avg), round(rtt.Min), round(rtt.Max), round(rtt.Jitter), rtt.Received, rtt.Sent)
+}
+
+func micros(us int64) time.Duration {
+	return round(time.Duration(us) * time.Microsecond)
+}
@@ -0,0 +1,38 @@
+package packetforward
+
+import (
+	"github.com/getlantern/packetforward/pferrors"
+)
+
+// Errors returned by the client. Use errors.Is to check for them, and errors.As
+// with a *pferrors.Error to get details like the server's reason for rejecting
+// the client.
+var (
+	// ErrClosed means that the client was already closed
+	ErrClosed = pferrors.ErrClosed
+
+	// ErrAuthRejected means that the server rejected the client's credentials
+	ErrAuthRejected = pferrors.ErrAuthRejected
+
+	// ErrAuthUnavailable means that the server couldn't authenticate the client right now. The
+	// client keeps trying to connect.
+	ErrAuthUnavailable = pferrors.ErrAuthUnavailable
+
+	// ErrServerUnreachable means that the client couldn't connect to the server within
+	// Opts.ReconnectTimeout
+	ErrServerUnreachable = pferrors.ErrServerUnreachable
+
+	// ErrHandshakeFailed means that the server rejected the handshake for a reason other than
+	// those below
+	ErrHandshakeFailed = pferrors.ErrHandshakeFailed
+
+	// ErrSessionEvicted means that the server ended the session
+	ErrSessionEvicted = pferrors.ErrSessionEvicted
+
+	// ErrQuotaExceeded means that the client used up its quota
+	ErrQuotaExceeded = pferrors.ErrQuotaExceeded
+
+	// ErrPolicyDenied means that server policy doesn't allow the requested session, for example
+	// because the server doesn't support the requested Mode
+	ErrPolicyDenied = pferrors.ErrPolicyDenied
+)
@@ -0,0 +1,185 @@
+package packetforward
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward/pferrors"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+func TestErrClosed(t *testing.T) {
+	c := Client(ioutil.Discard, time.Second, func(ctx context.Context) (net.Conn, error) {
+		return nil, errors.New("should not dial")
+	})
+	c.Close()
+	if _, err := c.Write([]byte("packet")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestErrServerUnreachable(t *testing.T) {
+	dialErr := errors.New("connection refused")
+	c := NewClient(ioutil.Discard, &Opts{
+		IdleTimeout:      50 * time.Millisecond,
+		ReconnectTimeout: 200 * time.Millisecond,
+		DialServer: func(ctx context.Context) (net.Conn, error) {
+			return nil, dialErr
+		},
+	})
+	defer c.Close()
+	_, err := c.Write([]byte("packet"))
+	if !errors.Is(err, ErrServerUnreachable) {
+		t.Errorf("Expected ErrServerUnreachable, got %v", err)
+	}
+	if !errors.Is(err, dialErr) {
+		t.Errorf("Expected dial error as cause, got %v", err)
+	}
+}
+
+func TestErrAuthRejected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rwc := framed.NewReadWriteCloser(conn)
+		rwc.EnableBigFrames()
+		b := make([]byte, protocol.MaxHelloSize)
+		if _, err := rwc.Read(b); err != nil {
+			return
+		}
+		resp, _ := protocol.EncodeHandshakeResponse(&protocol.HandshakeResponse{
+			Error: "authentication rejected: bad password",
+			Code:  pferrors.Code(ErrAuthRejected),
+		})
+		rwc.Write(resp)
+	}()
+
+	c := NewClient(ioutil.Discard, &Opts{
+		IdleTimeout: time.Second,
+		Username:    "user",
+		Password:    "wrong",
+		DialServer: func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", l.Addr().String())
+		},
+	})
+	defer c.Close()
+	_, err = c.Write([]byte("packet"))
+	if !errors.Is(err, ErrAuthRejected) {
+		t.Fatalf("Expected ErrAuthRejected, got %v", err)
+	}
+	var pfErr *pferrors.Error
+	if !errors.As(err, &pfErr) || pfErr.Reason != "bad password" {
+		t.Errorf("Expected reason from server, got %v", err)
+	}
+}
+
+func TestRetryQuotaExceeded(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var hellos int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			rwc := framed.NewReadWriteCloser(conn)
+			rwc.EnableBigFrames()
+			b := make([]byte, protocol.MaxHelloSize)
+			if _, err := rwc.Read(b); err == nil {
+				atomic.AddInt32(&hellos, 1)
+				resp, _ := protocol.EncodeHandshakeResponse(&protocol.HandshakeResponse{
+					Error: "quota exceeded",
+					Code:  pferrors.Code(ErrQuotaExceeded),
+				})
+				rwc.Write(resp)
+			}
+			conn.Close()
+		}
+	}()
+
+	c := NewClient(ioutil.Discard, &Opts{
+		IdleTimeout:      50 * time.Millisecond,
+		ReconnectTimeout: 300 * time.Millisecond,
+		Username:         "user",
+		DialServer: func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", l.Addr().String())
+		},
+	})
+	defer c.Close()
+	_, err = c.Write([]byte("packet"))
+	if pferrors.Kind(err) != ErrQuotaExceeded {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if atomic.LoadInt32(&hellos) < 2 {
+		t.Error("Quota rejections should be retried")
+	}
+}
+
+func TestErrSessionEvicted(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// end the session after the first packet
+			rwc := framed.NewReadWriteCloser(conn)
+			rwc.EnableBigFrames()
+			b := make([]byte, protocol.MaxHelloSize)
+			rwc.Read(b)
+			rwc.Read(b)
+			conn.Close()
+		}
+	}()
+
+	c := NewClient(ioutil.Discard, &Opts{
+		IdleTimeout: time.Second,
+		DialServer: func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", l.Addr().String())
+		},
+	})
+	defer c.Close()
+	if _, err := c.Write([]byte("packet")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().Evictions == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Eviction not noticed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := c.Stats(); !errors.Is(stats.LastEviction, ErrSessionEvicted) {
+		t.Errorf("Expected ErrSessionEvicted, got %v", stats.LastEviction)
+	}
+	// the client starts a new session
+	if _, err := c.Write([]byte("packet")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,56 @@
+// logging defines the Logger interface through which packetforward clients and
+// servers log, along with adapters for golog (the default) and, on Go 1.21 and
+// later, log/slog.
+package logging
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/getlantern/golog"
+)
+
+// Logger is a leveled logger with structured fields.
+type Logger interface {
+	// Debugf logs a debug message
+	Debugf(format string, args ...interface{})
+
+	// Errorf logs an error message
+	Errorf(format string, args ...interface{})
+
+	// With returns a Logger that attaches the given fields, specified as alternating keys and
+	// values, to every line that it logs.
+	With(keyvals ...interface{}) Logger
+}
+
+// FromGolog adapts a golog.Logger. Since golog doesn't support structured
+// fields, fields are prepended to messages as key=value pairs.
+func FromGolog(l golog.Logger) Logger {
+	return &gologLogger{l: l}
+}
+
+type gologLogger struct {
+	l      golog.Logger
+	prefix string
+}
+
+func (g *gologLogger) Debugf(format string, args ...interface{}) {
+	g.l.Debug(g.prefix + fmt.Sprintf(format, args...))
+}
+
+func (g *gologLogger) Errorf(format string, args ...interface{}) {
+	g.l.Error(g.prefix + fmt.Sprintf(format, args...))
+}
+
+func (g *gologLogger) With(keyvals ...interface{}) Logger {
+	var buf bytes.Buffer
+	buf.WriteString(g.prefix)
+	for i := 0; i < len(keyvals); i += 2 {
+		var value interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		fmt.Fprintf(&buf, "%v=%v ", keyvals[i], value)
+	}
+	return &gologLogger{l: g.l, prefix: buf.String()}
+}
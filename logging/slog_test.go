@@ -0,0 +1,25 @@
+//go:build go1.21
+// +build go1.21
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestSlog(t *testing.T) {
+	var buf bytes.Buffer
+	l := FromSlog(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	l.With("session", "abc", "remote", "10.0.0.1:1234").Errorf("failed %d times", 3)
+
+	line := make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["msg"] != "failed 3 times" || line["level"] != "ERROR" || line["session"] != "abc" || line["remote"] != "10.0.0.1:1234" {
+		t.Errorf("Unexpected log line %v", line)
+	}
+}
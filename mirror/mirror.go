@@ -0,0 +1,327 @@
+// mirror provides a pipeline.Handler that sends copies of packets to an
+// intrusion detection system or another collector, for example Suricata.
+//
+// Packets are encoded as pcapng Enhanced Packet Blocks whose comments contain
+// the packet's client ID and direction. IP packets are captured on an
+// interface with link type RAW and Ethernet frames on one with link type
+// ETHERNET. Stream sockets receive a single pcapng section per connection.
+// Datagram sockets receive a complete section, including the interface
+// descriptions, in every datagram, so that collectors can decode datagrams
+// independently. pcapng over UDP isn't a standard transport, so collectors
+// need a small shim that reads the datagrams, for example one that writes
+// them to a pipe that the IDS reads as a capture file.
+//
+// Alternatively, packets can be sent to UDP collectors with VXLAN
+// encapsulation, which IDSs like Suricata decode natively. IP packets are
+// wrapped in Ethernet frames with made-up MAC addresses that indicate their
+// direction. VXLAN can't carry the client ID.
+//
+// Mirroring never blocks forwarding. Packets are copied to a bounded queue
+// from which they're written in the background, and packets that don't fit
+// into the queue are dropped from the mirror (but not from the session).
+package mirror
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/packet"
+	"github.com/getlantern/packetforward/pcapng"
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+var log = golog.LoggerFor("packetforward.mirror")
+
+const (
+	// DefaultQueueSize is 1024 packets
+	DefaultQueueSize = 1024
+
+	// EncapsulationPCAPNG encodes packets as pcapng blocks
+	EncapsulationPCAPNG = "pcapng"
+
+	// EncapsulationVXLAN sends packets in VXLAN datagrams, by default to port 4789
+	EncapsulationVXLAN = "vxlan"
+
+	maxDialDelay = 1 * time.Second
+	writeTimeout = 5 * time.Second
+)
+
+// Opts configures a Mirror.
+type Opts struct {
+	// Network is the network of the collector, one of "unix", "unixgram" or "udp"
+	Network string
+
+	// Encapsulation determines how packets are sent to the collector, either
+	// EncapsulationPCAPNG or EncapsulationVXLAN, which requires a "udp" network. If not
+	// specified, defaults to EncapsulationPCAPNG.
+	Encapsulation string
+
+	// VNI is the VXLAN network identifier with EncapsulationVXLAN
+	VNI uint32
+
+	// Addr is the address of the collector, for example the path of a Unix socket or a
+	// host:port for UDP
+	Addr string
+
+	// SampleRate, if between 0 and 1, is the fraction of flows to mirror. Packets are sampled
+	// by flow (protocol, addresses and ports, in either direction), so the IDS sees entire
+	// connections. Packets that aren't TCP or UDP are sampled by client. If not specified, all
+	// packets are mirrored.
+	SampleRate float64
+
+	// Filter, if specified, selects which packets to mirror. It's called on the packet
+	// processing path, so it must not block.
+	Filter func(pkt *pipeline.Packet) bool
+
+	// QueueSize is the number of packets that can wait to be mirrored. If not specified,
+	// defaults to DefaultQueueSize.
+	QueueSize int
+
+	// Logger, if specified, is used for logging instead of the default golog logger
+	Logger logging.Logger
+}
+
+// Stats counts what a Mirror did with the packets it saw.
+type Stats struct {
+	// Mirrored counts packets written to the collector
+	Mirrored int64
+
+	// Skipped counts packets that weren't selected by the filter or sampling
+	Skipped int64
+
+	// Dropped counts packets that were selected but didn't fit into the queue
+	Dropped int64
+
+	// Failed counts packets that couldn't be written to the collector
+	Failed int64
+}
+
+// Mirror is a pipeline.Handler that mirrors the packets it sees to a
+// collector. It passes every packet, so it only sees packets that earlier
+// handlers in the chain didn't drop or respond to.
+type Mirror struct {
+	mirrored  int64
+	skipped   int64
+	dropped   int64
+	failed    int64
+	opts      *Opts
+	log       logging.Logger
+	threshold uint32
+	vxlan     bool
+	datagrams bool
+	queue     chan *capture
+	close     chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// New constructs a Mirror and starts mirroring in the background. The
+// collector is connected lazily and reconnected after errors.
+func New(opts *Opts) (*Mirror, error) {
+	var datagrams bool
+	switch opts.Network {
+	case "unix":
+	case "unixgram", "udp", "udp4", "udp6":
+		datagrams = true
+	default:
+		return nil, errors.New("unsupported mirror network " + opts.Network)
+	}
+	if opts.Addr == "" {
+		return nil, errors.New("no mirror address specified")
+	}
+	switch opts.Encapsulation {
+	case "":
+		opts.Encapsulation = EncapsulationPCAPNG
+	case EncapsulationPCAPNG:
+	case EncapsulationVXLAN:
+		if !strings.HasPrefix(opts.Network, "udp") {
+			return nil, errors.New("vxlan encapsulation requires a udp network")
+		}
+		if opts.VNI > maxVNI {
+			return nil, errors.New("vxlan network identifier must fit into 24 bits")
+		}
+	default:
+		return nil, errors.New("unsupported mirror encapsulation " + opts.Encapsulation)
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = logging.FromGolog(log)
+	}
+	m := &Mirror{
+		opts:      opts,
+		log:       logger,
+		threshold: 1<<32 - 1,
+		vxlan:     opts.Encapsulation == EncapsulationVXLAN,
+		datagrams: datagrams,
+		queue:     make(chan *capture, opts.QueueSize),
+		close:     make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	if opts.SampleRate > 0 && opts.SampleRate < 1 {
+		m.threshold = uint32(opts.SampleRate * float64(1<<32-1))
+	}
+	go m.run()
+	return m, nil
+}
+
+// capture is a copy of a packet as it was when the mirror saw it.
+type capture struct {
+	ts  time.Time
+	pkt pipeline.Packet
+}
+
+// Handle implements the method from pipeline.Handler.
+func (m *Mirror) Handle(pkt *pipeline.Packet) pipeline.Verdict {
+	if (m.opts.Filter != nil && !m.opts.Filter(pkt)) || !m.sampled(pkt) {
+		atomic.AddInt64(&m.skipped, 1)
+		return pipeline.Pass
+	}
+	c := &capture{ts: time.Now(), pkt: *pkt}
+	c.pkt.Data = append([]byte(nil), pkt.Data...)
+	c.pkt.Responses = nil
+	select {
+	case m.queue <- c:
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+	}
+	return pipeline.Pass
+}
+
+// sampled determines whether the packet's flow is sampled.
+func (m *Mirror) sampled(pkt *pipeline.Packet) bool {
+	if m.threshold == 1<<32-1 {
+		return true
+	}
+	return flowHash(pkt) <= m.threshold
+}
+
+// flowHash hashes the packet's flow such that both directions of the flow
+// have the same hash.
+func flowHash(pkt *pipeline.Packet) uint32 {
+	h := fnv.New32a()
+	b := pkt.Data
+	if pkt.Mode == protocol.ModeEthernet {
+		var ok bool
+		if b, ok = packet.FromEthernet(b); !ok {
+			b = nil
+		}
+	}
+	ip, err := packet.ParseIP(b)
+	if err != nil {
+		h.Write([]byte(pkt.ClientID))
+		return h.Sum32()
+	}
+	proto, transport := ip.Transport()
+	srcPort, dstPort, ok := packet.Ports(proto, transport)
+	if !ok {
+		h.Write([]byte(pkt.ClientID))
+		return h.Sum32()
+	}
+	a := append(append([]byte{}, ip.Src()...), byte(srcPort>>8), byte(srcPort))
+	z := append(append([]byte{}, ip.Dst()...), byte(dstPort>>8), byte(dstPort))
+	if string(a) > string(z) {
+		a, z = z, a
+	}
+	h.Write([]byte{proto})
+	h.Write(a)
+	h.Write(z)
+	return h.Sum32()
+}
+
+func (m *Mirror) run() {
+	defer close(m.closed)
+
+	var conn net.Conn
+	var nextDial time.Time
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	var b []byte
+	for {
+		var c *capture
+		select {
+		case <-m.close:
+			return
+		case c = <-m.queue:
+		}
+
+		if conn == nil {
+			if time.Now().Before(nextDial) {
+				atomic.AddInt64(&m.failed, 1)
+				continue
+			}
+			var err error
+			conn, err = net.Dial(m.opts.Network, m.opts.Addr)
+			if err == nil && !m.datagrams {
+				conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+				_, err = conn.Write(pcapng.AppendHeader(nil))
+			}
+			if err != nil {
+				m.log.Debugf("Unable to connect to mirror collector at %v: %v", m.opts.Addr, err)
+				if conn != nil {
+					conn.Close()
+					conn = nil
+				}
+				nextDial = time.Now().Add(maxDialDelay)
+				atomic.AddInt64(&m.failed, 1)
+				continue
+			}
+		}
+
+		b = b[:0]
+		switch {
+		case m.vxlan:
+			b = appendVXLAN(b, m.opts.VNI, &c.pkt)
+		case m.datagrams:
+			b = pcapng.AppendHeader(b)
+			b = pcapng.AppendPacket(b, c.ts, &c.pkt)
+		default:
+			b = pcapng.AppendPacket(b, c.ts, &c.pkt)
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := conn.Write(b); err != nil {
+			atomic.AddInt64(&m.failed, 1)
+			if !m.datagrams {
+				// a partially written block corrupts the stream, so start over
+				m.log.Debugf("Unable to write to mirror collector at %v: %v", m.opts.Addr, err)
+				conn.Close()
+				conn = nil
+			}
+			continue
+		}
+		atomic.AddInt64(&m.mirrored, 1)
+	}
+}
+
+// Stats returns the mirror's stats.
+func (m *Mirror) Stats() *Stats {
+	return &Stats{
+		Mirrored: atomic.LoadInt64(&m.mirrored),
+		Skipped:  atomic.LoadInt64(&m.skipped),
+		Dropped:  atomic.LoadInt64(&m.dropped),
+		Failed:   atomic.LoadInt64(&m.failed),
+	}
+}
+
+// Close stops mirroring. Packets that are still queued aren't mirrored.
+func (m *Mirror) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.close)
+	})
+	<-m.closed
+	return nil
+}
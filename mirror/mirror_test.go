@@ -0,0 +1,249 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/packetforward/pcapng"
+	"github.com/getlantern/packetforward/pipeline"
+)
+
+type block struct {
+	blockType uint32
+	body      []byte
+}
+
+// readBlocks parses pcapng blocks from b.
+func readBlocks(t *testing.T, b []byte) []block {
+	var blocks []block
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("Truncated block: %x", b)
+		}
+		length := int(binary.LittleEndian.Uint32(b[4:]))
+		if length%4 != 0 || length > len(b) || binary.LittleEndian.Uint32(b[length-4:]) != uint32(length) {
+			t.Fatalf("Invalid block length %d", length)
+		}
+		blocks = append(blocks, block{binary.LittleEndian.Uint32(b), b[8 : length-4]})
+		b = b[length:]
+	}
+	return blocks
+}
+
+func udpPacket(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	b := make([]byte, 28)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	b[9] = 17
+	copy(b[12:], src.To4())
+	copy(b[16:], dst.To4())
+	binary.BigEndian.PutUint16(b[20:], srcPort)
+	binary.BigEndian.PutUint16(b[22:], dstPort)
+	binary.BigEndian.PutUint16(b[24:], 8)
+	return b
+}
+
+func TestMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, network := range []string{"unixgram", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			addr := filepath.Join(dir, network+".sock")
+			var read func() []byte
+			if network == "unixgram" {
+				conn, err := net.ListenPacket(network, addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				read = func() []byte {
+					b := make([]byte, 65536)
+					conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+					n, _, err := conn.ReadFrom(b)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return b[:n]
+				}
+			} else {
+				l, err := net.Listen(network, addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer l.Close()
+				accepted := make(chan net.Conn, 1)
+				go func() {
+					conn, err := l.Accept()
+					if err == nil {
+						accepted <- conn
+					}
+				}()
+				var conn net.Conn
+				read = func() []byte {
+					if conn == nil {
+						conn = <-accepted
+					}
+					// header (28 + 2 * 20) and two packets with 28 bytes of data and a 68 byte
+					// comment each
+					b := make([]byte, 68+2*(32+28+8+4+68+4))
+					conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+					if _, err := io.ReadFull(conn, b); err != nil {
+						t.Fatal(err)
+					}
+					return b
+				}
+			}
+
+			m, err := New(&Opts{
+				Network: network,
+				Addr:    addr,
+				Filter: func(pkt *pipeline.Packet) bool {
+					return len(pkt.Data) > 1
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			chain := pipeline.New().Use("mirror", m)
+
+			id := "00000000-0000-0000-0000-000000000000"
+			up := udpPacket(net.ParseIP("10.0.0.2"), net.ParseIP("8.8.8.8"), 5000, 53)
+			down := udpPacket(net.ParseIP("8.8.8.8"), net.ParseIP("10.0.0.2"), 53, 5000)
+			chain.Process(&pipeline.Packet{Direction: pipeline.Upstream, ClientID: id, Data: []byte{0}})
+			chain.Process(&pipeline.Packet{Direction: pipeline.Upstream, ClientID: id, Data: up})
+			chain.Process(&pipeline.Packet{Direction: pipeline.Downstream, ClientID: id, Data: down})
+
+			var blocks []block
+			if network == "unixgram" {
+				for i := 0; i < 2; i++ {
+					datagram := readBlocks(t, read())
+					if len(datagram) != 4 || datagram[0].blockType != pcapng.BlockTypeSectionHeader || datagram[1].blockType != pcapng.BlockTypeInterface {
+						t.Fatalf("Each datagram should contain a complete section, got %d blocks", len(datagram))
+					}
+					blocks = append(blocks, datagram[3])
+				}
+			} else {
+				stream := readBlocks(t, read())
+				if len(stream) != 5 || stream[0].blockType != pcapng.BlockTypeSectionHeader {
+					t.Fatalf("Stream should contain a single section, got %d blocks", len(stream))
+				}
+				blocks = stream[3:]
+			}
+
+			for i, expected := range [][]byte{up, down} {
+				epb := blocks[i]
+				if epb.blockType != pcapng.BlockTypeEnhancedPacket {
+					t.Fatalf("Expected enhanced packet block, got %x", epb.blockType)
+				}
+				if binary.LittleEndian.Uint32(epb.body) != pcapng.InterfaceIP || binary.LittleEndian.Uint32(epb.body[12:]) != uint32(len(expected)) {
+					t.Error("Wrong interface or length")
+				}
+				if !bytes.Equal(epb.body[20:20+len(expected)], expected) {
+					t.Error("Wrong packet data")
+				}
+				flags := binary.LittleEndian.Uint32(epb.body[20+len(expected)+4:])
+				if (i == 0 && flags != pcapng.EPBFlagsOutbound) || (i == 1 && flags != pcapng.EPBFlagsInbound) {
+					t.Errorf("Wrong direction flags %d", flags)
+				}
+				direction := []string{"upstream", "downstream"}[i]
+				if !bytes.Contains(epb.body, []byte("client_id="+id+" direction="+direction)) {
+					t.Error("Missing client ID comment")
+				}
+			}
+
+			stats := m.Stats()
+			if stats.Mirrored != 2 || stats.Skipped != 1 || stats.Dropped != 0 || stats.Failed != 0 {
+				t.Errorf("Wrong stats: %+v", stats)
+			}
+		})
+	}
+}
+
+func TestVXLAN(t *testing.T) {
+	if _, err := New(&Opts{Network: "unixgram", Addr: "collector.sock", Encapsulation: EncapsulationVXLAN}); err == nil {
+		t.Error("VXLAN should require UDP")
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m, err := New(&Opts{Network: "udp", Addr: conn.LocalAddr().String(), Encapsulation: EncapsulationVXLAN, VNI: 0x123456})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	chain := pipeline.New().Use("mirror", m)
+
+	up := udpPacket(net.ParseIP("10.0.0.2"), net.ParseIP("8.8.8.8"), 5000, 53)
+	down := udpPacket(net.ParseIP("8.8.8.8"), net.ParseIP("10.0.0.2"), 53, 5000)
+	chain.Process(&pipeline.Packet{Direction: pipeline.Upstream, Data: up})
+	chain.Process(&pipeline.Packet{Direction: pipeline.Downstream, Data: down})
+
+	for i, expected := range [][]byte{up, down} {
+		b := make([]byte, 65536)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = b[:n]
+		if !bytes.Equal(b[:8], []byte{0x08, 0, 0, 0, 0x12, 0x34, 0x56, 0}) {
+			t.Errorf("Wrong VXLAN header %x", b[:8])
+		}
+		frame := b[8:]
+		dst, src := clientMAC, originMAC
+		if i == 0 {
+			dst, src = src, dst
+		}
+		if !bytes.Equal(frame[:6], dst) || !bytes.Equal(frame[6:12], src) || binary.BigEndian.Uint16(frame[12:]) != 0x0800 {
+			t.Errorf("Wrong Ethernet header %x", frame[:14])
+		}
+		if !bytes.Equal(frame[14:], expected) {
+			t.Error("Wrong packet data")
+		}
+	}
+}
+
+func TestSampling(t *testing.T) {
+	m := &Mirror{opts: &Opts{}, queue: make(chan *capture, 1)}
+	m.threshold = 1<<31 - 1
+
+	sampled := 0
+	for port := uint16(1); port <= 1000; port++ {
+		up := &pipeline.Packet{Data: udpPacket(net.ParseIP("10.0.0.2"), net.ParseIP("8.8.8.8"), port, 53)}
+		down := &pipeline.Packet{Data: udpPacket(net.ParseIP("8.8.8.8"), net.ParseIP("10.0.0.2"), 53, port), Direction: pipeline.Downstream}
+		if m.sampled(up) != m.sampled(down) {
+			t.Fatal("Both directions of a flow should be sampled alike")
+		}
+		if m.sampled(up) {
+			sampled++
+		}
+	}
+	if sampled < 400 || sampled > 600 {
+		t.Errorf("Expected about half of flows to be sampled, got %d", sampled)
+	}
+
+	// the queue holds only one packet and nothing drains it
+	m.threshold = 1<<32 - 1
+	pkt := &pipeline.Packet{Data: []byte("packet")}
+	if m.Handle(pkt) != pipeline.Pass || m.Handle(pkt) != pipeline.Pass {
+		t.Error("Mirror should pass all packets")
+	}
+	if stats := m.Stats(); stats.Dropped != 1 {
+		t.Errorf("Expected 1 packet to be dropped from the full queue, got %d", stats.Dropped)
+	}
+}
@@ -0,0 +1,44 @@
+package mirror
+
+import (
+	"github.com/getlantern/packetforward/packet"
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+const (
+	// vxlanFlagVNI marks the VNI in a VXLAN header as valid
+	vxlanFlagVNI = 0x08
+
+	// maxVNI is the largest VXLAN network identifier
+	maxVNI = 1<<24 - 1
+)
+
+var (
+	// clientMAC and originMAC are locally administered addresses for the two
+	// ends of mirrored IP packets, which tell collectors the direction
+	clientMAC = []byte{0x02, 0, 0, 0, 0, 1}
+	originMAC = []byte{0x02, 0, 0, 0, 0, 2}
+)
+
+// appendVXLAN appends a VXLAN header (RFC 7348) and the packet to b. IP
+// packets are wrapped in an Ethernet frame sent from clientMAC to originMAC
+// if they're upstream and from originMAC to clientMAC if they're downstream.
+func appendVXLAN(b []byte, vni uint32, pkt *pipeline.Packet) []byte {
+	b = append(b, vxlanFlagVNI, 0, 0, 0, byte(vni>>16), byte(vni>>8), byte(vni), 0)
+	if pkt.Mode == protocol.ModeEthernet {
+		return append(b, pkt.Data...)
+	}
+	src, dst := clientMAC, originMAC
+	if pkt.Direction == pipeline.Downstream {
+		src, dst = dst, src
+	}
+	etherType := packet.EtherTypeIPv4
+	if len(pkt.Data) > 0 && pkt.Data[0]>>4 == 6 {
+		etherType = packet.EtherTypeIPv6
+	}
+	b = append(b, dst...)
+	b = append(b, src...)
+	b = append(b, byte(etherType>>8), byte(etherType))
+	return append(b, pkt.Data...)
+}
@@ -0,0 +1,270 @@
+// mobile provides packetforward client bindings that can be used with
+// gomobile bind. It only exposes types that gomobile supports: packets are
+// byte slices, downstream packets and events are delivered through the
+// Callback interface and connecting to the server can be delegated to the host
+// app through the Dialer interface (for example to protect sockets from an
+// Android VpnService).
+package mobile
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/packetforward"
+	"github.com/getlantern/packetforward/pferrors"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+const (
+	// DefaultIdleTimeoutMillis is the default idle timeout
+	DefaultIdleTimeoutMillis = 70000
+)
+
+// Events reported to Callback.OnEvent
+const (
+	// EventConnected means that the client connected to the server and completed the handshake
+	EventConnected = "connected"
+
+	// EventDisconnected means that the connection to the server closed. The client reconnects
+	// automatically when it next has packets to send.
+	EventDisconnected = "disconnected"
+
+	// EventDialFailed means that connecting to the server failed. The detail describes the error.
+	EventDialFailed = "dial_failed"
+)
+
+// Options configures a Client.
+type Options struct {
+	// ServerAddr is the address (host:port) of the packetforward server
+	ServerAddr string
+
+	// ID optionally identifies the client to the server, see packetforward.Opts
+	ID string
+
+	// Username and Password, if specified, authenticate the client to the server
+	Username string
+	Password string
+
+	// IdleTimeoutMillis is the idle timeout in milliseconds. If not specified, defaults to
+	// DefaultIdleTimeoutMillis.
+	IdleTimeoutMillis int64
+
+	// Ethernet, if true, forwards Ethernet frames instead of IP packets
+	Ethernet bool
+}
+
+// Callback receives packets and events from a Client.
+type Callback interface {
+	// OnPacket is called with every packet received from the server, one at a time. It must not
+	// block for long.
+	OnPacket(packet []byte)
+
+	// OnEvent is called when the client's connection to the server changes (see the Event
+	// constants). detail provides additional information, such as the error for EventDialFailed.
+	OnEvent(event string, detail string)
+}
+
+// Dialer connects to the server on behalf of a Client.
+type Dialer interface {
+	// Dial connects to addr over TCP and returns the file descriptor of the connected socket.
+	// The Client takes ownership of the file descriptor.
+	Dial(addr string) (int, error)
+}
+
+// Stats are a Client's packet and byte counts.
+type Stats struct {
+	PacketsUp   int64
+	BytesUp     int64
+	PacketsDown int64
+	BytesDown   int64
+	WriteErrors int64
+}
+
+// Client is a packetforward client.
+type Client struct {
+	packetsUp   int64
+	bytesUp     int64
+	packetsDown int64
+	bytesDown   int64
+	writeErrors int64
+	pf          io.WriteCloser
+	callback    Callback
+	pending     *notifyingConn
+	pendingMx   sync.Mutex
+	closed      bool
+	mx          sync.RWMutex
+}
+
+// NewClient constructs a new Client. If dialer is nil, the client dials the
+// server itself. The client connects to the server when the first packet is
+// written.
+func NewClient(opts *Options, dialer Dialer, callback Callback) (*Client, error) {
+	if opts == nil || opts.ServerAddr == "" {
+		return nil, errors.New("server address required")
+	}
+	if callback == nil {
+		return nil, errors.New("callback required")
+	}
+	if opts.ID != "" && len(opts.ID) != protocol.IDLength {
+		return nil, errors.New("client ID must be %d characters long", protocol.IDLength)
+	}
+	idleTimeoutMillis := opts.IdleTimeoutMillis
+	if idleTimeoutMillis <= 0 {
+		idleTimeoutMillis = DefaultIdleTimeoutMillis
+	}
+
+	c := &Client{callback: callback}
+	pfOpts := &packetforward.Opts{
+		ID:          opts.ID,
+		IdleTimeout: time.Duration(idleTimeoutMillis) * time.Millisecond,
+		DialServer: func(ctx context.Context) (net.Conn, error) {
+			conn, err := dial(ctx, dialer, opts.ServerAddr)
+			if err != nil {
+				c.event(EventDialFailed, err.Error())
+				return nil, err
+			}
+			// the server may still reject the handshake, so EventConnected waits for the
+			// first successful write
+			nc := &notifyingConn{Conn: conn, c: c}
+			c.pendingMx.Lock()
+			c.pending = nc
+			c.pendingMx.Unlock()
+			return nc, nil
+		},
+		Username: opts.Username,
+		Password: opts.Password,
+	}
+	if opts.Ethernet {
+		pfOpts.Mode = protocol.ModeEthernet
+	}
+	c.pf = packetforward.NewClient(&downstream{c}, pfOpts)
+	return c, nil
+}
+
+func dial(ctx context.Context, dialer Dialer, addr string) (net.Conn, error) {
+	if dialer == nil {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	fd, err := dialer.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), addr)
+	// FileConn dups the file descriptor, so close ours either way
+	defer file.Close()
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, errors.New("unable to use file descriptor %d: %v", fd, err)
+	}
+	return conn, nil
+}
+
+// Write sends a single packet to the server. It blocks while (re)connecting to
+// the server. The packet is not retained after Write returns.
+func (c *Client) Write(packet []byte) error {
+	if _, err := c.pf.Write(packet); err != nil {
+		atomic.AddInt64(&c.writeErrors, 1)
+		return err
+	}
+	atomic.AddInt64(&c.packetsUp, 1)
+	atomic.AddInt64(&c.bytesUp, int64(len(packet)))
+	c.pendingMx.Lock()
+	conn := c.pending
+	c.pending = nil
+	c.pendingMx.Unlock()
+	if conn != nil {
+		conn.connected()
+	}
+	return nil
+}
+
+// ErrorCode classifies an error returned by Client.Write, returning one of the
+// pferrors codes (for example "auth_rejected" or "quota_exceeded"), or "" if
+// the error isn't classified.
+func ErrorCode(err error) string {
+	return pferrors.Code(err)
+}
+
+// Stats returns the client's current stats.
+func (c *Client) Stats() *Stats {
+	return &Stats{
+		PacketsUp:   atomic.LoadInt64(&c.packetsUp),
+		BytesUp:     atomic.LoadInt64(&c.bytesUp),
+		PacketsDown: atomic.LoadInt64(&c.packetsDown),
+		BytesDown:   atomic.LoadInt64(&c.bytesDown),
+		WriteErrors: atomic.LoadInt64(&c.writeErrors),
+	}
+}
+
+// Close closes the client. Once it returns, the Callback is no longer called.
+func (c *Client) Close() error {
+	err := c.pf.Close()
+	c.mx.Lock()
+	c.closed = true
+	c.mx.Unlock()
+	return err
+}
+
+func (c *Client) event(event string, detail string) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	if !c.closed {
+		c.callback.OnEvent(event, detail)
+	}
+}
+
+// downstream delivers packets from the server to the Callback.
+type downstream struct {
+	c *Client
+}
+
+func (d *downstream) Write(b []byte) (int, error) {
+	c := d.c
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	if !c.closed {
+		atomic.AddInt64(&c.packetsDown, 1)
+		atomic.AddInt64(&c.bytesDown, int64(len(b)))
+		c.callback.OnPacket(b)
+	}
+	return len(b), nil
+}
+
+// notifyingConn reports EventConnected once the connection to the server is
+// established and EventDisconnected when it closes.
+type notifyingConn struct {
+	net.Conn
+	c            *Client
+	wasConnected bool
+	closed       bool
+	mx           sync.Mutex
+}
+
+func (conn *notifyingConn) connected() {
+	conn.mx.Lock()
+	report := !conn.closed
+	conn.wasConnected = report
+	conn.mx.Unlock()
+	if report {
+		conn.c.event(EventConnected, conn.RemoteAddr().String())
+	}
+}
+
+func (conn *notifyingConn) Close() error {
+	err := conn.Conn.Close()
+	conn.mx.Lock()
+	report := conn.wasConnected && !conn.closed
+	conn.closed = true
+	conn.mx.Unlock()
+	if report {
+		conn.c.event(EventDisconnected, conn.RemoteAddr().String())
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package mobile
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+type recordingCallback struct {
+	packets chan []byte
+	events  []string
+	mx      sync.Mutex
+}
+
+func (cb *recordingCallback) OnPacket(packet []byte) {
+	cb.packets <- append([]byte{}, packet...)
+}
+
+func (cb *recordingCallback) OnEvent(event string, detail string) {
+	cb.mx.Lock()
+	cb.events = append(cb.events, event)
+	cb.mx.Unlock()
+}
+
+func (cb *recordingCallback) getEvents() []string {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	return append([]string{}, cb.events...)
+}
+
+// fdDialer dials like a host app would, handing over a file descriptor
+type fdDialer struct{}
+
+func (d *fdDialer) Dial(addr string) (int, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	file, err := conn.(*net.TCPConn).File()
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return syscall.Dup(int(file.Fd()))
+}
+
+// startEchoServer starts a server that skips the client's hello and echoes
+// all packets back
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				fc := framed.NewReadWriteCloser(conn)
+				fc.EnableBigFrames()
+				defer fc.Close()
+				b := make([]byte, 65536)
+				if _, err := fc.Read(b); err != nil {
+					return
+				}
+				for {
+					n, err := fc.Read(b)
+					if err != nil {
+						return
+					}
+					fc.Write(b[:n])
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func testClient(t *testing.T, dialer Dialer) {
+	l := startEchoServer(t)
+	defer l.Close()
+
+	cb := &recordingCallback{packets: make(chan []byte, 10)}
+	c, err := NewClient(&Options{ServerAddr: l.Addr().String(), IdleTimeoutMillis: 5000}, dialer, cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Write([]byte("packet")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case packet := <-cb.packets:
+		if string(packet) != "packet" {
+			t.Errorf("Unexpected packet %q", packet)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No packet received")
+	}
+
+	stats := c.Stats()
+	if stats.PacketsUp != 1 || stats.BytesUp != 6 || stats.PacketsDown != 1 || stats.BytesDown != 6 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// the disconnect is reported before the client stops calling back
+	c.Close()
+	events := cb.getEvents()
+	if len(events) != 2 || events[0] != EventConnected || events[1] != EventDisconnected {
+		t.Errorf("Unexpected events %v", events)
+	}
+}
+
+func TestClient(t *testing.T) {
+	testClient(t, nil)
+}
+
+func TestClientWithDialer(t *testing.T) {
+	testClient(t, &fdDialer{})
+}
+
+func TestRejectedHandshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				fc := framed.NewReadWriteCloser(conn)
+				fc.EnableBigFrames()
+				defer fc.Close()
+				b := make([]byte, protocol.MaxHelloSize)
+				if _, err := fc.Read(b); err != nil {
+					return
+				}
+				resp, _ := protocol.EncodeHandshakeResponse(&protocol.HandshakeResponse{Error: "bad password", Code: "auth_rejected"})
+				fc.Write(resp)
+			}()
+		}
+	}()
+
+	cb := &recordingCallback{packets: make(chan []byte, 10)}
+	c, err := NewClient(&Options{ServerAddr: l.Addr().String(), Username: "user", Password: "wrong", IdleTimeoutMillis: 5000}, nil, cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Write([]byte("packet"))
+	if ErrorCode(err) != "auth_rejected" {
+		t.Fatalf("Expected auth_rejected, got %v", err)
+	}
+	if events := cb.getEvents(); len(events) != 0 {
+		t.Errorf("Rejected handshake shouldn't report events, got %v", events)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	cb := &recordingCallback{}
+	if _, err := NewClient(&Options{}, nil, cb); err == nil {
+		t.Error("Missing server address should fail")
+	}
+	if _, err := NewClient(&Options{ServerAddr: "127.0.0.1:1", ID: "short"}, nil, cb); err == nil {
+		t.Error("Invalid ID should fail")
+	}
+}
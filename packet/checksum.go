@@ -0,0 +1,51 @@
+package packet
+
+import (
+	"net"
+)
+
+// Checksum computes the Internet checksum (RFC 1071) of b, starting from the
+// given partial sum, for example a PseudoHeaderSum.
+func Checksum(b []byte, sum uint32) uint16 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return ^fold(sum)
+}
+
+// PseudoHeaderSum computes the partial sum of the pseudo header that TCP, UDP
+// and ICMPv6 checksums cover. src and dst must both be IPv4 or both be IPv6
+// addresses of the same form (4 or 16 bytes).
+func PseudoHeaderSum(proto byte, src, dst net.IP, length int) uint32 {
+	sum := uint32(0)
+	for i := 0; i+1 < len(src); i += 2 {
+		sum += uint32(src[i])<<8 | uint32(src[i+1])
+		sum += uint32(dst[i])<<8 | uint32(dst[i+1])
+	}
+	sum += uint32(proto)
+	sum += uint32(length>>16) + uint32(length&0xffff)
+	return sum
+}
+
+// adjustChecksum incrementally updates a checksum for a change of the 16 bit
+// aligned data from old to new (RFC 1624). old and new must have the same even
+// length.
+func adjustChecksum(checksum uint16, old, new []byte) uint16 {
+	sum := uint32(^checksum)
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^(uint16(old[i])<<8 | uint16(old[i+1])))
+		sum += uint32(new[i])<<8 | uint32(new[i+1])
+	}
+	return ^fold(sum)
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,91 @@
+//go:build go1.18
+// +build go1.18
+
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzParse(f *testing.F) {
+	for _, proto := range []byte{ProtocolTCP, ProtocolUDP, ProtocolICMP} {
+		f.Add(buildIPv4(proto, []byte("payload")))
+	}
+	for _, proto := range []byte{ProtocolTCP, ProtocolUDP, ProtocolICMPv6} {
+		f.Add(buildIPv6(proto, []byte("payload")))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		ip, err := ParseIP(b)
+		if err != nil {
+			return
+		}
+		ip.Src()
+		ip.Dst()
+		ip.DSCP()
+		proto, transport := ip.Transport()
+		Ports(proto, transport)
+		if v4 := ip.IPv4(); v4 != nil {
+			v4.Options()
+			v4.Payload()
+		}
+		switch proto {
+		case ProtocolTCP:
+			if tcp, err := ParseTCP(transport); err == nil {
+				tcp.MSS()
+				tcp.Payload()
+			}
+		case ProtocolUDP:
+			if udp, err := ParseUDP(transport); err == nil {
+				udp.Payload()
+			}
+		case ProtocolICMP, ProtocolICMPv6:
+			if icmp, err := ParseICMP(transport); err == nil {
+				icmp.Body()
+			}
+		}
+	})
+}
+
+// FuzzSetAddress checks that changing addresses keeps valid checksums valid and
+// that changing them back restores the original packet.
+func FuzzSetAddress(f *testing.F) {
+	for _, proto := range []byte{ProtocolTCP, ProtocolUDP, ProtocolICMP} {
+		f.Add(buildIPv4(proto, []byte("payload")), []byte{192, 0, 2, 1})
+	}
+	for _, proto := range []byte{ProtocolTCP, ProtocolUDP, ProtocolICMPv6} {
+		f.Add(buildIPv6(proto, []byte("payload")), []byte(nat6))
+	}
+	f.Fuzz(func(t *testing.T, b []byte, addr []byte) {
+		ip, err := ParseIP(b)
+		if err != nil {
+			return
+		}
+		validBefore := transportChecksumValid(ip)
+		if v4 := ip.IPv4(); v4 != nil {
+			if v4.IsFragment() {
+				return
+			}
+			validBefore = validBefore && v4.ValidChecksum()
+		}
+		original := append([]byte{}, ip...)
+		oldDst := append([]byte{}, ip.Dst()...)
+		if err := ip.SetDst(addr); err != nil {
+			return
+		}
+		if validBefore {
+			if !transportChecksumValid(ip) {
+				t.Fatal("Transport checksum became invalid")
+			}
+			if v4 := ip.IPv4(); v4 != nil && !v4.ValidChecksum() {
+				t.Fatal("Header checksum became invalid")
+			}
+		}
+		if err := ip.SetDst(oldDst); err != nil {
+			t.Fatal(err)
+		}
+		if validBefore && !bytes.Equal(ip, original) {
+			t.Fatal("Restoring the address should restore the packet")
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package packet
+
+import (
+	"encoding/binary"
+)
+
+// ICMPHeaderSize is the size of an ICMP or ICMPv6 header
+const ICMPHeaderSize = 8
+
+// ICMP echo types
+const (
+	ICMPv4EchoReply   = 0
+	ICMPv4EchoRequest = 8
+	ICMPv6EchoRequest = 128
+	ICMPv6EchoReply   = 129
+)
+
+// ICMP is a view of an ICMP or ICMPv6 message.
+type ICMP []byte
+
+// ParseICMP parses an ICMP or ICMPv6 message, for example the payload of an
+// IPv4 packet.
+func ParseICMP(b []byte) (ICMP, error) {
+	if len(b) < ICMPHeaderSize {
+		return nil, ErrTooShort
+	}
+	return ICMP(b), nil
+}
+
+// Type returns the message type
+func (icmp ICMP) Type() byte {
+	return icmp[0]
+}
+
+// Code returns the message code
+func (icmp ICMP) Code() byte {
+	return icmp[1]
+}
+
+// Checksum returns the checksum
+func (icmp ICMP) Checksum() uint16 {
+	return binary.BigEndian.Uint16(icmp[2:])
+}
+
+// IsEcho returns whether the message is an echo request or reply
+func (icmp ICMP) IsEcho() bool {
+	switch icmp.Type() {
+	case ICMPv4EchoReply, ICMPv4EchoRequest, ICMPv6EchoRequest, ICMPv6EchoReply:
+		return icmp.Code() == 0
+	default:
+		return false
+	}
+}
+
+// ID returns the identifier of an echo request or reply
+func (icmp ICMP) ID() uint16 {
+	return binary.BigEndian.Uint16(icmp[4:])
+}
+
+// Seq returns the sequence number of an echo request or reply
+func (icmp ICMP) Seq() uint16 {
+	return binary.BigEndian.Uint16(icmp[6:])
+}
+
+// Body returns the data following the header
+func (icmp ICMP) Body() []byte {
+	return icmp[ICMPHeaderSize:]
+}
+
+// SetID sets the identifier of an echo request or reply, updating the checksum
+func (icmp ICMP) SetID(id uint16) {
+	var old [2]byte
+	copy(old[:], icmp[4:6])
+	binary.BigEndian.PutUint16(icmp[4:], id)
+	binary.BigEndian.PutUint16(icmp[2:], adjustChecksum(icmp.Checksum(), old[:], icmp[4:6]))
+}
@@ -0,0 +1,210 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// IPv4HeaderSize is the size of an IPv4 header without options
+const IPv4HeaderSize = 20
+
+// IPv4 is a view of an IPv4 packet.
+type IPv4 []byte
+
+// ParseIPv4 parses an IPv4 packet. Any trailing bytes beyond the packet's total
+// length are excluded from the returned view.
+func ParseIPv4(b []byte) (IPv4, error) {
+	if len(b) < IPv4HeaderSize {
+		return nil, ErrTooShort
+	}
+	if b[0]>>4 != 4 {
+		return nil, ErrInvalid
+	}
+	headerLength := int(b[0]&0x0f) * 4
+	totalLength := int(binary.BigEndian.Uint16(b[2:]))
+	if headerLength < IPv4HeaderSize || totalLength < headerLength {
+		return nil, ErrInvalid
+	}
+	if totalLength > len(b) {
+		return nil, ErrTooShort
+	}
+	return IPv4(b[:totalLength]), nil
+}
+
+// HeaderLength returns the length of the header, including options
+func (ip IPv4) HeaderLength() int {
+	return int(ip[0]&0x0f) * 4
+}
+
+// DSCP returns the differentiated services code point
+func (ip IPv4) DSCP() byte {
+	return ip[1] >> 2
+}
+
+// ECN returns the explicit congestion notification bits
+func (ip IPv4) ECN() byte {
+	return ip[1] & 0x03
+}
+
+// TotalLength returns the length of the packet, including the header
+func (ip IPv4) TotalLength() int {
+	return int(binary.BigEndian.Uint16(ip[2:]))
+}
+
+// ID returns the identification field
+func (ip IPv4) ID() uint16 {
+	return binary.BigEndian.Uint16(ip[4:])
+}
+
+// DontFragment returns whether the don't fragment flag is set
+func (ip IPv4) DontFragment() bool {
+	return ip[6]&0x40 != 0
+}
+
+// MoreFragments returns whether the more fragments flag is set
+func (ip IPv4) MoreFragments() bool {
+	return ip[6]&0x20 != 0
+}
+
+// FragmentOffset returns the fragment offset in bytes
+func (ip IPv4) FragmentOffset() int {
+	return int(binary.BigEndian.Uint16(ip[6:])&0x1fff) * 8
+}
+
+// IsFragment returns whether the packet is a fragment of a larger packet
+func (ip IPv4) IsFragment() bool {
+	return ip.MoreFragments() || ip.FragmentOffset() != 0
+}
+
+// TTL returns the time to live
+func (ip IPv4) TTL() byte {
+	return ip[8]
+}
+
+// Protocol returns the protocol of the payload
+func (ip IPv4) Protocol() byte {
+	return ip[9]
+}
+
+// Checksum returns the header checksum
+func (ip IPv4) Checksum() uint16 {
+	return binary.BigEndian.Uint16(ip[10:])
+}
+
+// ValidChecksum returns whether the header checksum is correct
+func (ip IPv4) ValidChecksum() bool {
+	return Checksum(ip[:ip.HeaderLength()], 0) == 0
+}
+
+// Src returns the source address. The address shares memory with the packet.
+func (ip IPv4) Src() net.IP {
+	return net.IP(ip[12:16])
+}
+
+// Dst returns the destination address. The address shares memory with the packet.
+func (ip IPv4) Dst() net.IP {
+	return net.IP(ip[16:20])
+}
+
+// Options returns the header options
+func (ip IPv4) Options() []byte {
+	return ip[IPv4HeaderSize:ip.HeaderLength()]
+}
+
+// Payload returns the payload following the header
+func (ip IPv4) Payload() []byte {
+	return ip[ip.HeaderLength():]
+}
+
+// SetSrc sets the source address, updating the header checksum and the TCP or
+// UDP checksum.
+func (ip IPv4) SetSrc(addr net.IP) error {
+	return ip.setAddr(12, addr)
+}
+
+// SetDst sets the destination address, updating the header checksum and the TCP
+// or UDP checksum.
+func (ip IPv4) SetDst(addr net.IP) error {
+	return ip.setAddr(16, addr)
+}
+
+func (ip IPv4) setAddr(offset int, addr net.IP) error {
+	addr = addr.To4()
+	if addr == nil {
+		return ErrInvalidAddress
+	}
+	var old [4]byte
+	copy(old[:], ip[offset:offset+4])
+	copy(ip[offset:offset+4], addr)
+	ip.adjustHeaderChecksum(old[:], addr)
+	if ip.FragmentOffset() == 0 {
+		adjustTransportChecksum(ip.Protocol(), ip.Payload(), old[:], addr, true)
+	}
+	return nil
+}
+
+// SetTTL sets the time to live, updating the header checksum
+func (ip IPv4) SetTTL(ttl byte) {
+	old := [2]byte{ip[8], ip[9]}
+	ip[8] = ttl
+	ip.adjustHeaderChecksum(old[:], ip[8:10])
+}
+
+// DecrementTTL decrements the time to live as a router would, updating the
+// header checksum. It returns false if the TTL was already zero.
+func (ip IPv4) DecrementTTL() bool {
+	if ip.TTL() == 0 {
+		return false
+	}
+	ip.SetTTL(ip.TTL() - 1)
+	return true
+}
+
+// SetDSCP sets the differentiated services code point, updating the header
+// checksum
+func (ip IPv4) SetDSCP(dscp byte) {
+	old := [2]byte{ip[0], ip[1]}
+	ip[1] = dscp<<2 | ip.ECN()
+	ip.adjustHeaderChecksum(old[:], ip[0:2])
+}
+
+// UpdateChecksum recomputes the header checksum from scratch
+func (ip IPv4) UpdateChecksum() {
+	ip[10], ip[11] = 0, 0
+	binary.BigEndian.PutUint16(ip[10:], Checksum(ip[:ip.HeaderLength()], 0))
+}
+
+func (ip IPv4) adjustHeaderChecksum(old, new []byte) {
+	binary.BigEndian.PutUint16(ip[10:], adjustChecksum(ip.Checksum(), old, new))
+}
+
+// adjustTransportChecksum updates the checksum of a transport segment whose
+// pseudo header changed from old to new. UDP over IPv4 may omit the checksum,
+// in which case it's left alone.
+func adjustTransportChecksum(proto byte, transport []byte, old, new []byte, v4 bool) {
+	offset := -1
+	switch proto {
+	case ProtocolTCP:
+		offset = 16
+	case ProtocolUDP:
+		offset = 6
+	case ProtocolICMPv6:
+		if !v4 {
+			offset = 2
+		}
+	}
+	if offset < 0 || len(transport) < offset+2 {
+		return
+	}
+	checksum := binary.BigEndian.Uint16(transport[offset:])
+	if proto == ProtocolUDP && checksum == 0 && v4 {
+		// no checksum
+		return
+	}
+	checksum = adjustChecksum(checksum, old, new)
+	if proto == ProtocolUDP && checksum == 0 {
+		// a computed checksum of 0 is transmitted as all ones
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(transport[offset:], checksum)
+}
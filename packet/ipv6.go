@@ -0,0 +1,162 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// IPv6HeaderSize is the size of the fixed IPv6 header
+const IPv6HeaderSize = 40
+
+// maxExtensionHeaders bounds how many extension headers Transport skips
+const maxExtensionHeaders = 8
+
+// IPv6 extension headers that Transport skips
+const (
+	ipv6HopByHop        = 0
+	ipv6Routing         = 43
+	ipv6Fragment        = 44
+	ipv6Authentication  = 51
+	ipv6DestinationOpts = 60
+)
+
+// IPv6 is a view of an IPv6 packet.
+type IPv6 []byte
+
+// ParseIPv6 parses an IPv6 packet. Any trailing bytes beyond the packet's
+// payload length are excluded from the returned view.
+func ParseIPv6(b []byte) (IPv6, error) {
+	if len(b) < IPv6HeaderSize {
+		return nil, ErrTooShort
+	}
+	if b[0]>>4 != 6 {
+		return nil, ErrInvalid
+	}
+	length := IPv6HeaderSize + int(binary.BigEndian.Uint16(b[4:]))
+	if length > len(b) {
+		return nil, ErrTooShort
+	}
+	return IPv6(b[:length]), nil
+}
+
+// TrafficClass returns the traffic class
+func (ip IPv6) TrafficClass() byte {
+	return ip[0]<<4 | ip[1]>>4
+}
+
+// DSCP returns the differentiated services code point
+func (ip IPv6) DSCP() byte {
+	return ip.TrafficClass() >> 2
+}
+
+// FlowLabel returns the flow label
+func (ip IPv6) FlowLabel() uint32 {
+	return binary.BigEndian.Uint32(ip[0:]) & 0x000fffff
+}
+
+// PayloadLength returns the length of the payload, including extension headers
+func (ip IPv6) PayloadLength() int {
+	return int(binary.BigEndian.Uint16(ip[4:]))
+}
+
+// NextHeader returns the type of the header following the fixed header
+func (ip IPv6) NextHeader() byte {
+	return ip[6]
+}
+
+// HopLimit returns the hop limit
+func (ip IPv6) HopLimit() byte {
+	return ip[7]
+}
+
+// Src returns the source address. The address shares memory with the packet.
+func (ip IPv6) Src() net.IP {
+	return net.IP(ip[8:24])
+}
+
+// Dst returns the destination address. The address shares memory with the packet.
+func (ip IPv6) Dst() net.IP {
+	return net.IP(ip[24:40])
+}
+
+// Payload returns the payload following the fixed header, including any
+// extension headers
+func (ip IPv6) Payload() []byte {
+	return ip[IPv6HeaderSize:]
+}
+
+// Transport skips extension headers and returns the transport protocol and
+// segment. The segment is nil for fragments other than the first and for
+// malformed extension headers.
+func (ip IPv6) Transport() (byte, []byte) {
+	proto := ip.NextHeader()
+	b := ip.Payload()
+	for i := 0; i < maxExtensionHeaders; i++ {
+		var length int
+		switch proto {
+		case ipv6HopByHop, ipv6Routing, ipv6DestinationOpts:
+			if len(b) < 2 {
+				return proto, nil
+			}
+			length = (int(b[1]) + 1) * 8
+		case ipv6Authentication:
+			if len(b) < 2 {
+				return proto, nil
+			}
+			length = (int(b[1]) + 2) * 4
+		case ipv6Fragment:
+			if len(b) < 8 {
+				return proto, nil
+			}
+			if binary.BigEndian.Uint16(b[2:])&0xfff8 != 0 {
+				// not the first fragment
+				return b[0], nil
+			}
+			length = 8
+		default:
+			return proto, b
+		}
+		if length > len(b) {
+			return proto, nil
+		}
+		proto = b[0]
+		b = b[length:]
+	}
+	return proto, nil
+}
+
+// SetSrc sets the source address, updating the TCP, UDP or ICMPv6 checksum
+func (ip IPv6) SetSrc(addr net.IP) error {
+	return ip.setAddr(8, addr)
+}
+
+// SetDst sets the destination address, updating the TCP, UDP or ICMPv6
+// checksum. Packets with a routing header are checksummed against the final
+// destination, so their checksums may not be correct afterwards.
+func (ip IPv6) SetDst(addr net.IP) error {
+	return ip.setAddr(24, addr)
+}
+
+func (ip IPv6) setAddr(offset int, addr net.IP) error {
+	if len(addr) != net.IPv6len || addr.To4() != nil {
+		return ErrInvalidAddress
+	}
+	var old [16]byte
+	copy(old[:], ip[offset:offset+16])
+	copy(ip[offset:offset+16], addr)
+	proto, transport := ip.Transport()
+	adjustTransportChecksum(proto, transport, old[:], addr, false)
+	return nil
+}
+
+// SetHopLimit sets the hop limit
+func (ip IPv6) SetHopLimit(hopLimit byte) {
+	ip[7] = hopLimit
+}
+
+// SetDSCP sets the differentiated services code point
+func (ip IPv6) SetDSCP(dscp byte) {
+	tc := dscp<<2 | ip.TrafficClass()&0x03
+	ip[0] = ip[0]&0xf0 | tc>>4
+	ip[1] = ip[1]&0x0f | tc<<4
+}
@@ -0,0 +1,165 @@
+// packet provides views of IPv4, IPv6, TCP, UDP and ICMP packets that parse
+// and modify packets in place without allocating, for use by clients, servers
+// and hooks that inspect packets (for example the raw bytes of packets passed
+// to gonat's OnOutbound and OnInbound).
+//
+// Views are byte slices, so a parsed packet can be converted back with
+// []byte(view). Parse functions only check that the headers are complete and
+// consistent. Accessors don't check bounds beyond that, and mutators update
+// the affected checksums incrementally.
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// IP protocol numbers
+const (
+	ProtocolICMP   = 1
+	ProtocolTCP    = 6
+	ProtocolUDP    = 17
+	ProtocolICMPv6 = 58
+)
+
+// Ethernet types
+const (
+	EtherTypeIPv4 = 0x0800
+	EtherTypeIPv6 = 0x86DD
+
+	// EthernetHeaderSize is the size of an Ethernet header without VLAN tags
+	EthernetHeaderSize = 14
+)
+
+var (
+	// ErrTooShort means that a packet is shorter than its headers say it should be
+	ErrTooShort = errors.New("packet too short")
+
+	// ErrInvalid means that a packet's headers are inconsistent, for example
+	// because it has the wrong version
+	ErrInvalid = errors.New("invalid packet")
+
+	// ErrInvalidAddress means that an address doesn't match the IP version of the packet
+	ErrInvalidAddress = errors.New("invalid address for IP version")
+)
+
+// IP is a view of an IPv4 or IPv6 packet.
+type IP []byte
+
+// ParseIP parses an IPv4 or IPv6 packet. Any trailing bytes beyond the packet's
+// length are excluded from the returned view.
+func ParseIP(b []byte) (IP, error) {
+	if len(b) < 1 {
+		return nil, ErrTooShort
+	}
+	switch b[0] >> 4 {
+	case 4:
+		ip, err := ParseIPv4(b)
+		return IP(ip), err
+	case 6:
+		ip, err := ParseIPv6(b)
+		return IP(ip), err
+	default:
+		return nil, ErrInvalid
+	}
+}
+
+// FromEthernet returns the IP packet contained in an Ethernet frame, or false
+// if the frame doesn't contain IPv4 or IPv6.
+func FromEthernet(frame []byte) ([]byte, bool) {
+	if len(frame) < EthernetHeaderSize {
+		return nil, false
+	}
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case EtherTypeIPv4, EtherTypeIPv6:
+		return frame[EthernetHeaderSize:], true
+	default:
+		return nil, false
+	}
+}
+
+// Version returns the IP version, 4 or 6
+func (ip IP) Version() int {
+	return int(ip[0] >> 4)
+}
+
+// IPv4 returns the packet as an IPv4 view, or nil if it's not IPv4
+func (ip IP) IPv4() IPv4 {
+	if ip.Version() != 4 {
+		return nil
+	}
+	return IPv4(ip)
+}
+
+// IPv6 returns the packet as an IPv6 view, or nil if it's not IPv6
+func (ip IP) IPv6() IPv6 {
+	if ip.Version() != 6 {
+		return nil
+	}
+	return IPv6(ip)
+}
+
+// Src returns the source address. The address shares memory with the packet.
+func (ip IP) Src() net.IP {
+	if ip.Version() == 4 {
+		return IPv4(ip).Src()
+	}
+	return IPv6(ip).Src()
+}
+
+// Dst returns the destination address. The address shares memory with the packet.
+func (ip IP) Dst() net.IP {
+	if ip.Version() == 4 {
+		return IPv4(ip).Dst()
+	}
+	return IPv6(ip).Dst()
+}
+
+// DSCP returns the differentiated services code point
+func (ip IP) DSCP() byte {
+	if ip.Version() == 4 {
+		return IPv4(ip).DSCP()
+	}
+	return IPv6(ip).DSCP()
+}
+
+// Transport returns the transport protocol and the transport layer segment.
+// The segment is nil for fragments other than the first, which don't contain
+// the transport header.
+func (ip IP) Transport() (byte, []byte) {
+	if ip.Version() == 4 {
+		v4 := IPv4(ip)
+		if v4.FragmentOffset() != 0 {
+			return v4.Protocol(), nil
+		}
+		return v4.Protocol(), v4.Payload()
+	}
+	return IPv6(ip).Transport()
+}
+
+// SetSrc sets the source address, updating checksums
+func (ip IP) SetSrc(addr net.IP) error {
+	if ip.Version() == 4 {
+		return IPv4(ip).SetSrc(addr)
+	}
+	return IPv6(ip).SetSrc(addr)
+}
+
+// SetDst sets the destination address, updating checksums
+func (ip IP) SetDst(addr net.IP) error {
+	if ip.Version() == 4 {
+		return IPv4(ip).SetDst(addr)
+	}
+	return IPv6(ip).SetDst(addr)
+}
+
+// Ports returns the source and destination ports of a TCP or UDP segment as
+// returned by Transport, or false if the segment isn't TCP or UDP or is too
+// short.
+func Ports(proto byte, transport []byte) (uint16, uint16, bool) {
+	if (proto != ProtocolTCP && proto != ProtocolUDP) || len(transport) < 4 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint16(transport[0:]), binary.BigEndian.Uint16(transport[2:]), true
+}
@@ -0,0 +1,358 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+var (
+	src4 = net.ParseIP("10.0.0.2").To4()
+	dst4 = net.ParseIP("203.0.113.7").To4()
+	nat4 = net.ParseIP("192.0.2.1").To4()
+	src6 = net.ParseIP("2001:db8::2")
+	dst6 = net.ParseIP("2001:db8::7")
+	nat6 = net.ParseIP("2001:db8::ffff")
+)
+
+// buildTransport builds a TCP, UDP or ICMP segment without checksum
+func buildTransport(proto byte, payload []byte) []byte {
+	var l4 []byte
+	switch proto {
+	case ProtocolTCP:
+		l4 = make([]byte, TCPHeaderSize+4+len(payload))
+		binary.BigEndian.PutUint16(l4[0:], 50000)
+		binary.BigEndian.PutUint16(l4[2:], 443)
+		binary.BigEndian.PutUint32(l4[4:], 1000)
+		binary.BigEndian.PutUint32(l4[8:], 2000)
+		l4[12] = 6 << 4
+		l4[13] = TCPFlagSYN | TCPFlagACK
+		binary.BigEndian.PutUint16(l4[14:], 65535)
+		l4[20], l4[21] = tcpOptionMSS, 4
+		binary.BigEndian.PutUint16(l4[22:], 1460)
+		copy(l4[24:], payload)
+	case ProtocolUDP:
+		l4 = make([]byte, UDPHeaderSize+len(payload))
+		binary.BigEndian.PutUint16(l4[0:], 40000)
+		binary.BigEndian.PutUint16(l4[2:], 53)
+		binary.BigEndian.PutUint16(l4[4:], uint16(len(l4)))
+		copy(l4[8:], payload)
+	default:
+		l4 = make([]byte, ICMPHeaderSize+len(payload))
+		l4[0] = ICMPv4EchoRequest
+		if proto == ProtocolICMPv6 {
+			l4[0] = ICMPv6EchoRequest
+		}
+		binary.BigEndian.PutUint16(l4[4:], 7)
+		binary.BigEndian.PutUint16(l4[6:], 1)
+		copy(l4[8:], payload)
+	}
+	return l4
+}
+
+func checksumOffset(proto byte) int {
+	switch proto {
+	case ProtocolTCP:
+		return 16
+	case ProtocolUDP:
+		return 6
+	default:
+		return 2
+	}
+}
+
+func buildIPv4(proto byte, payload []byte) []byte {
+	l4 := buildTransport(proto, payload)
+	pkt := make([]byte, IPv4HeaderSize+len(l4))
+	pkt[0] = 0x45
+	pkt[1] = 46 << 2
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[4:], 1234)
+	pkt[6] = 0x40
+	pkt[8] = 64
+	pkt[9] = proto
+	copy(pkt[12:], src4)
+	copy(pkt[16:], dst4)
+	IPv4(pkt).UpdateChecksum()
+	copy(pkt[IPv4HeaderSize:], l4)
+	sum := uint32(0)
+	if proto != ProtocolICMP {
+		sum = PseudoHeaderSum(proto, src4, dst4, len(l4))
+	}
+	binary.BigEndian.PutUint16(pkt[IPv4HeaderSize+checksumOffset(proto):], Checksum(pkt[IPv4HeaderSize:], sum))
+	return pkt
+}
+
+func buildIPv6(proto byte, payload []byte) []byte {
+	l4 := buildTransport(proto, payload)
+	pkt := make([]byte, IPv6HeaderSize+len(l4))
+	pkt[0] = 0x60 | 46>>2
+	pkt[1] = (46 << 6) & 0xff
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(l4)))
+	pkt[6] = proto
+	pkt[7] = 64
+	copy(pkt[8:], src6)
+	copy(pkt[24:], dst6)
+	copy(pkt[IPv6HeaderSize:], l4)
+	binary.BigEndian.PutUint16(pkt[IPv6HeaderSize+checksumOffset(proto):], Checksum(pkt[IPv6HeaderSize:], PseudoHeaderSum(proto, src6, dst6, len(l4))))
+	return pkt
+}
+
+// transportChecksumValid verifies the transport checksum of an unfragmented packet
+func transportChecksumValid(ip IP) bool {
+	proto, transport := ip.Transport()
+	sum := uint32(0)
+	if proto != ProtocolICMP {
+		src, dst := ip.Src(), ip.Dst()
+		if ip.Version() == 4 {
+			src, dst = src.To4(), dst.To4()
+		}
+		sum = PseudoHeaderSum(proto, src, dst, len(transport))
+	}
+	return Checksum(transport, sum) == 0
+}
+
+func TestIPv4(t *testing.T) {
+	b := append(buildIPv4(ProtocolTCP, []byte("hello")), "trailing"...)
+	ip, err := ParseIPv4(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ip) != len(b)-len("trailing") {
+		t.Errorf("Trailing bytes should have been excluded")
+	}
+	if ip.HeaderLength() != 20 || ip.DSCP() != 46 || ip.ID() != 1234 || !ip.DontFragment() || ip.IsFragment() || ip.TTL() != 64 || ip.Protocol() != ProtocolTCP {
+		t.Errorf("Wrong header fields")
+	}
+	if !ip.Src().Equal(src4) || !ip.Dst().Equal(dst4) || !ip.ValidChecksum() {
+		t.Errorf("Wrong addresses or checksum")
+	}
+
+	tcp, err := ParseTCP(ip.Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcp.SrcPort() != 50000 || tcp.DstPort() != 443 || tcp.Seq() != 1000 || tcp.Ack() != 2000 || tcp.Window() != 65535 {
+		t.Errorf("Wrong TCP fields")
+	}
+	if !tcp.HasFlags(TCPFlagSYN|TCPFlagACK) || tcp.HasFlags(TCPFlagFIN) || tcp.MSS() != 1460 || string(tcp.Payload()) != "hello" {
+		t.Errorf("Wrong TCP flags, options or payload")
+	}
+
+	if err := ip.SetSrc(nat4); err != nil {
+		t.Fatal(err)
+	}
+	if err := ip.SetDst(src6); err != ErrInvalidAddress {
+		t.Errorf("IPv6 address should be rejected, got %v", err)
+	}
+	ip.DecrementTTL()
+	ip.SetDSCP(0)
+	tcp.SetSrcPort(1)
+	tcp.SetWindow(100)
+	if !ip.Src().Equal(nat4) || ip.TTL() != 63 || ip.DSCP() != 0 || tcp.SrcPort() != 1 {
+		t.Errorf("Mutations not applied")
+	}
+	if !ip.ValidChecksum() || !transportChecksumValid(IP(ip)) {
+		t.Error("Checksums should have been updated")
+	}
+}
+
+func TestIPv4UDP(t *testing.T) {
+	ip, _ := ParseIPv4(buildIPv4(ProtocolUDP, []byte("query")))
+	udp, err := ParseUDP(ip.Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if udp.SrcPort() != 40000 || udp.DstPort() != 53 || udp.Length() != 13 || string(udp.Payload()) != "query" {
+		t.Errorf("Wrong UDP fields")
+	}
+	ip.SetDst(nat4)
+	udp.SetDstPort(5353)
+	if !transportChecksumValid(IP(ip)) {
+		t.Error("UDP checksum should have been updated")
+	}
+
+	// without checksum
+	udp[6], udp[7] = 0, 0
+	ip.SetSrc(dst4)
+	udp.SetSrcPort(1)
+	if udp.Checksum() != 0 {
+		t.Error("Missing checksum should stay missing")
+	}
+}
+
+func TestIPv4ICMP(t *testing.T) {
+	ip, _ := ParseIPv4(buildIPv4(ProtocolICMP, []byte("ping")))
+	icmp, err := ParseICMP(ip.Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !icmp.IsEcho() || icmp.ID() != 7 || icmp.Seq() != 1 || string(icmp.Body()) != "ping" {
+		t.Errorf("Wrong ICMP fields")
+	}
+	icmp.SetID(99)
+	ip.SetSrc(nat4)
+	if icmp.ID() != 99 || !transportChecksumValid(IP(ip)) {
+		t.Error("ICMP checksum should have been updated")
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	for _, proto := range []byte{ProtocolTCP, ProtocolUDP, ProtocolICMPv6} {
+		ip, err := ParseIPv6(buildIPv6(proto, []byte("data")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.DSCP() != 46 || ip.HopLimit() != 64 || ip.NextHeader() != proto || !ip.Src().Equal(src6) || !ip.Dst().Equal(dst6) {
+			t.Errorf("Wrong header fields for protocol %d", proto)
+		}
+		if err := ip.SetDst(nat6); err != nil {
+			t.Fatal(err)
+		}
+		if err := ip.SetSrc(src4); err != ErrInvalidAddress {
+			t.Errorf("IPv4 address should be rejected, got %v", err)
+		}
+		ip.SetDSCP(10)
+		if ip.DSCP() != 10 || ip[0]>>4 != 6 || !ip.Dst().Equal(nat6) {
+			t.Errorf("Mutations not applied for protocol %d", proto)
+		}
+		if !transportChecksumValid(IP(ip)) {
+			t.Errorf("Checksum should have been updated for protocol %d", proto)
+		}
+	}
+}
+
+func TestIPv6ExtensionHeaders(t *testing.T) {
+	pkt := buildIPv6(ProtocolUDP, []byte("data"))
+	udp := append([]byte{}, pkt[IPv6HeaderSize:]...)
+	// hop-by-hop options followed by a first fragment header
+	ext := []byte{ipv6Fragment, 0, 1, 0, 0, 0, 0, 0, ProtocolUDP, 0, 0, 0, 0, 0, 0, 1}
+	pkt = append(append(pkt[:IPv6HeaderSize], ext...), udp...)
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(ext)+len(udp)))
+	pkt[6] = ipv6HopByHop
+
+	ip, err := ParseIP(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto, transport := ip.Transport()
+	if proto != ProtocolUDP || len(transport) != len(udp) {
+		t.Fatalf("Wrong transport %d with %d bytes", proto, len(transport))
+	}
+
+	// not the first fragment
+	binary.BigEndian.PutUint16(pkt[IPv6HeaderSize+10:], 8)
+	if proto, transport := ip.Transport(); proto != ProtocolUDP || transport != nil {
+		t.Errorf("Later fragments shouldn't have a transport segment")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	pkt := buildIPv4(ProtocolTCP, nil)
+	if _, err := ParseIP(nil); err != ErrTooShort {
+		t.Errorf("Wrong error for empty packet: %v", err)
+	}
+	if _, err := ParseIPv4(pkt[:19]); err != ErrTooShort {
+		t.Errorf("Wrong error for short packet: %v", err)
+	}
+	if _, err := ParseIPv4(pkt[:30]); err != ErrTooShort {
+		t.Errorf("Wrong error for truncated packet: %v", err)
+	}
+	if _, err := ParseIPv6(pkt); err != ErrInvalid {
+		t.Errorf("Wrong error for wrong version: %v", err)
+	}
+	if _, err := ParseTCP(pkt[IPv4HeaderSize : IPv4HeaderSize+22]); err != ErrTooShort {
+		t.Errorf("Wrong error for truncated TCP options: %v", err)
+	}
+	if _, err := ParseUDP([]byte{0, 1, 0, 2, 0, 4, 0, 0}); err != ErrInvalid {
+		t.Errorf("Wrong error for invalid UDP length: %v", err)
+	}
+}
+
+func TestGenericIP(t *testing.T) {
+	for _, b := range [][]byte{buildIPv4(ProtocolUDP, nil), buildIPv6(ProtocolUDP, nil)} {
+		ip, err := ParseIP(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proto, transport := ip.Transport()
+		src, dst, ok := Ports(proto, transport)
+		if !ok || src != 40000 || dst != 53 || ip.DSCP() != 46 {
+			t.Errorf("Wrong ports or DSCP for IPv%d", ip.Version())
+		}
+		if (ip.IPv4() == nil) == (ip.IPv6() == nil) {
+			t.Error("Exactly one version specific view should be available")
+		}
+	}
+
+	frame := append(make([]byte, 12), 0x08, 0x00)
+	frame = append(frame, buildIPv4(ProtocolUDP, nil)...)
+	if pkt, ok := FromEthernet(frame); !ok || pkt[0]>>4 != 4 {
+		t.Error("Should have found IPv4 packet in frame")
+	}
+	frame[12] = 0x08
+	frame[13] = 0x06
+	if _, ok := FromEthernet(frame); ok {
+		t.Error("ARP frame shouldn't contain IP packet")
+	}
+}
+
+func TestZeroAllocations(t *testing.T) {
+	b := buildIPv4(ProtocolTCP, make([]byte, 1000))
+	allocs := testing.AllocsPerRun(100, func() {
+		ip, _ := ParseIP(b)
+		proto, transport := ip.Transport()
+		Ports(proto, transport)
+		ip.SetDst(nat4)
+		ip.SetDst(dst4)
+		tcp, _ := ParseTCP(transport)
+		tcp.SetDstPort(443)
+		tcp.MSS()
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations, got %v", allocs)
+	}
+}
+
+func BenchmarkParseIPv4TCP(b *testing.B) {
+	pkt := buildIPv4(ProtocolTCP, make([]byte, 1400))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(pkt)))
+	for i := 0; i < b.N; i++ {
+		ip, _ := ParseIP(pkt)
+		_, transport := ip.Transport()
+		tcp, _ := ParseTCP(transport)
+		tcp.DstPort()
+	}
+}
+
+func BenchmarkParseIPv6UDP(b *testing.B) {
+	pkt := buildIPv6(ProtocolUDP, make([]byte, 1400))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(pkt)))
+	for i := 0; i < b.N; i++ {
+		ip, _ := ParseIP(pkt)
+		_, transport := ip.Transport()
+		udp, _ := ParseUDP(transport)
+		udp.DstPort()
+	}
+}
+
+func BenchmarkSetDstIPv4(b *testing.B) {
+	pkt := buildIPv4(ProtocolTCP, make([]byte, 1400))
+	ip, _ := ParseIPv4(pkt)
+	addrs := []net.IP{nat4, dst4}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ip.SetDst(addrs[i%2])
+	}
+}
+
+func BenchmarkChecksum(b *testing.B) {
+	pkt := buildIPv4(ProtocolTCP, make([]byte, 1400))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(pkt)))
+	for i := 0; i < b.N; i++ {
+		Checksum(pkt, 0)
+	}
+}
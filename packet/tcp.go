@@ -0,0 +1,146 @@
+package packet
+
+import (
+	"encoding/binary"
+)
+
+// TCPHeaderSize is the size of a TCP header without options
+const TCPHeaderSize = 20
+
+// TCP flags
+const (
+	TCPFlagFIN = 0x01
+	TCPFlagSYN = 0x02
+	TCPFlagRST = 0x04
+	TCPFlagPSH = 0x08
+	TCPFlagACK = 0x10
+	TCPFlagURG = 0x20
+	TCPFlagECE = 0x40
+	TCPFlagCWR = 0x80
+)
+
+const tcpOptionMSS = 2
+
+// TCP is a view of a TCP segment.
+type TCP []byte
+
+// ParseTCP parses a TCP segment, for example the payload of an IPv4 packet.
+func ParseTCP(b []byte) (TCP, error) {
+	if len(b) < TCPHeaderSize {
+		return nil, ErrTooShort
+	}
+	offset := int(b[12]>>4) * 4
+	if offset < TCPHeaderSize {
+		return nil, ErrInvalid
+	}
+	if offset > len(b) {
+		return nil, ErrTooShort
+	}
+	return TCP(b), nil
+}
+
+// SrcPort returns the source port
+func (tcp TCP) SrcPort() uint16 {
+	return binary.BigEndian.Uint16(tcp[0:])
+}
+
+// DstPort returns the destination port
+func (tcp TCP) DstPort() uint16 {
+	return binary.BigEndian.Uint16(tcp[2:])
+}
+
+// Seq returns the sequence number
+func (tcp TCP) Seq() uint32 {
+	return binary.BigEndian.Uint32(tcp[4:])
+}
+
+// Ack returns the acknowledgment number
+func (tcp TCP) Ack() uint32 {
+	return binary.BigEndian.Uint32(tcp[8:])
+}
+
+// HeaderLength returns the length of the header, including options
+func (tcp TCP) HeaderLength() int {
+	return int(tcp[12]>>4) * 4
+}
+
+// Flags returns the flags, see TCPFlagFIN and friends
+func (tcp TCP) Flags() byte {
+	return tcp[13]
+}
+
+// HasFlags returns whether all of the given flags are set
+func (tcp TCP) HasFlags(flags byte) bool {
+	return tcp[13]&flags == flags
+}
+
+// Window returns the receive window
+func (tcp TCP) Window() uint16 {
+	return binary.BigEndian.Uint16(tcp[14:])
+}
+
+// Checksum returns the checksum
+func (tcp TCP) Checksum() uint16 {
+	return binary.BigEndian.Uint16(tcp[16:])
+}
+
+// Urgent returns the urgent pointer
+func (tcp TCP) Urgent() uint16 {
+	return binary.BigEndian.Uint16(tcp[18:])
+}
+
+// Options returns the header options
+func (tcp TCP) Options() []byte {
+	return tcp[TCPHeaderSize:tcp.HeaderLength()]
+}
+
+// Payload returns the data following the header
+func (tcp TCP) Payload() []byte {
+	return tcp[tcp.HeaderLength():]
+}
+
+// MSS returns the maximum segment size option, or 0 if there is none
+func (tcp TCP) MSS() uint16 {
+	options := tcp.Options()
+	for len(options) > 0 {
+		switch options[0] {
+		case 0:
+			// end of options
+			return 0
+		case 1:
+			// no-op
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || int(options[1]) < 2 || int(options[1]) > len(options) {
+			return 0
+		}
+		if options[0] == tcpOptionMSS && options[1] == 4 {
+			return binary.BigEndian.Uint16(options[2:])
+		}
+		options = options[options[1]:]
+	}
+	return 0
+}
+
+// SetSrcPort sets the source port, updating the checksum
+func (tcp TCP) SetSrcPort(port uint16) {
+	tcp.setUint16(0, port)
+}
+
+// SetDstPort sets the destination port, updating the checksum
+func (tcp TCP) SetDstPort(port uint16) {
+	tcp.setUint16(2, port)
+}
+
+// SetWindow sets the receive window, updating the checksum
+func (tcp TCP) SetWindow(window uint16) {
+	tcp.setUint16(14, window)
+}
+
+func (tcp TCP) setUint16(offset int, value uint16) {
+	var old [2]byte
+	copy(old[:], tcp[offset:offset+2])
+	binary.BigEndian.PutUint16(tcp[offset:], value)
+	binary.BigEndian.PutUint16(tcp[16:], adjustChecksum(tcp.Checksum(), old[:], tcp[offset:offset+2]))
+}
@@ -0,0 +1,78 @@
+package packet
+
+import (
+	"encoding/binary"
+)
+
+// UDPHeaderSize is the size of a UDP header
+const UDPHeaderSize = 8
+
+// UDP is a view of a UDP datagram.
+type UDP []byte
+
+// ParseUDP parses a UDP datagram, for example the payload of an IPv4 packet.
+// Any trailing bytes beyond the datagram's length are excluded from the
+// returned view.
+func ParseUDP(b []byte) (UDP, error) {
+	if len(b) < UDPHeaderSize {
+		return nil, ErrTooShort
+	}
+	length := int(binary.BigEndian.Uint16(b[4:]))
+	if length < UDPHeaderSize {
+		return nil, ErrInvalid
+	}
+	if length > len(b) {
+		return nil, ErrTooShort
+	}
+	return UDP(b[:length]), nil
+}
+
+// SrcPort returns the source port
+func (udp UDP) SrcPort() uint16 {
+	return binary.BigEndian.Uint16(udp[0:])
+}
+
+// DstPort returns the destination port
+func (udp UDP) DstPort() uint16 {
+	return binary.BigEndian.Uint16(udp[2:])
+}
+
+// Length returns the length of the datagram, including the header
+func (udp UDP) Length() int {
+	return int(binary.BigEndian.Uint16(udp[4:]))
+}
+
+// Checksum returns the checksum. Over IPv4, 0 means that there is no checksum.
+func (udp UDP) Checksum() uint16 {
+	return binary.BigEndian.Uint16(udp[6:])
+}
+
+// Payload returns the data following the header
+func (udp UDP) Payload() []byte {
+	return udp[UDPHeaderSize:]
+}
+
+// SetSrcPort sets the source port, updating the checksum
+func (udp UDP) SetSrcPort(port uint16) {
+	udp.setUint16(0, port)
+}
+
+// SetDstPort sets the destination port, updating the checksum
+func (udp UDP) SetDstPort(port uint16) {
+	udp.setUint16(2, port)
+}
+
+func (udp UDP) setUint16(offset int, value uint16) {
+	var old [2]byte
+	copy(old[:], udp[offset:offset+2])
+	binary.BigEndian.PutUint16(udp[offset:], value)
+	if udp.Checksum() == 0 {
+		// no checksum
+		return
+	}
+	checksum := adjustChecksum(udp.Checksum(), old[:], udp[offset:offset+2])
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], checksum)
+}
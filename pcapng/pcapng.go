@@ -0,0 +1,137 @@
+// pcapng encodes packets in the pcapng capture file format, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+//
+// Sections start with a header that describes two interfaces, one with link
+// type RAW for IP packets and one with link type ETHERNET for Ethernet frames.
+// Packets are encoded as Enhanced Packet Blocks whose comments contain the
+// packet's client ID and direction.
+package pcapng
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+// Block types
+const (
+	BlockTypeSectionHeader  = 0x0A0D0D0A
+	BlockTypeInterface      = 0x00000001
+	BlockTypeEnhancedPacket = 0x00000006
+)
+
+// Interfaces described by the section header
+const (
+	InterfaceIP       = 0
+	InterfaceEthernet = 1
+)
+
+// Values of the epb_flags option, which records the direction of packets
+const (
+	EPBFlagsInbound  = 1
+	EPBFlagsOutbound = 2
+)
+
+const (
+	byteOrderMagic           = 0x1A2B3C4D
+	linkTypeEthernet         = 1
+	linkTypeRaw              = 101
+	optionEnd                = 0
+	optionComment            = 1
+	optionEPBFlags           = 2
+	snapLen                  = 0
+	sectionHeaderLength      = 28
+	interfaceLength          = 20
+	enhancedPacketBaseLength = 32
+)
+
+// header is the start of a section.
+var header = func() []byte {
+	b := make([]byte, 0, sectionHeaderLength+2*interfaceLength)
+	b = appendBlockStart(b, BlockTypeSectionHeader, sectionHeaderLength)
+	b = appendUint32(b, byteOrderMagic)
+	b = appendUint16(b, 1) // major version
+	b = appendUint16(b, 0) // minor version
+	b = appendUint32(b, 0xFFFFFFFF)
+	b = appendUint32(b, 0xFFFFFFFF) // unspecified section length
+	b = appendUint32(b, sectionHeaderLength)
+	for _, linkType := range []uint16{linkTypeRaw, linkTypeEthernet} {
+		b = appendBlockStart(b, BlockTypeInterface, interfaceLength)
+		b = appendUint16(b, linkType)
+		b = appendUint16(b, 0)
+		b = appendUint32(b, snapLen)
+		b = appendUint32(b, interfaceLength)
+	}
+	return b
+}()
+
+// AppendHeader appends the header that starts a section to b.
+func AppendHeader(b []byte) []byte {
+	return append(b, header...)
+}
+
+// AppendPacket appends an Enhanced Packet Block for the given packet to b.
+// The packet's client ID and direction are recorded in a comment and its
+// direction also in the block's flags, from the point of view of an interface
+// facing origins, so upstream packets are outbound.
+func AppendPacket(b []byte, ts time.Time, pkt *pipeline.Packet) []byte {
+	comment := "client_id=" + pkt.ClientID + " direction=" + pkt.Direction.String()
+	length := enhancedPacketBaseLength + padded(len(pkt.Data)) + 8 + 4 + padded(len(comment)) + 4
+	iface := uint32(InterfaceIP)
+	if pkt.Mode == protocol.ModeEthernet {
+		iface = InterfaceEthernet
+	}
+	flags := uint32(EPBFlagsOutbound)
+	if pkt.Direction == pipeline.Downstream {
+		flags = EPBFlagsInbound
+	}
+	micros := uint64(ts.UnixNano() / int64(time.Microsecond))
+
+	b = appendBlockStart(b, BlockTypeEnhancedPacket, length)
+	b = appendUint32(b, iface)
+	b = appendUint32(b, uint32(micros>>32))
+	b = appendUint32(b, uint32(micros))
+	b = appendUint32(b, uint32(len(pkt.Data)))
+	b = appendUint32(b, uint32(len(pkt.Data)))
+	b = appendPadded(b, pkt.Data)
+	b = appendUint16(b, optionEPBFlags)
+	b = appendUint16(b, 4)
+	b = appendUint32(b, flags)
+	b = appendUint16(b, optionComment)
+	b = appendUint16(b, uint16(len(comment)))
+	b = appendPadded(b, []byte(comment))
+	b = appendUint16(b, optionEnd)
+	b = appendUint16(b, 0)
+	return appendUint32(b, uint32(length))
+}
+
+func appendBlockStart(b []byte, blockType uint32, length int) []byte {
+	b = appendUint32(b, blockType)
+	return appendUint32(b, uint32(length))
+}
+
+func appendPadded(b []byte, data []byte) []byte {
+	b = append(b, data...)
+	for i := len(data); i < padded(len(data)); i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func padded(n int) int {
+	return (n + 3) &^ 3
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
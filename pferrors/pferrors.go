@@ -0,0 +1,142 @@
+// pferrors defines the errors returned by packetforward clients and servers.
+// Both packages re-export them, so callers don't usually need to import this
+// package directly.
+//
+// Every error is either one of the sentinel errors below or an *Error whose
+// Kind is one of them, so callers can classify errors with errors.Is and get
+// details with errors.As:
+//
+//	if errors.Is(err, packetforward.ErrAuthRejected) { ... }
+//	var pfErr *pferrors.Error
+//	if errors.As(err, &pfErr) { log.Print(pfErr.Reason) }
+package pferrors
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrClosed means that the client was already closed
+	ErrClosed = errors.New("client closed")
+
+	// ErrAuthRejected means that the server rejected the client's credentials
+	ErrAuthRejected = errors.New("authentication rejected")
+
+	// ErrAuthUnavailable means that the server couldn't authenticate the client, for example
+	// because its authentication backend didn't respond. Unlike ErrAuthRejected, it's
+	// temporary.
+	ErrAuthUnavailable = errors.New("authentication unavailable")
+
+	// ErrServerUnreachable means that the client couldn't connect to the server
+	ErrServerUnreachable = errors.New("server unreachable")
+
+	// ErrHandshakeFailed means that the client and server couldn't complete the handshake
+	ErrHandshakeFailed = errors.New("handshake failed")
+
+	// ErrSessionEvicted means that the server ended the session, for example because it was
+	// idle or exceeded its session timeout
+	ErrSessionEvicted = errors.New("session evicted")
+
+	// ErrQuotaExceeded means that the session transferred more than its quota
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// ErrPolicyDenied means that server policy doesn't allow what the client asked for
+	ErrPolicyDenied = errors.New("denied by policy")
+)
+
+// kinds lists the error kinds with the codes that identify them on the wire
+var kinds = []struct {
+	kind error
+	code string
+}{
+	{ErrClosed, "closed"},
+	{ErrAuthRejected, "auth_rejected"},
+	{ErrAuthUnavailable, "auth_unavailable"},
+	{ErrServerUnreachable, "server_unreachable"},
+	{ErrHandshakeFailed, "handshake_failed"},
+	{ErrSessionEvicted, "session_evicted"},
+	{ErrQuotaExceeded, "quota_exceeded"},
+	{ErrPolicyDenied, "policy_denied"},
+}
+
+// Error is an error of a specific Kind with additional details.
+type Error struct {
+	// Kind is one of the sentinel errors in this package
+	Kind error
+
+	// Reason, if specified, explains the error
+	Reason string
+
+	// Err, if specified, is the underlying cause
+	Err error
+}
+
+// New constructs an *Error. reason and cause are optional.
+func New(kind error, reason string, cause error) *Error {
+	return &Error{Kind: kind, Reason: reason, Err: cause}
+}
+
+func (e *Error) Error() string {
+	msg := e.Kind.Error()
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Is makes errors.Is(err, kind) work.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying cause.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Kind returns the sentinel error that classifies err, or nil if err isn't
+// part of the taxonomy. If err matches several kinds, for example because an
+// *Error wraps another one, the outermost *Error's Kind wins.
+func Kind(err error) error {
+	var pfErr *Error
+	if errors.As(err, &pfErr) {
+		return pfErr.Kind
+	}
+	for _, k := range kinds {
+		if errors.Is(err, k.kind) {
+			return k.kind
+		}
+	}
+	return nil
+}
+
+// Code returns the wire code for err's kind, or "" if err isn't part of the
+// taxonomy.
+func Code(err error) string {
+	kind := Kind(err)
+	for _, k := range kinds {
+		if k.kind == kind {
+			return k.code
+		}
+	}
+	return ""
+}
+
+// FromCode reconstructs an error received from the other side from its code and
+// full message. Unknown codes are treated as ErrHandshakeFailed.
+func FromCode(code string, msg string) *Error {
+	kind := ErrHandshakeFailed
+	for _, k := range kinds {
+		if k.code == code {
+			kind = k.kind
+			break
+		}
+	}
+	// avoid repeating the kind in Error()
+	reason := strings.TrimPrefix(strings.TrimPrefix(msg, kind.Error()), ": ")
+	return New(kind, reason, nil)
+}
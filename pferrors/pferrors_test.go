@@ -0,0 +1,57 @@
+package pferrors
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	err := fmt.Errorf("writing: %w", New(ErrSessionEvicted, "idle", io.EOF))
+	if !errors.Is(err, ErrSessionEvicted) {
+		t.Error("Should be session evicted")
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Error("Should unwrap to cause")
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		t.Error("Should not be quota exceeded")
+	}
+	var pfErr *Error
+	if !errors.As(err, &pfErr) || pfErr.Reason != "idle" {
+		t.Errorf("Unable to get details from %v", err)
+	}
+	if err.Error() != "writing: session evicted: idle: EOF" {
+		t.Errorf("Unexpected message %q", err.Error())
+	}
+}
+
+func TestCodes(t *testing.T) {
+	if Code(ErrQuotaExceeded) != "quota_exceeded" || Code(New(ErrAuthRejected, "", nil)) != "auth_rejected" || Code(io.EOF) != "" {
+		t.Error("Wrong codes")
+	}
+	err := FromCode("policy_denied", "denied by policy: ethernet mode disabled")
+	if !errors.Is(err, ErrPolicyDenied) || err.Reason != "ethernet mode disabled" {
+		t.Errorf("Wrong error from code: %v", err)
+	}
+	if FromCode("quota_exceeded", "quota exceeded").Error() != "quota exceeded" {
+		t.Error("Kind should not be repeated")
+	}
+	if !errors.Is(FromCode("something_new", ""), ErrHandshakeFailed) {
+		t.Error("Unknown codes should be handshake failures")
+	}
+}
+
+func TestKindOfNestedErrors(t *testing.T) {
+	// matches both kinds, the outer one must win every time
+	err := New(ErrServerUnreachable, "", New(ErrPolicyDenied, "", nil))
+	for i := 0; i < 100; i++ {
+		if Kind(err) != ErrServerUnreachable || Code(err) != "server_unreachable" {
+			t.Fatalf("Wrong kind %v", Kind(err))
+		}
+	}
+	if Kind(fmt.Errorf("wrapped: %w", ErrQuotaExceeded)) != ErrQuotaExceeded {
+		t.Error("Wrapped sentinels should be classified")
+	}
+}
@@ -0,0 +1,77 @@
+package packetforward
+
+import (
+	"io"
+
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+// processUpstream runs a packet written by the consumer through the pipeline.
+// It returns the packet to send to the server, or false if the packet
+// shouldn't be sent. Responses are delivered downstream.
+func (f *forwarder) processUpstream(b []byte) ([]byte, bool) {
+	pkt := f.pipelinePacket(pipeline.Upstream, b)
+	switch f.pipeline.Process(pkt) {
+	case pipeline.Drop:
+		return nil, false
+	case pipeline.Respond:
+		f.downstreamMx.Lock()
+		defer f.downstreamMx.Unlock()
+		for _, response := range pkt.Responses {
+			if _, err := f.downstream.Write(response); err != nil {
+				f.log.Debugf("Unable to deliver response downstream: %v", err)
+				return nil, false
+			}
+		}
+		return nil, false
+	case pipeline.Rewrite:
+		return pkt.Data, len(pkt.Data) > 0
+	default:
+		return b, true
+	}
+}
+
+// processDownstream runs a packet received from the server through the
+// pipeline. It returns the packet to deliver downstream, or false if the
+// packet shouldn't be delivered. Responses are sent back to the server over
+// upstream, the connection from which the packet was read.
+func (f *forwarder) processDownstream(upstream io.Writer, b []byte) ([]byte, bool) {
+	pkt := f.pipelinePacket(pipeline.Downstream, b)
+	switch f.pipeline.Process(pkt) {
+	case pipeline.Drop:
+		return nil, false
+	case pipeline.Respond:
+		for _, response := range pkt.Responses {
+			if f.handshake != nil && f.handshake.Records {
+				// Responses aren't sequenced, since the sequence belongs to Write
+				response = protocol.EncodePacket(response)
+			}
+			f.upstreamMx.Lock()
+			_, err := upstream.Write(response)
+			f.upstreamMx.Unlock()
+			if err != nil {
+				f.log.Debugf("Unable to send response upstream: %v", err)
+				return nil, false
+			}
+		}
+		return nil, false
+	case pipeline.Rewrite:
+		return pkt.Data, len(pkt.Data) > 0
+	default:
+		return b, true
+	}
+}
+
+func (f *forwarder) pipelinePacket(direction pipeline.Direction, b []byte) *pipeline.Packet {
+	pkt := &pipeline.Packet{
+		Direction: direction,
+		ClientID:  f.id,
+		Data:      b,
+	}
+	if f.handshake != nil {
+		pkt.Username = f.handshake.Username
+		pkt.Mode = f.handshake.Mode
+	}
+	return pkt
+}
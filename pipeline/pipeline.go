@@ -0,0 +1,217 @@
+// pipeline provides composable chains of packet handlers. Each handler can
+// pass, drop, rewrite or respond to a packet, so independent concerns like
+// access control, rewriting, DNS interception and logging can be stacked.
+// Chains count what each handler did with the packets it saw.
+package pipeline
+
+import (
+	"sync/atomic"
+
+	"github.com/getlantern/packetforward/protocol"
+)
+
+// Direction is the direction in which a packet travels.
+type Direction int
+
+const (
+	// Upstream packets travel from the client towards origins
+	Upstream Direction = iota
+
+	// Downstream packets travel from origins back to the client
+	Downstream
+)
+
+func (d Direction) String() string {
+	if d == Upstream {
+		return "upstream"
+	}
+	return "downstream"
+}
+
+// Verdict is what a Handler decided to do with a packet.
+type Verdict int
+
+const (
+	// Pass passes the packet on to the next handler unchanged
+	Pass Verdict = iota
+
+	// Rewrite passes the packet on to the next handler after the handler modified Packet.Data
+	Rewrite
+
+	// Drop drops the packet. Later handlers don't see it.
+	Drop
+
+	// Respond drops the packet and sends Packet.Responses back to where the packet came from.
+	// Later handlers don't see it.
+	Respond
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Pass:
+		return "pass"
+	case Rewrite:
+		return "rewrite"
+	case Drop:
+		return "drop"
+	case Respond:
+		return "respond"
+	default:
+		return "unknown"
+	}
+}
+
+// Packet is a packet passing through a Chain.
+type Packet struct {
+	// Direction is the direction in which the packet travels
+	Direction Direction
+
+	// ClientID identifies the session that the packet belongs to
+	ClientID string
+
+	// Username is the authenticated user of the session, if known
+	Username string
+
+	// Mode determines whether Data is an IP packet or an Ethernet frame
+	Mode protocol.Mode
+
+	// Data is the packet. Handlers that rewrite the packet may modify it in place or replace
+	// it and must return Rewrite.
+	Data []byte
+
+	// Responses are the packets to send back to where the packet came from when a handler
+	// returns Respond
+	Responses [][]byte
+}
+
+// Respond adds a response and returns Respond, so handlers can answer a
+// packet with "return pkt.Respond(response)".
+func (pkt *Packet) Respond(response []byte) Verdict {
+	pkt.Responses = append(pkt.Responses, response)
+	return Respond
+}
+
+// Handler handles packets in a Chain. Handlers are called concurrently for
+// different packets, so they must be safe for concurrent use, and they're
+// called on the packet processing path, so they must not block.
+type Handler interface {
+	Handle(pkt *Packet) Verdict
+}
+
+// Responder is implemented by handlers that return Respond. Not every user of a
+// Chain can deliver responses in both directions, so handlers that respond
+// should declare the directions in which they do, which lets such users reject
+// the chain up front instead of failing packet by packet.
+type Responder interface {
+	// RespondsTo reports whether the handler may respond to packets travelling in the given
+	// direction.
+	RespondsTo(direction Direction) bool
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(pkt *Packet) Verdict
+
+// Handle implements the method from Handler.
+func (fn HandlerFunc) Handle(pkt *Packet) Verdict {
+	return fn(pkt)
+}
+
+// HandlerStats counts what a handler did with the packets it saw.
+type HandlerStats struct {
+	Name      string
+	Packets   int64
+	Passed    int64
+	Rewritten int64
+	Dropped   int64
+	Responded int64
+}
+
+// Chain is an ordered chain of handlers.
+type Chain struct {
+	stages []*stage
+}
+
+type stage struct {
+	packets   int64
+	passed    int64
+	rewritten int64
+	dropped   int64
+	responded int64
+	name      string
+	handler   Handler
+}
+
+// New constructs an empty Chain.
+func New() *Chain {
+	return &Chain{}
+}
+
+// Use appends a handler to the chain. name identifies the handler in stats.
+// Handlers must be added before the chain is used.
+func (c *Chain) Use(name string, handler Handler) *Chain {
+	c.stages = append(c.stages, &stage{name: name, handler: handler})
+	return c
+}
+
+// UseFunc is like Use but takes a function.
+func (c *Chain) UseFunc(name string, fn func(pkt *Packet) Verdict) *Chain {
+	return c.Use(name, HandlerFunc(fn))
+}
+
+// Process runs the packet through the chain's handlers in order, stopping at
+// the first handler that drops or responds to it. It returns Rewrite if any
+// handler rewrote the packet and otherwise passed it.
+func (c *Chain) Process(pkt *Packet) Verdict {
+	result := Pass
+	for _, s := range c.stages {
+		atomic.AddInt64(&s.packets, 1)
+		verdict := s.handler.Handle(pkt)
+		switch verdict {
+		case Rewrite:
+			atomic.AddInt64(&s.rewritten, 1)
+			result = Rewrite
+		case Drop:
+			atomic.AddInt64(&s.dropped, 1)
+			return Drop
+		case Respond:
+			atomic.AddInt64(&s.responded, 1)
+			return Respond
+		default:
+			atomic.AddInt64(&s.passed, 1)
+		}
+	}
+	return result
+}
+
+// Stats returns stats for each handler, in order.
+func (c *Chain) Stats() []*HandlerStats {
+	stats := make([]*HandlerStats, 0, len(c.stages))
+	for _, s := range c.stages {
+		stats = append(stats, &HandlerStats{
+			Name:      s.name,
+			Packets:   atomic.LoadInt64(&s.packets),
+			Passed:    atomic.LoadInt64(&s.passed),
+			Rewritten: atomic.LoadInt64(&s.rewritten),
+			Dropped:   atomic.LoadInt64(&s.dropped),
+			Responded: atomic.LoadInt64(&s.responded),
+		})
+	}
+	return stats
+}
+
+// Responders returns the names of the handlers that declare that they may
+// respond to packets travelling in the given direction (see Responder).
+func (c *Chain) Responders(direction Direction) []string {
+	var names []string
+	for _, s := range c.stages {
+		if r, ok := s.handler.(Responder); ok && r.RespondsTo(direction) {
+			names = append(names, s.name)
+		}
+	}
+	return names
+}
+
+// Len returns the number of handlers in the chain.
+func (c *Chain) Len() int {
+	return len(c.stages)
+}
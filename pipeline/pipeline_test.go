@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var seenByLogger [][]byte
+	chain := New().
+		UseFunc("acl", func(pkt *Packet) Verdict {
+			if bytes.HasPrefix(pkt.Data, []byte("blocked")) {
+				return Drop
+			}
+			return Pass
+		}).
+		UseFunc("dns", func(pkt *Packet) Verdict {
+			if bytes.HasPrefix(pkt.Data, []byte("query")) {
+				return pkt.Respond([]byte("answer"))
+			}
+			return Pass
+		}).
+		UseFunc("rewrite", func(pkt *Packet) Verdict {
+			if pkt.Direction == Downstream {
+				pkt.Data = bytes.ToUpper(pkt.Data)
+				return Rewrite
+			}
+			return Pass
+		}).
+		UseFunc("logger", func(pkt *Packet) Verdict {
+			seenByLogger = append(seenByLogger, pkt.Data)
+			return Pass
+		})
+
+	if v := chain.Process(&Packet{Data: []byte("blocked packet")}); v != Drop {
+		t.Errorf("Expected drop, got %v", v)
+	}
+	query := &Packet{Data: []byte("query")}
+	if v := chain.Process(query); v != Respond || len(query.Responses) != 1 || string(query.Responses[0]) != "answer" {
+		t.Errorf("Expected response, got %v with %d responses", v, len(query.Responses))
+	}
+	down := &Packet{Direction: Downstream, Data: []byte("data")}
+	if v := chain.Process(down); v != Rewrite || string(down.Data) != "DATA" {
+		t.Errorf("Expected rewrite, got %v with %q", v, down.Data)
+	}
+	if v := chain.Process(&Packet{Data: []byte("data")}); v != Pass {
+		t.Errorf("Expected pass, got %v", v)
+	}
+	if len(seenByLogger) != 2 || string(seenByLogger[0]) != "DATA" {
+		t.Errorf("Logger should only see passed packets after earlier handlers: %q", seenByLogger)
+	}
+
+	expected := []HandlerStats{
+		{Name: "acl", Packets: 4, Passed: 3, Dropped: 1},
+		{Name: "dns", Packets: 3, Passed: 2, Responded: 1},
+		{Name: "rewrite", Packets: 2, Passed: 1, Rewritten: 1},
+		{Name: "logger", Packets: 2, Passed: 2},
+	}
+	for i, stats := range chain.Stats() {
+		if *stats != expected[i] {
+			t.Errorf("Wrong stats for %v: %+v", expected[i].Name, stats)
+		}
+	}
+}
+
+type upstreamResponder struct {
+	HandlerFunc
+}
+
+func (r upstreamResponder) RespondsTo(direction Direction) bool {
+	return direction == Upstream
+}
+
+func TestResponders(t *testing.T) {
+	pass := func(pkt *Packet) Verdict { return Pass }
+	chain := New().UseFunc("logger", pass).Use("dns", upstreamResponder{HandlerFunc(pass)})
+	if names := chain.Responders(Upstream); len(names) != 1 || names[0] != "dns" {
+		t.Errorf("Expected dns to respond upstream, got %v", names)
+	}
+	if names := chain.Responders(Downstream); len(names) != 0 {
+		t.Errorf("Expected no downstream responders, got %v", names)
+	}
+}
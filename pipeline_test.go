@@ -0,0 +1,104 @@
+package packetforward
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+func TestPipeline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rwc := framed.NewReadWriteCloser(conn)
+		rwc.EnableBigFrames()
+		b := make([]byte, protocol.MaxHelloSize)
+		// skip hello, then echo
+		if _, err := rwc.Read(b); err != nil {
+			return
+		}
+		for {
+			n, err := rwc.Read(b)
+			if err != nil {
+				return
+			}
+			rwc.Write(b[:n])
+		}
+	}()
+
+	chain := pipeline.New().
+		UseFunc("firewall", func(pkt *pipeline.Packet) pipeline.Verdict {
+			if pkt.Direction == pipeline.Upstream && string(pkt.Data) == "drop" {
+				return pipeline.Drop
+			}
+			return pipeline.Pass
+		}).
+		UseFunc("local", func(pkt *pipeline.Packet) pipeline.Verdict {
+			switch {
+			case pkt.Direction == pipeline.Upstream && string(pkt.Data) == "ping":
+				return pkt.Respond([]byte("pong"))
+			case pkt.Direction == pipeline.Downstream && string(pkt.Data) == "knock":
+				return pkt.Respond([]byte("answer"))
+			case pkt.Direction == pipeline.Downstream && string(pkt.Data) == "hello":
+				pkt.Data = []byte("HELLO")
+				return pipeline.Rewrite
+			}
+			return pipeline.Pass
+		})
+
+	downstream := make(channelWriter, 10)
+	c := NewClient(downstream, &Opts{
+		IdleTimeout: time.Second,
+		DialServer: func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", l.Addr().String())
+		},
+		Pipeline: chain,
+	})
+	defer c.Close()
+
+	for _, pkt := range []string{"ping", "drop", "hello", "knock"} {
+		n, err := c.Write([]byte(pkt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(pkt) {
+			t.Errorf("Write of %v returned %d", pkt, n)
+		}
+	}
+
+	// ping is answered locally, hello is rewritten on its way back and knock is
+	// answered by sending answer to the server, which echoes it
+	for _, expected := range []string{"pong", "HELLO", "answer"} {
+		select {
+		case pkt := <-downstream:
+			if string(pkt) != expected {
+				t.Errorf("Expected %v, got %v", expected, string(pkt))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %v", expected)
+		}
+	}
+
+	stats := c.Stats()
+	if stats.PacketsUp != 2 {
+		t.Errorf("Only hello and knock should have been sent to the server, got %d packets", stats.PacketsUp)
+	}
+	handlerStats := chain.Stats()
+	if handlerStats[0].Dropped != 1 || handlerStats[1].Responded != 2 || handlerStats[1].Rewritten != 1 {
+		t.Errorf("Wrong handler stats: %+v %+v", handlerStats[0], handlerStats[1])
+	}
+}
@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"github.com/getlantern/packetforward/packet"
+)
+
+const (
+	// MaxRealTimePacketSize is the largest UDP packet that RealTime considers to
+	// be real-time traffic
+	MaxRealTimePacketSize = 400
+
+	// minRealTimeDSCP is CS5. Traffic marked CS5 or above (including EF) is
+	// considered real-time.
+	minRealTimeDSCP = 40
+)
+
+// RealTime classifies IP packets as real-time traffic. It matches UDP packets
+// of up to MaxRealTimePacketSize bytes (typical of VoIP and gaming) as well as
+// any packet with a DSCP marking of CS5 or higher (which includes EF).
+func RealTime(pkt []byte) bool {
+	ip, err := packet.ParseIP(pkt)
+	if err != nil {
+		return false
+	}
+	if ip.DSCP() >= minRealTimeDSCP {
+		return true
+	}
+	proto, _ := ip.Transport()
+	return proto == packet.ProtocolUDP && len(pkt) <= MaxRealTimePacketSize
+}
+
+// RealTimeFrame is like RealTime, but classifies the IP packets contained in
+// Ethernet frames.
+func RealTimeFrame(frame []byte) bool {
+	pkt, ok := packet.FromEthernet(frame)
+	return ok && RealTime(pkt)
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"sync"
+)
+
+const (
+	// DedupWindow is how many sequence numbers a Deduplicator remembers
+	DedupWindow = 4096
+)
+
+// Deduplicator detects sequence numbers that have been seen before, within a
+// sliding window of the DedupWindow most recent sequence numbers. Sequence
+// numbers that fall behind the window are treated as duplicates. Sequence
+// numbers start at 1.
+type Deduplicator struct {
+	highest uint64
+	seen    [DedupWindow / 64]uint64
+	mx      sync.Mutex
+}
+
+// Duplicate records seq and reports whether it had already been seen.
+func (d *Deduplicator) Duplicate(seq uint64) bool {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if seq > d.highest {
+		// advance the window, forgetting sequence numbers that drop out of it
+		if seq-d.highest >= DedupWindow {
+			d.seen = [DedupWindow / 64]uint64{}
+		} else {
+			for s := d.highest + 1; s < seq; s++ {
+				d.clear(s)
+			}
+		}
+		d.highest = seq
+		d.set(seq)
+		return false
+	}
+	if d.highest-seq >= DedupWindow {
+		return true
+	}
+	if d.isSet(seq) {
+		return true
+	}
+	d.set(seq)
+	return false
+}
+
+// Reset forgets all sequence numbers, for example because the peer started a
+// new sequence.
+func (d *Deduplicator) Reset() {
+	d.mx.Lock()
+	d.highest = 0
+	d.seen = [DedupWindow / 64]uint64{}
+	d.mx.Unlock()
+}
+
+func (d *Deduplicator) set(seq uint64) {
+	i := seq % DedupWindow
+	d.seen[i/64] |= 1 << (i % 64)
+}
+
+func (d *Deduplicator) clear(seq uint64) {
+	i := seq % DedupWindow
+	d.seen[i/64] &^= 1 << (i % 64)
+}
+
+func (d *Deduplicator) isSet(seq uint64) bool {
+	i := seq % DedupWindow
+	return d.seen[i/64]&(1<<(i%64)) != 0
+}
@@ -0,0 +1,128 @@
+// protocol defines the wire format shared by packetforward clients and servers.
+//
+// Every connection from a client to a server begins with a hello frame that
+// contains the client's 36 byte ID. Clients that need to negotiate anything
+// with the server (for example credentials) append a JSON encoded Handshake to
+// the ID. In that case, the server answers with a single JSON encoded
+// HandshakeResponse frame before any packets are exchanged. Clients that send a
+// bare ID get no response, which keeps the protocol compatible with older
+// clients and servers.
+package protocol
+
+import (
+	"encoding/json"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// IDLength is the length of a client ID (a string formatted UUID)
+	IDLength = 36
+
+	// MaxHelloSize is the maximum size of a hello frame, including the handshake
+	MaxHelloSize = 8192
+)
+
+// Mode determines what kind of traffic a session carries.
+type Mode string
+
+const (
+	// ModeIP sessions carry IP packets, which the server NATs to their destinations. This is the
+	// default.
+	ModeIP Mode = ""
+
+	// ModeEthernet sessions carry Ethernet frames, which the server bridges into a local network.
+	ModeEthernet Mode = "ethernet"
+)
+
+// Handshake contains options that a client negotiates with the server when
+// connecting.
+type Handshake struct {
+	// Username identifies the user for authentication purposes
+	Username string `json:"username,omitempty"`
+
+	// Password authenticates the user
+	Password string `json:"password,omitempty"`
+
+	// Mode is the kind of traffic that the client wants to forward
+	Mode Mode `json:"mode,omitempty"`
+
+	// Records indicates that the client and server exchange typed records (see
+	// RecordPacket) rather than raw packets.
+	Records bool `json:"records,omitempty"`
+
+	// Secondary indicates that this connection is an additional path for an
+	// existing session rather than a replacement of the session's connection.
+	// Secondary paths require Records.
+	Secondary bool `json:"secondary,omitempty"`
+
+	// SpeedTest, if specified, asks the server to run a speed test instead of
+	// starting a session. Speed tests require Records.
+	SpeedTest *SpeedTest `json:"speed_test,omitempty"`
+}
+
+// HandshakeResponse is the server's answer to a Handshake.
+type HandshakeResponse struct {
+	// OK indicates whether or not the server accepted the handshake
+	OK bool `json:"ok"`
+
+	// Error explains why the server rejected the handshake
+	Error string `json:"error,omitempty"`
+
+	// Code classifies the rejection (see pferrors.Code). Older servers don't
+	// send it.
+	Code string `json:"code,omitempty"`
+}
+
+// EncodeHello encodes a hello frame for the given client id and optional
+// handshake.
+func EncodeHello(id string, hs *Handshake) ([]byte, error) {
+	if len(id) != IDLength {
+		return nil, errors.New("client ID must be %d bytes long, not %d", IDLength, len(id))
+	}
+	if hs == nil {
+		return []byte(id), nil
+	}
+	encoded, err := json.Marshal(hs)
+	if err != nil {
+		return nil, errors.New("unable to encode handshake: %v", err)
+	}
+	b := make([]byte, 0, IDLength+len(encoded))
+	b = append(b, id...)
+	return append(b, encoded...), nil
+}
+
+// DecodeHello decodes a hello frame. If the client didn't include a handshake,
+// the returned Handshake is nil.
+func DecodeHello(b []byte) (string, *Handshake, error) {
+	if len(b) < IDLength {
+		return "", nil, errors.New("hello too short to contain client ID: %d", len(b))
+	}
+	id := string(b[:IDLength])
+	if len(b) == IDLength {
+		return id, nil, nil
+	}
+	hs := &Handshake{}
+	if err := json.Unmarshal(b[IDLength:], hs); err != nil {
+		return "", nil, errors.New("unable to decode handshake: %v", err)
+	}
+	return id, hs, nil
+}
+
+// EncodeHandshakeResponse encodes a HandshakeResponse.
+func EncodeHandshakeResponse(resp *HandshakeResponse) ([]byte, error) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return nil, errors.New("unable to encode handshake response: %v", err)
+	}
+	return b, nil
+}
+
+// DecodeHandshakeResponse decodes a HandshakeResponse.
+func DecodeHandshakeResponse(b []byte) (*HandshakeResponse, error) {
+	resp := &HandshakeResponse{}
+	if err := json.Unmarshal(b, resp); err != nil {
+		return nil, errors.New("unable to decode handshake response: %v", err)
+	}
+	return resp, nil
+}
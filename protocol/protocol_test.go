@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/getlantern/packetforward/packet"
+)
+
+func TestDeduplicator(t *testing.T) {
+	d := &Deduplicator{}
+	for _, seq := range []uint64{1, 3, 2, 5} {
+		if d.Duplicate(seq) {
+			t.Errorf("%d should not be a duplicate", seq)
+		}
+	}
+	for _, seq := range []uint64{1, 2, 3, 5} {
+		if !d.Duplicate(seq) {
+			t.Errorf("%d should be a duplicate", seq)
+		}
+	}
+	if d.Duplicate(4) {
+		t.Error("4 arrived late but should not be a duplicate")
+	}
+
+	// slide the window
+	if d.Duplicate(5 + DedupWindow) {
+		t.Error("new sequence number should not be a duplicate")
+	}
+	if !d.Duplicate(5) {
+		t.Error("sequence numbers behind the window should be treated as duplicates")
+	}
+	if d.Duplicate(6 + DedupWindow/2) {
+		t.Error("sequence number within window that wasn't seen should not be a duplicate")
+	}
+
+	// jump far ahead
+	if d.Duplicate(10 * DedupWindow) {
+		t.Error("new sequence number should not be a duplicate")
+	}
+	if d.Duplicate(10*DedupWindow - 1) {
+		t.Error("unseen sequence number within window should not be a duplicate")
+	}
+
+	// the peer starts a new sequence
+	d.Reset()
+	for _, seq := range []uint64{1, 2} {
+		if d.Duplicate(seq) {
+			t.Errorf("%d of new sequence should not be a duplicate", seq)
+		}
+	}
+}
+
+func TestRecords(t *testing.T) {
+	r, err := DecodeRecord(EncodeSequencedPacket(42, []byte("packet")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Type != RecordSequencedPacket || r.Sequence != 42 || string(r.Payload) != "packet" {
+		t.Errorf("Wrong sequenced record: %+v", r)
+	}
+	r, err = DecodeRecord(EncodePacket([]byte("packet")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Type != RecordPacket || string(r.Payload) != "packet" {
+		t.Errorf("Wrong record: %+v", r)
+	}
+	if _, err := DecodeRecord([]byte{RecordSequencedPacket, 1}); err == nil {
+		t.Error("Truncated sequenced record should fail to decode")
+	}
+	r, err = DecodeRecord(EncodePong(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Type != RecordPong || r.Sequence != 7 {
+		t.Errorf("Wrong pong: %+v", r)
+	}
+
+	r, err = DecodeRecord(EncodeTestData(8, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Type != RecordTestData || r.Sequence != 8 || len(r.Payload) != 100-MinTestDataSize {
+		t.Errorf("Wrong test data: %+v", r)
+	}
+
+	encoded, err := EncodeTestSummary(&SpeedTestSummary{Packets: 2, Bytes: 200, ElapsedMicros: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = DecodeRecord(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := DecodeTestSummary(r.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Type != RecordTestSummary || summary.Packets != 2 || summary.Bytes != 200 || summary.ElapsedMicros != 5 {
+		t.Errorf("Wrong test summary: %+v %+v", r, summary)
+	}
+}
+
+func TestRealTime(t *testing.T) {
+	udp := make([]byte, 100)
+	udp[0] = 0x45
+	binary.BigEndian.PutUint16(udp[2:], uint16(len(udp)))
+	udp[9] = packet.ProtocolUDP
+	if !RealTime(udp) {
+		t.Error("Small UDP packet should be real-time")
+	}
+	if RealTime(udp[:50]) {
+		t.Error("Truncated packet should not be real-time")
+	}
+	bulk := make([]byte, 1400)
+	copy(bulk, udp)
+	binary.BigEndian.PutUint16(bulk[2:], uint16(len(bulk)))
+	if RealTime(bulk) {
+		t.Error("Large UDP packet should not be real-time")
+	}
+	bulk[1] = 46 << 2
+	if !RealTime(bulk) {
+		t.Error("EF marked packet should be real-time")
+	}
+	frame := append([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x08, 0x00}, udp...)
+	if !RealTimeFrame(frame) {
+		t.Error("Frame containing small UDP packet should be real-time")
+	}
+}
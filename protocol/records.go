@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"encoding/binary"
+
+	"github.com/getlantern/errors"
+)
+
+// Record types. Sessions that negotiate Records in their handshake exchange
+// frames that start with one of these types instead of raw packets.
+const (
+	// RecordPacket is followed by a packet
+	RecordPacket byte = 0
+
+	// RecordSequencedPacket is followed by an 8 byte big endian sequence number
+	// and a packet. Sequenced packets may arrive more than once (for example
+	// when sent over redundant paths) and receivers discard duplicates.
+	RecordSequencedPacket byte = 1
+
+	// RecordPing is followed by an 8 byte big endian ID. The receiver answers it
+	// with a RecordPong containing the same ID, which lets clients measure the
+	// round trip time to the server.
+	RecordPing byte = 2
+
+	// RecordPong is followed by the 8 byte big endian ID of the RecordPing that
+	// it answers
+	RecordPong byte = 3
+
+	// RecordTestData is followed by an 8 byte big endian sequence number and
+	// padding. It carries the test data of a speed test (see SpeedTest).
+	RecordTestData byte = 4
+
+	// RecordTestSummary is followed by a JSON encoded SpeedTestSummary
+	RecordTestSummary byte = 5
+)
+
+const (
+	sequenceLength = 8
+
+	// MaxRecordOverhead is the maximum number of bytes that a record adds to a packet
+	MaxRecordOverhead = 1 + sequenceLength
+)
+
+// EncodePacket encodes a RecordPacket.
+func EncodePacket(pkt []byte) []byte {
+	b := make([]byte, 1+len(pkt))
+	b[0] = RecordPacket
+	copy(b[1:], pkt)
+	return b
+}
+
+// EncodeSequencedPacket encodes a RecordSequencedPacket.
+func EncodeSequencedPacket(seq uint64, pkt []byte) []byte {
+	b := make([]byte, 1+sequenceLength+len(pkt))
+	b[0] = RecordSequencedPacket
+	binary.BigEndian.PutUint64(b[1:], seq)
+	copy(b[1+sequenceLength:], pkt)
+	return b
+}
+
+// EncodePing encodes a RecordPing.
+func EncodePing(id uint64) []byte {
+	return encodeControl(RecordPing, id)
+}
+
+// EncodePong encodes a RecordPong.
+func EncodePong(id uint64) []byte {
+	return encodeControl(RecordPong, id)
+}
+
+func encodeControl(recordType byte, id uint64) []byte {
+	b := make([]byte, 1+sequenceLength)
+	b[0] = recordType
+	binary.BigEndian.PutUint64(b[1:], id)
+	return b
+}
+
+// Record is a decoded record. Payload aliases the buffer from which the record
+// was decoded. The Sequence of pings and pongs is their ID.
+type Record struct {
+	Type     byte
+	Sequence uint64
+	Payload  []byte
+}
+
+// DecodeRecord decodes a record.
+func DecodeRecord(b []byte) (*Record, error) {
+	if len(b) < 1 {
+		return nil, errors.New("empty record")
+	}
+	r := &Record{Type: b[0]}
+	switch r.Type {
+	case RecordSequencedPacket, RecordPing, RecordPong, RecordTestData:
+		if len(b) < 1+sequenceLength {
+			return nil, errors.New("record of type %d too short: %d", r.Type, len(b))
+		}
+		r.Sequence = binary.BigEndian.Uint64(b[1:])
+		r.Payload = b[1+sequenceLength:]
+	default:
+		r.Payload = b[1:]
+	}
+	return r, nil
+}
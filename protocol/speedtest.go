@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/getlantern/errors"
+)
+
+// SpeedTestDirection is the direction in which a speed test sends test data.
+type SpeedTestDirection string
+
+const (
+	// SpeedTestUpload tests send test data from the client to the server
+	SpeedTestUpload SpeedTestDirection = "upload"
+
+	// SpeedTestDownload tests send test data from the server to the client
+	SpeedTestDownload SpeedTestDirection = "download"
+)
+
+// SpeedTest asks the server to measure the throughput of the tunnel itself
+// rather than to forward packets. Speed tests require Records.
+//
+// During a test, the sender sends RecordTestData records as fast as it can,
+// followed by a RecordTestSummary of what it sent. In upload tests, the server
+// answers the client's summary with a summary of what it received. Both sides
+// answer pings throughout, so clients can measure the latency under load. If
+// the client's quota runs out, the server ends the test early: in download
+// tests it stops sending and sends its summary, and in upload tests it sends
+// its summary without waiting for the client's, and clients should stop
+// sending when they receive it. Either summary has QuotaExceeded set.
+type SpeedTest struct {
+	// Direction is the direction in which to send test data
+	Direction SpeedTestDirection `json:"direction"`
+
+	// DurationMillis is how long the server sends test data in download tests. Servers limit
+	// it to their own maximum.
+	DurationMillis int64 `json:"duration_ms,omitempty"`
+
+	// PacketSize is the size of the test data records that the server sends in download tests
+	PacketSize int `json:"packet_size,omitempty"`
+}
+
+// SpeedTestSummary summarizes the test data that one side of a speed test sent
+// or received.
+type SpeedTestSummary struct {
+	// Packets is the number of RecordTestData records
+	Packets int64 `json:"packets"`
+
+	// Bytes is the size of the RecordTestData records, including their headers
+	Bytes int64 `json:"bytes"`
+
+	// ElapsedMicros is the time between the first and the last RecordTestData record
+	ElapsedMicros int64 `json:"elapsed_us"`
+
+	// QuotaExceeded is set by servers that ended the test early because the client's quota
+	// ran out
+	QuotaExceeded bool `json:"quota_exceeded,omitempty"`
+}
+
+// MinTestDataSize is the size of the smallest RecordTestData record
+const MinTestDataSize = 1 + sequenceLength
+
+// EncodeTestData encodes a RecordTestData of the given total size (which is
+// at least MinTestDataSize).
+func EncodeTestData(seq uint64, size int) []byte {
+	if size < MinTestDataSize {
+		size = MinTestDataSize
+	}
+	b := make([]byte, size)
+	b[0] = RecordTestData
+	binary.BigEndian.PutUint64(b[1:], seq)
+	return b
+}
+
+// EncodeTestSummary encodes a RecordTestSummary.
+func EncodeTestSummary(summary *SpeedTestSummary) ([]byte, error) {
+	encoded, err := json.Marshal(summary)
+	if err != nil {
+		return nil, errors.New("unable to encode speed test summary: %v", err)
+	}
+	return append([]byte{RecordTestSummary}, encoded...), nil
+}
+
+// DecodeTestSummary decodes the payload of a RecordTestSummary.
+func DecodeTestSummary(payload []byte) (*SpeedTestSummary, error) {
+	summary := &SpeedTestSummary{}
+	if err := json.Unmarshal(payload, summary); err != nil {
+		return nil, errors.New("unable to decode speed test summary: %v", err)
+	}
+	return summary, nil
+}
@@ -0,0 +1,217 @@
+package packetforward
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/gonat"
+	"github.com/getlantern/ops"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+const (
+	// secondaryQueueSize is how many records can wait to be written to a secondary path
+	secondaryQueueSize = 64
+
+	// secondaryWriteTimeout is how long a write to a secondary path may take before the path
+	// is considered stalled and dropped
+	secondaryWriteTimeout = 1 * time.Second
+)
+
+// encodeRecord encodes an upstream packet as a record. Packets selected for
+// redundant transmission are sequenced and immediately sent over the secondary
+// path too.
+func (f *forwarder) encodeRecord(pkt []byte) []byte {
+	if f.secondary == nil || !f.redundant(pkt) {
+		return protocol.EncodePacket(pkt)
+	}
+	f.sequence++
+	record := protocol.EncodeSequencedPacket(f.sequence, pkt)
+	if f.fatalErr == nil {
+		f.secondary.write(record)
+	}
+	return record
+}
+
+// writeToDownstream writes a packet received from the server over upstream to
+// downstream, unwrapping it from its record and discarding duplicates if
+// necessary.
+func (f *forwarder) writeToDownstream(upstream io.Writer, b []byte) error {
+	if f.handshake != nil && f.handshake.Records {
+		record, err := protocol.DecodeRecord(b)
+		if err != nil {
+			f.log.Debugf("Ignoring invalid record: %v", err)
+			f.stats.droppedPacket()
+			return nil
+		}
+		switch record.Type {
+		case protocol.RecordPacket:
+		case protocol.RecordSequencedPacket:
+			if f.dedup.Duplicate(record.Sequence) {
+				return nil
+			}
+		default:
+			// ignore record types that we don't know about
+			return nil
+		}
+		b = record.Payload
+	}
+	if f.pipeline != nil {
+		var ok bool
+		b, ok = f.processDownstream(upstream, b)
+		if !ok {
+			return nil
+		}
+	}
+
+	f.downstreamMx.Lock()
+	defer f.downstreamMx.Unlock()
+	_, err := f.downstream.Write(b)
+	if err == nil {
+		f.stats.wroteDownstream(len(b))
+		if f.traffic != nil {
+			f.traffic.downstream(b)
+		}
+	}
+	return err
+}
+
+// secondaryPath is an additional connection to the server over which redundant
+// packets are duplicated. It's connected lazily and, unlike the primary
+// connection, writes to it never block or retry. Records are queued for a
+// dedicated writer and dropped if the queue is full, so a stalled secondary
+// path never holds up the primary one. If it's not available, redundant
+// packets simply travel over the primary connection only.
+type secondaryPath struct {
+	f        *forwarder
+	dial     DialFunc
+	conn     *secondaryConn
+	dialing  bool
+	nextDial time.Time
+	closed   bool
+	mx       sync.Mutex
+}
+
+// secondaryConn is a single connection of a secondary path.
+type secondaryConn struct {
+	p         *secondaryPath
+	conn      net.Conn
+	upstream  io.ReadWriteCloser
+	log       logging.Logger
+	queue     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *secondaryPath) write(record []byte) {
+	p.mx.Lock()
+	sc := p.conn
+	if sc == nil && !p.dialing && !p.closed && time.Now().After(p.nextDial) {
+		p.dialing = true
+		ops.Go(p.connect)
+	}
+	p.mx.Unlock()
+
+	if sc != nil {
+		sc.Write(record)
+	}
+}
+
+func (p *secondaryPath) connect() {
+	hs := *p.f.handshake
+	hs.Secondary = true
+	conn, upstream, _, err := p.f.connect(p.dial, &hs)
+
+	p.mx.Lock()
+	p.dialing = false
+	if err != nil {
+		p.nextDial = time.Now().Add(maxDialDelay)
+		p.mx.Unlock()
+		p.f.log.Debugf("Unable to connect secondary path: %v", err)
+		return
+	}
+	if p.closed {
+		p.mx.Unlock()
+		upstream.Close()
+		return
+	}
+	sc := &secondaryConn{
+		p:        p,
+		conn:     conn,
+		upstream: upstream,
+		log:      p.f.log.With("remote", conn.RemoteAddr()),
+		queue:    make(chan []byte, secondaryQueueSize),
+		done:     make(chan struct{}),
+	}
+	p.conn = sc
+	p.mx.Unlock()
+
+	sc.log.Debugf("Connected secondary path")
+	ops.Go(sc.writeQueued)
+	b := make([]byte, gonat.MaximumIPPacketSize+protocol.MaxRecordOverhead)
+	for {
+		n, err := upstream.Read(b)
+		if err == nil {
+			err = p.f.writeToDownstream(sc, b[:n])
+		}
+		if err != nil {
+			sc.log.Debugf("Secondary path failed: %v", err)
+			p.drop(sc)
+			return
+		}
+	}
+}
+
+// Write queues a record for writing, dropping it if the queue is full. It
+// never blocks. Dropping is fine, because the primary path carries the record
+// too.
+func (sc *secondaryConn) Write(record []byte) (int, error) {
+	select {
+	case sc.queue <- record:
+	default:
+	}
+	return len(record), nil
+}
+
+// writeQueued writes queued records until the connection is dropped. Writes
+// that take longer than secondaryWriteTimeout drop the connection.
+func (sc *secondaryConn) writeQueued() {
+	for {
+		select {
+		case <-sc.done:
+			return
+		case record := <-sc.queue:
+			sc.conn.SetWriteDeadline(time.Now().Add(secondaryWriteTimeout))
+			if _, err := sc.upstream.Write(record); err != nil {
+				sc.log.Debugf("Unexpected error writing to secondary path: %v", err)
+				sc.p.drop(sc)
+				return
+			}
+		}
+	}
+}
+
+func (p *secondaryPath) drop(sc *secondaryConn) {
+	p.mx.Lock()
+	if p.conn == sc {
+		p.conn = nil
+	}
+	p.mx.Unlock()
+	sc.closeOnce.Do(func() {
+		close(sc.done)
+		sc.upstream.Close()
+	})
+}
+
+func (p *secondaryPath) close() {
+	p.mx.Lock()
+	p.closed = true
+	sc := p.conn
+	p.mx.Unlock()
+	if sc != nil {
+		p.drop(sc)
+	}
+}
@@ -0,0 +1,52 @@
+package packetforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward/logging"
+)
+
+func TestStalledSecondaryPath(t *testing.T) {
+	f := &forwarder{log: logging.FromGolog(log)}
+	// never redial, the test only covers a single connection
+	p := &secondaryPath{f: f, nextDial: time.Now().Add(time.Hour)}
+
+	// nobody reads from the other end, so writes stall
+	conn, stalled := net.Pipe()
+	defer stalled.Close()
+	sc := &secondaryConn{
+		p:        p,
+		conn:     conn,
+		upstream: framed.NewReadWriteCloser(conn),
+		log:      f.log,
+		queue:    make(chan []byte, secondaryQueueSize),
+		done:     make(chan struct{}),
+	}
+	p.conn = sc
+	go sc.writeQueued()
+
+	start := time.Now()
+	for i := 0; i < 10*secondaryQueueSize; i++ {
+		p.write([]byte("record"))
+	}
+	if time.Since(start) > secondaryWriteTimeout/2 {
+		t.Error("Writing to a stalled secondary path blocked")
+	}
+
+	deadline := time.Now().Add(5 * secondaryWriteTimeout)
+	for {
+		p.mx.Lock()
+		dropped := p.conn == nil
+		p.mx.Unlock()
+		if dropped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Stalled secondary path should have been dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
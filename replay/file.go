@@ -0,0 +1,125 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/getlantern/packetforward/pipeline"
+)
+
+// magic identifies recordings and their format version
+var magic = []byte("pfrec001")
+
+// frameHeaderSize is the size of the header preceding each recorded frame: an
+// 8 byte offset in nanoseconds, a direction byte and a 4 byte length, all big
+// endian.
+const frameHeaderSize = 8 + 1 + 4
+
+// Frame is a frame of a recorded session.
+type Frame struct {
+	// Offset is the time at which the frame was seen, relative to the start of the session
+	Offset time.Duration
+
+	// Direction is Upstream for frames from the client and Downstream for frames from the
+	// server
+	Direction pipeline.Direction
+
+	// Data is the frame exactly as exchanged by client and server, starting with the hello
+	Data []byte
+}
+
+// Writer writes a recording. It's safe for concurrent use.
+type Writer struct {
+	w  *bufio.Writer
+	mx sync.Mutex
+}
+
+// NewWriter starts a recording on w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(magic); err != nil {
+		return nil, err
+	}
+	return &Writer{w: bw}, nil
+}
+
+// Write records a frame.
+func (w *Writer) Write(f *Frame) error {
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint64(header[0:], uint64(f.Offset))
+	header[8] = byte(f.Direction)
+	binary.BigEndian.PutUint32(header[9:], uint32(len(f.Data)))
+
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if _, err := w.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(f.Data)
+	return err
+}
+
+// Flush writes buffered frames to the underlying writer.
+func (w *Writer) Flush() error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.w.Flush()
+}
+
+// Reader reads a recording.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader starts reading a recording from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	b := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, b); err != nil {
+		return nil, fmt.Errorf("unable to read recording header: %v", err)
+	}
+	if string(b) != string(magic) {
+		return nil, errors.New("not a packetforward recording")
+	}
+	return &Reader{r: br}, nil
+}
+
+// Read reads the next frame. It returns io.EOF at the end of the recording.
+func (r *Reader) Read() (*Frame, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated frame header")
+		}
+		return nil, err
+	}
+	f := &Frame{
+		Offset:    time.Duration(binary.BigEndian.Uint64(header[0:])),
+		Direction: pipeline.Direction(header[8]),
+		Data:      make([]byte, binary.BigEndian.Uint32(header[9:])),
+	}
+	if _, err := io.ReadFull(r.r, f.Data); err != nil {
+		return nil, errors.New("truncated frame")
+	}
+	return f, nil
+}
+
+// ReadAll reads all remaining frames.
+func (r *Reader) ReadAll() ([]*Frame, error) {
+	var frames []*Frame
+	for {
+		f, err := r.Read()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, f)
+	}
+}
@@ -0,0 +1,49 @@
+package replay
+
+import (
+	"github.com/getlantern/packetforward/packet"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+// IgnoreVolatile is a normalizer for Opts.Normalize that zeroes the fields of
+// IP, TCP and UDP headers that usually differ between runs even if the server
+// behaves the same: the IPv4 identification, TCP sequence and acknowledgement
+// numbers and all checksums. Packets that it can't parse are compared as they
+// are.
+func IgnoreVolatile(mode protocol.Mode, pkt []byte) []byte {
+	normalized := append([]byte(nil), pkt...)
+	b := normalized
+	if mode == protocol.ModeEthernet {
+		var ok bool
+		if b, ok = packet.FromEthernet(b); !ok {
+			return normalized
+		}
+	}
+	ip, err := packet.ParseIP(b)
+	if err != nil {
+		return normalized
+	}
+	if ip.Version() == 4 {
+		zero(ip[4:6])   // identification
+		zero(ip[10:12]) // header checksum
+	}
+	proto, transport := ip.Transport()
+	switch proto {
+	case packet.ProtocolTCP:
+		if tcp, err := packet.ParseTCP(transport); err == nil {
+			zero(tcp[4:12])  // sequence and acknowledgement numbers
+			zero(tcp[16:18]) // checksum
+		}
+	case packet.ProtocolUDP:
+		if udp, err := packet.ParseUDP(transport); err == nil {
+			zero(udp[6:8]) // checksum
+		}
+	}
+	return normalized
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
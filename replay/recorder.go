@@ -0,0 +1,180 @@
+// replay records the framed stream of client sessions and replays recordings
+// against a server, comparing the downstream packets that the server sends
+// with the recorded ones. This makes it possible to build regression corpora
+// from real traffic.
+//
+// Sessions are recorded by a Recorder, a proxy between clients and a server
+// that writes every frame it forwards, with a timestamp, to one file per
+// connection. Recordings contain the traffic of real users, so they're only
+// readable by their owner and passwords in handshakes are redacted. Replay
+// sends the recorded upstream frames to a server, with their timing preserved
+// or accelerated.
+package replay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/gonat"
+	"github.com/getlantern/packetforward"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/protocol"
+	"github.com/getlantern/uuid"
+)
+
+var log = golog.LoggerFor("packetforward.replay")
+
+// maxFrameSize is the size of the largest frame that clients and servers exchange
+const maxFrameSize = gonat.MaximumIPPacketSize + protocol.MaxRecordOverhead
+
+// RecorderOpts configures a Recorder.
+type RecorderOpts struct {
+	// DialServer configures how to connect to the packetforward server
+	DialServer packetforward.DialFunc
+
+	// Dir is the directory in which to write recordings. Each connection is recorded to a file
+	// named after the client's ID and the time at which it connected.
+	Dir string
+
+	// Logger, if specified, is used for logging instead of the default golog logger
+	Logger logging.Logger
+}
+
+// Recorder is a proxy that records the sessions that pass through it.
+type Recorder struct {
+	opts *RecorderOpts
+	log  logging.Logger
+}
+
+// NewRecorder constructs a Recorder.
+func NewRecorder(opts *RecorderOpts) (*Recorder, error) {
+	if opts.DialServer == nil {
+		return nil, fmt.Errorf("no DialServer specified")
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create recording directory: %v", err)
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = logging.FromGolog(log)
+	}
+	return &Recorder{opts: opts, log: logger}, nil
+}
+
+// Serve accepts client connections on the given Listener and records them
+// until the Listener fails.
+func (r *Recorder) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := r.record(conn); err != nil {
+				r.log.With("remote", conn.RemoteAddr()).Errorf("Unable to record session: %v", err)
+			}
+		}()
+	}
+}
+
+func (r *Recorder) record(conn net.Conn) error {
+	defer conn.Close()
+	start := time.Now()
+	client := framed.NewReadWriteCloser(conn)
+	client.EnableBigFrames()
+
+	// the hello identifies the client, so read it before creating the file
+	hello := make([]byte, protocol.MaxHelloSize)
+	n, err := client.Read(hello)
+	if err != nil {
+		return fmt.Errorf("unable to read hello: %v", err)
+	}
+	hello = hello[:n]
+	id, hs, err := protocol.DecodeHello(hello)
+	if err != nil {
+		return err
+	}
+	// the ID names the file, so make sure that it can't point elsewhere
+	if _, err := uuid.Parse(id); err != nil {
+		return fmt.Errorf("invalid client ID %q: %v", id, err)
+	}
+	recordedHello, err := redactHello(id, hs, hello)
+	if err != nil {
+		return err
+	}
+
+	serverConn, err := r.opts.DialServer(context.Background())
+	if err != nil {
+		return fmt.Errorf("unable to dial server: %v", err)
+	}
+	defer serverConn.Close()
+	server := framed.NewReadWriteCloser(serverConn)
+	server.EnableBigFrames()
+
+	name := filepath.Join(r.opts.Dir, fmt.Sprintf("%v-%d.pfrec", id, start.UnixNano()))
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w, err := NewWriter(file)
+	if err != nil {
+		return err
+	}
+	defer w.Flush()
+
+	if err := w.Write(&Frame{Offset: time.Since(start), Direction: pipeline.Upstream, Data: recordedHello}); err != nil {
+		return err
+	}
+	if _, err := server.Write(hello); err != nil {
+		return err
+	}
+	r.log.With("session", id, "remote", conn.RemoteAddr()).Debugf("Recording to %v", name)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyFrames := func(dst io.WriteCloser, src io.Reader, direction pipeline.Direction) {
+		defer wg.Done()
+		// closing the destination stops the copy in the other direction
+		defer dst.Close()
+		b := make([]byte, maxFrameSize)
+		for {
+			n, err := src.Read(b)
+			if err != nil {
+				return
+			}
+			offset := time.Since(start)
+			if _, err := dst.Write(b[:n]); err != nil {
+				return
+			}
+			if err := w.Write(&Frame{Offset: offset, Direction: direction, Data: b[:n]}); err != nil {
+				r.log.Errorf("Unable to record frame: %v", err)
+				return
+			}
+		}
+	}
+	go copyFrames(server, client, pipeline.Upstream)
+	go copyFrames(client, server, pipeline.Downstream)
+	wg.Wait()
+	return nil
+}
+
+// redactHello returns the hello to record, with the password in the handshake,
+// if any, removed.
+func redactHello(id string, hs *protocol.Handshake, hello []byte) ([]byte, error) {
+	if hs == nil || hs.Password == "" {
+		return hello, nil
+	}
+	redacted := *hs
+	redacted.Password = ""
+	return protocol.EncodeHello(id, &redacted)
+}
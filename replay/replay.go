@@ -0,0 +1,294 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward"
+	"github.com/getlantern/packetforward/pferrors"
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+const (
+	// DefaultLinger is 2 seconds
+	DefaultLinger = 2 * time.Second
+
+	// DefaultTimeout is 10 seconds
+	DefaultTimeout = 10 * time.Second
+)
+
+// Opts configures a replay.
+type Opts struct {
+	// DialServer configures how to connect to the packetforward server
+	DialServer packetforward.DialFunc
+
+	// Speed scales the recorded timing. 1 preserves it and 10, for example, replays ten times
+	// faster. If not specified, defaults to 1.
+	Speed float64
+
+	// Linger is how long to wait for downstream packets after the recorded session ended
+	// (scaled by Speed). The replay ends early once all expected packets have been received.
+	// If not specified, defaults to DefaultLinger.
+	Linger time.Duration
+
+	// Timeout limits dialing and waiting for the handshake response. If not specified,
+	// defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// Password, if specified, is sent in place of the recorded password, which the Recorder
+	// redacts, for replaying against servers that authenticate clients
+	Password string
+
+	// Normalize, if specified, is applied to expected and received downstream packets before
+	// comparing them, for example to ignore fields that differ between runs (see
+	// IgnoreVolatile). It must not modify the given packet.
+	Normalize func(mode protocol.Mode, pkt []byte) []byte
+}
+
+// Result compares the downstream packets of a replay with the recorded ones.
+// Packets are compared as a multiset, so reordering doesn't count as a
+// difference.
+type Result struct {
+	// Sent is the number of upstream frames sent, including the hello
+	Sent int
+
+	// Expected is the number of recorded downstream packets
+	Expected int
+
+	// Received is the number of downstream packets received during the replay
+	Received int
+
+	// Matched is the number of received packets that matched a recorded packet
+	Matched int
+
+	// Missing are recorded packets that weren't received
+	Missing [][]byte
+
+	// Unexpected are received packets that weren't recorded
+	Unexpected [][]byte
+}
+
+// OK reports whether the replay received exactly the recorded downstream
+// packets.
+func (r *Result) OK() bool {
+	return len(r.Missing) == 0 && len(r.Unexpected) == 0
+}
+
+// Replay replays a recorded session against a server. Only frames carrying
+// packets are compared, so pongs and other control records are ignored.
+func Replay(frames []*Frame, opts *Opts) (*Result, error) {
+	if opts.DialServer == nil {
+		return nil, errors.New("no DialServer specified")
+	}
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	if opts.Linger <= 0 {
+		opts.Linger = DefaultLinger
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if len(frames) == 0 || frames[0].Direction != pipeline.Upstream {
+		return nil, errors.New("recording doesn't start with a hello")
+	}
+	id, hs, err := protocol.DecodeHello(frames[0].Data)
+	if err != nil {
+		return nil, err
+	}
+	var mode protocol.Mode
+	var records bool
+	if hs != nil {
+		mode, records = hs.Mode, hs.Records
+	}
+
+	p := &player{
+		opts:     opts,
+		mode:     mode,
+		records:  records,
+		expected: make(map[string][][]byte),
+		done:     make(chan struct{}),
+	}
+	var end time.Duration
+	skippedResponse := hs == nil
+	for _, f := range frames {
+		end = f.Offset
+		if f.Direction != pipeline.Downstream {
+			continue
+		}
+		if !skippedResponse {
+			skippedResponse = true
+			continue
+		}
+		if pkt := p.packetIn(f.Data); pkt != nil {
+			key := p.key(pkt)
+			p.expected[key] = append(p.expected[key], pkt)
+			p.remaining++
+			p.result.Expected++
+		}
+	}
+	if p.remaining == 0 {
+		close(p.done)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	conn, err := opts.DialServer(ctx)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial server: %v", err)
+	}
+	defer conn.Close()
+	p.rwc = framed.NewReadWriteCloser(conn)
+	p.rwc.EnableBigFrames()
+
+	hello := frames[0].Data
+	if hs != nil && opts.Password != "" {
+		withPassword := *hs
+		withPassword.Password = opts.Password
+		if hello, err = protocol.EncodeHello(id, &withPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	if _, err := p.rwc.Write(hello); err != nil {
+		return nil, err
+	}
+	p.result.Sent++
+	if hs != nil {
+		if err := p.readHandshakeResponse(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.readDownstream()
+	}()
+
+	for _, f := range frames[1:] {
+		if f.Direction != pipeline.Upstream {
+			continue
+		}
+		time.Sleep(time.Until(start.Add(p.scale(f.Offset))))
+		if _, err := p.rwc.Write(f.Data); err != nil {
+			return nil, fmt.Errorf("unable to send frame: %v", err)
+		}
+		p.result.Sent++
+	}
+
+	timer := time.NewTimer(time.Until(start.Add(p.scale(end) + opts.Linger)))
+	select {
+	case <-p.done:
+		timer.Stop()
+	case <-timer.C:
+	}
+	conn.Close()
+	wg.Wait()
+
+	for _, pkts := range p.expected {
+		p.result.Missing = append(p.result.Missing, pkts...)
+	}
+	return &p.result, nil
+}
+
+// player is the state of a replay.
+type player struct {
+	opts      *Opts
+	mode      protocol.Mode
+	records   bool
+	rwc       *framed.ReadWriteCloser
+	result    Result
+	expected  map[string][][]byte
+	remaining int
+	done      chan struct{}
+}
+
+func (p *player) scale(offset time.Duration) time.Duration {
+	return time.Duration(float64(offset) / p.opts.Speed)
+}
+
+func (p *player) readHandshakeResponse(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(p.opts.Timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	b := make([]byte, protocol.MaxHelloSize)
+	n, err := p.rwc.Read(b)
+	if err != nil {
+		return fmt.Errorf("unable to read handshake response: %v", err)
+	}
+	resp, err := protocol.DecodeHandshakeResponse(b[:n])
+	if err != nil {
+		return err
+	}
+	if !resp.OK {
+		return pferrors.FromCode(resp.Code, resp.Error)
+	}
+	return nil
+}
+
+// readDownstream matches downstream packets against the expected ones until
+// the connection is closed.
+func (p *player) readDownstream() {
+	b := make([]byte, maxFrameSize)
+	for {
+		n, err := p.rwc.Read(b)
+		if err != nil {
+			return
+		}
+		pkt := p.packetIn(b[:n])
+		if pkt == nil {
+			continue
+		}
+		pkt = append([]byte(nil), pkt...)
+		p.result.Received++
+		key := p.key(pkt)
+		candidates := p.expected[key]
+		if len(candidates) == 0 {
+			p.result.Unexpected = append(p.result.Unexpected, pkt)
+			continue
+		}
+		p.result.Matched++
+		if len(candidates) == 1 {
+			delete(p.expected, key)
+		} else {
+			p.expected[key] = candidates[1:]
+		}
+		p.remaining--
+		if p.remaining == 0 {
+			close(p.done)
+		}
+	}
+}
+
+// packetIn returns the packet contained in a downstream frame, or nil if the
+// frame doesn't contain one.
+func (p *player) packetIn(frame []byte) []byte {
+	if !p.records {
+		return frame
+	}
+	record, err := protocol.DecodeRecord(frame)
+	if err != nil {
+		return nil
+	}
+	switch record.Type {
+	case protocol.RecordPacket, protocol.RecordSequencedPacket:
+		return record.Payload
+	default:
+		return nil
+	}
+}
+
+func (p *player) key(pkt []byte) string {
+	if p.opts.Normalize != nil {
+		pkt = p.opts.Normalize(p.mode, pkt)
+	}
+	return string(pkt)
+}
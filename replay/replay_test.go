@@ -0,0 +1,214 @@
+package replay
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+// udpPacket builds an IPv4 UDP packet with the given identification.
+func udpPacket(id uint16, payload []byte) []byte {
+	b := make([]byte, 28+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[4:], id)
+	b[8] = 64
+	b[9] = 17
+	copy(b[12:], []byte{10, 0, 0, 1})
+	copy(b[16:], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(b[20:], 53)
+	binary.BigEndian.PutUint16(b[22:], 5353)
+	binary.BigEndian.PutUint16(b[24:], uint16(8+len(payload)))
+	copy(b[28:], payload)
+	return b
+}
+
+// echoServer answers each packet with a UDP packet carrying the packet's
+// payload and an identification based on idBase.
+func echoServer(t *testing.T, idBase uint16) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rwc := framed.NewReadWriteCloser(conn)
+				rwc.EnableBigFrames()
+				b := make([]byte, 65536)
+				if _, err := rwc.Read(b); err != nil {
+					return
+				}
+				resp, _ := protocol.EncodeHandshakeResponse(&protocol.HandshakeResponse{OK: true})
+				rwc.Write(resp)
+				for id := idBase; ; id++ {
+					n, err := rwc.Read(b)
+					if err != nil {
+						return
+					}
+					record, err := protocol.DecodeRecord(b[:n])
+					if err != nil || record.Type != protocol.RecordPacket {
+						continue
+					}
+					rwc.Write(protocol.EncodePacket(udpPacket(id, record.Payload[28:])))
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func dialer(l net.Listener) func(ctx context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", l.Addr().String())
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := echoServer(t, 1)
+	defer server.Close()
+	recorder, err := NewRecorder(&RecorderOpts{DialServer: dialer(server), Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go recorder.Serve(l)
+
+	// run a session through the recorder
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rwc := framed.NewReadWriteCloser(conn)
+	rwc.EnableBigFrames()
+	hello, _ := protocol.EncodeHello("00000000-0000-0000-0000-000000000000", &protocol.Handshake{Records: true, Username: "user", Password: "secret"})
+	redacted, _ := protocol.EncodeHello("00000000-0000-0000-0000-000000000000", &protocol.Handshake{Records: true, Username: "user"})
+	rwc.Write(hello)
+	b := make([]byte, 65536)
+	if _, err := rwc.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"one", "two", "three"} {
+		rwc.Write(protocol.EncodePacket(udpPacket(0, []byte(payload))))
+		if _, err := rwc.Read(b); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rwc.Write(protocol.EncodePing(1))
+	conn.Close()
+
+	var frames []*Frame
+	for i := 0; i < 100 && len(frames) < 9; i++ {
+		time.Sleep(10 * time.Millisecond)
+		files, _ := filepath.Glob(filepath.Join(dir, "00000000-0000-0000-0000-000000000000-*.pfrec"))
+		if len(files) != 1 {
+			continue
+		}
+		info, err := os.Stat(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("Recording should only be readable by its owner, has mode %v", info.Mode())
+		}
+		file, err := os.Open(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(file)
+		if err == nil {
+			frames, _ = r.ReadAll()
+		}
+		file.Close()
+	}
+	if len(frames) != 9 {
+		t.Fatalf("Expected 9 recorded frames, got %d", len(frames))
+	}
+	if frames[0].Direction != pipeline.Upstream || string(frames[0].Data) != string(redacted) || frames[1].Direction != pipeline.Downstream {
+		t.Error("Recording should start with redacted hello and handshake response")
+	}
+	if frames[8].Offset < 30*time.Millisecond {
+		t.Errorf("Timing not recorded: %v", frames[8].Offset)
+	}
+
+	result, err := Replay(frames, &Opts{DialServer: dialer(server), Speed: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK() || result.Sent != 5 || result.Expected != 3 || result.Received != 3 || result.Matched != 3 {
+		t.Errorf("Replay against the same server should match: %+v", result)
+	}
+
+	changed := echoServer(t, 100)
+	defer changed.Close()
+	result, err = Replay(frames, &Opts{DialServer: dialer(changed), Speed: 10, Linger: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OK() || len(result.Missing) != 3 || len(result.Unexpected) != 3 {
+		t.Errorf("Replay against a different server should report differences: %+v", result)
+	}
+	result, err = Replay(frames, &Opts{DialServer: dialer(changed), Speed: 10, Normalize: IgnoreVolatile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK() || result.Matched != 3 {
+		t.Errorf("Replay ignoring volatile fields should match: %+v", result)
+	}
+}
+
+func TestRecorderRejectsInvalidID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recordings := filepath.Join(dir, "recordings")
+
+	server := echoServer(t, 1)
+	defer server.Close()
+	recorder, err := NewRecorder(&RecorderOpts{DialServer: dialer(server), Dir: recordings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		rwc := framed.NewReadWriteCloser(clientConn)
+		rwc.EnableBigFrames()
+		// as long as a client ID, but escapes the recording directory
+		rwc.Write([]byte("../escaped-0000-0000-0000-0000000000"))
+	}()
+	if err := recorder.record(serverConn); err == nil {
+		t.Error("Invalid client ID should be rejected")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "escaped*")); len(files) != 0 {
+		t.Errorf("Recording escaped its directory: %v", files)
+	}
+}
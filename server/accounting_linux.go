@@ -0,0 +1,29 @@
+package server
+
+import (
+	"time"
+)
+
+// account reports the session to the Accountant until the session terminates.
+func (c *client) account() {
+	accountant := c.tenant.Accountant
+	interval := c.s.opts.AccountingInterval
+	if c.auth.InterimInterval > 0 {
+		interval = c.auth.InterimInterval
+	}
+
+	accountant.AccountingStart(c.info(TerminateUnknown))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			accountant.AccountingUpdate(c.info(TerminateUnknown))
+		case <-c.done:
+			accountant.AccountingStop(c.info(c.cause))
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// AuthRequest contains the information a client presented when connecting.
+type AuthRequest struct {
+	ClientID   string
+	Username   string
+	Password   string
+	RemoteAddr net.Addr
+
+	// Tenant is the name of the tenant that the client selected, if any
+	Tenant string
+}
+
+// AuthResult contains the parameters that an Authenticator granted to a
+// session. Zero values mean that no limit applies.
+type AuthResult struct {
+	// SessionTimeout limits the total lifetime of the session
+	SessionTimeout time.Duration
+
+	// InterimInterval overrides Opts.AccountingInterval for the session
+	InterimInterval time.Duration
+
+	// UpstreamBytesPerSecond limits the rate at which the client can send data
+	UpstreamBytesPerSecond int64
+
+	// DownstreamBytesPerSecond limits the rate at which the client can receive data
+	DownstreamBytesPerSecond int64
+
+	// Quota overrides Opts.Quota for the session
+	Quota int64
+}
+
+// Authenticator authenticates clients during the handshake. Authenticate is
+// called for every new connection, including reconnections of existing
+// sessions. If it returns an error, the client is rejected.
+type Authenticator interface {
+	Authenticate(req *AuthRequest) (*AuthResult, error)
+}
+
+// Accountant is notified when sessions start, periodically while they're
+// running and when they stop. Calls for a given session are made in order on a
+// goroutine dedicated to that session, so implementations may block without
+// holding up packet processing.
+type Accountant interface {
+	AccountingStart(session *SessionInfo)
+
+	AccountingUpdate(session *SessionInfo)
+
+	AccountingStop(session *SessionInfo)
+}
+
+// TerminateCause explains why a session ended.
+type TerminateCause int
+
+const (
+	TerminateUnknown TerminateCause = iota
+	TerminateIdleTimeout
+	TerminateSessionTimeout
+	TerminateConnectionLost
+	TerminateQuotaExceeded
+)
+
+func (tc TerminateCause) String() string {
+	switch tc {
+	case TerminateIdleTimeout:
+		return "idle timeout"
+	case TerminateSessionTimeout:
+		return "session timeout"
+	case TerminateConnectionLost:
+		return "connection lost"
+	case TerminateQuotaExceeded:
+		return "quota exceeded"
+	default:
+		return "unknown"
+	}
+}
+
+// SessionInfo is a snapshot of a session. Upstream counters count traffic
+// from the client towards origins, downstream counters count traffic from
+// origins back to the client.
+type SessionInfo struct {
+	ClientID       string
+	Tenant         string
+	Username       string
+	RemoteAddr     net.Addr
+	Started        time.Time
+	Duration       time.Duration
+	BytesUp        int64
+	BytesDown      int64
+	PacketsUp      int64
+	PacketsDown    int64
+	TerminateCause TerminateCause
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"io"
+	"sync"
+
+	"github.com/getlantern/packetforward/tap"
+)
+
+// bridgeServer bridges an Ethernet mode session into a local bridge by way of
+// a dedicated TAP device.
+type bridgeServer struct {
+	c         *client
+	dev       *tap.Device
+	closeOnce sync.Once
+}
+
+func newBridgeServer(c *client, bridge string) (*bridgeServer, error) {
+	dev, err := tap.Open("pf%d", 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := tap.AddToBridge(bridge, dev.Name()); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	c.log.Debugf("Bridging into %v via %v", bridge, dev.Name())
+	return &bridgeServer{
+		c:   c,
+		dev: dev,
+	}, nil
+}
+
+// Serve copies frames between the client and the TAP device until the session
+// ends.
+func (bs *bridgeServer) Serve() error {
+	defer bs.Close()
+	go bs.copyFromDevice()
+
+	pool := bs.c.s.opts.BufferPool
+	for {
+		b := pool.GetSlice()
+		n, err := bs.c.Read(b)
+		if err != nil {
+			pool.PutSlice(b)
+			return err
+		}
+		if _, writeErr := bs.dev.Write(b.Bytes()[:n]); writeErr != nil {
+			bs.c.log.Debugf("Unable to write frame to %v: %v", bs.dev.Name(), writeErr)
+		}
+		pool.PutSlice(b)
+	}
+}
+
+func (bs *bridgeServer) copyFromDevice() {
+	pool := bs.c.s.opts.BufferPool
+	for {
+		b := pool.GetSlice()
+		n, err := bs.dev.Read(b.Bytes())
+		if err != nil {
+			pool.PutSlice(b)
+			if err != io.EOF {
+				bs.c.log.Debugf("Stopped reading from %v: %v", bs.dev.Name(), err)
+			}
+			return
+		}
+		_, writeErr := bs.c.Write(b.ResliceTo(n))
+		pool.PutSlice(b)
+		if writeErr != nil {
+			bs.Close()
+			return
+		}
+	}
+}
+
+// Close closes the TAP device, which also removes it from the bridge.
+func (bs *bridgeServer) Close() error {
+	var err error
+	bs.closeOnce.Do(func() {
+		err = bs.dev.Close()
+	})
+	return err
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/eventual"
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/pferrors"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+func TestCheckMode(t *testing.T) {
+	s := &server{opts: &Opts{}}
+	if err := s.checkMode(protocol.ModeIP); err != nil {
+		t.Errorf("IP mode should always be allowed: %v", err)
+	}
+	if err := s.checkMode(protocol.ModeEthernet); pferrors.Kind(err) != ErrPolicyDenied {
+		t.Errorf("Ethernet mode without a bridge should be denied by policy, got %v", err)
+	}
+	if err := s.checkMode("carrier-pigeon"); pferrors.Kind(err) != ErrPolicyDenied {
+		t.Errorf("Unknown modes should be denied by policy, got %v", err)
+	}
+	s.opts.Bridge = "br0"
+	if err := s.checkMode(protocol.ModeEthernet); err != nil {
+		t.Errorf("Ethernet mode with a bridge should be allowed: %v", err)
+	}
+}
+
+func TestModeNegotiation(t *testing.T) {
+	opts := &Opts{ReadBufferSize: DefaultReadBufferSize, HandshakeTimeout: DefaultHandshakeTimeout}
+	opts.IdleTimeout = time.Minute
+	s := &server{
+		opts:      opts,
+		log:       logging.FromGolog(log),
+		tenants:   make(map[string]*tenant),
+		clients:   make(map[string]*client),
+		starting:  make(map[string]chan struct{}),
+		exhausted: make(map[string]*exhaustedSession),
+	}
+	s.defaultTenant = s.newTenant(opts.defaultTenant())
+
+	handshake := func(id string, hs *protocol.Handshake) *protocol.HandshakeResponse {
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		go s.handle(serverConn, nil)
+		rwc := framed.NewReadWriteCloser(clientConn)
+		rwc.EnableBigFrames()
+		hello, err := protocol.EncodeHello(id, hs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rwc.Write(hello); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, protocol.MaxHelloSize)
+		n, err := rwc.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := protocol.DecodeHandshakeResponse(b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	ipID := "00000000-0000-0000-0000-000000000001"
+	if resp := handshake(ipID, &protocol.Handshake{Mode: protocol.ModeEthernet}); resp.OK || resp.Code != "policy_denied" {
+		t.Errorf("Ethernet mode without a bridge should be denied by policy: %+v", resp)
+	}
+	if err := pferrors.FromCode("policy_denied", "denied by policy: ethernet mode not enabled on this server"); pferrors.Kind(err) != ErrPolicyDenied {
+		t.Errorf("Client should see the rejection as denied by policy, got %v", err)
+	}
+
+	// existing sessions, which reconnecting clients reattach to without creating TAP devices
+	s.opts.Bridge = "br0"
+	ethernetID := "00000000-0000-0000-0000-000000000002"
+	for _, c := range []*client{
+		{id: ipID, key: ipID, mode: protocol.ModeIP},
+		{id: ethernetID, key: ethernetID, mode: protocol.ModeEthernet, records: true},
+	} {
+		c.tenant = s.defaultTenant
+		c.log = s.log.With("session", c.id)
+		c.started = time.Now()
+		c.auth = &AuthResult{}
+		c.s = s
+		c.framedConn = eventual.NewValue()
+		c.done = make(chan struct{})
+		c.markActive()
+		s.clients[c.key] = c
+	}
+
+	if resp := handshake(ipID, &protocol.Handshake{Mode: protocol.ModeEthernet}); resp.OK || resp.Code != "handshake_failed" {
+		t.Errorf("Reattaching with a different mode should fail: %+v", resp)
+	}
+	if resp := handshake(ipID, &protocol.Handshake{Records: true}); resp.OK || resp.Code != "handshake_failed" {
+		t.Errorf("Reattaching with different framing should fail: %+v", resp)
+	}
+	if resp := handshake(ethernetID, &protocol.Handshake{Mode: protocol.ModeEthernet}); resp.OK || resp.Code != "handshake_failed" {
+		t.Errorf("Reattaching without records should fail: %+v", resp)
+	}
+	if resp := handshake(ethernetID, &protocol.Handshake{Mode: protocol.ModeEthernet, Records: true}); !resp.OK {
+		t.Errorf("Reattaching with the same mode and framing should succeed: %+v", resp)
+	}
+	if resp := handshake(ipID, &protocol.Handshake{}); !resp.OK {
+		t.Errorf("Handshake without a mode should reattach to an IP session: %+v", resp)
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"github.com/getlantern/packetforward/pferrors"
+)
+
+// Errors that the server reports to clients and hooks. Authenticators and other
+// hooks can return them (optionally wrapped in a *pferrors.Error with a reason)
+// to control how the client classifies a rejection.
+var (
+	// ErrAuthRejected means that the client's credentials were rejected. Authenticators should
+	// only return it if they're sure that the credentials are wrong.
+	ErrAuthRejected = pferrors.ErrAuthRejected
+
+	// ErrAuthUnavailable means that the client couldn't be authenticated right now, for example
+	// because the authentication backend didn't respond, so the client should try again.
+	// Authenticator errors that aren't otherwise classified are treated as ErrAuthUnavailable.
+	ErrAuthUnavailable = pferrors.ErrAuthUnavailable
+
+	// ErrHandshakeFailed means that the client's handshake was inconsistent with its session
+	ErrHandshakeFailed = pferrors.ErrHandshakeFailed
+
+	// ErrSessionEvicted means that the server ended the session
+	ErrSessionEvicted = pferrors.ErrSessionEvicted
+
+	// ErrSessionTimeout means that the session exceeded the SessionTimeout granted by the
+	// Authenticator. It is an ErrSessionEvicted.
+	ErrSessionTimeout error = pferrors.New(ErrSessionEvicted, "session timed out", nil)
+
+	// ErrQuotaExceeded means that the session transferred more than its quota
+	ErrQuotaExceeded = pferrors.ErrQuotaExceeded
+
+	// ErrPolicyDenied means that server policy doesn't allow the requested session
+	ErrPolicyDenied = pferrors.ErrPolicyDenied
+)
+
+// Err returns the error that corresponds to tc, or nil if the session simply
+// lost its connection or hasn't ended.
+func (tc TerminateCause) Err() error {
+	switch tc {
+	case TerminateIdleTimeout:
+		return pferrors.New(ErrSessionEvicted, tc.String(), nil)
+	case TerminateSessionTimeout:
+		return ErrSessionTimeout
+	case TerminateQuotaExceeded:
+		return ErrQuotaExceeded
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"time"
+)
+
+// SessionEventType identifies the type of a SessionEvent.
+type SessionEventType string
+
+const (
+	// SessionStart happens when a client connects for the first time
+	SessionStart SessionEventType = "session_start"
+
+	// SessionReattach happens when a client reconnects to an existing session
+	SessionReattach SessionEventType = "session_reattach"
+
+	// SessionQuotaThreshold happens when a session's usage crosses one of the
+	// configured QuotaThresholds
+	SessionQuotaThreshold SessionEventType = "quota_threshold"
+
+	// SessionEnd happens when a session terminates
+	SessionEnd SessionEventType = "session_end"
+)
+
+// SessionEvent describes something that happened to a session.
+type SessionEvent struct {
+	Type    SessionEventType
+	Time    time.Time
+	Session *SessionInfo
+
+	// Threshold is the fraction of the quota that was crossed, only set for SessionQuotaThreshold
+	Threshold float64
+}
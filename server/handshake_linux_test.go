@@ -0,0 +1,61 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/pferrors"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+	opts := &Opts{ReadBufferSize: DefaultReadBufferSize, HandshakeTimeout: 50 * time.Millisecond}
+	s := &server{
+		opts:     opts,
+		log:      logging.FromGolog(log),
+		tenants:  make(map[string]*tenant),
+		clients:  make(map[string]*client),
+		starting: make(map[string]chan struct{}),
+	}
+	s.defaultTenant = s.newTenant(opts.defaultTenant())
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	handled := make(chan struct{})
+	go func() {
+		s.handle(serverConn, nil)
+		close(handled)
+	}()
+
+	// the client never sends its hello
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Silent client should have been disconnected")
+	}
+	if _, err := clientConn.Read(make([]byte, 1)); err == nil {
+		t.Error("Connection should have been closed")
+	}
+}
+
+func TestAuthenticateErrors(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		kind error
+	}{
+		{errors.New("did not respond after 3 attempts"), ErrAuthUnavailable},
+		{pferrors.New(ErrAuthRejected, "bad password", nil), ErrAuthRejected},
+		{ErrPolicyDenied, ErrPolicyDenied},
+	} {
+		err := tc.err
+		tn := &tenant{Tenant: &Tenant{Authenticator: authenticatorFunc(func(req *AuthRequest) (*AuthResult, error) {
+			return nil, err
+		})}}
+		_, authErr := tn.authenticate(&AuthRequest{})
+		if kind := pferrors.Kind(authErr); kind != tc.kind {
+			t.Errorf("Expected %v to be classified as %v, got %v", tc.err, tc.kind, kind)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HealthCheck is the result of a single health check.
+type HealthCheck struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+
+	// Detail describes what was checked and, if the check failed, why
+	Detail string `json:"detail,omitempty"`
+}
+
+// Health is the result of a liveness or readiness probe. It's OK if all of
+// its checks are.
+type Health struct {
+	OK     bool           `json:"ok"`
+	Checks []*HealthCheck `json:"checks"`
+}
+
+func (h *Health) add(name string, ok bool, detail string) {
+	h.Checks = append(h.Checks, &HealthCheck{Name: name, OK: ok, Detail: detail})
+	h.OK = h.OK && ok
+}
+
+// LivenessHandler serves the server's liveness (see Server.Liveness) as JSON,
+// with status 200 if the server is alive and 503 otherwise.
+func LivenessHandler(s Server) http.Handler {
+	return healthHandler(s.Liveness)
+}
+
+// ReadinessHandler serves the server's readiness (see Server.Readiness) as
+// JSON, with status 200 if the server is ready and 503 otherwise.
+func ReadinessHandler(s Server) http.Handler {
+	return healthHandler(s.Readiness)
+}
+
+func healthHandler(probe func() *Health) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		health := probe()
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Header().Set("Cache-Control", "no-store")
+		if !health.OK {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(resp).Encode(health)
+	})
+}
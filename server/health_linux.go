@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/gonat"
+)
+
+// routeTable is where Linux lists the IPv4 routes
+const routeTable = "/proc/net/route"
+
+// Liveness implements the method from Server.
+func (s *server) Liveness() *Health {
+	h := &Health{OK: true}
+	if s.closing() {
+		h.add("reaper", true, "server is shutting down")
+		return h
+	}
+	sinceReap := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&s.lastReap))
+	if sinceReap > 3*s.opts.ReapInterval {
+		h.add("reaper", false, fmt.Sprintf("session reaper hasn't run for %v, the server may be deadlocked", sinceReap.Round(time.Second)))
+	} else {
+		h.add("reaper", true, "")
+	}
+	return h
+}
+
+// Readiness implements the method from Server.
+func (s *server) Readiness() *Health {
+	h := &Health{OK: true}
+	if s.closing() {
+		h.add("shutdown", false, "server is shutting down")
+	} else {
+		h.add("shutdown", true, "")
+	}
+
+	listening := atomic.LoadInt64(&s.listening)
+	switch {
+	case listening == 0:
+		h.add("listener", false, "not serving any listener")
+	case atomic.LoadInt32(&s.acceptFailing) == 1:
+		h.add("listener", false, "accepting connections is failing")
+	default:
+		h.add("listener", true, fmt.Sprintf("serving %d listeners", listening))
+	}
+
+	ifNames, errs := s.egressInterfaces()
+	for _, ifName := range ifNames {
+		ok, detail := checkInterface(ifName)
+		h.add("egress "+ifName, ok, detail)
+	}
+	for _, err := range errs {
+		h.add("egress", false, err)
+	}
+
+	s.clientsMx.Lock()
+	sessions := len(s.clients)
+	s.clientsMx.Unlock()
+	if max := s.opts.ReadinessMaxSessions; max > 0 {
+		h.add("sessions", sessions < max, fmt.Sprintf("%d of %d sessions", sessions, max))
+	} else {
+		h.add("sessions", true, fmt.Sprintf("%d sessions", sessions))
+	}
+
+	if max := s.opts.ReadinessMaxHeapBytes; max > 0 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		h.add("memory", ms.HeapAlloc < max, fmt.Sprintf("%d of %d heap bytes", ms.HeapAlloc, max))
+	}
+	return h
+}
+
+func (s *server) closing() bool {
+	select {
+	case <-s.close:
+		return true
+	default:
+		return false
+	}
+}
+
+// egressInterfaces returns the distinct interfaces through which the server
+// and its tenants send traffic, and the distinct reasons why it couldn't
+// determine some of them.
+func (s *server) egressInterfaces() ([]string, []string) {
+	names := make(map[string]bool)
+	errs := make(map[string]bool)
+	for _, t := range append([]*tenant{s.defaultTenant}, s.orderedTenants...) {
+		name, err := egressInterface(t.natOpts)
+		if err != nil {
+			errs[err.Error()] = true
+		} else {
+			names[name] = true
+		}
+	}
+	return sortedKeys(names), sortedKeys(errs)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	result := make([]string, 0, len(m))
+	for key := range m {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// egressInterface returns the interface through which gonat sends traffic
+// with the given options. Like gonat, it prefers IFAddr to IFName and falls
+// back to the default route if neither is set.
+func egressInterface(opts *gonat.Opts) (string, error) {
+	if opts.IFAddr != "" {
+		return interfaceWithAddr(opts.IFAddr)
+	}
+	if opts.IFName != "" {
+		return opts.IFName, nil
+	}
+	file, err := os.Open(routeTable)
+	if err != nil {
+		return "", fmt.Errorf("unable to read routes: %v", err)
+	}
+	defer file.Close()
+	return defaultRouteInterface(file)
+}
+
+// interfaceWithAddr returns the interface that has the given address.
+func interfaceWithAddr(addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", fmt.Errorf("invalid egress address %v", addr)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no interface has egress address %v", addr)
+}
+
+// defaultRouteInterface returns the interface of the default route in a route
+// table formatted like /proc/net/route.
+func defaultRouteInterface(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Iface, Destination, Gateway, Flags, RefCnt, Use, Metric, Mask, ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 8 && fields[1] == "00000000" && fields[7] == "00000000" {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("unable to read routes: %v", err)
+	}
+	return "", errors.New("no egress interface configured and no default route")
+}
+
+// checkInterface checks that an interface exists, is up and has an address.
+func checkInterface(name string) (bool, string) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false, err.Error()
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return false, name + " is down"
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false, err.Error()
+	}
+	if len(addrs) == 0 {
+		return false, name + " has no addresses"
+	}
+	strs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+	}
+	return true, name + " is up with " + strings.Join(strs, ", ")
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/packetforward/logging"
+)
+
+func newHealthTestServer(opts *Opts) *server {
+	opts.IFName = "lo"
+	if opts.ReapInterval == 0 {
+		opts.ReapInterval = time.Second
+	}
+	s := &server{
+		opts:    opts,
+		log:     logging.FromGolog(log),
+		tenants: make(map[string]*tenant),
+		clients: make(map[string]*client),
+		close:   make(chan interface{}),
+		closed:  make(chan interface{}),
+	}
+	s.defaultTenant = s.newTenant(opts.defaultTenant())
+	for _, tc := range opts.Tenants {
+		s.tenants[tc.Name] = s.newTenant(tc)
+		s.orderedTenants = append(s.orderedTenants, s.tenants[tc.Name])
+	}
+	atomic.StoreInt64(&s.lastReap, time.Now().UnixNano())
+	atomic.StoreInt64(&s.listening, 1)
+	return s
+}
+
+func failedChecks(h *Health) map[string]string {
+	failed := make(map[string]string)
+	for _, check := range h.Checks {
+		if !check.OK {
+			failed[check.Name] = check.Detail
+		}
+	}
+	return failed
+}
+
+func TestReadiness(t *testing.T) {
+	s := newHealthTestServer(&Opts{ReadinessMaxSessions: 2})
+	if h := s.Readiness(); !h.OK {
+		t.Fatalf("Server should be ready, failed checks: %v", failedChecks(h))
+	}
+
+	s.clients["a"] = &client{}
+	s.clients["b"] = &client{}
+	if failed := failedChecks(s.Readiness()); len(failed) != 1 || failed["sessions"] != "2 of 2 sessions" {
+		t.Errorf("Only sessions should fail, got %v", failed)
+	}
+	s.clients = make(map[string]*client)
+
+	atomic.StoreInt32(&s.acceptFailing, 1)
+	if _, failed := failedChecks(s.Readiness())["listener"]; !failed {
+		t.Error("Failing accepts should fail the listener check")
+	}
+	atomic.StoreInt32(&s.acceptFailing, 0)
+	atomic.StoreInt64(&s.listening, 0)
+	if _, failed := failedChecks(s.Readiness())["listener"]; !failed {
+		t.Error("Not serving a listener should fail the listener check")
+	}
+	atomic.StoreInt64(&s.listening, 1)
+
+	s.opts.ReadinessMaxHeapBytes = 1
+	if _, failed := failedChecks(s.Readiness())["memory"]; !failed {
+		t.Error("Exceeding the heap limit should fail the memory check")
+	}
+	s.opts.ReadinessMaxHeapBytes = 0
+
+	close(s.close)
+	if failed := failedChecks(s.Readiness()); len(failed) != 1 || failed["shutdown"] == "" {
+		t.Errorf("Only shutdown should fail, got %v", failed)
+	}
+}
+
+func TestReadinessEgress(t *testing.T) {
+	s := newHealthTestServer(&Opts{Tenants: []*Tenant{{Name: "acme", IFName: "nonexistent0"}, {Name: "initech"}}})
+	h := s.Readiness()
+	failed := failedChecks(h)
+	if len(failed) != 1 || failed["egress nonexistent0"] == "" {
+		t.Errorf("Only the missing interface should fail, got %v", failed)
+	}
+	var checkedLoopback bool
+	for _, check := range h.Checks {
+		if check.Name == "egress lo" {
+			checkedLoopback = true
+		}
+	}
+	if !checkedLoopback {
+		t.Error("Default interface should be checked once")
+	}
+}
+
+func TestReadinessEgressWithoutIFName(t *testing.T) {
+	s := newHealthTestServer(&Opts{})
+	s.opts.IFName = ""
+	s.opts.IFAddr = "127.0.0.1"
+	if failed := failedChecks(s.Readiness()); len(failed) != 0 {
+		t.Errorf("Interface with the egress address should be checked, got failures %v", failed)
+	}
+	s.opts.IFAddr = "192.0.2.1"
+	if failed := failedChecks(s.Readiness()); len(failed) != 1 || failed["egress"] == "" {
+		t.Errorf("Only the egress address without an interface should fail, got %v", failed)
+	}
+
+	routes := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth1\t000200C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+		"eth0\t00000000\t010200C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n"
+	if name, err := defaultRouteInterface(strings.NewReader(routes)); err != nil || name != "eth0" {
+		t.Errorf("Expected default route through eth0, got %v, %v", name, err)
+	}
+	if _, err := defaultRouteInterface(strings.NewReader(strings.Split(routes, "eth0")[0])); err == nil {
+		t.Error("Route table without default route should fail")
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	s := newHealthTestServer(&Opts{})
+	if h := s.Liveness(); !h.OK {
+		t.Fatalf("Server should be alive, failed checks: %v", failedChecks(h))
+	}
+	atomic.StoreInt64(&s.lastReap, time.Now().Add(-time.Minute).UnixNano())
+	if _, failed := failedChecks(s.Liveness())["reaper"]; !failed {
+		t.Error("Stalled reaper should fail liveness")
+	}
+	close(s.close)
+	if h := s.Liveness(); !h.OK {
+		t.Error("Server that's shutting down should still be alive")
+	}
+}
+
+func TestHealthHandlers(t *testing.T) {
+	s := newHealthTestServer(&Opts{ReadinessMaxSessions: 1})
+	s.clients["a"] = &client{}
+
+	get := func(handler http.Handler) (int, *Health) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Unexpected content type %v", ct)
+		}
+		h := &Health{}
+		if err := json.NewDecoder(rec.Body).Decode(h); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, h
+	}
+
+	if code, h := get(LivenessHandler(s)); code != http.StatusOK || !h.OK {
+		t.Errorf("Liveness should be OK, got %d %v", code, failedChecks(h))
+	}
+	code, h := get(ReadinessHandler(s))
+	if code != http.StatusServiceUnavailable || h.OK {
+		t.Errorf("Readiness should be unavailable, got %d", code)
+	}
+	if detail := failedChecks(h)["sessions"]; detail != "1 of 1 sessions" {
+		t.Errorf("Unexpected sessions detail %q", detail)
+	}
+}
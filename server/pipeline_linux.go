@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/oxtoacart/bpool"
+)
+
+// checkPipeline rejects pipelines with handlers that respond to downstream
+// packets, since the server can't send responses towards origins.
+func checkPipeline(chain *pipeline.Chain) error {
+	if chain == nil {
+		return nil
+	}
+	if names := chain.Responders(pipeline.Downstream); len(names) > 0 {
+		return fmt.Errorf("pipeline handlers %v respond to downstream packets, which the server doesn't support", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// processUpstream runs a packet read from the client through the pipeline. It
+// returns the packet's possibly rewritten length, or false if the packet
+// shouldn't be forwarded.
+func (c *client) processUpstream(b bpool.ByteSlice, n int) (int, bool, error) {
+	pkt := &pipeline.Packet{
+		Direction: pipeline.Upstream,
+		ClientID:  c.id,
+		Username:  c.username,
+		Mode:      c.mode,
+		Data:      b.Bytes()[:n],
+	}
+	switch c.tenant.Pipeline.Process(pkt) {
+	case pipeline.Drop:
+		return 0, false, nil
+	case pipeline.Respond:
+		for _, response := range pkt.Responses {
+			frame := response
+			if c.records {
+				frame = c.encodeRecord(response)
+			}
+			if _, err := c.write(bpool.ByteSlice{}, frame, len(response)); err != nil {
+				return 0, false, err
+			}
+		}
+		return 0, false, nil
+	case pipeline.Rewrite:
+		if len(pkt.Data) > len(b.Bytes()) {
+			c.log.Debugf("Dropping rewritten packet of %d bytes, which exceeds buffer size of %d", len(pkt.Data), len(b.Bytes()))
+			return 0, false, nil
+		}
+		return copy(b.Bytes(), pkt.Data), true, nil
+	default:
+		return n, true, nil
+	}
+}
+
+// processDownstream runs a packet destined for the client through the
+// pipeline. It returns the rewritten packet along with Rewrite, Pass or Drop.
+func (c *client) processDownstream(data []byte) ([]byte, pipeline.Verdict) {
+	pkt := &pipeline.Packet{
+		Direction: pipeline.Downstream,
+		ClientID:  c.id,
+		Username:  c.username,
+		Mode:      c.mode,
+		Data:      data,
+	}
+	switch c.tenant.Pipeline.Process(pkt) {
+	case pipeline.Drop:
+		return nil, pipeline.Drop
+	case pipeline.Respond:
+		if atomic.CompareAndSwapInt32(&c.respondedDownstream, 0, 1) {
+			c.log.Errorf("Dropping downstream packets that the pipeline responds to, responding to downstream packets isn't supported")
+		}
+		return nil, pipeline.Drop
+	case pipeline.Rewrite:
+		if len(pkt.Data) == 0 {
+			return nil, pipeline.Drop
+		}
+		return pkt.Data, pipeline.Rewrite
+	default:
+		return data, pipeline.Pass
+	}
+}
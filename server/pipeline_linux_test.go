@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/eventual"
+	"github.com/getlantern/framed"
+	"github.com/getlantern/gonat"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/pipeline"
+)
+
+func TestPipeline(t *testing.T) {
+	chain := pipeline.New().
+		UseFunc("drop", func(pkt *pipeline.Packet) pipeline.Verdict {
+			if bytes.HasPrefix(pkt.Data, []byte("drop")) {
+				return pipeline.Drop
+			}
+			return pipeline.Pass
+		}).
+		UseFunc("ping", func(pkt *pipeline.Packet) pipeline.Verdict {
+			if pkt.Direction == pipeline.Upstream && string(pkt.Data) == "ping" {
+				return pkt.Respond([]byte("pong"))
+			}
+			return pipeline.Pass
+		}).
+		UseFunc("shout", func(pkt *pipeline.Packet) pipeline.Verdict {
+			if pkt.Direction == pipeline.Downstream {
+				pkt.Data = bytes.ToUpper(pkt.Data)
+				return pipeline.Rewrite
+			}
+			return pipeline.Pass
+		})
+	s := &server{
+		opts:    &Opts{Pipeline: chain},
+		log:     logging.FromGolog(log),
+		clients: make(map[string]*client),
+	}
+	s.opts.BufferPool = framed.NewHeaderPreservingBufferPool(DefaultBufferPoolSize, gonat.MaximumIPPacketSize, true)
+	s.opts.IdleTimeout = time.Minute
+	s.defaultTenant = s.newTenant(s.opts.defaultTenant())
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	serverFramed := framed.NewReadWriteCloser(serverConn)
+	serverFramed.EnableBigFrames()
+	clientFramed := framed.NewReadWriteCloser(clientConn)
+	clientFramed.EnableBigFrames()
+
+	efc := eventual.NewValue()
+	efc.Set(serverFramed)
+	c := &client{
+		id:         "client",
+		key:        "client",
+		tenant:     s.defaultTenant,
+		log:        s.log.With("session", "client"),
+		started:    time.Now(),
+		auth:       &AuthResult{},
+		s:          s,
+		framedConn: efc,
+		done:       make(chan struct{}),
+	}
+	c.markActive()
+
+	received := make(chan string, 10)
+	go func() {
+		b := make([]byte, 100)
+		for {
+			n, err := clientFramed.Read(b)
+			if err != nil {
+				return
+			}
+			received <- string(b[:n])
+		}
+	}()
+	go func() {
+		for _, pkt := range []string{"drop this", "ping", "data"} {
+			clientFramed.Write([]byte(pkt))
+		}
+	}()
+
+	b := s.opts.BufferPool.GetSlice()
+	n, err := c.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b.Bytes()[:n]) != "data" {
+		t.Errorf("Expected only passed packet to be read, got %q", b.Bytes()[:n])
+	}
+	if response := <-received; response != "pong" {
+		t.Errorf("Expected response to ping, got %q", response)
+	}
+
+	for _, pkt := range []string{"drop me too", "hello"} {
+		b := s.opts.BufferPool.GetSlice()
+		b = b.ResliceTo(copy(b.Bytes(), pkt))
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if downstream := <-received; downstream != "HELLO" {
+		t.Errorf("Expected rewritten downstream packet, got %q", downstream)
+	}
+
+	stats := chain.Stats()
+	if stats[0].Dropped != 2 || stats[1].Responded != 1 || stats[2].Rewritten != 1 {
+		t.Errorf("Wrong stats: %+v %+v %+v", stats[0], stats[1], stats[2])
+	}
+}
+
+// exclusiveConn records whether writes to it ever overlap.
+type exclusiveConn struct {
+	net.Conn
+	writing    int32
+	overlapped int32
+}
+
+func (c *exclusiveConn) Write(b []byte) (int, error) {
+	if !atomic.CompareAndSwapInt32(&c.writing, 0, 1) {
+		atomic.StoreInt32(&c.overlapped, 1)
+		return c.Conn.Write(b)
+	}
+	defer atomic.StoreInt32(&c.writing, 0)
+	return c.Conn.Write(b)
+}
+
+func TestPipelineRespondWhileWriting(t *testing.T) {
+	chain := pipeline.New().
+		UseFunc("ping", func(pkt *pipeline.Packet) pipeline.Verdict {
+			if pkt.Direction == pipeline.Upstream && string(pkt.Data) == "ping" {
+				return pkt.Respond([]byte("pong"))
+			}
+			return pipeline.Pass
+		})
+	s := &server{
+		opts:    &Opts{Pipeline: chain},
+		log:     logging.FromGolog(log),
+		clients: make(map[string]*client),
+	}
+	s.opts.BufferPool = framed.NewHeaderPreservingBufferPool(DefaultBufferPoolSize, gonat.MaximumIPPacketSize, true)
+	s.opts.IdleTimeout = time.Minute
+	s.defaultTenant = s.newTenant(s.opts.defaultTenant())
+
+	pipeServer, clientConn := net.Pipe()
+	serverConn := &exclusiveConn{Conn: pipeServer}
+	defer serverConn.Close()
+	defer clientConn.Close()
+	serverFramed := framed.NewReadWriteCloser(serverConn)
+	serverFramed.EnableBigFrames()
+	serverFramed.DisableThreadSafety()
+	clientFramed := framed.NewReadWriteCloser(clientConn)
+	clientFramed.EnableBigFrames()
+
+	efc := eventual.NewValue()
+	efc.Set(serverFramed)
+	c := &client{
+		id:         "client",
+		key:        "client",
+		tenant:     s.defaultTenant,
+		log:        s.log.With("session", "client"),
+		started:    time.Now(),
+		auth:       &AuthResult{},
+		s:          s,
+		framedConn: efc,
+		done:       make(chan struct{}),
+	}
+	c.markActive()
+
+	const count = 100
+	received := make(chan string, 2*count)
+	go func() {
+		b := make([]byte, 100)
+		for {
+			n, err := clientFramed.Read(b)
+			if err != nil {
+				return
+			}
+			received <- string(b[:n])
+		}
+	}()
+	go func() {
+		for i := 0; i < count; i++ {
+			clientFramed.Write([]byte("ping"))
+		}
+		clientFramed.Write([]byte("data"))
+	}()
+	go func() {
+		// answers all pings before returning the data packet
+		c.Read(s.opts.BufferPool.GetSlice())
+	}()
+
+	go func() {
+		for i := 0; i < count; i++ {
+			b := s.opts.BufferPool.GetSlice()
+			b = b.ResliceTo(copy(b.Bytes(), "down"))
+			if _, err := c.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	counts := make(map[string]int)
+	for i := 0; i < 2*count; i++ {
+		select {
+		case frame := <-received:
+			counts[frame]++
+		case <-time.After(5 * time.Second):
+			// overlapping writes corrupt the framing, which stalls the reader
+			t.Fatalf("Timed out after receiving %v, writes overlapped: %v", counts, atomic.LoadInt32(&serverConn.overlapped) == 1)
+		}
+	}
+	if counts["pong"] != count || counts["down"] != count {
+		t.Errorf("Expected %d intact pongs and downstream packets, got %v", count, counts)
+	}
+	if atomic.LoadInt32(&serverConn.overlapped) == 1 {
+		t.Error("Writes to the session's connection overlapped")
+	}
+}
+
+type downstreamResponder struct {
+	pipeline.HandlerFunc
+}
+
+func (r downstreamResponder) RespondsTo(direction pipeline.Direction) bool {
+	return direction == pipeline.Downstream
+}
+
+func TestPipelineRespondDownstream(t *testing.T) {
+	respond := func(pkt *pipeline.Packet) pipeline.Verdict {
+		return pkt.Respond([]byte("response"))
+	}
+	declared := pipeline.New().Use("responder", downstreamResponder{pipeline.HandlerFunc(respond)})
+	if err := checkPipeline(declared); err == nil {
+		t.Error("Pipeline that responds to downstream packets should be rejected")
+	}
+	if err := validateTenants([]*Tenant{{Name: "acme", Pipeline: declared}}); err == nil {
+		t.Error("Tenant pipeline that responds to downstream packets should be rejected")
+	}
+	if err := checkPipeline(pipeline.New().UseFunc("undeclared", respond)); err != nil {
+		t.Errorf("Pipeline without declared downstream responders should be accepted: %v", err)
+	}
+
+	s := &server{
+		opts:    &Opts{Pipeline: pipeline.New().UseFunc("undeclared", respond)},
+		log:     logging.FromGolog(log),
+		clients: make(map[string]*client),
+	}
+	s.defaultTenant = s.newTenant(s.opts.defaultTenant())
+	c := &client{id: "client", tenant: s.defaultTenant, log: s.log.With("session", "client"), s: s}
+	if _, verdict := c.processDownstream([]byte("data")); verdict != pipeline.Drop {
+		t.Errorf("Downstream packet that can't be answered should be dropped, got %v", verdict)
+	}
+	if atomic.LoadInt32(&c.respondedDownstream) != 1 {
+		t.Error("Responding to downstream packets should be reported")
+	}
+}
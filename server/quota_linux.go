@@ -0,0 +1,66 @@
+package server
+
+import (
+	"time"
+)
+
+// exhaustedSession remembers a session that used up its per-session quota, so
+// that its client can't get a fresh quota by reconnecting with the same ID.
+// Like the session would have, it ends once the client has stayed away for
+// IdleTimeout or at the session's SessionTimeout.
+type exhaustedSession struct {
+	lastActive time.Time
+	expires    time.Time
+}
+
+func (e *exhaustedSession) ended(now time.Time, idleTimeout time.Duration) bool {
+	return now.Sub(e.lastActive) > idleTimeout || (!e.expires.IsZero() && now.After(e.expires))
+}
+
+// rememberExhausted remembers that the given session used up its per-session
+// quota. Daily and monthly quotas don't need this, because they're checked
+// against the UsageStore when clients connect.
+func (s *server) rememberExhausted(c *client) {
+	if c.tenant.QuotaPeriod != 0 {
+		return
+	}
+	e := &exhaustedSession{lastActive: time.Now()}
+	if c.auth.SessionTimeout > 0 {
+		e.expires = c.started.Add(c.auth.SessionTimeout)
+	}
+	s.clientsMx.Lock()
+	s.exhausted[c.key] = e
+	s.clientsMx.Unlock()
+}
+
+// sessionQuotaExhausted checks whether the session with the given key used up
+// its per-session quota and would still be running. Attempts to reconnect
+// count as activity, so clients have to stay away for IdleTimeout before they
+// get a new session.
+func (s *server) sessionQuotaExhausted(key string) bool {
+	now := time.Now()
+	s.clientsMx.Lock()
+	defer s.clientsMx.Unlock()
+	e := s.exhausted[key]
+	if e == nil {
+		return false
+	}
+	if e.ended(now, s.opts.IdleTimeout) {
+		delete(s.exhausted, key)
+		return false
+	}
+	e.lastActive = now
+	return true
+}
+
+// forgetEndedExhausted forgets exhausted sessions that have ended.
+func (s *server) forgetEndedExhausted() {
+	now := time.Now()
+	s.clientsMx.Lock()
+	for key, e := range s.exhausted {
+		if e.ended(now, s.opts.IdleTimeout) {
+			delete(s.exhausted, key)
+		}
+	}
+	s.clientsMx.Unlock()
+}
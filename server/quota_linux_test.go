@@ -0,0 +1,179 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/eventual"
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/protocol"
+	"github.com/getlantern/packetforward/server/usage"
+)
+
+func TestSessionQuotaSurvivesReconnect(t *testing.T) {
+	opts := &Opts{
+		ReadBufferSize:   DefaultReadBufferSize,
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		Quota:            10,
+	}
+	opts.IdleTimeout = time.Minute
+	s := &server{
+		opts:      opts,
+		log:       logging.FromGolog(log),
+		tenants:   make(map[string]*tenant),
+		clients:   make(map[string]*client),
+		starting:  make(map[string]chan struct{}),
+		exhausted: make(map[string]*exhaustedSession),
+	}
+	s.defaultTenant = s.newTenant(opts.defaultTenant())
+
+	id := "00000000-0000-0000-0000-000000000000"
+	c := &client{
+		id:         id,
+		key:        id,
+		tenant:     s.defaultTenant,
+		log:        s.log.With("session", id),
+		started:    time.Now(),
+		auth:       &AuthResult{},
+		quota:      opts.Quota,
+		bytesUp:    opts.Quota,
+		s:          s,
+		framedConn: eventual.NewValue(),
+		done:       make(chan struct{}),
+	}
+	c.markActive()
+	s.clients[id] = c
+	c.finished(ErrQuotaExceeded)
+	if c.cause != TerminateQuotaExceeded {
+		t.Fatalf("Wrong terminate cause %v", c.cause)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go s.handle(serverConn, nil)
+	rwc := framed.NewReadWriteCloser(clientConn)
+	rwc.EnableBigFrames()
+	hello, err := protocol.EncodeHello(id, &protocol.Handshake{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rwc.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, protocol.MaxHelloSize)
+	n, err := rwc.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := protocol.DecodeHandshakeResponse(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.OK || resp.Code != "quota_exceeded" {
+		t.Errorf("Reconnecting client should get no new quota: %+v", resp)
+	}
+
+	s.exhausted[id].lastActive = time.Now().Add(-2 * opts.IdleTimeout)
+	s.reapOnce()
+	if s.sessionQuotaExhausted(id) {
+		t.Error("Client that stayed away for IdleTimeout should get a new session")
+	}
+}
+
+func TestPeriodQuotaAcrossSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal, err := usage.OpenJournal(filepath.Join(dir, "usage.journal"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	opts := &Opts{
+		ReadBufferSize:   DefaultReadBufferSize,
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		Quota:            10,
+		QuotaPeriod:      usage.PeriodDay,
+		UsageStore:       journal,
+	}
+	opts.IdleTimeout = time.Minute
+	s := &server{
+		opts:      opts,
+		log:       logging.FromGolog(log),
+		tenants:   make(map[string]*tenant),
+		clients:   make(map[string]*client),
+		starting:  make(map[string]chan struct{}),
+		exhausted: make(map[string]*exhaustedSession),
+	}
+	s.defaultTenant = s.newTenant(opts.defaultTenant())
+
+	id := "00000000-0000-0000-0000-000000000000"
+	newSession := func() *client {
+		c := &client{
+			id:         id,
+			key:        id,
+			tenant:     s.defaultTenant,
+			log:        s.log.With("session", id),
+			started:    time.Now(),
+			auth:       &AuthResult{},
+			quota:      opts.Quota,
+			s:          s,
+			framedConn: eventual.NewValue(),
+			done:       make(chan struct{}),
+		}
+		c.refreshPeriodUsage(time.Now(), 0)
+		return c
+	}
+
+	first := newSession()
+	atomic.AddInt64(&first.bytesUp, 6)
+	first.flushUsage()
+	if first.overQuota() {
+		t.Fatal("First session shouldn't be over quota yet")
+	}
+
+	// the client reconnects and gets a new session
+	second := newSession()
+	if second.overQuota() {
+		t.Fatal("Second session shouldn't start over quota")
+	}
+	atomic.AddInt64(&second.bytesDown, 4)
+	if !second.overQuota() {
+		t.Error("Usage of the first session should count toward the second session's daily quota")
+	}
+	second.flushUsage()
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go s.handle(serverConn, nil)
+	rwc := framed.NewReadWriteCloser(clientConn)
+	rwc.EnableBigFrames()
+	hello, err := protocol.EncodeHello(id, &protocol.Handshake{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rwc.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, protocol.MaxHelloSize)
+	n, err := rwc.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := protocol.DecodeHandshakeResponse(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.OK || resp.Code != "quota_exceeded" {
+		t.Errorf("Client that used up its daily quota should be rejected: %+v", resp)
+	}
+}
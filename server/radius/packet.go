@@ -0,0 +1,297 @@
+package radius
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/getlantern/errors"
+)
+
+// Packet codes (RFC 2865 and RFC 2866)
+const (
+	CodeAccessRequest      = 1
+	CodeAccessAccept       = 2
+	CodeAccessReject       = 3
+	CodeAccountingRequest  = 4
+	CodeAccountingResponse = 5
+)
+
+// Attribute types (RFC 2865, RFC 2866 and RFC 2869)
+const (
+	AttrUserName             = 1
+	AttrUserPassword         = 2
+	AttrReplyMessage         = 18
+	AttrVendorSpecific       = 26
+	AttrSessionTimeout       = 27
+	AttrCallingStationID     = 31
+	AttrNASIdentifier        = 32
+	AttrAcctStatusType       = 40
+	AttrAcctInputOctets      = 42
+	AttrAcctOutputOctets     = 43
+	AttrAcctSessionID        = 44
+	AttrAcctSessionTime      = 46
+	AttrAcctInputPackets     = 47
+	AttrAcctOutputPackets    = 48
+	AttrAcctTerminateCause   = 49
+	AttrAcctInputGigawords   = 52
+	AttrAcctOutputGigawords  = 53
+	AttrMessageAuthenticator = 80
+	AttrAcctInterimInterval  = 85
+)
+
+// Acct-Status-Type values
+const (
+	AcctStatusStart         = 1
+	AcctStatusStop          = 2
+	AcctStatusInterimUpdate = 3
+)
+
+// Acct-Terminate-Cause values
+const (
+	TerminateCauseLostCarrier    = 2
+	TerminateCauseIdleTimeout    = 4
+	TerminateCauseSessionTimeout = 5
+	TerminateCauseNASRequest     = 10
+)
+
+// WISPr vendor specific attributes, which are the de facto standard for
+// communicating bandwidth limits (in bits per second).
+const (
+	VendorWISPr           = 14122
+	WISPrBandwidthMaxUp   = 7
+	WISPrBandwidthMaxDown = 8
+)
+
+const (
+	headerLength               = 20
+	authenticatorLength        = 16
+	maxPacketLength            = 4096
+	messageAuthenticatorLength = 16
+)
+
+// Attribute is a single RADIUS attribute
+type Attribute struct {
+	Type  byte
+	Value []byte
+}
+
+// Packet is a RADIUS packet
+type Packet struct {
+	Code          byte
+	Identifier    byte
+	Authenticator [authenticatorLength]byte
+	Attributes    []Attribute
+}
+
+// Add adds an attribute to the packet
+func (p *Packet) Add(typ byte, value []byte) {
+	p.Attributes = append(p.Attributes, Attribute{Type: typ, Value: value})
+}
+
+// AddString adds a string attribute to the packet
+func (p *Packet) AddString(typ byte, value string) {
+	p.Add(typ, []byte(value))
+}
+
+// AddUint32 adds an integer attribute to the packet
+func (p *Packet) AddUint32(typ byte, value uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	p.Add(typ, b)
+}
+
+// Get returns the value of the first attribute of the given type, or nil
+func (p *Packet) Get(typ byte) []byte {
+	for _, attr := range p.Attributes {
+		if attr.Type == typ {
+			return attr.Value
+		}
+	}
+	return nil
+}
+
+// GetUint32 returns the value of the first integer attribute of the given type
+func (p *Packet) GetUint32(typ byte) (uint32, bool) {
+	value := p.Get(typ)
+	if len(value) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(value), true
+}
+
+// GetVendorUint32 returns the value of the first integer vendor specific
+// attribute of the given vendor and type.
+func (p *Packet) GetVendorUint32(vendor uint32, typ byte) (uint32, bool) {
+	for _, attr := range p.Attributes {
+		if attr.Type != AttrVendorSpecific || len(attr.Value) < 6 || binary.BigEndian.Uint32(attr.Value) != vendor {
+			continue
+		}
+		// a single Vendor-Specific attribute may contain several sub-attributes
+		sub := attr.Value[4:]
+		for len(sub) >= 2 {
+			subLength := int(sub[1])
+			if subLength < 2 || subLength > len(sub) {
+				break
+			}
+			if sub[0] == typ && subLength == 6 {
+				return binary.BigEndian.Uint32(sub[2:6]), true
+			}
+			sub = sub[subLength:]
+		}
+	}
+	return 0, false
+}
+
+// AddVendorUint32 adds an integer vendor specific attribute to the packet
+func (p *Packet) AddVendorUint32(vendor uint32, typ byte, value uint32) {
+	b := make([]byte, 10)
+	binary.BigEndian.PutUint32(b, vendor)
+	b[4] = typ
+	b[5] = 6
+	binary.BigEndian.PutUint32(b[6:], value)
+	p.Add(AttrVendorSpecific, b)
+}
+
+// Encode encodes the packet to its wire format
+func (p *Packet) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(p.Code)
+	buf.WriteByte(p.Identifier)
+	buf.Write([]byte{0, 0})
+	buf.Write(p.Authenticator[:])
+	for _, attr := range p.Attributes {
+		if len(attr.Value) > 253 {
+			return nil, errors.New("attribute %d too long: %d", attr.Type, len(attr.Value))
+		}
+		buf.WriteByte(attr.Type)
+		buf.WriteByte(byte(len(attr.Value) + 2))
+		buf.Write(attr.Value)
+	}
+	b := buf.Bytes()
+	if len(b) > maxPacketLength {
+		return nil, errors.New("packet too long: %d", len(b))
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	return b, nil
+}
+
+// Decode decodes a packet from its wire format
+func Decode(b []byte) (*Packet, error) {
+	if len(b) < headerLength {
+		return nil, errors.New("packet too short: %d", len(b))
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length < headerLength || length > len(b) {
+		return nil, errors.New("invalid packet length %d", length)
+	}
+	p := &Packet{
+		Code:       b[0],
+		Identifier: b[1],
+	}
+	copy(p.Authenticator[:], b[4:headerLength])
+	attrs := b[headerLength:length]
+	for len(attrs) > 0 {
+		if len(attrs) < 2 {
+			return nil, errors.New("truncated attribute")
+		}
+		attrLength := int(attrs[1])
+		if attrLength < 2 || attrLength > len(attrs) {
+			return nil, errors.New("invalid attribute length %d", attrLength)
+		}
+		value := make([]byte, attrLength-2)
+		copy(value, attrs[2:attrLength])
+		p.Add(attrs[0], value)
+		attrs = attrs[attrLength:]
+	}
+	return p, nil
+}
+
+// newAccessRequest builds an Access-Request with a random request authenticator
+// and the given user's password hidden using the shared secret.
+func newAccessRequest(identifier byte, secret []byte, username, password string) (*Packet, error) {
+	p := &Packet{
+		Code:       CodeAccessRequest,
+		Identifier: identifier,
+	}
+	if _, err := rand.Read(p.Authenticator[:]); err != nil {
+		return nil, errors.New("unable to generate request authenticator: %v", err)
+	}
+	p.AddString(AttrUserName, username)
+	p.Add(AttrUserPassword, hidePassword([]byte(password), secret, p.Authenticator[:]))
+	return p, nil
+}
+
+// encodeAccessRequest encodes an Access-Request, signing it with a
+// Message-Authenticator (RFC 3579 section 3.2).
+func encodeAccessRequest(p *Packet, secret []byte) ([]byte, error) {
+	p.Add(AttrMessageAuthenticator, make([]byte, messageAuthenticatorLength))
+	b, err := p.Encode()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(md5.New, secret)
+	mac.Write(b)
+	// Message-Authenticator is the last attribute
+	copy(b[len(b)-messageAuthenticatorLength:], mac.Sum(nil))
+	return b, nil
+}
+
+// encodeAccountingRequest encodes an Accounting-Request, computing its request
+// authenticator (RFC 2866 section 3).
+func encodeAccountingRequest(p *Packet, secret []byte) ([]byte, error) {
+	p.Authenticator = [authenticatorLength]byte{}
+	b, err := p.Encode()
+	if err != nil {
+		return nil, err
+	}
+	h := md5.New()
+	h.Write(b)
+	h.Write(secret)
+	copy(b[4:headerLength], h.Sum(nil))
+	copy(p.Authenticator[:], b[4:headerLength])
+	return b, nil
+}
+
+// verifyResponse checks that the response authenticator of b was computed from
+// the given request authenticator and shared secret.
+func verifyResponse(b []byte, requestAuthenticator []byte, secret []byte) bool {
+	if len(b) < headerLength {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length < headerLength || length > len(b) {
+		return false
+	}
+	h := md5.New()
+	h.Write(b[:4])
+	h.Write(requestAuthenticator)
+	h.Write(b[headerLength:length])
+	h.Write(secret)
+	return hmac.Equal(h.Sum(nil), b[4:headerLength])
+}
+
+// hidePassword implements the User-Password hiding algorithm from RFC 2865
+// section 5.2.
+func hidePassword(password, secret, requestAuthenticator []byte) []byte {
+	padded := len(password)
+	if padded == 0 || padded%16 != 0 {
+		padded += 16 - padded%16
+	}
+	result := make([]byte, padded)
+	copy(result, password)
+	last := requestAuthenticator
+	for i := 0; i < padded; i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(last)
+		b := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			result[i+j] ^= b[j]
+		}
+		last = result[i : i+16]
+	}
+	return result
+}
@@ -0,0 +1,266 @@
+// radius provides a packetforward server.Authenticator and server.Accountant
+// that authenticate sessions with, and report accounting information to, a
+// RADIUS server.
+//
+// Clients authenticate using PAP. Session-Timeout and Acct-Interim-Interval
+// attributes in the Access-Accept are honored, as are the WISPr-Bandwidth-Max-Up
+// and WISPr-Bandwidth-Max-Down vendor specific attributes.
+package radius
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/pferrors"
+	"github.com/getlantern/packetforward/server"
+)
+
+var log = golog.LoggerFor("packetforward.radius")
+
+const (
+	// DefaultTimeout is the default time to wait for a response to each attempt
+	DefaultTimeout = 3 * time.Second
+
+	// DefaultRetries is the default number of times to retry requests that timed out
+	DefaultRetries = 2
+)
+
+// Opts configures a RADIUS Client
+type Opts struct {
+	// AuthAddr is the host:port of the RADIUS authentication server, usually on port 1812
+	AuthAddr string
+
+	// AcctAddr is the host:port of the RADIUS accounting server, usually on port 1813. If empty,
+	// no accounting requests are sent.
+	AcctAddr string
+
+	// Secret is the shared secret used to authenticate packets exchanged with the RADIUS server
+	Secret string
+
+	// NASIdentifier, if specified, is sent in the NAS-Identifier attribute of every request
+	NASIdentifier string
+
+	// Timeout is how long to wait for a response to each attempt. If not specified, defaults to
+	// DefaultTimeout.
+	Timeout time.Duration
+
+	// Retries is how many times to retry requests that time out. If not specified, defaults to
+	// DefaultRetries.
+	Retries int
+
+	// Logger, if specified, is used for logging instead of the default golog logger
+	Logger logging.Logger
+}
+
+// Client is a RADIUS client that implements server.Authenticator and
+// server.Accountant.
+type Client struct {
+	identifier uint32
+	opts       *Opts
+	secret     []byte
+	log        logging.Logger
+}
+
+// New constructs a new RADIUS Client.
+func New(opts *Opts) *Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = DefaultRetries
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = logging.FromGolog(log)
+	}
+	return &Client{
+		opts:   opts,
+		secret: []byte(opts.Secret),
+		log:    logger,
+	}
+}
+
+// Authenticate implements the method from server.Authenticator by sending an
+// Access-Request.
+func (c *Client) Authenticate(req *server.AuthRequest) (*server.AuthResult, error) {
+	p, err := newAccessRequest(c.nextIdentifier(), c.secret, req.Username, req.Password)
+	if err != nil {
+		return nil, err
+	}
+	c.addCommonAttributes(p, req.RemoteAddr)
+	b, err := encodeAccessRequest(p, c.secret)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.exchange(c.opts.AuthAddr, p, b)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.Code {
+	case CodeAccessAccept:
+		return authResultFor(resp), nil
+	case CodeAccessReject:
+		return nil, pferrors.New(server.ErrAuthRejected, string(resp.Get(AttrReplyMessage)), nil)
+	default:
+		return nil, errors.New("unexpected response code %d", resp.Code)
+	}
+}
+
+func authResultFor(resp *Packet) *server.AuthResult {
+	result := &server.AuthResult{}
+	if timeout, ok := resp.GetUint32(AttrSessionTimeout); ok {
+		result.SessionTimeout = time.Duration(timeout) * time.Second
+	}
+	if interval, ok := resp.GetUint32(AttrAcctInterimInterval); ok {
+		result.InterimInterval = time.Duration(interval) * time.Second
+	}
+	if up, ok := resp.GetVendorUint32(VendorWISPr, WISPrBandwidthMaxUp); ok {
+		result.UpstreamBytesPerSecond = int64(up) / 8
+	}
+	if down, ok := resp.GetVendorUint32(VendorWISPr, WISPrBandwidthMaxDown); ok {
+		result.DownstreamBytesPerSecond = int64(down) / 8
+	}
+	return result
+}
+
+// AccountingStart implements the method from server.Accountant.
+func (c *Client) AccountingStart(session *server.SessionInfo) {
+	c.account(AcctStatusStart, session)
+}
+
+// AccountingUpdate implements the method from server.Accountant.
+func (c *Client) AccountingUpdate(session *server.SessionInfo) {
+	c.account(AcctStatusInterimUpdate, session)
+}
+
+// AccountingStop implements the method from server.Accountant.
+func (c *Client) AccountingStop(session *server.SessionInfo) {
+	c.account(AcctStatusStop, session)
+}
+
+func (c *Client) account(status uint32, session *server.SessionInfo) {
+	if c.opts.AcctAddr == "" {
+		return
+	}
+
+	p := &Packet{
+		Code:       CodeAccountingRequest,
+		Identifier: c.nextIdentifier(),
+	}
+	p.AddUint32(AttrAcctStatusType, status)
+	p.AddString(AttrAcctSessionID, acctSessionID(session))
+	if session.Username != "" {
+		p.AddString(AttrUserName, session.Username)
+	}
+	c.addCommonAttributes(p, session.RemoteAddr)
+	if status != AcctStatusStart {
+		// from the NAS' perspective, input is what it received from the user
+		addOctets(p, AttrAcctInputOctets, AttrAcctInputGigawords, session.BytesUp)
+		addOctets(p, AttrAcctOutputOctets, AttrAcctOutputGigawords, session.BytesDown)
+		p.AddUint32(AttrAcctInputPackets, uint32(session.PacketsUp))
+		p.AddUint32(AttrAcctOutputPackets, uint32(session.PacketsDown))
+		p.AddUint32(AttrAcctSessionTime, uint32(session.Duration/time.Second))
+	}
+	if status == AcctStatusStop {
+		p.AddUint32(AttrAcctTerminateCause, terminateCauseFor(session.TerminateCause))
+	}
+
+	b, err := encodeAccountingRequest(p, c.secret)
+	if err != nil {
+		c.log.Errorf("Unable to encode accounting request for %v: %v", session.ClientID, err)
+		return
+	}
+	resp, err := c.exchange(c.opts.AcctAddr, p, b)
+	if err != nil {
+		c.log.Errorf("Unable to send accounting request for %v: %v", session.ClientID, err)
+		return
+	}
+	if resp.Code != CodeAccountingResponse {
+		c.log.Errorf("Unexpected response code to accounting request for %v: %d", session.ClientID, resp.Code)
+	}
+}
+
+func (c *Client) addCommonAttributes(p *Packet, remoteAddr net.Addr) {
+	if c.opts.NASIdentifier != "" {
+		p.AddString(AttrNASIdentifier, c.opts.NASIdentifier)
+	}
+	if remoteAddr != nil {
+		p.AddString(AttrCallingStationID, remoteAddr.String())
+	}
+}
+
+// exchange sends the encoded request b to addr and waits for a matching,
+// properly authenticated response, retrying on timeouts.
+func (c *Client) exchange(addr string, req *Packet, b []byte) (*Packet, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.New("unable to dial RADIUS server at %v: %v", addr, err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, maxPacketLength)
+	for attempt := 0; attempt <= c.opts.Retries; attempt++ {
+		if _, err := conn.Write(b); err != nil {
+			return nil, errors.New("unable to send request to RADIUS server at %v: %v", addr, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(c.opts.Timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return nil, errors.New("unable to read response from RADIUS server at %v: %v", addr, err)
+			}
+			resp, err := Decode(buf[:n])
+			if err != nil {
+				c.log.Debugf("Ignoring invalid response from RADIUS server at %v: %v", addr, err)
+				continue
+			}
+			if resp.Identifier != req.Identifier {
+				// stale response to an earlier request
+				continue
+			}
+			if !verifyResponse(buf[:n], req.Authenticator[:], c.secret) {
+				c.log.Debugf("Ignoring response with invalid authenticator from RADIUS server at %v", addr)
+				continue
+			}
+			return resp, nil
+		}
+	}
+	return nil, errors.New("RADIUS server at %v did not respond after %d attempts", addr, c.opts.Retries+1)
+}
+
+func (c *Client) nextIdentifier() byte {
+	return byte(atomic.AddUint32(&c.identifier, 1))
+}
+
+func acctSessionID(session *server.SessionInfo) string {
+	return fmt.Sprintf("%v-%x", session.ClientID, session.Started.UnixNano())
+}
+
+func addOctets(p *Packet, octetsType byte, gigawordsType byte, octets int64) {
+	p.AddUint32(octetsType, uint32(octets))
+	if gigawords := uint32(octets >> 32); gigawords > 0 {
+		p.AddUint32(gigawordsType, gigawords)
+	}
+}
+
+func terminateCauseFor(cause server.TerminateCause) uint32 {
+	switch cause {
+	case server.TerminateIdleTimeout:
+		return TerminateCauseIdleTimeout
+	case server.TerminateSessionTimeout:
+		return TerminateCauseSessionTimeout
+	case server.TerminateConnectionLost:
+		return TerminateCauseLostCarrier
+	default:
+		return TerminateCauseNASRequest
+	}
+}
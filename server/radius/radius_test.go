@@ -0,0 +1,258 @@
+package radius
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/packetforward/server"
+)
+
+const (
+	testSecret   = "testing123"
+	testUser     = "alice"
+	testPassword = "a password that spans more than one block"
+)
+
+// standIn is a minimal local RADIUS server used in place of a real one.
+type standIn struct {
+	conn       net.PacketConn
+	accounting []*Packet
+	requests   []*Packet
+	dropFirst  bool
+	mx         sync.Mutex
+}
+
+func newStandIn(t *testing.T) *standIn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &standIn{conn: conn}
+	go s.serve()
+	return s
+}
+
+func (s *standIn) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *standIn) serve() {
+	b := make([]byte, maxPacketLength)
+	for {
+		n, addr, err := s.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		req, err := Decode(b[:n])
+		if err != nil {
+			continue
+		}
+		s.mx.Lock()
+		s.requests = append(s.requests, req)
+		drop := s.dropFirst
+		s.dropFirst = false
+		s.mx.Unlock()
+		if drop {
+			continue
+		}
+
+		resp := &Packet{Identifier: req.Identifier}
+		switch req.Code {
+		case CodeAccessRequest:
+			password := revealPassword(req.Get(AttrUserPassword), []byte(testSecret), req.Authenticator[:])
+			if string(req.Get(AttrUserName)) == testUser && string(password) == testPassword {
+				resp.Code = CodeAccessAccept
+				resp.AddUint32(AttrSessionTimeout, 3600)
+				resp.AddUint32(AttrAcctInterimInterval, 60)
+				resp.AddVendorUint32(VendorWISPr, WISPrBandwidthMaxUp, 8000)
+				resp.AddVendorUint32(VendorWISPr, WISPrBandwidthMaxDown, 16000)
+			} else {
+				resp.Code = CodeAccessReject
+				resp.AddString(AttrReplyMessage, "bad credentials")
+			}
+		case CodeAccountingRequest:
+			s.mx.Lock()
+			s.accounting = append(s.accounting, req)
+			s.mx.Unlock()
+			resp.Code = CodeAccountingResponse
+		}
+		s.conn.WriteTo(sign(resp, req.Authenticator[:]), addr)
+	}
+}
+
+func (s *standIn) request(i int) *Packet {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.requests[i]
+}
+
+func (s *standIn) accounted() []*Packet {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return append([]*Packet{}, s.accounting...)
+}
+
+func sign(resp *Packet, requestAuthenticator []byte) []byte {
+	b, _ := resp.Encode()
+	h := md5.New()
+	h.Write(b[:4])
+	h.Write(requestAuthenticator)
+	h.Write(b[headerLength:])
+	h.Write([]byte(testSecret))
+	copy(b[4:headerLength], h.Sum(nil))
+	return b
+}
+
+func revealPassword(hidden, secret, requestAuthenticator []byte) []byte {
+	result := make([]byte, len(hidden))
+	last := requestAuthenticator
+	for i := 0; i+16 <= len(hidden); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(last)
+		b := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			result[i+j] = hidden[i+j] ^ b[j]
+		}
+		last = hidden[i : i+16]
+	}
+	return bytes.TrimRight(result, "\x00")
+}
+
+func newTestClient(s *standIn) *Client {
+	return New(&Opts{
+		AuthAddr:      s.addr(),
+		AcctAddr:      s.addr(),
+		Secret:        testSecret,
+		NASIdentifier: "packetforward-test",
+		Timeout:       250 * time.Millisecond,
+	})
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := newStandIn(t)
+	defer s.conn.Close()
+	c := newTestClient(s)
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 5000}
+
+	result, err := c.Authenticate(&server.AuthRequest{ClientID: "client", Username: testUser, Password: testPassword, RemoteAddr: remoteAddr})
+	if err != nil {
+		t.Fatalf("Unable to authenticate: %v", err)
+	}
+	if result.SessionTimeout != time.Hour {
+		t.Errorf("Wrong session timeout: %v", result.SessionTimeout)
+	}
+	if result.InterimInterval != time.Minute {
+		t.Errorf("Wrong interim interval: %v", result.InterimInterval)
+	}
+	if result.UpstreamBytesPerSecond != 1000 || result.DownstreamBytesPerSecond != 2000 {
+		t.Errorf("Wrong bandwidth limits: %d / %d", result.UpstreamBytesPerSecond, result.DownstreamBytesPerSecond)
+	}
+	req := s.request(0)
+	if string(req.Get(AttrNASIdentifier)) != "packetforward-test" {
+		t.Errorf("Wrong NAS-Identifier: %v", string(req.Get(AttrNASIdentifier)))
+	}
+	if string(req.Get(AttrCallingStationID)) != remoteAddr.String() {
+		t.Errorf("Wrong Calling-Station-Id: %v", string(req.Get(AttrCallingStationID)))
+	}
+	if len(req.Get(AttrMessageAuthenticator)) != messageAuthenticatorLength {
+		t.Error("Missing Message-Authenticator")
+	}
+
+	_, err = c.Authenticate(&server.AuthRequest{ClientID: "client", Username: testUser, Password: "wrong"})
+	if !errors.Is(err, server.ErrAuthRejected) {
+		t.Fatalf("Authentication with wrong password should have been rejected: %v", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	s := newStandIn(t)
+	defer s.conn.Close()
+	s.mx.Lock()
+	s.dropFirst = true
+	s.mx.Unlock()
+	c := newTestClient(s)
+
+	if _, err := c.Authenticate(&server.AuthRequest{Username: testUser, Password: testPassword}); err != nil {
+		t.Fatalf("Authentication should have succeeded on retry: %v", err)
+	}
+}
+
+func TestAccounting(t *testing.T) {
+	s := newStandIn(t)
+	defer s.conn.Close()
+	c := newTestClient(s)
+
+	session := &server.SessionInfo{
+		ClientID: "client",
+		Username: testUser,
+		Started:  time.Now(),
+	}
+	c.AccountingStart(session)
+	session.Duration = 90 * time.Second
+	session.BytesUp = 5 << 32
+	session.BytesDown = 1000
+	session.PacketsUp = 10
+	session.PacketsDown = 20
+	c.AccountingUpdate(session)
+	session.TerminateCause = server.TerminateIdleTimeout
+	c.AccountingStop(session)
+
+	accounted := s.accounted()
+	if len(accounted) != 3 {
+		t.Fatalf("Expected 3 accounting requests, got %d", len(accounted))
+	}
+	for i, expected := range []uint32{AcctStatusStart, AcctStatusInterimUpdate, AcctStatusStop} {
+		status, _ := accounted[i].GetUint32(AttrAcctStatusType)
+		if status != expected {
+			t.Errorf("Request %d: expected status %d, got %d", i, expected, status)
+		}
+		if string(accounted[i].Get(AttrAcctSessionID)) != acctSessionID(session) {
+			t.Errorf("Request %d: wrong session ID", i)
+		}
+	}
+
+	stop := accounted[2]
+	gigawords, _ := stop.GetUint32(AttrAcctInputGigawords)
+	octets, _ := stop.GetUint32(AttrAcctInputOctets)
+	if gigawords != 5 || octets != 0 {
+		t.Errorf("Wrong input octets: %d gigawords, %d octets", gigawords, octets)
+	}
+	if octets, _ := stop.GetUint32(AttrAcctOutputOctets); octets != 1000 {
+		t.Errorf("Wrong output octets: %d", octets)
+	}
+	if packets, _ := stop.GetUint32(AttrAcctOutputPackets); packets != 20 {
+		t.Errorf("Wrong output packets: %d", packets)
+	}
+	if sessionTime, _ := stop.GetUint32(AttrAcctSessionTime); sessionTime != 90 {
+		t.Errorf("Wrong session time: %d", sessionTime)
+	}
+	if cause, _ := stop.GetUint32(AttrAcctTerminateCause); cause != TerminateCauseIdleTimeout {
+		t.Errorf("Wrong terminate cause: %d", cause)
+	}
+	if _, hasGigawords := accounted[0].GetUint32(AttrAcctInputGigawords); hasGigawords {
+		t.Error("Start shouldn't include counters")
+	}
+}
+
+func TestVendorSpecific(t *testing.T) {
+	p := &Packet{}
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint32(b, VendorWISPr)
+	// two sub-attributes in a single Vendor-Specific attribute
+	b[4], b[5] = WISPrBandwidthMaxUp, 6
+	binary.BigEndian.PutUint32(b[6:], 100)
+	b[10], b[11] = WISPrBandwidthMaxDown, 6
+	binary.BigEndian.PutUint32(b[12:], 200)
+	p.Add(AttrVendorSpecific, b)
+
+	if down, ok := p.GetVendorUint32(VendorWISPr, WISPrBandwidthMaxDown); !ok || down != 200 {
+		t.Errorf("Wrong value for second sub-attribute: %d", down)
+	}
+}
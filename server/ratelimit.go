@@ -0,0 +1,49 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that limits throughput to a fixed number of
+// bytes per second, allowing bursts of up to one second's worth of data. A nil
+// rateLimiter doesn't limit anything.
+type rateLimiter struct {
+	bytesPerSecond float64
+	tokens         float64
+	last           time.Time
+	mx             sync.Mutex
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		bytesPerSecond: float64(bytesPerSecond),
+		tokens:         float64(bytesPerSecond),
+		last:           time.Now(),
+	}
+}
+
+// wait blocks until n bytes may be transmitted.
+func (rl *rateLimiter) wait(n int) {
+	if rl == nil {
+		return
+	}
+
+	rl.mx.Lock()
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.bytesPerSecond
+	if rl.tokens > rl.bytesPerSecond {
+		rl.tokens = rl.bytesPerSecond
+	}
+	rl.last = now
+	rl.tokens -= float64(n)
+	deficit := -rl.tokens
+	rl.mx.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / rl.bytesPerSecond * float64(time.Second)))
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/idletiming"
+	"github.com/getlantern/packetforward/pferrors"
+)
+
+// reap periodically evicts sessions that are idle or have exceeded their
+// SessionTimeout. Without it, sessions whose packet processing has stalled
+// would keep their goroutines and NAT state around indefinitely.
+func (s *server) reap() {
+	ticker := time.NewTicker(s.opts.ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		// the reaper runs regularly, so Liveness uses it as a heartbeat
+		atomic.StoreInt64(&s.lastReap, time.Now().UnixNano())
+		select {
+		case <-s.close:
+			return
+		case <-ticker.C:
+			s.reapOnce()
+		}
+	}
+}
+
+// reapOnce evicts all sessions that are currently idle or expired and returns
+// the number of evicted sessions.
+func (s *server) reapOnce() int {
+	var evict []*client
+	s.clientsMx.Lock()
+	for _, c := range s.clients {
+		if c.idle() || c.expired() {
+			evict = append(evict, c)
+		}
+	}
+	s.clientsMx.Unlock()
+	s.forgetEndedExhausted()
+
+	evicted := 0
+	for _, c := range evict {
+		if c.evict() {
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// evict ends the session and stops processing its packets, unless the session
+// already ended on its own.
+func (c *client) evict() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	err := ErrSessionTimeout
+	if !c.expired() {
+		err = pferrors.New(ErrSessionEvicted, "idle", idletiming.ErrIdled)
+	}
+	c.log.Debugf("Evicting session: %v", err)
+	atomic.AddInt64(&c.s.evictions, 1)
+	atomic.AddInt64(&c.tenant.evictions, 1)
+	c.finished(err)
+	if c.ps != nil {
+		if closeErr := c.ps.Close(); closeErr != nil {
+			c.log.Debugf("Error stopping packet processing: %v", closeErr)
+		}
+	}
+	return true
+}
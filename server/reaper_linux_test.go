@@ -0,0 +1,123 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/eventual"
+	"github.com/getlantern/packetforward/logging"
+)
+
+type fakePacketServer struct {
+	closed int32
+}
+
+func (ps *fakePacketServer) Serve() error {
+	return nil
+}
+
+func (ps *fakePacketServer) Close() error {
+	atomic.StoreInt32(&ps.closed, 1)
+	return nil
+}
+
+func TestReap(t *testing.T) {
+	var ended []*SessionEvent
+	s := &server{
+		opts: &Opts{
+			ReapInterval: time.Minute,
+			OnSessionEvent: func(event *SessionEvent) {
+				ended = append(ended, event)
+			},
+		},
+		log:     logging.FromGolog(log),
+		clients: make(map[string]*client),
+	}
+	s.opts.IdleTimeout = time.Minute
+	s.defaultTenant = s.newTenant(s.opts.defaultTenant())
+
+	newClient := func(id string, lastActive time.Time, auth *AuthResult) (*client, *fakePacketServer) {
+		ps := &fakePacketServer{}
+		c := &client{
+			id:         id,
+			key:        id,
+			tenant:     s.defaultTenant,
+			log:        s.log.With("session", id),
+			started:    time.Now().Add(-2 * time.Hour),
+			lastActive: lastActive.UnixNano(),
+			auth:       auth,
+			s:          s,
+			ps:         ps,
+			framedConn: eventual.NewValue(),
+			done:       make(chan struct{}),
+		}
+		s.clients[id] = c
+		return c, ps
+	}
+	_, activePS := newClient("active", time.Now(), &AuthResult{})
+	_, idlePS := newClient("idle", time.Now().Add(-2*time.Minute), &AuthResult{})
+	_, expiredPS := newClient("expired", time.Now(), &AuthResult{SessionTimeout: time.Hour})
+
+	if evicted := s.reapOnce(); evicted != 2 {
+		t.Errorf("Expected 2 evictions, got %d", evicted)
+	}
+	if _, found := s.clients["active"]; !found || len(s.clients) != 1 {
+		t.Errorf("Only active session should remain, have %d sessions", len(s.clients))
+	}
+	if atomic.LoadInt32(&activePS.closed) == 1 {
+		t.Error("Active session's packet processing should not have been stopped")
+	}
+	if atomic.LoadInt32(&idlePS.closed) != 1 || atomic.LoadInt32(&expiredPS.closed) != 1 {
+		t.Error("Evicted sessions' packet processing should have been stopped")
+	}
+	causes := make(map[string]TerminateCause)
+	for _, event := range ended {
+		causes[event.Session.ClientID] = event.Session.TerminateCause
+	}
+	if causes["idle"] != TerminateIdleTimeout || causes["expired"] != TerminateSessionTimeout {
+		t.Errorf("Wrong terminate causes: %v", causes)
+	}
+	if atomic.LoadInt64(&s.evictions) != 2 {
+		t.Errorf("Wrong eviction count: %d", s.evictions)
+	}
+
+	if evicted := s.reapOnce(); evicted != 0 {
+		t.Errorf("Nothing left to evict, but evicted %d", evicted)
+	}
+}
+
+func TestFinishedKeepsReplacement(t *testing.T) {
+	s := &server{
+		opts:      &Opts{},
+		log:       logging.FromGolog(log),
+		clients:   make(map[string]*client),
+		exhausted: make(map[string]*exhaustedSession),
+	}
+	s.defaultTenant = s.newTenant(s.opts.defaultTenant())
+	newClient := func() *client {
+		return &client{
+			id:         "id",
+			key:        "id",
+			tenant:     s.defaultTenant,
+			log:        s.log.With("session", "id"),
+			auth:       &AuthResult{},
+			s:          s,
+			ps:         &fakePacketServer{},
+			framedConn: eventual.NewValue(),
+			done:       make(chan struct{}),
+		}
+	}
+	old, replacement := newClient(), newClient()
+	s.clients["id"] = replacement
+
+	// the old session finishing late must not forget its replacement
+	old.finished(nil)
+	if s.clients["id"] != replacement {
+		t.Error("Replacement session should remain")
+	}
+	replacement.finished(nil)
+	if len(s.clients) != 0 {
+		t.Error("Finished session should be forgotten")
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward/protocol"
+	"github.com/oxtoacart/bpool"
+)
+
+// readRecords reads records from one of the session's connections (primary or
+// secondary) until it fails and queues the packets they contain for Read.
+func (c *client) readRecords(conn *framed.ReadWriteCloser) {
+	defer conn.Close()
+
+	b := make([]byte, c.s.opts.ReadBufferSize+protocol.MaxRecordOverhead)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			atomic.AddInt64(&c.s.failedReads, 1)
+			return
+		}
+		record, err := protocol.DecodeRecord(b[:n])
+		if err != nil {
+			c.log.Debugf("Ignoring invalid record: %v", err)
+			continue
+		}
+		switch record.Type {
+		case protocol.RecordPacket:
+		case protocol.RecordSequencedPacket:
+			if c.dedup.Duplicate(record.Sequence) {
+				continue
+			}
+		case protocol.RecordPing:
+			c.pong(conn, record.Sequence)
+			continue
+		default:
+			// ignore record types that we don't know about
+			continue
+		}
+		pkt := c.s.opts.BufferPool.GetSlice()
+		pkt = pkt.ResliceTo(copy(pkt.Bytes(), record.Payload))
+		select {
+		case c.inbound <- pkt:
+		case <-c.done:
+			c.s.opts.BufferPool.PutSlice(pkt)
+			return
+		}
+	}
+}
+
+// readRecord is the implementation of Read for sessions that use records.
+func (c *client) readRecord(b bpool.ByteSlice) (int, error) {
+	for {
+		if c.idle() || c.expired() {
+			return c.finished(io.EOF)
+		}
+		if c.overQuota() {
+			return c.finished(ErrQuotaExceeded)
+		}
+
+		timer := time.NewTimer(c.s.opts.IdleTimeout)
+		select {
+		case pkt := <-c.inbound:
+			timer.Stop()
+			n := copy(b.Bytes(), pkt.Bytes())
+			c.s.opts.BufferPool.PutSlice(pkt)
+			c.countUpstream(n)
+			return n, nil
+		case <-timer.C:
+			// check whether we've gone idle
+		}
+	}
+}
+
+// encodeRecord encodes a downstream packet as a record. If the session has a
+// secondary path and the packet is selected for redundant transmission, the
+// record is sequenced and immediately sent over the secondary path.
+func (c *client) encodeRecord(pkt []byte) []byte {
+	secondary := c.getSecondary()
+	if secondary == nil || !c.redundant(pkt) {
+		return protocol.EncodePacket(pkt)
+	}
+	record := protocol.EncodeSequencedPacket(atomic.AddUint64(&c.sequence, 1), pkt)
+	c.writeMx.Lock()
+	_, err := secondary.Write(record)
+	c.writeMx.Unlock()
+	if err != nil {
+		c.log.Debugf("Unable to write to secondary path, dropping it: %v", err)
+		c.dropSecondary(secondary)
+	}
+	return record
+}
+
+// pong answers a ping received over conn.
+func (c *client) pong(conn *framed.ReadWriteCloser, id uint64) {
+	c.writeMx.Lock()
+	_, err := conn.Write(protocol.EncodePong(id))
+	c.writeMx.Unlock()
+	if err != nil {
+		c.log.Debugf("Unable to answer ping: %v", err)
+	}
+}
+
+func (c *client) attachSecondary(framedConn *framed.ReadWriteCloser) {
+	c.mx.Lock()
+	old := c.secondary
+	c.secondary = framedConn
+	c.mx.Unlock()
+	if old != nil {
+		go old.Close()
+	}
+	go c.readRecords(framedConn)
+}
+
+func (c *client) getSecondary() *framed.ReadWriteCloser {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.secondary
+}
+
+func (c *client) dropSecondary(secondary *framed.ReadWriteCloser) {
+	c.mx.Lock()
+	if c.secondary == secondary {
+		c.secondary = nil
+	}
+	c.mx.Unlock()
+	secondary.Close()
+}
+
+func (c *client) closeSecondary() {
+	if secondary := c.getSecondary(); secondary != nil {
+		c.dropSecondary(secondary)
+	}
+}
@@ -2,8 +2,12 @@ package server
 
 import (
 	"net"
+	"time"
 
 	"github.com/getlantern/gonat"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/server/usage"
 )
 
 type Opts struct {
@@ -14,11 +18,123 @@ type Opts struct {
 
 	// ReadBufferSize is the size of the read buffer for reading framed packets from clients. If not specified, defaults to gonat.MaximumIPPacketSize
 	ReadBufferSize int
+
+	// Bridge, if specified, enables Ethernet mode sessions. Each such session gets its own TAP
+	// device, which is attached to the named local bridge. If not specified, clients requesting
+	// Ethernet mode are rejected.
+	Bridge string
+
+	// Authenticator, if specified, authenticates clients when they connect. Clients that fail
+	// authentication are disconnected.
+	Authenticator Authenticator
+
+	// Accountant, if specified, is notified about session starts and stops and receives interim
+	// updates while sessions are running.
+	Accountant Accountant
+
+	// AccountingInterval is how frequently the Accountant receives interim updates. If not
+	// specified, defaults to 5 minutes.
+	AccountingInterval time.Duration
+
+	// Quota, if specified, limits the number of bytes (upstream plus downstream) that each
+	// session may transfer. Sessions that exhaust their quota are terminated. An Authenticator
+	// may override this per session.
+	Quota int64
+
+	// QuotaPeriod is the period over which Quota applies. If not specified, quotas apply to
+	// individual sessions. Daily and monthly quotas require a UsageStore.
+	QuotaPeriod usage.Period
+
+	// QuotaThresholds are fractions of the quota (for example 0.8) at which to emit
+	// SessionQuotaThreshold events.
+	QuotaThresholds []float64
+
+	// UsageStore, if specified, records each client's usage so that it persists across sessions
+	// and server restarts.
+	UsageStore usage.Store
+
+	// UsageFlushInterval is how frequently session usage is written to the UsageStore. If not
+	// specified, defaults to 1 minute.
+	UsageFlushInterval time.Duration
+
+	// Logger, if specified, is used for logging instead of the default golog logger. Lines
+	// about a session are tagged with the client's ID as "session" and its address as "remote".
+	Logger logging.Logger
+
+	// Redundant selects which packets to send over both paths of sessions whose clients
+	// connected a secondary path for redundant transmission. If not specified, defaults to
+	// protocol.RealTime (protocol.RealTimeFrame for Ethernet mode sessions).
+	Redundant func(pkt []byte) bool
+
+	// Pipeline, if specified, processes every packet that the server reads from or writes to a
+	// client, before gonat's OnOutbound and after its OnInbound hook. Responses to upstream
+	// packets are sent back to the client. Responding to downstream packets isn't supported,
+	// so NewServer rejects pipelines with handlers that declare that they respond to them (see
+	// pipeline.Responder). Downstream packets that other handlers respond to are dropped, and
+	// the server logs an error for the session.
+	Pipeline *pipeline.Chain
+
+	// ReapInterval is how frequently the server scans for sessions that are idle or have
+	// exceeded their SessionTimeout and evicts them. Sessions are also ended when packet
+	// processing notices that they're idle, but that only happens while gonat is still reading
+	// from or writing to them. If not specified, defaults to 10 seconds.
+	ReapInterval time.Duration
+
+	// HandshakeTimeout limits how long clients may take to send their hello and complete
+	// authentication, after which they're disconnected. If not specified, defaults to 30
+	// seconds.
+	HandshakeTimeout time.Duration
+
+	// OnSessionEvent, if specified, is called whenever a session starts, reattaches, crosses a
+	// quota threshold or ends. It's called on the packet processing path, so it must not block.
+	OnSessionEvent func(event *SessionEvent)
+
+	// MaxSpeedTestDuration, if specified, lets authenticated clients run speed tests (see
+	// protocol.SpeedTest) lasting up to this long. Speed tests measure the throughput between
+	// client and server without forwarding anything. If not specified, speed tests are
+	// rejected.
+	MaxSpeedTestDuration time.Duration
+
+	// MaxSpeedTests limits how many speed tests can run at the same time. Clients requesting
+	// more are rejected. If not specified, defaults to DefaultMaxSpeedTests.
+	MaxSpeedTests int
+
+	// ReadinessMaxSessions, if specified, is the number of sessions at which Readiness reports
+	// that the server can't take more traffic. It doesn't limit the number of sessions.
+	ReadinessMaxSessions int
+
+	// ReadinessMaxHeapBytes, if specified, is the heap size at which Readiness reports that the
+	// server can't take more traffic
+	ReadinessMaxHeapBytes uint64
+
+	// Tenants are customers hosted on this server, each with its own settings. Clients that
+	// don't select one of them use the settings in these Opts.
+	Tenants []*Tenant
 }
 
 type Server interface {
 	Serve(l net.Listener) error
 
+	// ServeTenant is like Serve, but all clients connecting through the given Listener belong
+	// to the named tenant, regardless of their usernames. If the Listener fails or is closed
+	// while other listeners are still being served, the server only forgets the sessions of
+	// tenants that no remaining listener serves. The server closes once its last listener
+	// stops.
+	ServeTenant(l net.Listener, tenant string) error
+
+	// TenantStats returns stats for clients that don't belong to a tenant followed by stats for
+	// each tenant, in the order in which the tenants were configured.
+	TenantStats() []*TenantStats
+
+	// Liveness reports whether the server is alive, i.e. whether its background processing is
+	// still running. A server that isn't alive should be restarted.
+	Liveness() *Health
+
+	// Readiness reports whether the server can take traffic: it isn't shutting down, serves a
+	// listener that accepts connections, its egress interfaces are usable and it has headroom
+	// for more sessions and memory (see ReadinessMaxSessions and ReadinessMaxHeapBytes).
+	Readiness() *Health
+
 	// Close closes this server and associated resources.
 	Close() error
 }
@@ -5,8 +5,10 @@ package server
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,6 +18,11 @@ import (
 	"github.com/getlantern/golog"
 	"github.com/getlantern/gonat"
 	"github.com/getlantern/idletiming"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/pferrors"
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/protocol"
+	"github.com/getlantern/packetforward/server/usage"
 	"github.com/oxtoacart/bpool"
 )
 
@@ -32,6 +39,18 @@ const (
 
 	// DefaultReadBufferSize is gonat.MaximumIPPacketSize
 	DefaultReadBufferSize = gonat.MaximumIPPacketSize
+
+	// DefaultAccountingInterval is 5 minutes
+	DefaultAccountingInterval = 5 * time.Minute
+
+	// DefaultUsageFlushInterval is 1 minute
+	DefaultUsageFlushInterval = 1 * time.Minute
+
+	// DefaultReapInterval is 10 seconds
+	DefaultReapInterval = 10 * time.Second
+
+	// DefaultHandshakeTimeout is 30 seconds
+	DefaultHandshakeTimeout = 30 * time.Second
 )
 
 const (
@@ -46,9 +65,22 @@ type server struct {
 	failedReads      int64
 	successfulWrites int64
 	failedWrites     int64
+	evictions        int64
+	lastReap         int64
+	listening        int64
+	acceptFailing    int32
+	speedTests       int32
+	sharedListeners  int
 	opts             *Opts
+	log              logging.Logger
+	defaultTenant    *tenant
+	tenants          map[string]*tenant
+	orderedTenants   []*tenant
 	clients          map[string]*client
+	starting         map[string]chan struct{}
+	exhausted        map[string]*exhaustedSession
 	clientsMx        sync.Mutex
+	listenersMx      sync.Mutex
 	close            chan interface{}
 	closed           chan interface{}
 }
@@ -64,6 +96,41 @@ func NewServer(opts *Opts) (Server, error) {
 		opts.ReadBufferSize = DefaultReadBufferSize
 	}
 
+	if opts.AccountingInterval <= 0 {
+		opts.AccountingInterval = DefaultAccountingInterval
+	}
+
+	if opts.UsageFlushInterval <= 0 {
+		opts.UsageFlushInterval = DefaultUsageFlushInterval
+	}
+
+	if opts.ReapInterval <= 0 {
+		opts.ReapInterval = DefaultReapInterval
+	}
+
+	if opts.HandshakeTimeout <= 0 {
+		opts.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+
+	if opts.MaxSpeedTests <= 0 {
+		opts.MaxSpeedTests = DefaultMaxSpeedTests
+	}
+
+	if opts.QuotaPeriod != 0 && opts.UsageStore == nil {
+		return nil, errors.New("daily and monthly quotas require a UsageStore")
+	}
+
+	thresholds := append([]float64{}, opts.QuotaThresholds...)
+	sort.Float64s(thresholds)
+	opts.QuotaThresholds = thresholds
+
+	if err := checkPipeline(opts.Pipeline); err != nil {
+		return nil, err
+	}
+	if err := validateTenants(opts.Tenants); err != nil {
+		return nil, err
+	}
+
 	// Apply defaults
 	err := opts.ApplyDefaults()
 	if err != nil {
@@ -72,26 +139,49 @@ func NewServer(opts *Opts) (Server, error) {
 
 	opts.BufferPool = framed.NewHeaderPreservingBufferPool(opts.BufferPoolSize, gonat.MaximumIPPacketSize, true)
 
+	logger := opts.Logger
+	if logger == nil {
+		logger = logging.FromGolog(log)
+	}
+
 	s := &server{
-		opts:    opts,
-		clients: make(map[string]*client),
-		close:   make(chan interface{}),
-		closed:  make(chan interface{}),
+		lastReap:  time.Now().UnixNano(),
+		opts:      opts,
+		log:       logger,
+		tenants:   make(map[string]*tenant, len(opts.Tenants)),
+		clients:   make(map[string]*client),
+		starting:  make(map[string]chan struct{}),
+		exhausted: make(map[string]*exhaustedSession),
+		close:     make(chan interface{}),
+		closed:    make(chan interface{}),
+	}
+	s.defaultTenant = s.newTenant(opts.defaultTenant())
+	for _, t := range opts.Tenants {
+		s.tenants[t.Name] = s.newTenant(t)
+		s.orderedTenants = append(s.orderedTenants, s.tenants[t.Name])
 	}
 	go s.printStats()
+	go s.reap()
 	return s, nil
 }
 
 // Serve serves new packetforward client connections inbound on the given Listener.
 func (s *server) Serve(l net.Listener) error {
-	defer s.Close()
-	defer s.forgetClients()
+	return s.serve(l, nil)
+}
+
+// serve serves client connections for the given tenant or, if it's nil, for the
+// tenants that the clients select.
+func (s *server) serve(l net.Listener, t *tenant) error {
+	s.addListener(t)
+	defer s.removeListener(t)
 
 	tempDelay := time.Duration(0)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				atomic.StoreInt32(&s.acceptFailing, 1)
 				// delay code based on net/http.Server
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -101,62 +191,390 @@ func (s *server) Serve(l net.Listener) error {
 				if tempDelay > maxListenDelay {
 					tempDelay = maxListenDelay
 				}
-				log.Debugf("Error accepting connection: %v; retrying in %v", err, tempDelay)
+				s.log.Debugf("Error accepting connection: %v; retrying in %v", err, tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
-			return log.Errorf("Error accepting: %v", err)
+			s.log.Errorf("Error accepting: %v", err)
+			return fmt.Errorf("Error accepting: %v", err)
 		}
 		tempDelay = 0
-		s.handle(conn)
+		atomic.StoreInt32(&s.acceptFailing, 0)
+		go s.handle(conn, t)
 	}
 }
 
-func (s *server) handle(conn net.Conn) {
+// addListener registers a listener that serves t or, if it's nil, the tenants
+// that clients select.
+func (s *server) addListener(t *tenant) {
+	s.listenersMx.Lock()
+	if t == nil {
+		s.sharedListeners++
+	} else {
+		t.listeners++
+	}
+	s.listenersMx.Unlock()
+	atomic.AddInt64(&s.listening, 1)
+}
+
+// removeListener unregisters a listener that stopped serving. The server
+// forgets the clients of tenants that no remaining listener serves, and closes
+// once no listener is left, so one tenant's listener failing doesn't affect the
+// other tenants.
+func (s *server) removeListener(t *tenant) {
+	s.listenersMx.Lock()
+	if t == nil {
+		s.sharedListeners--
+	} else {
+		t.listeners--
+	}
+	unserved := make(map[*tenant]bool)
+	if s.sharedListeners == 0 {
+		for _, candidate := range append([]*tenant{s.defaultTenant}, s.orderedTenants...) {
+			if candidate.listeners == 0 {
+				unserved[candidate] = true
+			}
+		}
+	}
+	s.listenersMx.Unlock()
+
+	if atomic.AddInt64(&s.listening, -1) == 0 {
+		s.forgetClients()
+		s.Close()
+		return
+	}
+	s.forgetTenantClients(unserved)
+}
+
+func (s *server) handle(conn net.Conn, t *tenant) {
+	// clients that don't complete the handshake in time are disconnected
+	conn.SetDeadline(time.Now().Add(s.opts.HandshakeTimeout))
+
 	// use framed protocol
 	framedConn := framed.NewReadWriteCloser(conn)
 	framedConn.EnableBigFrames()
 	framedConn.DisableThreadSafety()
 	framedConn.EnableBuffering(s.opts.ReadBufferSize)
 
-	// Read client ID
-	b := make([]byte, 36)
-	_, err := framedConn.Read(b)
+	// Read client ID and handshake
+	b := make([]byte, protocol.MaxHelloSize)
+	n, err := framedConn.Read(b)
 	if err != nil {
-		log.Errorf("Unable to read client ID: %v", err)
+		s.log.With("remote", conn.RemoteAddr()).Errorf("Unable to read client ID: %v", err)
+		framedConn.Close()
+		return
+	}
+	id, hs, err := protocol.DecodeHello(b[:n])
+	if err != nil {
+		s.log.With("remote", conn.RemoteAddr()).Errorf("Unable to decode hello: %v", err)
+		framedConn.Close()
 		return
 	}
-	id := string(b)
 
-	s.clientsMx.Lock()
-	c := s.clients[id]
-	if c == nil {
-		efc := eventual.NewValue()
-		efc.Set(framedConn)
-		c = &client{
-			id:         id,
-			s:          s,
-			framedConn: efc,
-		}
-		c.markActive()
-
-		gn, err := gonat.NewServer(c, &s.opts.Opts)
+	req := &AuthRequest{
+		ClientID:   id,
+		RemoteAddr: conn.RemoteAddr(),
+	}
+	mode := protocol.ModeIP
+	if hs != nil {
+		req.Username = hs.Username
+		req.Password = hs.Password
+		mode = hs.Mode
+	}
+	if t == nil {
+		t = s.tenantFor(req.Username)
+	}
+	req.Tenant = t.Name
+	if err := s.checkMode(mode); err != nil {
+		s.reject(t, framedConn, hs, req, err)
+		return
+	}
+	auth, err := t.authenticate(req)
+	if err != nil {
+		s.reject(t, framedConn, hs, req, err)
+		return
+	}
+
+	key := t.sessionKey(id)
+	if hs != nil && hs.SpeedTest != nil {
+		if err := s.checkSpeedTest(hs); err != nil {
+			s.reject(t, framedConn, hs, req, err)
+			return
+		}
+		if t.periodQuotaExhausted(key, auth) || s.sessionQuotaExhausted(key) {
+			s.reject(t, framedConn, hs, req, ErrQuotaExceeded)
+			return
+		}
+		if !s.startSpeedTest() {
+			s.reject(t, framedConn, hs, req, pferrors.New(ErrPolicyDenied, "too many speed tests running", nil))
+			return
+		}
+		defer s.finishSpeedTest()
+		if s.accept(conn, framedConn, hs, req) {
+			s.speedTest(conn, framedConn, hs.SpeedTest, t, key, auth, s.logFor(req))
+		}
+		return
+	}
+
+	records := hs != nil && hs.Records
+	for {
+		s.clientsMx.Lock()
+		c, starting := s.clients[key], s.starting[key]
+		s.clientsMx.Unlock()
+		if starting != nil {
+			// another connection of the same client is starting the session, join it once it has
+			<-starting
+			continue
+		}
+
+		if c != nil && c.username != req.Username {
+			s.reject(t, framedConn, hs, req, pferrors.New(ErrPolicyDenied, "client ID in use by a different user", nil))
+			return
+		}
+		if c != nil && c.mode != mode {
+			s.reject(t, framedConn, hs, req, pferrors.New(ErrHandshakeFailed, "client ID in use by a session with a different mode", nil))
+			return
+		}
+		if c != nil && c.records != records {
+			s.reject(t, framedConn, hs, req, pferrors.New(ErrHandshakeFailed, "client ID in use by a session with different framing", nil))
+			return
+		}
+		if hs != nil && hs.Secondary {
+			if c == nil || !records {
+				s.reject(t, framedConn, hs, req, pferrors.New(ErrHandshakeFailed, "no session to which to add a secondary path", nil))
+				return
+			}
+			if s.accept(conn, framedConn, hs, req) {
+				c.attachSecondary(framedConn)
+			}
+			return
+		}
+		if c != nil {
+			if s.accept(conn, framedConn, hs, req) {
+				c.attach(framedConn)
+				c.emit(SessionReattach, TerminateUnknown, 0)
+			}
+			return
+		}
+
+		if t.periodQuotaExhausted(key, auth) || s.sessionQuotaExhausted(key) {
+			s.reject(t, framedConn, hs, req, ErrQuotaExceeded)
+			return
+		}
+		started, ok := s.reserve(key)
+		if !ok {
+			continue
+		}
+		c, err = s.newClient(t, key, mode, records, req, auth)
+		s.clientsMx.Lock()
+		if err == nil {
+			s.clients[key] = c
+		}
+		delete(s.starting, key)
+		s.clientsMx.Unlock()
+		close(started)
 		if err != nil {
-			log.Errorf("Unable to open gonat: %v", err)
+			c.log.Errorf("Unable to start session: %v", err)
+			s.reject(t, framedConn, hs, req, pferrors.New(ErrHandshakeFailed, "unable to start session", nil))
 			return
 		}
-		go func() {
-			if serveErr := gn.Serve(); serveErr != nil {
-				if serveErr != io.EOF {
-					log.Errorf("Error handling packets: %v", serveErr)
-				}
+
+		c.start(framedConn)
+		atomic.AddInt64(&t.sessionsStarted, 1)
+		c.emit(SessionStart, TerminateUnknown, 0)
+		// if this fails, the session waits for the client to reattach until it's idle
+		s.accept(conn, framedConn, hs, req)
+		return
+	}
+}
+
+// reserve reserves key for a session that's being started, returning a
+// channel to close once it has started or failed. It returns false if there's
+// already a session with that key or one is being started.
+func (s *server) reserve(key string) (chan struct{}, bool) {
+	s.clientsMx.Lock()
+	defer s.clientsMx.Unlock()
+	if s.clients[key] != nil || s.starting[key] != nil {
+		return nil, false
+	}
+	started := make(chan struct{})
+	s.starting[key] = started
+	return started, true
+}
+
+// newClient constructs a session along with its packet server, without
+// starting it. Constructing the packet server may be slow, for example when
+// it creates a TAP device, so this mustn't be called while holding clientsMx.
+func (s *server) newClient(t *tenant, key string, mode protocol.Mode, records bool, req *AuthRequest, auth *AuthResult) (*client, error) {
+	c := &client{
+		id:                req.ClientID,
+		key:               key,
+		tenant:            t,
+		mode:              mode,
+		records:           records,
+		redundant:         s.redundantFor(mode),
+		username:          req.Username,
+		log:               s.logFor(req),
+		remoteAddr:        req.RemoteAddr,
+		started:           time.Now(),
+		auth:              auth,
+		quota:             t.quotaFor(auth),
+		upstreamLimiter:   newRateLimiter(auth.UpstreamBytesPerSecond),
+		downstreamLimiter: newRateLimiter(auth.DownstreamBytesPerSecond),
+		s:                 s,
+		framedConn:        eventual.NewValue(),
+		done:              make(chan struct{}),
+	}
+	ps, err := s.newPacketServer(c)
+	if err != nil {
+		return c, err
+	}
+	c.ps = ps
+	return c, nil
+}
+
+// start starts processing the packets of a new session that reads from and
+// writes to framedConn.
+func (c *client) start(framedConn *framed.ReadWriteCloser) {
+	c.framedConn.Set(framedConn)
+	if c.records {
+		c.inbound = make(chan bpool.ByteSlice)
+		go c.readRecords(framedConn)
+	}
+	c.markActive()
+	if c.tenant.Accountant != nil {
+		go c.account()
+	}
+	if c.tenant.UsageStore != nil {
+		c.refreshPeriodUsage(time.Now(), 0)
+		go c.trackUsage()
+	}
+	go func() {
+		if serveErr := c.ps.Serve(); serveErr != nil {
+			if serveErr != io.EOF {
+				c.log.Errorf("Error handling packets: %v", serveErr)
 			}
-		}()
-		s.clients[id] = c
-	} else {
-		c.attach(framedConn)
+		}
+	}()
+}
+
+// packetServer processes the packets of a single session.
+type packetServer interface {
+	Serve() error
+
+	Close() error
+}
+
+func (s *server) checkMode(mode protocol.Mode) error {
+	switch mode {
+	case protocol.ModeIP:
+		return nil
+	case protocol.ModeEthernet:
+		if s.opts.Bridge == "" {
+			return pferrors.New(ErrPolicyDenied, "ethernet mode not enabled on this server", nil)
+		}
+		return nil
+	default:
+		return pferrors.New(ErrPolicyDenied, "unsupported mode "+string(mode), nil)
 	}
-	s.clientsMx.Unlock()
+}
+
+func (s *server) newPacketServer(c *client) (packetServer, error) {
+	if c.mode == protocol.ModeEthernet {
+		return newBridgeServer(c, s.opts.Bridge)
+	}
+	// gonat applies defaults to the options it's given, so give it a copy that it can
+	// resolve IFAddr on without racing other sessions
+	natOpts := *c.tenant.natOpts
+	return gonat.NewServer(c, &natOpts)
+}
+
+func (s *server) redundantFor(mode protocol.Mode) func([]byte) bool {
+	if s.opts.Redundant != nil {
+		return s.opts.Redundant
+	}
+	if mode == protocol.ModeEthernet {
+		return protocol.RealTimeFrame
+	}
+	return protocol.RealTime
+}
+
+func (t *tenant) authenticate(req *AuthRequest) (*AuthResult, error) {
+	if t.Authenticator == nil {
+		return &AuthResult{}, nil
+	}
+	auth, err := t.Authenticator.Authenticate(req)
+	if err != nil {
+		if pferrors.Kind(err) == nil {
+			// for example, the RADIUS server didn't respond, so the client should try again
+			err = pferrors.New(ErrAuthUnavailable, "", err)
+		}
+		return nil, err
+	}
+	if auth == nil {
+		auth = &AuthResult{}
+	}
+	return auth, nil
+}
+
+func (t *tenant) quotaFor(auth *AuthResult) int64 {
+	if auth.Quota > 0 {
+		return auth.Quota
+	}
+	return t.Quota
+}
+
+// periodQuotaExhausted checks whether a client has already used up its daily
+// or monthly quota in previous sessions. key is the client's session key.
+func (t *tenant) periodQuotaExhausted(key string, auth *AuthResult) bool {
+	quota := t.quotaFor(auth)
+	if quota <= 0 || t.QuotaPeriod == 0 {
+		return false
+	}
+	return t.UsageStore.Get(key, t.QuotaPeriod, time.Now()).Total() >= quota
+}
+
+// accept tells the client that its handshake succeeded, if it sent one, and
+// lifts the handshake deadline.
+func (s *server) accept(conn net.Conn, framedConn *framed.ReadWriteCloser, hs *protocol.Handshake, req *AuthRequest) bool {
+	if hs != nil {
+		if err := respondToHandshake(framedConn, &protocol.HandshakeResponse{OK: true}); err != nil {
+			s.logFor(req).Errorf("Unable to respond to handshake: %v", err)
+			framedConn.Close()
+			return false
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return true
+}
+
+func (s *server) reject(t *tenant, framedConn *framed.ReadWriteCloser, hs *protocol.Handshake, req *AuthRequest, err error) {
+	atomic.AddInt64(&t.rejections, 1)
+	clog := s.logFor(req)
+	clog.Errorf("Rejecting client: %v", err)
+	if hs != nil {
+		if respondErr := respondToHandshake(framedConn, &protocol.HandshakeResponse{Error: err.Error(), Code: pferrors.Code(err)}); respondErr != nil {
+			clog.Debugf("Unable to notify client of rejection: %v", respondErr)
+		}
+	}
+	framedConn.Close()
+}
+
+// logFor returns a logger for lines about the given client.
+func (s *server) logFor(req *AuthRequest) logging.Logger {
+	if req.Tenant != "" {
+		return s.log.With("tenant", req.Tenant, "session", req.ClientID, "remote", req.RemoteAddr)
+	}
+	return s.log.With("session", req.ClientID, "remote", req.RemoteAddr)
+}
+
+func respondToHandshake(framedConn io.Writer, resp *protocol.HandshakeResponse) error {
+	b, err := protocol.EncodeHandshakeResponse(resp)
+	if err != nil {
+		return err
+	}
+	_, err = framedConn.Write(b)
+	return err
 }
 
 func (s *server) forgetClients() {
@@ -165,9 +583,26 @@ func (s *server) forgetClients() {
 	s.clientsMx.Unlock()
 }
 
-func (s *server) forgetClient(id string) {
+// forgetTenantClients forgets the clients of the given tenants
+func (s *server) forgetTenantClients(tenants map[*tenant]bool) {
+	if len(tenants) == 0 {
+		return
+	}
 	s.clientsMx.Lock()
-	delete(s.clients, id)
+	for key, c := range s.clients {
+		if tenants[c.tenant] {
+			delete(s.clients, key)
+		}
+	}
+	s.clientsMx.Unlock()
+}
+
+// forgetClient forgets c, unless a new session has already replaced it
+func (s *server) forgetClient(c *client) {
+	s.clientsMx.Lock()
+	if s.clients[c.key] == c {
+		delete(s.clients, c.key)
+	}
 	s.clientsMx.Unlock()
 }
 
@@ -185,10 +620,42 @@ func (s *server) Close() error {
 type client struct {
 	failedOnCurrentConn int64
 	lastActive          int64
+	bytesUp             int64
+	bytesDown           int64
+	packetsUp           int64
+	packetsDown         int64
+	periodUsed          int64
+	usedAtRefresh       int64
+	quota               int64
+	nextThreshold       int64
+	sequence            uint64
+	respondedDownstream int32
 	id                  string
+	key                 string
+	tenant              *tenant
+	mode                protocol.Mode
+	records             bool
+	redundant           func([]byte) bool
+	dedup               protocol.Deduplicator
+	inbound             chan bpool.ByteSlice
+	secondary           *framed.ReadWriteCloser
+	username            string
+	log                 logging.Logger
+	remoteAddr          net.Addr
+	started             time.Time
+	auth                *AuthResult
+	upstreamLimiter     *rateLimiter
+	downstreamLimiter   *rateLimiter
 	s                   *server
+	ps                  packetServer
 	framedConn          eventual.Value
+	flushed             usage.Usage
+	done                chan struct{}
+	cause               TerminateCause
+	finishOnce          sync.Once
 	mx                  sync.RWMutex
+	// writeMx serializes writes to the session's connections, which aren't thread safe
+	writeMx sync.Mutex
 }
 
 func (c *client) getFramedConn(timeout time.Duration) *framed.ReadWriteCloser {
@@ -199,22 +666,50 @@ func (c *client) getFramedConn(timeout time.Duration) *framed.ReadWriteCloser {
 	return _framedConn.(*framed.ReadWriteCloser)
 }
 
-func (c *client) attach(framedConn io.ReadWriteCloser) {
+func (c *client) attach(framedConn *framed.ReadWriteCloser) {
 	oldFramedConn := c.getFramedConn(0)
 	if oldFramedConn != nil {
 		go oldFramedConn.Close()
 	}
 	atomic.StoreInt64(&c.failedOnCurrentConn, 0)
 	c.framedConn.Set(framedConn)
+	if c.records {
+		// the client may have restarted, starting its sequence over
+		c.dedup.Reset()
+		go c.readRecords(framedConn)
+	}
 }
 
 func (c *client) Read(b bpool.ByteSlice) (int, error) {
+	if c.tenant.Pipeline == nil {
+		return c.readPacket(b)
+	}
+	for {
+		n, err := c.readPacket(b)
+		if err != nil {
+			return n, err
+		}
+		n, ok, err := c.processUpstream(b, n)
+		if ok || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (c *client) readPacket(b bpool.ByteSlice) (int, error) {
+	if c.records {
+		return c.readRecord(b)
+	}
+
 	i := 0
 	for {
 		conn := c.getFramedConn(c.s.opts.IdleTimeout)
-		if conn == nil || c.idle() {
+		if conn == nil || c.idle() || c.expired() {
 			return c.finished(io.EOF)
 		}
+		if c.overQuota() {
+			return c.finished(ErrQuotaExceeded)
+		}
 
 		if c.isFailedOnCurrentConn() {
 			// wait for client to reconnect before idling
@@ -227,8 +722,7 @@ func (c *client) Read(b bpool.ByteSlice) (int, error) {
 
 		n, err := conn.Read(b.Bytes())
 		if err == nil {
-			c.markActive()
-			atomic.AddInt64(&c.s.successfulReads, 1)
+			c.countUpstream(n)
 			return n, err
 		}
 
@@ -238,7 +732,42 @@ func (c *client) Read(b bpool.ByteSlice) (int, error) {
 	}
 }
 
+func (c *client) countUpstream(n int) {
+	c.markActive()
+	atomic.AddInt64(&c.s.successfulReads, 1)
+	atomic.AddInt64(&c.packetsUp, 1)
+	atomic.AddInt64(&c.bytesUp, int64(n))
+	atomic.AddInt64(&c.tenant.packetsUp, 1)
+	atomic.AddInt64(&c.tenant.bytesUp, int64(n))
+	c.checkQuotaThresholds()
+	c.upstreamLimiter.wait(n)
+}
+
 func (c *client) Write(b bpool.ByteSlice) (int, error) {
+	pkt := b.Bytes()
+	// frame, if set, is written instead of b
+	var frame []byte
+	if c.tenant.Pipeline != nil {
+		rewritten, verdict := c.processDownstream(pkt)
+		switch verdict {
+		case pipeline.Drop:
+			return len(b.Bytes()), nil
+		case pipeline.Rewrite:
+			pkt, frame = rewritten, rewritten
+		}
+	}
+	if c.records {
+		frame = c.encodeRecord(pkt)
+	}
+	if _, err := c.write(b, frame, len(pkt)); err != nil {
+		return 0, err
+	}
+	return len(b.Bytes()), nil
+}
+
+// write writes a packet of the given size to the client, either as frame or, if
+// frame is nil, atomically from b.
+func (c *client) write(b bpool.ByteSlice, frame []byte, size int) (int, error) {
 	i := 0
 	for {
 		conn := c.getFramedConn(c.s.opts.IdleTimeout)
@@ -246,7 +775,13 @@ func (c *client) Write(b bpool.ByteSlice) (int, error) {
 			return c.finished(ErrNoConnection)
 		}
 		if c.idle() {
-			return c.finished(idletiming.ErrIdled)
+			return c.finished(pferrors.New(ErrSessionEvicted, "idle", idletiming.ErrIdled))
+		}
+		if c.expired() {
+			return c.finished(ErrSessionTimeout)
+		}
+		if c.overQuota() {
+			return c.finished(ErrQuotaExceeded)
 		}
 
 		if c.isFailedOnCurrentConn() {
@@ -258,9 +793,24 @@ func (c *client) Write(b bpool.ByteSlice) (int, error) {
 		// we're not failed, let's write
 		i = 0
 
-		n, err := conn.WriteAtomic(b)
+		c.downstreamLimiter.wait(size)
+		var n int
+		var err error
+		c.writeMx.Lock()
+		if frame != nil {
+			_, err = conn.Write(frame)
+			n = size
+		} else {
+			n, err = conn.WriteAtomic(b)
+		}
+		c.writeMx.Unlock()
 		if err == nil {
 			atomic.AddInt64(&c.s.successfulWrites, 1)
+			atomic.AddInt64(&c.packetsDown, 1)
+			atomic.AddInt64(&c.bytesDown, int64(n))
+			atomic.AddInt64(&c.tenant.packetsDown, 1)
+			atomic.AddInt64(&c.tenant.bytesDown, int64(n))
+			c.checkQuotaThresholds()
 			c.markActive()
 			return n, err
 		}
@@ -276,10 +826,32 @@ func (c *client) finished(err error) (int, error) {
 	if current != nil {
 		current.Close()
 	}
-	c.s.forgetClient(c.id)
+	c.closeSecondary()
+	c.s.forgetClient(c)
+	c.finishOnce.Do(func() {
+		c.cause = c.terminateCause()
+		if c.cause == TerminateQuotaExceeded {
+			c.s.rememberExhausted(c)
+		}
+		close(c.done)
+		c.emit(SessionEnd, c.cause, 0)
+	})
 	return 0, err
 }
 
+func (c *client) terminateCause() TerminateCause {
+	switch {
+	case c.overQuota():
+		return TerminateQuotaExceeded
+	case c.expired():
+		return TerminateSessionTimeout
+	case c.idle():
+		return TerminateIdleTimeout
+	default:
+		return TerminateConnectionLost
+	}
+}
+
 func (c *client) markActive() {
 	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
 }
@@ -300,6 +872,70 @@ func (c *client) idle() bool {
 	return time.Duration(time.Now().UnixNano()-atomic.LoadInt64(&c.lastActive)) > c.s.opts.IdleTimeout
 }
 
+func (c *client) expired() bool {
+	return c.auth.SessionTimeout > 0 && time.Since(c.started) > c.auth.SessionTimeout
+}
+
+// used returns the number of bytes that count against the session's quota.
+func (c *client) used() int64 {
+	sessionUsed := atomic.LoadInt64(&c.bytesUp) + atomic.LoadInt64(&c.bytesDown)
+	if c.tenant.QuotaPeriod == 0 {
+		return sessionUsed
+	}
+	return atomic.LoadInt64(&c.periodUsed) + sessionUsed - atomic.LoadInt64(&c.usedAtRefresh)
+}
+
+func (c *client) overQuota() bool {
+	return c.quota > 0 && c.used() >= c.quota
+}
+
+// checkQuotaThresholds emits a SessionQuotaThreshold event for every threshold
+// that the session's usage has crossed since the last check.
+func (c *client) checkQuotaThresholds() {
+	if c.quota <= 0 {
+		return
+	}
+	thresholds := c.tenant.QuotaThresholds
+	used := float64(c.used())
+	for {
+		next := atomic.LoadInt64(&c.nextThreshold)
+		if next >= int64(len(thresholds)) || used < thresholds[next]*float64(c.quota) {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&c.nextThreshold, next, next+1) {
+			c.emit(SessionQuotaThreshold, TerminateUnknown, thresholds[next])
+		}
+	}
+}
+
+func (c *client) info(cause TerminateCause) *SessionInfo {
+	return &SessionInfo{
+		ClientID:       c.id,
+		Tenant:         c.tenant.Name,
+		Username:       c.username,
+		RemoteAddr:     c.remoteAddr,
+		Started:        c.started,
+		Duration:       time.Since(c.started),
+		BytesUp:        atomic.LoadInt64(&c.bytesUp),
+		BytesDown:      atomic.LoadInt64(&c.bytesDown),
+		PacketsUp:      atomic.LoadInt64(&c.packetsUp),
+		PacketsDown:    atomic.LoadInt64(&c.packetsDown),
+		TerminateCause: cause,
+	}
+}
+
+func (c *client) emit(eventType SessionEventType, cause TerminateCause, threshold float64) {
+	if c.tenant.OnSessionEvent == nil {
+		return
+	}
+	c.tenant.OnSessionEvent(&SessionEvent{
+		Type:      eventType,
+		Time:      time.Now(),
+		Session:   c.info(cause),
+		Threshold: threshold,
+	})
+}
+
 func sleepWithExponentialBackoff(i int) int {
 	sleepTime := time.Duration(2 << i * baseIODelay)
 	if sleepTime > maxIODelay {
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/gonat"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/pferrors"
+	"github.com/getlantern/packetforward/protocol"
+	"github.com/getlantern/packetforward/server/usage"
+)
+
+const (
+	// DefaultSpeedTestPacketSize is the size of the test data records that the server sends
+	// in download tests if the client doesn't request a size
+	DefaultSpeedTestPacketSize = 1500
+
+	// DefaultMaxSpeedTests is the default number of speed tests that can run at the same time
+	DefaultMaxSpeedTests = 4
+
+	// speedTestGrace is how much longer than its duration a speed test may take,
+	// for example to drain buffers and exchange summaries
+	speedTestGrace = 10 * time.Second
+)
+
+// checkSpeedTest checks whether the server can run the requested speed test.
+func (s *server) checkSpeedTest(hs *protocol.Handshake) error {
+	if s.opts.MaxSpeedTestDuration <= 0 {
+		return pferrors.New(ErrPolicyDenied, "speed tests not enabled on this server", nil)
+	}
+	if !hs.Records {
+		return pferrors.New(ErrHandshakeFailed, "speed tests require records", nil)
+	}
+	switch hs.SpeedTest.Direction {
+	case protocol.SpeedTestUpload, protocol.SpeedTestDownload:
+		return nil
+	default:
+		return pferrors.New(ErrHandshakeFailed, "unsupported speed test direction "+string(hs.SpeedTest.Direction), nil)
+	}
+}
+
+// startSpeedTest reserves one of the server's MaxSpeedTests slots, returning
+// false if they're all taken.
+func (s *server) startSpeedTest() bool {
+	if atomic.AddInt32(&s.speedTests, 1) > int32(s.opts.MaxSpeedTests) {
+		atomic.AddInt32(&s.speedTests, -1)
+		return false
+	}
+	return true
+}
+
+func (s *server) finishSpeedTest() {
+	atomic.AddInt32(&s.speedTests, -1)
+}
+
+// speedTestBudget returns how many bytes of test data a speed test may
+// transfer before the client's quota is used up.
+func (s *server) speedTestBudget(t *tenant, key string, auth *AuthResult) int64 {
+	quota := t.quotaFor(auth)
+	if quota <= 0 {
+		return math.MaxInt64
+	}
+	var used int64
+	if t.QuotaPeriod != 0 {
+		used = t.UsageStore.Get(key, t.QuotaPeriod, time.Now()).Total()
+	} else {
+		s.clientsMx.Lock()
+		c := s.clients[key]
+		s.clientsMx.Unlock()
+		if c != nil {
+			used = c.used()
+		}
+	}
+	if used >= quota {
+		return 0
+	}
+	return quota - used
+}
+
+// speedTest is a speed test running on a client's connection. It doesn't
+// forward anything, so it only measures the path between client and server.
+// The session's rate limits apply and the test data counts toward the
+// client's usage. The test ends early once the test data would exceed the
+// client's remaining quota (budget).
+type speedTest struct {
+	framedConn *framed.ReadWriteCloser
+	log        logging.Logger
+	bufferSize int
+	budget     int64
+	writeMx    sync.Mutex
+}
+
+// speedTest runs the requested speed test on an accepted connection and
+// closes it when done.
+func (s *server) speedTest(conn net.Conn, framedConn *framed.ReadWriteCloser, req *protocol.SpeedTest, t *tenant, key string, auth *AuthResult, clog logging.Logger) {
+	defer framedConn.Close()
+
+	duration := time.Duration(req.DurationMillis) * time.Millisecond
+	if duration <= 0 || duration > s.opts.MaxSpeedTestDuration {
+		duration = s.opts.MaxSpeedTestDuration
+	}
+	conn.SetDeadline(time.Now().Add(duration + speedTestGrace))
+
+	st := &speedTest{
+		framedConn: framedConn,
+		log:        clog,
+		bufferSize: s.opts.ReadBufferSize + protocol.MaxRecordOverhead,
+		budget:     s.speedTestBudget(t, key, auth),
+	}
+	var summary *protocol.SpeedTestSummary
+	var err error
+	if req.Direction == protocol.SpeedTestUpload {
+		summary, err = st.sink(newRateLimiter(auth.UpstreamBytesPerSecond))
+	} else {
+		size := req.PacketSize
+		if size <= 0 {
+			size = DefaultSpeedTestPacketSize
+		}
+		if size < protocol.MinTestDataSize {
+			size = protocol.MinTestDataSize
+		}
+		if size > gonat.MaximumIPPacketSize+protocol.MaxRecordOverhead {
+			size = gonat.MaximumIPPacketSize + protocol.MaxRecordOverhead
+		}
+		summary, err = st.source(duration, size, newRateLimiter(auth.DownstreamBytesPerSecond))
+	}
+	t.recordSpeedTestUsage(key, req.Direction, summary, clog)
+	if err != nil {
+		clog.Debugf("Error running %v speed test: %v", req.Direction, err)
+		return
+	}
+	if summary.QuotaExceeded {
+		clog.Debugf("Ended %v speed test early, quota exceeded after %d packets, %d bytes", req.Direction, summary.Packets, summary.Bytes)
+		return
+	}
+	clog.Debugf("Finished %v speed test: %d packets, %d bytes in %v", req.Direction, summary.Packets, summary.Bytes, time.Duration(summary.ElapsedMicros)*time.Microsecond)
+}
+
+// recordSpeedTestUsage counts the test data that a speed test transferred
+// toward the client's usage.
+func (t *tenant) recordSpeedTestUsage(key string, direction protocol.SpeedTestDirection, summary *protocol.SpeedTestSummary, clog logging.Logger) {
+	if summary.Packets == 0 {
+		return
+	}
+	var delta usage.Usage
+	if direction == protocol.SpeedTestUpload {
+		delta.BytesUp, delta.PacketsUp = summary.Bytes, summary.Packets
+		atomic.AddInt64(&t.bytesUp, summary.Bytes)
+		atomic.AddInt64(&t.packetsUp, summary.Packets)
+	} else {
+		delta.BytesDown, delta.PacketsDown = summary.Bytes, summary.Packets
+		atomic.AddInt64(&t.bytesDown, summary.Bytes)
+		atomic.AddInt64(&t.packetsDown, summary.Packets)
+	}
+	if t.UsageStore != nil {
+		if err := t.UsageStore.Add(key, time.Now(), delta); err != nil {
+			clog.Errorf("Unable to record usage: %v", err)
+		}
+	}
+}
+
+// sink receives test data until the client sends its summary and answers
+// with a summary of what it received. If test data would exceed the budget,
+// it answers right away, discards the rest and waits for the client to hang
+// up. If it fails, it still returns what it received so far.
+func (st *speedTest) sink(limiter *rateLimiter) (*protocol.SpeedTestSummary, error) {
+	received := &protocol.SpeedTestSummary{}
+	var first, last time.Time
+	b := make([]byte, st.bufferSize)
+	for {
+		n, err := st.framedConn.Read(b)
+		if err != nil {
+			return received, err
+		}
+		record, err := protocol.DecodeRecord(b[:n])
+		if err != nil {
+			continue
+		}
+		switch record.Type {
+		case protocol.RecordTestData:
+			if received.Bytes+int64(n) > st.budget {
+				received.QuotaExceeded = true
+				received.ElapsedMicros = int64(last.Sub(first) / time.Microsecond)
+				encoded, err := protocol.EncodeTestSummary(received)
+				if err != nil {
+					return received, err
+				}
+				if err := st.write(encoded); err != nil {
+					return received, err
+				}
+				if err := st.answerPings(); err != io.EOF {
+					return received, err
+				}
+				return received, nil
+			}
+			limiter.wait(n)
+			last = time.Now()
+			if received.Packets == 0 {
+				first = last
+			}
+			received.Packets++
+			received.Bytes += int64(n)
+		case protocol.RecordPing:
+			if err := st.write(protocol.EncodePong(record.Sequence)); err != nil {
+				return received, err
+			}
+		case protocol.RecordTestSummary:
+			received.ElapsedMicros = int64(last.Sub(first) / time.Microsecond)
+			encoded, err := protocol.EncodeTestSummary(received)
+			if err != nil {
+				return received, err
+			}
+			return received, st.write(encoded)
+		}
+	}
+}
+
+// source sends test data for the given duration, or until more would exceed
+// the budget, followed by a summary of what it sent, answering pings in the
+// meantime. It returns once the client hangs up. If it fails, it still returns
+// what it sent so far.
+func (st *speedTest) source(duration time.Duration, size int, limiter *rateLimiter) (*protocol.SpeedTestSummary, error) {
+	hungUp := make(chan error, 1)
+	go func() {
+		hungUp <- st.answerPings()
+	}()
+
+	sent := &protocol.SpeedTestSummary{}
+	record := protocol.EncodeTestData(0, size)
+	start := time.Now()
+	for seq := uint64(1); time.Since(start) < duration; seq++ {
+		if sent.Bytes+int64(len(record)) > st.budget {
+			sent.QuotaExceeded = true
+			break
+		}
+		binary.BigEndian.PutUint64(record[1:], seq)
+		limiter.wait(len(record))
+		if err := st.write(record); err != nil {
+			return sent, err
+		}
+		sent.Packets++
+		sent.Bytes += int64(len(record))
+	}
+	sent.ElapsedMicros = int64(time.Since(start) / time.Microsecond)
+	encoded, err := protocol.EncodeTestSummary(sent)
+	if err != nil {
+		return sent, err
+	}
+	if err := st.write(encoded); err != nil {
+		return sent, err
+	}
+	if err := <-hungUp; err != io.EOF {
+		return sent, err
+	}
+	return sent, nil
+}
+
+// answerPings answers pings until the connection fails.
+func (st *speedTest) answerPings() error {
+	b := make([]byte, st.bufferSize)
+	for {
+		n, err := st.framedConn.Read(b)
+		if err != nil {
+			return err
+		}
+		record, err := protocol.DecodeRecord(b[:n])
+		if err != nil || record.Type != protocol.RecordPing {
+			continue
+		}
+		if err := st.write(protocol.EncodePong(record.Sequence)); err != nil {
+			return err
+		}
+	}
+}
+
+func (st *speedTest) write(record []byte) error {
+	st.writeMx.Lock()
+	defer st.writeMx.Unlock()
+	_, err := st.framedConn.Write(record)
+	return err
+}
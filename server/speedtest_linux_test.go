@@ -0,0 +1,268 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/protocol"
+	"github.com/getlantern/packetforward/server/usage"
+)
+
+func TestSpeedTest(t *testing.T) {
+	store := &memoryUsageStore{usage: make(map[string]usage.Usage)}
+	opts := &Opts{ReadBufferSize: DefaultReadBufferSize, HandshakeTimeout: DefaultHandshakeTimeout, MaxSpeedTests: 1, UsageStore: store}
+	s := &server{
+		opts:      opts,
+		log:       logging.FromGolog(log),
+		tenants:   make(map[string]*tenant),
+		clients:   make(map[string]*client),
+		exhausted: make(map[string]*exhaustedSession),
+	}
+	s.defaultTenant = s.newTenant(opts.defaultTenant())
+
+	connect := func(st *protocol.SpeedTest) (*framed.ReadWriteCloser, *protocol.HandshakeResponse) {
+		return connectSpeedTest(t, s, st)
+	}
+	readRecord := func(rwc *framed.ReadWriteCloser) *protocol.Record {
+		return readSpeedTestRecord(t, rwc)
+	}
+
+	rwc, resp := connect(&protocol.SpeedTest{Direction: protocol.SpeedTestUpload})
+	rwc.Close()
+	if resp.OK || resp.Code != "policy_denied" {
+		t.Errorf("Speed test should have been rejected while disabled: %+v", resp)
+	}
+
+	opts.MaxSpeedTestDuration = 50 * time.Millisecond
+	rwc, resp = connect(&protocol.SpeedTest{Direction: "sideways"})
+	rwc.Close()
+	if resp.OK {
+		t.Error("Speed test with unsupported direction should have been rejected")
+	}
+
+	rwc, resp = connect(&protocol.SpeedTest{Direction: protocol.SpeedTestUpload})
+	if !resp.OK {
+		t.Fatalf("Upload test rejected: %+v", resp)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		rwc.Write(protocol.EncodeTestData(i, 100))
+	}
+	rwc.Write(protocol.EncodePing(1))
+	if record := readRecord(rwc); record.Type != protocol.RecordPong || record.Sequence != 1 {
+		t.Errorf("Expected pong, got %+v", record)
+	}
+
+	// only one test may run at a time
+	other, otherResp := connect(&protocol.SpeedTest{Direction: protocol.SpeedTestUpload})
+	other.Close()
+	if otherResp.OK || otherResp.Code != "policy_denied" {
+		t.Errorf("Concurrent speed test should have been rejected: %+v", otherResp)
+	}
+
+	summary, _ := protocol.EncodeTestSummary(&protocol.SpeedTestSummary{Packets: 10, Bytes: 1000})
+	rwc.Write(summary)
+	record := readRecord(rwc)
+	received, err := protocol.DecodeTestSummary(record.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Type != protocol.RecordTestSummary || received.Packets != 10 || received.Bytes != 1000 {
+		t.Errorf("Wrong upload summary: %+v", received)
+	}
+	rwc.Close()
+	for atomic.LoadInt32(&s.speedTests) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the server limits the duration to MaxSpeedTestDuration
+	start := time.Now()
+	rwc, resp = connect(&protocol.SpeedTest{Direction: protocol.SpeedTestDownload, DurationMillis: 60000, PacketSize: 200})
+	if !resp.OK {
+		t.Fatalf("Download test rejected: %+v", resp)
+	}
+	var packets, bytes int64
+	for {
+		record := readRecord(rwc)
+		if record.Type == protocol.RecordTestData {
+			packets++
+			bytes += int64(1 + 8 + len(record.Payload))
+			continue
+		}
+		sent, err := protocol.DecodeTestSummary(record.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packets == 0 || sent.Packets != packets || sent.Bytes != bytes || bytes != packets*200 {
+			t.Errorf("Wrong download summary %+v for %d packets, %d bytes", sent, packets, bytes)
+		}
+		break
+	}
+	rwc.Close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Download test should have been limited to MaxSpeedTestDuration, took %v", elapsed)
+	}
+
+	// the test data counts toward the client's usage once the server notices the hang up
+	deadline := time.Now().Add(5 * time.Second)
+	for store.get("00000000-0000-0000-0000-000000000000").BytesDown != bytes {
+		if time.Now().After(deadline) {
+			t.Fatalf("Wrong usage %+v", store.get("00000000-0000-0000-0000-000000000000"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if used := store.get("00000000-0000-0000-0000-000000000000"); used.BytesUp != 1000 || used.PacketsUp != 10 || used.PacketsDown != packets {
+		t.Errorf("Wrong usage %+v", used)
+	}
+}
+
+func TestSpeedTestQuota(t *testing.T) {
+	const id = "00000000-0000-0000-0000-000000000000"
+	store := &memoryUsageStore{usage: map[string]usage.Usage{id: {BytesUp: 700}}}
+	opts := &Opts{
+		ReadBufferSize:       DefaultReadBufferSize,
+		HandshakeTimeout:     DefaultHandshakeTimeout,
+		MaxSpeedTests:        1,
+		MaxSpeedTestDuration: 5 * time.Second,
+		Quota:                1000,
+		QuotaPeriod:          usage.PeriodDay,
+		UsageStore:           store,
+	}
+	s := &server{
+		opts:      opts,
+		log:       logging.FromGolog(log),
+		tenants:   make(map[string]*tenant),
+		clients:   make(map[string]*client),
+		exhausted: make(map[string]*exhaustedSession),
+	}
+	s.defaultTenant = s.newTenant(opts.defaultTenant())
+	waitForUsage := func(expected usage.Usage) {
+		deadline := time.Now().Add(5 * time.Second)
+		for store.get(id) != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("Wrong usage %+v, expected %+v", store.get(id), expected)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for atomic.LoadInt32(&s.speedTests) > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the server stops sinking test data once the remaining 300 bytes are used up
+	start := time.Now()
+	rwc, resp := connectSpeedTest(t, s, &protocol.SpeedTest{Direction: protocol.SpeedTestUpload})
+	if !resp.OK {
+		t.Fatalf("Upload test rejected: %+v", resp)
+	}
+	go func(rwc *framed.ReadWriteCloser) {
+		for i := uint64(1); i <= 10; i++ {
+			if _, err := rwc.Write(protocol.EncodeTestData(i, 100)); err != nil {
+				return
+			}
+		}
+	}(rwc)
+	record := readSpeedTestRecord(t, rwc)
+	received, err := protocol.DecodeTestSummary(record.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Type != protocol.RecordTestSummary || !received.QuotaExceeded || received.Packets != 3 || received.Bytes != 300 {
+		t.Errorf("Wrong upload summary: %+v", received)
+	}
+	rwc.Close()
+	waitForUsage(usage.Usage{BytesUp: 1000, PacketsUp: 3})
+
+	// a download test with less than a record's worth of quota left sends nothing
+	store.mx.Lock()
+	store.usage[id] = usage.Usage{BytesDown: 850}
+	store.mx.Unlock()
+	rwc, resp = connectSpeedTest(t, s, &protocol.SpeedTest{Direction: protocol.SpeedTestDownload, DurationMillis: 60000, PacketSize: 200})
+	if !resp.OK {
+		t.Fatalf("Download test rejected: %+v", resp)
+	}
+	record = readSpeedTestRecord(t, rwc)
+	sent, err := protocol.DecodeTestSummary(record.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Type != protocol.RecordTestSummary || !sent.QuotaExceeded || sent.Packets != 0 || sent.Bytes != 0 {
+		t.Errorf("Wrong download summary: %+v", sent)
+	}
+	rwc.Close()
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("Speed tests should have ended once the quota was used up, took %v", elapsed)
+	}
+	waitForUsage(usage.Usage{BytesDown: 850})
+}
+
+// connectSpeedTest connects a client to s that requests the given speed test
+// and returns the server's response.
+func connectSpeedTest(t *testing.T, s *server, st *protocol.SpeedTest) (*framed.ReadWriteCloser, *protocol.HandshakeResponse) {
+	serverConn, clientConn := net.Pipe()
+	go s.handle(serverConn, nil)
+	rwc := framed.NewReadWriteCloser(clientConn)
+	rwc.EnableBigFrames()
+	hello, err := protocol.EncodeHello("00000000-0000-0000-0000-000000000000", &protocol.Handshake{Records: true, SpeedTest: st})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rwc.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, protocol.MaxHelloSize)
+	n, err := rwc.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := protocol.DecodeHandshakeResponse(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rwc, resp
+}
+
+func readSpeedTestRecord(t *testing.T, rwc *framed.ReadWriteCloser) *protocol.Record {
+	b := make([]byte, 65536)
+	n, err := rwc.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := protocol.DecodeRecord(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// memoryUsageStore keeps usage in memory, ignoring periods
+type memoryUsageStore struct {
+	usage map[string]usage.Usage
+	mx    sync.Mutex
+}
+
+func (s *memoryUsageStore) Add(clientID string, at time.Time, delta usage.Usage) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	u := s.usage[clientID]
+	u.BytesUp += delta.BytesUp
+	u.BytesDown += delta.BytesDown
+	u.PacketsUp += delta.PacketsUp
+	u.PacketsDown += delta.PacketsDown
+	s.usage[clientID] = u
+	return nil
+}
+
+func (s *memoryUsageStore) Get(clientID string, period usage.Period, at time.Time) usage.Usage {
+	return s.get(clientID)
+}
+
+func (s *memoryUsageStore) get(clientID string) usage.Usage {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.usage[clientID]
+}
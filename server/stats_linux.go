@@ -20,9 +20,21 @@ func (s *server) printStats() {
 			s.clientsMx.Lock()
 			numClients := len(s.clients)
 			s.clientsMx.Unlock()
-			log.Debugf("Number of Clients: %d", numClients)
-			log.Debugf("Reads Succeeded: %d   Failed: %d", atomic.LoadInt64(&s.successfulReads), atomic.LoadInt64(&s.failedReads))
-			log.Debugf("Writes Succeeded: %d   Failed: %d", atomic.LoadInt64(&s.successfulWrites), atomic.LoadInt64(&s.failedWrites))
+			s.log.Debugf("Number of Clients: %d", numClients)
+			s.log.Debugf("Reads Succeeded: %d   Failed: %d", atomic.LoadInt64(&s.successfulReads), atomic.LoadInt64(&s.failedReads))
+			s.log.Debugf("Writes Succeeded: %d   Failed: %d", atomic.LoadInt64(&s.successfulWrites), atomic.LoadInt64(&s.failedWrites))
+			s.log.Debugf("Sessions Evicted: %d", atomic.LoadInt64(&s.evictions))
+			for _, ts := range s.TenantStats() {
+				tlog := s.log
+				if ts.Name != "" {
+					tlog = s.log.With("tenant", ts.Name)
+					tlog.Debugf("Sessions: %d   Started: %d   Rejected: %d   Evicted: %d", ts.Sessions, ts.SessionsStarted, ts.Rejections, ts.Evictions)
+					tlog.Debugf("Bytes Up: %d   Down: %d", ts.BytesUp, ts.BytesDown)
+				}
+				for _, stats := range ts.Pipeline {
+					tlog.Debugf("Pipeline %v: %d packets   Passed: %d   Rewritten: %d   Dropped: %d   Responded: %d", stats.Name, stats.Packets, stats.Passed, stats.Rewritten, stats.Dropped, stats.Responded)
+				}
+			}
 		}
 	}
 }
@@ -0,0 +1,202 @@
+// systemd integrates packetforward servers with systemd without cgo. It
+// supports socket activation (see sd_listen_fds(3)) and sends readiness,
+// status and watchdog notifications to the notify socket (see sd_notify(3)).
+//
+// A typical service runs with Type=notify and optionally WatchdogSec, and
+// calls Ready once it serves its listeners, RunStatus and RunWatchdog while
+// serving and Stopping when it begins to shut down.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/packetforward/server"
+)
+
+var log = golog.LoggerFor("packetforward.systemd")
+
+// listenFDsStart is the first file descriptor passed by socket activation
+const listenFDsStart = 3
+
+// Listeners returns listeners for the sockets that systemd passed to this
+// process through socket activation, in the order in which they're configured
+// in the socket unit. It returns no listeners if the process wasn't socket
+// activated. The socket activation environment variables are unset so that
+// child processes don't inherit them.
+func Listeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		// FileListener duplicates the descriptor with close-on-exec set, so the
+		// original can be closed
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errors.New("unable to listen on socket %v: %v", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// Notifier sends notifications to systemd. A nil Notifier, which NewNotifier
+// returns if the process doesn't run under systemd with a notify socket,
+// ignores all notifications, so callers don't need to check.
+type Notifier struct {
+	conn *net.UnixConn
+}
+
+// NewNotifier connects to the notify socket in NOTIFY_SOCKET. It returns nil
+// if NOTIFY_SOCKET isn't set.
+func NewNotifier() (*Notifier, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil, nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return nil, errors.New("unable to connect to notify socket %v: %v", addr, err)
+	}
+	return &Notifier{conn: conn}, nil
+}
+
+// Notify sends the given state assignments, for example "READY=1", in a
+// single notification.
+func (n *Notifier) Notify(state ...string) error {
+	if n == nil {
+		return nil
+	}
+	if _, err := n.conn.Write([]byte(strings.Join(state, "\n"))); err != nil {
+		return errors.New("unable to notify systemd: %v", err)
+	}
+	return nil
+}
+
+// Ready notifies systemd that the server finished starting up.
+func (n *Notifier) Ready() error {
+	return n.Notify("READY=1")
+}
+
+// Stopping notifies systemd that the server is shutting down.
+func (n *Notifier) Stopping() error {
+	return n.Notify("STOPPING=1")
+}
+
+// Status sets the status that systemctl status shows for the service.
+func (n *Notifier) Status(status string) error {
+	return n.Notify("STATUS=" + status)
+}
+
+// Watchdog pings systemd's service watchdog.
+func (n *Notifier) Watchdog() error {
+	return n.Notify("WATCHDOG=1")
+}
+
+// Close closes the connection to the notify socket.
+func (n *Notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+	return n.conn.Close()
+}
+
+// WatchdogInterval returns how frequently systemd expects watchdog pings
+// (WatchdogSec in the service unit), or 0 if the watchdog isn't enabled for
+// this process.
+func WatchdogInterval() (time.Duration, error) {
+	usecs := os.Getenv("WATCHDOG_USEC")
+	if usecs == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	usec, err := strconv.ParseInt(usecs, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, errors.New("invalid WATCHDOG_USEC %v", usecs)
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// RunWatchdog pings the watchdog at half the given interval until stop is
+// closed. If healthy is specified, pings are skipped while it returns false,
+// so that systemd restarts a server that stopped working.
+func (n *Notifier) RunWatchdog(interval time.Duration, healthy func() bool, stop <-chan struct{}) {
+	if n == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		if healthy == nil || healthy() {
+			if err := n.Watchdog(); err != nil {
+				log.Debug(err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RunStatus updates the service's status with the server's session counts at
+// the given interval until stop is closed.
+func (n *Notifier) RunStatus(s server.Server, interval time.Duration, stop <-chan struct{}) {
+	if n == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := n.Status(StatusFor(s.TenantStats())); err != nil {
+			log.Debug(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// StatusFor summarizes tenant stats as a status line.
+func StatusFor(stats []*server.TenantStats) string {
+	var sessions int
+	var started, rejected int64
+	for _, ts := range stats {
+		sessions += ts.Sessions
+		started += ts.SessionsStarted
+		rejected += ts.Rejections
+	}
+	return fmt.Sprintf("%d sessions, %d started, %d rejected", sessions, started, rejected)
+}
@@ -0,0 +1,159 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/getlantern/packetforward/server"
+)
+
+func TestListeners(t *testing.T) {
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	listeners, err := Listeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("Sockets for another process should be ignored: %v %v", listeners, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("Environment should have been unset")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// socket activated processes receive their sockets starting at file descriptor 3
+	cmd := exec.Command(os.Args[0], "-test.run=TestActivatedProcess")
+	cmd.Env = append(os.Environ(), "SYSTEMD_TEST_ACTIVATED=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=packetforward")
+	cmd.ExtraFiles = []*os.File{f}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "packetforward" {
+		t.Errorf("Activated process should have accepted on the passed socket, got %q", b)
+	}
+}
+
+// TestActivatedProcess runs in the process started by TestListeners.
+func TestActivatedProcess(t *testing.T) {
+	if os.Getenv("SYSTEMD_TEST_ACTIVATED") == "" {
+		return
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	listeners, err := Listeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 {
+		t.Fatalf("Expected 1 listener, got %d", len(listeners))
+	}
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("packetforward"))
+	conn.Close()
+}
+
+func TestNotifier(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	n, err := NewNotifier()
+	if err != nil || n != nil {
+		t.Fatal("Notifier should be nil without NOTIFY_SOCKET")
+	}
+	if err := n.Ready(); err != nil {
+		t.Error("nil Notifier should ignore notifications")
+	}
+
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "notify")
+	socket, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	read := func() string {
+		b := make([]byte, 1024)
+		n, err := socket.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b[:n])
+	}
+
+	os.Setenv("NOTIFY_SOCKET", addr)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	n, err = NewNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	n.Ready()
+	if msg := read(); msg != "READY=1" {
+		t.Errorf("Unexpected notification %q", msg)
+	}
+	n.Status(StatusFor([]*server.TenantStats{{Sessions: 2, SessionsStarted: 5, Rejections: 1}, {Sessions: 1, SessionsStarted: 1}}))
+	if msg := read(); msg != "STATUS=3 sessions, 6 started, 1 rejected" {
+		t.Errorf("Unexpected notification %q", msg)
+	}
+	n.Notify("STOPPING=1", "STATUS=Shutting down")
+	if msg := read(); msg != "STOPPING=1\nSTATUS=Shutting down" {
+		t.Errorf("Unexpected notification %q", msg)
+	}
+
+	stop := make(chan struct{})
+	healthy := false
+	go n.RunWatchdog(20*time.Millisecond, func() bool {
+		healthy = !healthy
+		return healthy
+	}, stop)
+	for i := 0; i < 2; i++ {
+		if msg := read(); msg != "WATCHDOG=1" {
+			t.Errorf("Unexpected notification %q", msg)
+		}
+	}
+	close(stop)
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	interval, err := WatchdogInterval()
+	if err != nil || interval != 30*time.Second {
+		t.Errorf("Wrong watchdog interval %v: %v", interval, err)
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	if interval, _ := WatchdogInterval(); interval != 0 {
+		t.Error("Watchdog for another process should be ignored")
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"github.com/getlantern/packetforward/pipeline"
+	"github.com/getlantern/packetforward/server/usage"
+)
+
+// Tenant is a customer hosted on a shared server. Each tenant has its own
+// egress interface, packet pipeline, authentication, accounting, quotas and
+// stats. Clients select a tenant by authenticating with a username of the form
+// "user@name", where name is the tenant's Name, or by connecting to a listener
+// that the server serves with ServeTenant. Clients that select no tenant use
+// the settings in Opts.
+//
+// Unlike the egress interface, a tenant's policy, quotas and hooks don't fall
+// back to the ones in Opts, which keeps tenants isolated from each other and
+// from clients that don't belong to a tenant.
+type Tenant struct {
+	// Name identifies the tenant. It must not contain '@' or '/'. Log lines about the tenant's
+	// sessions are tagged with it as "tenant".
+	Name string
+
+	// Labels are reported with the tenant's stats, for example to label metrics
+	Labels map[string]string
+
+	// IFName, if specified, is the interface through which the tenant's traffic leaves the
+	// server. If not specified, defaults to Opts.IFName.
+	IFName string
+
+	// Pipeline, if specified, processes the tenant's packets like Opts.Pipeline does for
+	// clients that don't belong to a tenant, for example to apply the tenant's ACLs
+	Pipeline *pipeline.Chain
+
+	// Authenticator, if specified, authenticates the tenant's clients. The username that it
+	// sees includes the tenant's realm, if the client sent one.
+	Authenticator Authenticator
+
+	// Accountant, if specified, accounts for the tenant's sessions
+	Accountant Accountant
+
+	// Quota, QuotaPeriod and QuotaThresholds work like the corresponding Opts for the tenant's
+	// sessions.
+	Quota           int64
+	QuotaPeriod     usage.Period
+	QuotaThresholds []float64
+
+	// UsageStore, if specified, records the usage of the tenant's clients. Usage is recorded
+	// under "name/id", so tenants may share a store without their clients' IDs colliding.
+	UsageStore usage.Store
+
+	// OnSessionEvent, if specified, is called for the tenant's session events like
+	// Opts.OnSessionEvent
+	OnSessionEvent func(event *SessionEvent)
+}
+
+// TenantStats is a snapshot of a tenant's stats. Stats for clients that don't
+// belong to a tenant are reported with an empty Name.
+type TenantStats struct {
+	Name   string
+	Labels map[string]string
+
+	// Sessions is the number of current sessions
+	Sessions int
+
+	// SessionsStarted counts sessions that started since the server started
+	SessionsStarted int64
+
+	// Rejections counts connections that the server rejected
+	Rejections int64
+
+	// Evictions counts sessions that the server evicted because they were idle or expired
+	Evictions int64
+
+	BytesUp     int64
+	BytesDown   int64
+	PacketsUp   int64
+	PacketsDown int64
+
+	// Pipeline contains stats for the handlers in the tenant's pipeline, if it has one
+	Pipeline []*pipeline.HandlerStats
+}
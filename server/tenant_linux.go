@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/getlantern/gonat"
+)
+
+// tenant is a Tenant along with its stats.
+type tenant struct {
+	sessionsStarted int64
+	rejections      int64
+	evictions       int64
+	bytesUp         int64
+	bytesDown       int64
+	packetsUp       int64
+	packetsDown     int64
+	*Tenant
+	natOpts *gonat.Opts
+	// listeners counts the listeners serving only this tenant, protected by the
+	// server's listenersMx
+	listeners int
+}
+
+// defaultTenant returns a Tenant with the settings for clients that don't
+// belong to a tenant.
+func (opts *Opts) defaultTenant() *Tenant {
+	return &Tenant{
+		Pipeline:        opts.Pipeline,
+		Authenticator:   opts.Authenticator,
+		Accountant:      opts.Accountant,
+		Quota:           opts.Quota,
+		QuotaPeriod:     opts.QuotaPeriod,
+		QuotaThresholds: opts.QuotaThresholds,
+		UsageStore:      opts.UsageStore,
+		OnSessionEvent:  opts.OnSessionEvent,
+	}
+}
+
+// validateTenants checks the configured tenants and sorts their quota
+// thresholds.
+func validateTenants(tenants []*Tenant) error {
+	names := make(map[string]bool, len(tenants))
+	for _, t := range tenants {
+		if t.Name == "" {
+			return errors.New("tenants must have a name")
+		}
+		if strings.ContainsAny(t.Name, "@/") {
+			return fmt.Errorf("tenant name %v must not contain '@' or '/'", t.Name)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate tenant %v", t.Name)
+		}
+		names[t.Name] = true
+		if t.QuotaPeriod != 0 && t.UsageStore == nil {
+			return fmt.Errorf("daily and monthly quotas for tenant %v require a UsageStore", t.Name)
+		}
+		if err := checkPipeline(t.Pipeline); err != nil {
+			return fmt.Errorf("tenant %v: %v", t.Name, err)
+		}
+		thresholds := append([]float64{}, t.QuotaThresholds...)
+		sort.Float64s(thresholds)
+		t.QuotaThresholds = thresholds
+	}
+	return nil
+}
+
+func (s *server) newTenant(t *Tenant) *tenant {
+	natOpts := &s.opts.Opts
+	if t.IFName != "" && t.IFName != natOpts.IFName {
+		tenantNATOpts := *natOpts
+		tenantNATOpts.IFName = t.IFName
+		// IFAddr overrides IFName, so clear the one resolved for the server's interface and
+		// let gonat resolve it from the tenant's interface when starting each session
+		tenantNATOpts.IFAddr = ""
+		natOpts = &tenantNATOpts
+	}
+	return &tenant{Tenant: t, natOpts: natOpts}
+}
+
+// ServeTenant implements the method from Server.
+func (s *server) ServeTenant(l net.Listener, name string) error {
+	t := s.tenants[name]
+	if name == "" || t == nil {
+		return fmt.Errorf("unknown tenant %v", name)
+	}
+	return s.serve(l, t)
+}
+
+// tenantFor returns the tenant selected by the realm of the given username,
+// or the default tenant if the username doesn't have the realm of a known
+// tenant.
+func (s *server) tenantFor(username string) *tenant {
+	if i := strings.LastIndex(username, "@"); i >= 0 {
+		if t := s.tenants[username[i+1:]]; t != nil {
+			return t
+		}
+	}
+	return s.defaultTenant
+}
+
+// sessionKey identifies a session of the client with the given id. Clients of
+// different tenants may use the same id without their sessions colliding.
+func (t *tenant) sessionKey(id string) string {
+	if t.Name == "" {
+		return id
+	}
+	return t.Name + "/" + id
+}
+
+// TenantStats implements the method from Server.
+func (s *server) TenantStats() []*TenantStats {
+	tenants := append([]*tenant{s.defaultTenant}, s.orderedTenants...)
+	sessions := make(map[*tenant]int, len(tenants))
+	s.clientsMx.Lock()
+	for _, c := range s.clients {
+		sessions[c.tenant]++
+	}
+	s.clientsMx.Unlock()
+
+	stats := make([]*TenantStats, 0, len(tenants))
+	for _, t := range tenants {
+		ts := &TenantStats{
+			Name:            t.Name,
+			Labels:          t.Labels,
+			Sessions:        sessions[t],
+			SessionsStarted: atomic.LoadInt64(&t.sessionsStarted),
+			Rejections:      atomic.LoadInt64(&t.rejections),
+			Evictions:       atomic.LoadInt64(&t.evictions),
+			BytesUp:         atomic.LoadInt64(&t.bytesUp),
+			BytesDown:       atomic.LoadInt64(&t.bytesDown),
+			PacketsUp:       atomic.LoadInt64(&t.packetsUp),
+			PacketsDown:     atomic.LoadInt64(&t.packetsDown),
+		}
+		if t.Pipeline != nil {
+			ts.Pipeline = t.Pipeline.Stats()
+		}
+		stats = append(stats, ts)
+	}
+	return stats
+}
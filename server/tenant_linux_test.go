@@ -0,0 +1,227 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/eventual"
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+type authenticatorFunc func(req *AuthRequest) (*AuthResult, error)
+
+func (fn authenticatorFunc) Authenticate(req *AuthRequest) (*AuthResult, error) {
+	return fn(req)
+}
+
+func TestTenants(t *testing.T) {
+	if err := validateTenants([]*Tenant{{Name: "acme"}, {Name: "acme"}}); err == nil {
+		t.Error("Duplicate tenants should be rejected")
+	}
+	if err := validateTenants([]*Tenant{{Name: "a@b"}}); err == nil {
+		t.Error("Tenant names with '@' should be rejected")
+	}
+
+	var requests []*AuthRequest
+	reject := authenticatorFunc(func(req *AuthRequest) (*AuthResult, error) {
+		requests = append(requests, req)
+		return nil, ErrAuthRejected
+	})
+	opts := &Opts{
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		Tenants: []*Tenant{
+			{Name: "acme", IFName: "eth1", Authenticator: reject, Labels: map[string]string{"customer": "ACME"}},
+			{Name: "initech"},
+		},
+	}
+	opts.IFName = "eth0"
+	opts.IFAddr = "192.0.2.1"
+	if err := validateTenants(opts.Tenants); err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		opts:    opts,
+		log:     logging.FromGolog(log),
+		tenants: make(map[string]*tenant),
+		clients: make(map[string]*client),
+	}
+	s.defaultTenant = s.newTenant(opts.defaultTenant())
+	for _, tc := range opts.Tenants {
+		s.tenants[tc.Name] = s.newTenant(tc)
+		s.orderedTenants = append(s.orderedTenants, s.tenants[tc.Name])
+	}
+
+	acme, initech := s.tenants["acme"], s.tenants["initech"]
+	if s.tenantFor("bob@acme") != acme || s.tenantFor("bob@example.com") != s.defaultTenant || s.tenantFor("bob") != s.defaultTenant {
+		t.Error("Wrong tenant selected by username")
+	}
+	if acme.natOpts.IFName != "eth1" || initech.natOpts.IFName != "eth0" || s.defaultTenant.natOpts.IFName != "eth0" {
+		t.Error("Wrong egress interfaces")
+	}
+	if acme.natOpts.IFAddr != "" || initech.natOpts.IFAddr != "192.0.2.1" || s.defaultTenant.natOpts.IFAddr != "192.0.2.1" {
+		t.Error("Tenants with their own interface shouldn't use the server's egress address")
+	}
+	if acme.sessionKey("id") == initech.sessionKey("id") || s.defaultTenant.sessionKey("id") != "id" {
+		t.Error("Session keys of different tenants should differ")
+	}
+
+	id := "00000000-0000-0000-0000-000000000000"
+	handshake := func(username string, listenerTenant *tenant) *protocol.HandshakeResponse {
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		go s.handle(serverConn, listenerTenant)
+		rwc := framed.NewReadWriteCloser(clientConn)
+		rwc.EnableBigFrames()
+		hello, err := protocol.EncodeHello(id, &protocol.Handshake{Username: username})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rwc.Write(hello); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, protocol.MaxHelloSize)
+		n, err := rwc.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := protocol.DecodeHandshakeResponse(b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := handshake("bob@acme", nil); resp.OK || resp.Code != "auth_rejected" {
+		t.Errorf("Tenant's authenticator should have rejected client selecting it by realm: %+v", resp)
+	}
+	if resp := handshake("bob", acme); resp.OK {
+		t.Errorf("Tenant's authenticator should have rejected client connecting through its listener: %+v", resp)
+	}
+	if len(requests) != 2 || requests[0].Tenant != "acme" || requests[0].Username != "bob@acme" {
+		t.Errorf("Wrong auth requests: %+v", requests)
+	}
+
+	stats := s.TenantStats()
+	if len(stats) != 3 || stats[0].Name != "" || stats[1].Name != "acme" || stats[2].Name != "initech" {
+		t.Fatalf("Wrong tenant stats: %+v", stats)
+	}
+	if stats[0].Rejections != 0 || stats[1].Rejections != 2 || stats[2].Rejections != 0 {
+		t.Error("Only acme should have rejected clients")
+	}
+	if stats[1].Labels["customer"] != "ACME" {
+		t.Error("Missing labels")
+	}
+}
+
+func TestTenantListenerClosed(t *testing.T) {
+	opts := &Opts{
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		Tenants:          []*Tenant{{Name: "acme"}, {Name: "initech"}},
+	}
+	opts.IdleTimeout = time.Minute
+	s := &server{
+		opts:    opts,
+		log:     logging.FromGolog(log),
+		tenants: make(map[string]*tenant),
+		clients: make(map[string]*client),
+		close:   make(chan interface{}),
+		closed:  make(chan interface{}),
+	}
+	close(s.closed)
+	s.defaultTenant = s.newTenant(opts.defaultTenant())
+	for _, tc := range opts.Tenants {
+		s.tenants[tc.Name] = s.newTenant(tc)
+		s.orderedTenants = append(s.orderedTenants, s.tenants[tc.Name])
+	}
+
+	newClient := func(tenantName string) (*client, *framed.ReadWriteCloser) {
+		serverConn, clientConn := net.Pipe()
+		serverFramed := framed.NewReadWriteCloser(serverConn)
+		serverFramed.EnableBigFrames()
+		clientFramed := framed.NewReadWriteCloser(clientConn)
+		clientFramed.EnableBigFrames()
+		efc := eventual.NewValue()
+		efc.Set(serverFramed)
+		tnt := s.tenants[tenantName]
+		c := &client{
+			id:         "00000000-0000-0000-0000-000000000000",
+			key:        tnt.sessionKey("00000000-0000-0000-0000-000000000000"),
+			tenant:     tnt,
+			log:        s.log.With("tenant", tenantName),
+			started:    time.Now(),
+			auth:       &AuthResult{},
+			s:          s,
+			framedConn: efc,
+			done:       make(chan struct{}),
+		}
+		c.markActive()
+		s.clients[c.key] = c
+		return c, clientFramed
+	}
+	acme, acmeConn := newClient("acme")
+	defer acmeConn.Close()
+	initech, initechConn := newClient("initech")
+	defer initechConn.Close()
+
+	serve := func(tenantName string) (net.Listener, chan error) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		served := make(chan error, 1)
+		go func() {
+			served <- s.ServeTenant(l, tenantName)
+		}()
+		return l, served
+	}
+	acmeListener, acmeServed := serve("acme")
+	initechListener, initechServed := serve("initech")
+	for atomic.LoadInt64(&s.listening) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	acmeListener.Close()
+	<-acmeServed
+	s.clientsMx.Lock()
+	_, acmeRemembered := s.clients[acme.key]
+	_, initechRemembered := s.clients[initech.key]
+	s.clientsMx.Unlock()
+	if acmeRemembered || !initechRemembered {
+		t.Errorf("Only the sessions of the tenant whose listener closed should be forgotten, acme: %v, initech: %v", acmeRemembered, initechRemembered)
+	}
+	if s.closing() {
+		t.Fatal("Server shouldn't close while a listener is still being served")
+	}
+
+	received := make(chan string, 1)
+	go func() {
+		b := make([]byte, 100)
+		n, err := initechConn.Read(b)
+		if err == nil {
+			received <- string(b[:n])
+		}
+	}()
+	b := framed.NewHeaderPreservingBufferPool(DefaultBufferPoolSize, 100, true).GetSlice()
+	b = b.ResliceTo(copy(b.Bytes(), "data"))
+	if _, err := initech.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pkt := <-received:
+		if pkt != "data" {
+			t.Errorf("Unexpected packet %q", pkt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Other tenant's session should keep forwarding")
+	}
+
+	initechListener.Close()
+	<-initechServed
+	if !s.closing() {
+		t.Error("Server should close when its last listener stops")
+	}
+}
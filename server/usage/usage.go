@@ -0,0 +1,326 @@
+// usage tracks how much data each packetforward client transferred, bucketed
+// by day and month, and persists these totals in an append-only journal file
+// so that they survive sessions ending and server restarts.
+//
+// Buckets are based on UTC calendar days and months.
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// DefaultRetention is how long buckets are kept by default
+	DefaultRetention = 400 * 24 * time.Hour
+
+	dayFormat   = "2006-01-02"
+	monthFormat = "2006-01"
+)
+
+// Period identifies a bucket size.
+type Period int
+
+const (
+	PeriodDay Period = iota + 1
+	PeriodMonth
+)
+
+func (p Period) key(t time.Time) string {
+	t = t.UTC()
+	if p == PeriodMonth {
+		return t.Format(monthFormat)
+	}
+	return t.Format(dayFormat)
+}
+
+// Usage is an amount of data transferred. Upstream is from the client towards
+// origins, downstream from origins back to the client.
+type Usage struct {
+	BytesUp     int64 `json:"bu,omitempty"`
+	BytesDown   int64 `json:"bd,omitempty"`
+	PacketsUp   int64 `json:"pu,omitempty"`
+	PacketsDown int64 `json:"pd,omitempty"`
+}
+
+// Total returns the total number of bytes transferred in both directions.
+func (u Usage) Total() int64 {
+	return u.BytesUp + u.BytesDown
+}
+
+func (u *Usage) add(other Usage) {
+	u.BytesUp += other.BytesUp
+	u.BytesDown += other.BytesDown
+	u.PacketsUp += other.PacketsUp
+	u.PacketsDown += other.PacketsDown
+}
+
+// Bucket is a client's usage during a single day or month.
+type Bucket struct {
+	// Start is the beginning of the day or month
+	Start time.Time
+	Usage
+}
+
+// Store records and reports usage.
+type Store interface {
+	// Add adds delta to the client's usage at the given time
+	Add(clientID string, at time.Time, delta Usage) error
+
+	// Get gets the client's total usage during the period containing the given time
+	Get(clientID string, period Period, at time.Time) Usage
+}
+
+// record is a single line in the journal.
+type record struct {
+	ClientID string `json:"id"`
+	Time     int64  `json:"t"`
+	Usage
+}
+
+type clientUsage struct {
+	daily   map[string]Usage
+	monthly map[string]Usage
+}
+
+// Journal is a Store backed by an append-only file of JSON records. On open,
+// the journal is compacted to one record per client per day, dropping days
+// older than the retention period. While it's open, it forgets days and months
+// that ended before the retention period once a day, along with clients that
+// have no usage left.
+type Journal struct {
+	path      string
+	retention time.Duration
+	file      *os.File
+	clients   map[string]*clientUsage
+	prunedDay string
+	mx        sync.RWMutex
+}
+
+// OpenJournal opens the journal at path, creating it if necessary, and loads
+// its contents. If retention is 0, DefaultRetention is used.
+func OpenJournal(path string, retention time.Duration) (*Journal, error) {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	j := &Journal{
+		path:      path,
+		retention: retention,
+		clients:   make(map[string]*clientUsage),
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.New("unable to open usage journal %v for appending: %v", path, err)
+	}
+	j.file = file
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New("unable to open usage journal %v: %v", j.path, err)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			rec := &record{}
+			if decodeErr := json.Unmarshal(line, rec); decodeErr != nil {
+				// most likely a partial write at the end of the file, skip it
+				continue
+			}
+			j.apply(rec.ClientID, time.Unix(rec.Time, 0), rec.Usage)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.New("unable to read usage journal %v: %v", j.path, err)
+		}
+	}
+}
+
+// prune forgets buckets that ended before the retention period as of now,
+// and clients without any remaining buckets.
+func (j *Journal) prune(now time.Time) {
+	cutoff := now.Add(-j.retention)
+	dayCutoff, monthCutoff := PeriodDay.key(cutoff), PeriodMonth.key(cutoff)
+	for clientID, cu := range j.clients {
+		for day := range cu.daily {
+			if day < dayCutoff {
+				delete(cu.daily, day)
+			}
+		}
+		for month := range cu.monthly {
+			if month < monthCutoff {
+				delete(cu.monthly, month)
+			}
+		}
+		if len(cu.daily) == 0 && len(cu.monthly) == 0 {
+			delete(j.clients, clientID)
+		}
+	}
+	j.prunedDay = PeriodDay.key(now)
+}
+
+// compact rewrites the journal with one record per client per day.
+func (j *Journal) compact() error {
+	j.prune(time.Now())
+	tmpPath := j.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.New("unable to create compacted usage journal: %v", err)
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for clientID, cu := range j.clients {
+		for day, u := range cu.daily {
+			start, _ := time.Parse(dayFormat, day)
+			if err := enc.Encode(&record{ClientID: clientID, Time: start.Unix(), Usage: u}); err != nil {
+				file.Close()
+				return errors.New("unable to write compacted usage journal: %v", err)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return errors.New("unable to write compacted usage journal: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.New("unable to sync compacted usage journal: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return errors.New("unable to close compacted usage journal: %v", err)
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return errors.New("unable to replace usage journal: %v", err)
+	}
+	return nil
+}
+
+func (j *Journal) apply(clientID string, at time.Time, delta Usage) {
+	cu := j.clients[clientID]
+	if cu == nil {
+		cu = &clientUsage{
+			daily:   make(map[string]Usage),
+			monthly: make(map[string]Usage),
+		}
+		j.clients[clientID] = cu
+	}
+	day := PeriodDay.key(at)
+	u := cu.daily[day]
+	u.add(delta)
+	cu.daily[day] = u
+	month := PeriodMonth.key(at)
+	u = cu.monthly[month]
+	u.add(delta)
+	cu.monthly[month] = u
+}
+
+// Add implements the method from Store.
+func (j *Journal) Add(clientID string, at time.Time, delta Usage) error {
+	line, err := json.Marshal(&record{ClientID: clientID, Time: at.Unix(), Usage: delta})
+	if err != nil {
+		return errors.New("unable to encode usage record: %v", err)
+	}
+	line = append(line, '\n')
+
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	if j.file == nil {
+		return errors.New("usage journal closed")
+	}
+	if _, err := j.file.Write(line); err != nil {
+		return errors.New("unable to append to usage journal: %v", err)
+	}
+	j.apply(clientID, at, delta)
+	if now := time.Now(); PeriodDay.key(now) != j.prunedDay {
+		j.prune(now)
+	}
+	return nil
+}
+
+// Get implements the method from Store.
+func (j *Journal) Get(clientID string, period Period, at time.Time) Usage {
+	j.mx.RLock()
+	defer j.mx.RUnlock()
+	cu := j.clients[clientID]
+	if cu == nil {
+		return Usage{}
+	}
+	if period == PeriodMonth {
+		return cu.monthly[period.key(at)]
+	}
+	return cu.daily[period.key(at)]
+}
+
+// Clients lists the IDs of all clients with recorded usage.
+func (j *Journal) Clients() []string {
+	j.mx.RLock()
+	defer j.mx.RUnlock()
+	ids := make([]string, 0, len(j.clients))
+	for id := range j.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// History returns the client's usage buckets for the given period, oldest
+// first.
+func (j *Journal) History(clientID string, period Period) []Bucket {
+	j.mx.RLock()
+	defer j.mx.RUnlock()
+	cu := j.clients[clientID]
+	if cu == nil {
+		return nil
+	}
+	buckets := cu.daily
+	format := dayFormat
+	if period == PeriodMonth {
+		buckets = cu.monthly
+		format = monthFormat
+	}
+	result := make([]Bucket, 0, len(buckets))
+	for key, u := range buckets {
+		start, _ := time.Parse(format, key)
+		result = append(result, Bucket{Start: start, Usage: u})
+	}
+	sort.Slice(result, func(a, b int) bool {
+		return result[a].Start.Before(result[b].Start)
+	})
+	return result
+}
+
+// Close closes the journal.
+func (j *Journal) Close() error {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	j.file.Sync()
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
@@ -0,0 +1,106 @@
+package usage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "usage.journal")
+
+	now := time.Now()
+	yesterday := now.Add(-24 * time.Hour)
+	ancient := now.Add(-2 * DefaultRetention)
+
+	j, err := OpenJournal(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Add("a", now, Usage{BytesUp: 10, BytesDown: 20, PacketsUp: 1, PacketsDown: 2})
+	j.Add("a", now, Usage{BytesUp: 5})
+	j.Add("a", yesterday, Usage{BytesDown: 100})
+	j.Add("a", ancient, Usage{BytesDown: 1000})
+	j.Add("b", now, Usage{BytesUp: 1})
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// append a partially written record, which should be ignored
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte(`{"id":"a","t":`))
+	f.Close()
+
+	j, err = OpenJournal(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	today := j.Get("a", PeriodDay, now)
+	if today.BytesUp != 15 || today.BytesDown != 20 || today.PacketsUp != 1 || today.PacketsDown != 2 {
+		t.Errorf("Wrong usage for today: %+v", today)
+	}
+	if total := j.Get("a", PeriodDay, yesterday).Total(); total != 100 {
+		t.Errorf("Wrong usage for yesterday: %d", total)
+	}
+	expectedMonthly := int64(35)
+	if PeriodMonth.key(yesterday) == PeriodMonth.key(now) {
+		expectedMonthly += 100
+	}
+	if total := j.Get("a", PeriodMonth, now).Total(); total != expectedMonthly {
+		t.Errorf("Wrong usage for this month: %d", total)
+	}
+	if total := j.Get("a", PeriodDay, ancient).Total(); total != 0 {
+		t.Errorf("Usage older than retention period should have been dropped, got %d", total)
+	}
+	if history := j.History("a", PeriodDay); len(history) != 2 || !history[0].Start.Before(history[1].Start) {
+		t.Errorf("Wrong daily history: %+v", history)
+	}
+	if clients := j.Clients(); len(clients) != 2 || clients[0] != "a" || clients[1] != "b" {
+		t.Errorf("Wrong clients: %v", clients)
+	}
+}
+
+func TestJournalPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := OpenJournal(filepath.Join(dir, "usage.journal"), 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	now := time.Now()
+	old := now.Add(-100 * 24 * time.Hour)
+	j.Add("gone", old, Usage{BytesUp: 1})
+	j.Add("active", old, Usage{BytesUp: 1})
+	j.Add("active", now, Usage{BytesUp: 2})
+	if clients := j.Clients(); len(clients) != 2 {
+		t.Fatalf("Usage shouldn't be pruned more than once a day, got clients %v", clients)
+	}
+
+	// pretend that the day changed since the last time the journal was pruned
+	j.prunedDay = PeriodDay.key(old)
+	j.Add("active", now, Usage{BytesUp: 3})
+	if clients := j.Clients(); len(clients) != 1 || clients[0] != "active" {
+		t.Errorf("Clients without usage in the retention period should be forgotten, got %v", clients)
+	}
+	if history := j.History("active", PeriodMonth); len(history) != 1 || history[0].Total() != 5 {
+		t.Errorf("Months before the retention period should be forgotten, got %+v", history)
+	}
+	if history := j.History("active", PeriodDay); len(history) != 1 {
+		t.Errorf("Days before the retention period should be forgotten, got %+v", history)
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/packetforward/server/usage"
+)
+
+// trackUsage periodically writes the session's usage to the UsageStore until
+// the session terminates.
+func (c *client) trackUsage() {
+	ticker := time.NewTicker(c.s.opts.UsageFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.flushUsage()
+		case <-c.done:
+			c.flushUsage()
+			return
+		}
+	}
+}
+
+func (c *client) flushUsage() {
+	current := usage.Usage{
+		BytesUp:     atomic.LoadInt64(&c.bytesUp),
+		BytesDown:   atomic.LoadInt64(&c.bytesDown),
+		PacketsUp:   atomic.LoadInt64(&c.packetsUp),
+		PacketsDown: atomic.LoadInt64(&c.packetsDown),
+	}
+	delta := usage.Usage{
+		BytesUp:     current.BytesUp - c.flushed.BytesUp,
+		BytesDown:   current.BytesDown - c.flushed.BytesDown,
+		PacketsUp:   current.PacketsUp - c.flushed.PacketsUp,
+		PacketsDown: current.PacketsDown - c.flushed.PacketsDown,
+	}
+	now := time.Now()
+	if delta != (usage.Usage{}) {
+		if err := c.tenant.UsageStore.Add(c.key, now, delta); err != nil {
+			c.log.Errorf("Unable to record usage: %v", err)
+			return
+		}
+		c.flushed = current
+	}
+	c.refreshPeriodUsage(now, current.Total())
+}
+
+// refreshPeriodUsage records the client's usage during the current quota
+// period, as of the point at which the session had used sessionUsed bytes.
+func (c *client) refreshPeriodUsage(now time.Time, sessionUsed int64) {
+	if c.tenant.QuotaPeriod == 0 {
+		return
+	}
+	atomic.StoreInt64(&c.periodUsed, c.tenant.UsageStore.Get(c.key, c.tenant.QuotaPeriod, now).Total())
+	atomic.StoreInt64(&c.usedAtRefresh, sessionUsed)
+}
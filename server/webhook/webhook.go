@@ -0,0 +1,313 @@
+// webhook delivers packetforward session events to HTTP endpoints as JSON.
+//
+// Each event is POSTed to every configured URL. Deliveries to each URL are
+// queued in a bounded queue and processed by a dedicated goroutine, so a slow
+// or unavailable endpoint never blocks packet processing and doesn't hold up
+// the other endpoints. Events that don't fit in the queue are dropped. Failed
+// deliveries are retried with exponential backoff.
+//
+// If a Secret is configured, every request is signed with an HMAC-SHA256 over
+// the timestamp header, a period and the request body, hex encoded in the
+// X-Packetforward-Signature header as "sha256=<signature>".
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/server"
+	"github.com/getlantern/uuid"
+)
+
+var log = golog.LoggerFor("packetforward.webhook")
+
+const (
+	// DefaultQueueSize is the default number of pending deliveries per URL
+	DefaultQueueSize = 1000
+
+	// DefaultMaxAttempts is the default number of times to try delivering each event
+	DefaultMaxAttempts = 5
+
+	// DefaultInitialBackoff is the default time to wait before the first retry
+	DefaultInitialBackoff = 1 * time.Second
+
+	// DefaultMaxBackoff is the default maximum time to wait between retries
+	DefaultMaxBackoff = 1 * time.Minute
+
+	// DefaultTimeout is the default timeout for each delivery attempt
+	DefaultTimeout = 10 * time.Second
+)
+
+// Headers set on every request
+const (
+	HeaderEvent     = "X-Packetforward-Event"
+	HeaderDelivery  = "X-Packetforward-Delivery"
+	HeaderTimestamp = "X-Packetforward-Timestamp"
+	HeaderSignature = "X-Packetforward-Signature"
+)
+
+// Opts configures a Notifier
+type Opts struct {
+	// URLs are the endpoints to which to POST events
+	URLs []string
+
+	// Secret, if specified, is used to sign requests
+	Secret string
+
+	// QueueSize is the maximum number of pending deliveries per URL. If not specified, defaults
+	// to DefaultQueueSize.
+	QueueSize int
+
+	// MaxAttempts is the maximum number of times to try delivering each event. If not
+	// specified, defaults to DefaultMaxAttempts.
+	MaxAttempts int
+
+	// InitialBackoff is how long to wait before the first retry. Subsequent retries back off
+	// exponentially. If not specified, defaults to DefaultInitialBackoff.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the time between retries. If not specified, defaults to DefaultMaxBackoff.
+	MaxBackoff time.Duration
+
+	// Timeout is the timeout for each delivery attempt. If not specified, defaults to
+	// DefaultTimeout.
+	Timeout time.Duration
+
+	// Logger, if specified, is used for logging instead of the default golog logger
+	Logger logging.Logger
+}
+
+// Event is the JSON body POSTed for each server.SessionEvent.
+type Event struct {
+	Type            string    `json:"type"`
+	Time            time.Time `json:"time"`
+	ClientID        string    `json:"client_id"`
+	Tenant          string    `json:"tenant,omitempty"`
+	Username        string    `json:"username,omitempty"`
+	RemoteAddr      string    `json:"remote_addr,omitempty"`
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	BytesUp         int64     `json:"bytes_up"`
+	BytesDown       int64     `json:"bytes_down"`
+	PacketsUp       int64     `json:"packets_up"`
+	PacketsDown     int64     `json:"packets_down"`
+	Threshold       float64   `json:"threshold,omitempty"`
+	TerminateCause  string    `json:"terminate_cause,omitempty"`
+}
+
+type delivery struct {
+	id        string
+	eventType string
+	body      []byte
+}
+
+// Notifier POSTs session events to webhooks.
+type Notifier struct {
+	delivered int64
+	failed    int64
+	dropped   int64
+	opts      *Opts
+	log       logging.Logger
+	hc        *http.Client
+	queues    []chan *delivery
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// New constructs a new Notifier and starts delivering events in the
+// background. Use Notify as the server's OnSessionEvent.
+func New(opts *Opts) *Notifier {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultMaxAttempts
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = DefaultInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = logging.FromGolog(log)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		opts:   opts,
+		log:    logger,
+		hc:     &http.Client{Timeout: opts.Timeout},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for _, url := range opts.URLs {
+		queue := make(chan *delivery, opts.QueueSize)
+		n.queues = append(n.queues, queue)
+		n.wg.Add(1)
+		go n.deliver(url, queue)
+	}
+	return n
+}
+
+// Notify queues the given event for delivery to all URLs. It never blocks.
+func (n *Notifier) Notify(event *server.SessionEvent) {
+	body, err := json.Marshal(eventFor(event))
+	if err != nil {
+		n.log.Errorf("Unable to encode %v event: %v", event.Type, err)
+		return
+	}
+	d := &delivery{
+		id:        uuid.New().String(),
+		eventType: string(event.Type),
+		body:      body,
+	}
+	for _, queue := range n.queues {
+		select {
+		case queue <- d:
+		default:
+			atomic.AddInt64(&n.dropped, 1)
+		}
+	}
+}
+
+func eventFor(event *server.SessionEvent) *Event {
+	session := event.Session
+	e := &Event{
+		Type:            string(event.Type),
+		Time:            event.Time,
+		ClientID:        session.ClientID,
+		Tenant:          session.Tenant,
+		Username:        session.Username,
+		Started:         session.Started,
+		DurationSeconds: session.Duration.Seconds(),
+		BytesUp:         session.BytesUp,
+		BytesDown:       session.BytesDown,
+		PacketsUp:       session.PacketsUp,
+		PacketsDown:     session.PacketsDown,
+		Threshold:       event.Threshold,
+	}
+	if session.RemoteAddr != nil {
+		e.RemoteAddr = session.RemoteAddr.String()
+	}
+	if event.Type == server.SessionEnd {
+		e.TerminateCause = session.TerminateCause.String()
+	}
+	return e
+}
+
+func (n *Notifier) deliver(url string, queue chan *delivery) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case d := <-queue:
+			if n.deliverWithRetries(url, d) {
+				atomic.AddInt64(&n.delivered, 1)
+			} else {
+				atomic.AddInt64(&n.failed, 1)
+			}
+		}
+	}
+}
+
+func (n *Notifier) deliverWithRetries(url string, d *delivery) bool {
+	backoff := n.opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		retryable, err := n.post(url, d)
+		if err == nil {
+			return true
+		}
+		if !retryable || attempt >= n.opts.MaxAttempts {
+			n.log.Errorf("Giving up on delivering %v event to %v after %d attempts: %v", d.eventType, url, attempt, err)
+			return false
+		}
+		n.log.Debugf("Unable to deliver %v event to %v, will retry in %v: %v", d.eventType, url, backoff, err)
+		select {
+		case <-n.ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > n.opts.MaxBackoff {
+			backoff = n.opts.MaxBackoff
+		}
+	}
+}
+
+// post POSTs a single delivery, returning whether the failure (if any) is
+// worth retrying.
+func (n *Notifier) post(url string, d *delivery) (bool, error) {
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodPost, url, bytes.NewReader(d.body))
+	if err != nil {
+		return false, errors.New("unable to build request: %v", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, d.eventType)
+	req.Header.Set(HeaderDelivery, d.id)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if n.opts.Secret != "" {
+		req.Header.Set(HeaderSignature, "sha256="+Sign(n.opts.Secret, timestamp, d.body))
+	}
+
+	resp, err := n.hc.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, errors.New("unexpected response status %v", resp.Status)
+	default:
+		return false, errors.New("unexpected response status %v", resp.Status)
+	}
+}
+
+// Sign computes the hex encoded signature of a request with the given
+// timestamp and body. Receivers can use it to verify requests.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Stats returns the number of events delivered, failed after all retries and
+// dropped because a queue was full, summed across all URLs.
+func (n *Notifier) Stats() (delivered int64, failed int64, dropped int64) {
+	return atomic.LoadInt64(&n.delivered), atomic.LoadInt64(&n.failed), atomic.LoadInt64(&n.dropped)
+}
+
+// Close stops delivering events. Pending deliveries are discarded and requests
+// in flight are cancelled.
+func (n *Notifier) Close() error {
+	n.cancel()
+	n.wg.Wait()
+	return nil
+}
@@ -0,0 +1,167 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/packetforward/logging"
+	"github.com/getlantern/packetforward/server"
+)
+
+func TestDeliveryWithRetries(t *testing.T) {
+	var attempts int64
+	received := make(chan *Event, 1)
+	hs := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt64(&attempts, 1) < 3 {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get(HeaderSignature) != "sha256="+Sign("secret", req.Header.Get(HeaderTimestamp), body) {
+			t.Error("Invalid signature")
+		}
+		if req.Header.Get(HeaderEvent) != string(server.SessionEnd) {
+			t.Errorf("Wrong event header: %v", req.Header.Get(HeaderEvent))
+		}
+		event := &Event{}
+		if err := json.Unmarshal(body, event); err != nil {
+			t.Error(err)
+		}
+		received <- event
+	}))
+	defer hs.Close()
+
+	n := New(&Opts{
+		URLs:           []string{hs.URL},
+		Secret:         "secret",
+		InitialBackoff: 10 * time.Millisecond,
+	})
+	defer n.Close()
+
+	n.Notify(&server.SessionEvent{
+		Type: server.SessionEnd,
+		Time: time.Now(),
+		Session: &server.SessionInfo{
+			ClientID:       "client",
+			RemoteAddr:     &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234},
+			BytesUp:        100,
+			TerminateCause: server.TerminateQuotaExceeded,
+		},
+	})
+
+	select {
+	case event := <-received:
+		if event.ClientID != "client" || event.BytesUp != 100 || event.RemoteAddr != "10.0.0.1:1234" {
+			t.Errorf("Wrong event: %+v", event)
+		}
+		if event.TerminateCause != "quota exceeded" {
+			t.Errorf("Wrong terminate cause: %v", event.TerminateCause)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event not delivered")
+	}
+}
+
+func TestFullQueueDrops(t *testing.T) {
+	block := make(chan interface{})
+	hs := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		<-block
+	}))
+	defer hs.Close()
+
+	n := New(&Opts{
+		URLs:      []string{hs.URL},
+		QueueSize: 1,
+	})
+	defer n.Close()
+	defer close(block)
+
+	event := &server.SessionEvent{Type: server.SessionStart, Session: &server.SessionInfo{}}
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		n.Notify(event)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Notify blocked")
+	}
+	if _, _, dropped := n.Stats(); dropped < 8 {
+		t.Errorf("Expected at least 8 dropped events, got %d", dropped)
+	}
+}
+
+func TestCloseCancelsDeliveries(t *testing.T) {
+	block := make(chan interface{})
+	received := make(chan interface{}, 1)
+	hs := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		received <- nil
+		<-block
+	}))
+	defer hs.Close()
+	defer close(block)
+
+	n := New(&Opts{
+		URLs:    []string{hs.URL},
+		Timeout: time.Minute,
+	})
+	n.Notify(&server.SessionEvent{Type: server.SessionStart, Session: &server.SessionInfo{}})
+	<-received
+
+	closed := make(chan interface{})
+	go func() {
+		n.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the request in flight")
+	}
+}
+
+type recordingLogger struct {
+	errors chan string
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.errors <- fmt.Sprintf(format, args...)
+}
+
+func (l *recordingLogger) With(keyvals ...interface{}) logging.Logger {
+	return l
+}
+
+func TestLogger(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer hs.Close()
+
+	logger := &recordingLogger{errors: make(chan string, 10)}
+	n := New(&Opts{
+		URLs:           []string{hs.URL},
+		MaxAttempts:    1,
+		InitialBackoff: time.Millisecond,
+		Logger:         logger,
+	})
+	defer n.Close()
+	n.Notify(&server.SessionEvent{Type: server.SessionStart, Session: &server.SessionInfo{}})
+
+	select {
+	case line := <-logger.errors:
+		if !strings.Contains(line, "Giving up") {
+			t.Errorf("Unexpected error logged: %v", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Failed delivery should be logged through the configured Logger")
+	}
+}
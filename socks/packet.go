@@ -0,0 +1,159 @@
+package socks
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/getlantern/packetforward/packet"
+)
+
+const (
+	ipv4HeaderSize = packet.IPv4HeaderSize
+	tcpHeaderSize  = packet.TCPHeaderSize
+	udpHeaderSize  = packet.UDPHeaderSize
+
+	protocolTCP = packet.ProtocolTCP
+	protocolUDP = packet.ProtocolUDP
+
+	flagFIN = packet.TCPFlagFIN
+	flagSYN = packet.TCPFlagSYN
+	flagRST = packet.TCPFlagRST
+	flagPSH = packet.TCPFlagPSH
+	flagACK = packet.TCPFlagACK
+
+	optionMSS = 2
+)
+
+// endpoint is an IPv4 address and port.
+type endpoint struct {
+	ip   [4]byte
+	port uint16
+}
+
+func endpointFor(addr *net.UDPAddr) endpoint {
+	e := endpoint{port: uint16(addr.Port)}
+	copy(e.ip[:], addr.IP.To4())
+	return e
+}
+
+func (e endpoint) udpAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(e.ip[0], e.ip[1], e.ip[2], e.ip[3]), Port: int(e.port)}
+}
+
+func (e endpoint) tcpAddr() *net.TCPAddr {
+	return &net.TCPAddr{IP: net.IPv4(e.ip[0], e.ip[1], e.ip[2], e.ip[3]), Port: int(e.port)}
+}
+
+// segment is a parsed TCP segment or UDP datagram.
+type segment struct {
+	proto   byte
+	src     endpoint
+	dst     endpoint
+	seq     uint32
+	ack     uint32
+	flags   byte
+	window  uint16
+	mss     uint16
+	payload []byte
+}
+
+// parse parses an IPv4 packet containing TCP or UDP. It returns false for
+// anything else, including fragments.
+func parse(pkt []byte) (*segment, bool) {
+	ip, err := packet.ParseIPv4(pkt)
+	if err != nil || ip.IsFragment() {
+		return nil, false
+	}
+	s := &segment{proto: ip.Protocol()}
+	copy(s.src.ip[:], ip.Src())
+	copy(s.dst.ip[:], ip.Dst())
+	switch s.proto {
+	case protocolTCP:
+		tcp, err := packet.ParseTCP(ip.Payload())
+		if err != nil {
+			return nil, false
+		}
+		s.src.port = tcp.SrcPort()
+		s.dst.port = tcp.DstPort()
+		s.seq = tcp.Seq()
+		s.ack = tcp.Ack()
+		s.flags = tcp.Flags()
+		s.window = tcp.Window()
+		s.payload = tcp.Payload()
+		if s.flags&flagSYN != 0 {
+			s.mss = tcp.MSS()
+		}
+	case protocolUDP:
+		udp, err := packet.ParseUDP(ip.Payload())
+		if err != nil {
+			return nil, false
+		}
+		s.src.port = udp.SrcPort()
+		s.dst.port = udp.DstPort()
+		s.payload = udp.Payload()
+	default:
+		return nil, false
+	}
+	return s, true
+}
+
+// buildIPv4 builds an IPv4 packet around the given layer 4 segment, filling in
+// the layer 4 checksum at checksumOffset.
+func buildIPv4(id uint16, proto byte, src, dst endpoint, l4 []byte, checksumOffset int) []byte {
+	pkt := make([]byte, ipv4HeaderSize+len(l4))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[4:], id)
+	binary.BigEndian.PutUint16(pkt[6:], 0x4000) // don't fragment
+	pkt[8] = 64
+	pkt[9] = proto
+	copy(pkt[12:16], src.ip[:])
+	copy(pkt[16:20], dst.ip[:])
+	binary.BigEndian.PutUint16(pkt[10:], packet.Checksum(pkt[:ipv4HeaderSize], 0))
+
+	copy(pkt[ipv4HeaderSize:], l4)
+	l4 = pkt[ipv4HeaderSize:]
+	pseudo := pseudoHeaderSum(proto, src, dst, len(l4))
+	binary.BigEndian.PutUint16(l4[checksumOffset:], packet.Checksum(l4, pseudo))
+	return pkt
+}
+
+func buildTCP(id uint16, s *segment, mss uint16) []byte {
+	headerSize := tcpHeaderSize
+	if mss > 0 {
+		headerSize += 4
+	}
+	l4 := make([]byte, headerSize+len(s.payload))
+	binary.BigEndian.PutUint16(l4[0:], s.src.port)
+	binary.BigEndian.PutUint16(l4[2:], s.dst.port)
+	binary.BigEndian.PutUint32(l4[4:], s.seq)
+	binary.BigEndian.PutUint32(l4[8:], s.ack)
+	l4[12] = byte(headerSize/4) << 4
+	l4[13] = s.flags
+	binary.BigEndian.PutUint16(l4[14:], s.window)
+	if mss > 0 {
+		l4[20] = optionMSS
+		l4[21] = 4
+		binary.BigEndian.PutUint16(l4[22:], mss)
+	}
+	copy(l4[headerSize:], s.payload)
+	return buildIPv4(id, protocolTCP, s.src, s.dst, l4, 16)
+}
+
+func buildUDP(id uint16, src, dst endpoint, payload []byte) []byte {
+	l4 := make([]byte, udpHeaderSize+len(payload))
+	binary.BigEndian.PutUint16(l4[0:], src.port)
+	binary.BigEndian.PutUint16(l4[2:], dst.port)
+	binary.BigEndian.PutUint16(l4[4:], uint16(len(l4)))
+	copy(l4[udpHeaderSize:], payload)
+	pkt := buildIPv4(id, protocolUDP, src, dst, l4, 6)
+	if pkt[ipv4HeaderSize+6] == 0 && pkt[ipv4HeaderSize+7] == 0 {
+		// a computed checksum of 0 is transmitted as all ones
+		pkt[ipv4HeaderSize+6], pkt[ipv4HeaderSize+7] = 0xff, 0xff
+	}
+	return pkt
+}
+
+func pseudoHeaderSum(proto byte, src, dst endpoint, length int) uint32 {
+	return packet.PseudoHeaderSum(proto, src.ip[:], dst.ip[:], length)
+}
@@ -0,0 +1,476 @@
+// socks provides a SOCKS5 front-end for packetforward that doesn't require a
+// TUN device (and hence root privileges). It accepts SOCKS5 CONNECT and UDP
+// ASSOCIATE requests and converts them into IPv4 packets using a minimal
+// userspace TCP/IP stack. These packets are sent upstream, typically to a
+// packetforward client, and response packets are written back to the Server,
+// which acts as the packetforward client's downstream:
+//
+//	s, _ := socks.NewServer(&socks.Opts{})
+//	client := packetforward.NewClient(s, &packetforward.Opts{...})
+//	s.Serve(l, client)
+//
+// Domain names are resolved through the tunnel using the configured DNS server.
+// Only IPv4 destinations are supported.
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/packetforward/logging"
+)
+
+var log = golog.LoggerFor("packetforward.socks")
+
+var (
+	errClosed  = errors.New("connection closed")
+	errTimeout = &timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+const (
+	// DefaultConnectTimeout is the default timeout for connecting to origins
+	DefaultConnectTimeout = 30 * time.Second
+
+	socksVersion = 5
+
+	methodNoAuth       = 0
+	methodNoAcceptable = 0xff
+
+	cmdConnect      = 1
+	cmdUDPAssociate = 3
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+
+	replySucceeded               = 0
+	replyGeneralFailure          = 1
+	replyHostUnreachable         = 4
+	replyConnectionRefused       = 5
+	replyCommandNotSupported     = 7
+	replyAddressTypeNotSupported = 8
+
+	maxUDPPacketSize = 65535
+)
+
+// Opts configures a Server.
+type Opts struct {
+	// LocalIP is the source address of packets sent upstream. It must be an IPv4 address. If
+	// not specified, defaults to DefaultLocalIP.
+	LocalIP net.IP
+
+	// MTU is the maximum size of packets sent upstream. If not specified, defaults to
+	// DefaultMTU.
+	MTU int
+
+	// DNSServer is the DNS server (IP and port) used to resolve domain names, reached through
+	// the tunnel. If not specified, defaults to DefaultDNSServer.
+	DNSServer string
+
+	// ConnectTimeout limits how long to wait for TCP connections to origins to be established.
+	// If not specified, defaults to DefaultConnectTimeout.
+	ConnectTimeout time.Duration
+
+	// Logger, if specified, is used for logging instead of the default golog logger
+	Logger logging.Logger
+}
+
+// Server is a SOCKS5 server that forwards connections as IP packets. It
+// implements io.Writer; write packets received from downstream to it.
+type Server struct {
+	opts  *Opts
+	log   logging.Logger
+	stack *stack
+}
+
+// NewServer constructs a new Server.
+func NewServer(opts *Opts) (*Server, error) {
+	if opts.LocalIP == nil {
+		opts.LocalIP = net.ParseIP(DefaultLocalIP)
+	}
+	if opts.MTU <= 0 {
+		opts.MTU = DefaultMTU
+	}
+	if opts.DNSServer == "" {
+		opts.DNSServer = DefaultDNSServer
+	}
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = DefaultConnectTimeout
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = logging.FromGolog(log)
+	}
+	stack, err := newStack(opts.LocalIP, opts.MTU, opts.DNSServer, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{opts: opts, log: logger, stack: stack}, nil
+}
+
+// Write accepts a packet received from downstream.
+func (s *Server) Write(pkt []byte) (int, error) {
+	s.stack.deliver(pkt)
+	return len(pkt), nil
+}
+
+// Dial opens a TCP connection to the given address through the tunnel. The
+// returned connection has an MSS method that returns the maximum segment size
+// negotiated with the peer.
+func (s *Server) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return s.stack.dialTCP(ctx, addr)
+}
+
+// DialUDP opens a UDP connection to the given address, which must be an IPv4
+// address and port, through the tunnel.
+func (s *Server) DialUDP(addr string) (net.Conn, error) {
+	return s.stack.dialUDP(addr)
+}
+
+// Resolver returns a Resolver that queries the configured DNS server through
+// the tunnel.
+func (s *Server) Resolver() *net.Resolver {
+	return s.stack.resolver
+}
+
+// Start sends the packets of connections opened with Dial, DialUDP and
+// Resolver to upstream, without accepting SOCKS5 connections. Call either
+// Start or Serve, not both.
+func (s *Server) Start(upstream io.Writer) {
+	go s.stack.writeUpstream(upstream)
+}
+
+// Serve accepts SOCKS5 connections on the given Listener and sends the
+// resulting packets to upstream. It returns when the Listener fails.
+func (s *Server) Serve(l net.Listener, upstream io.Writer) error {
+	s.Start(upstream)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close closes all connections.
+func (s *Server) Close() error {
+	s.stack.close()
+	return nil
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	if err := s.negotiate(conn); err != nil {
+		s.log.Debugf("Unable to negotiate SOCKS5 with %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	cmd, host, port, err := readRequest(conn)
+	if err != nil {
+		s.log.Debugf("Unable to read SOCKS5 request from %v: %v", conn.RemoteAddr(), err)
+		if err == errAddressType {
+			writeReply(conn, replyAddressTypeNotSupported, nil)
+		}
+		return
+	}
+
+	switch cmd {
+	case cmdConnect:
+		s.connect(conn, net.JoinHostPort(host, strconv.Itoa(port)))
+	case cmdUDPAssociate:
+		s.associate(conn)
+	default:
+		writeReply(conn, replyCommandNotSupported, nil)
+	}
+}
+
+func (s *Server) negotiate(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return errors.New("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	for _, method := range methods {
+		if method == methodNoAuth {
+			_, err := conn.Write([]byte{socksVersion, methodNoAuth})
+			return err
+		}
+	}
+	conn.Write([]byte{socksVersion, methodNoAcceptable})
+	return errors.New("client doesn't support connecting without authentication")
+}
+
+var errAddressType = errors.New("unsupported address type")
+
+func readRequest(conn io.Reader) (byte, string, int, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, "", 0, err
+	}
+	if header[0] != socksVersion {
+		return 0, "", 0, errors.New("unsupported SOCKS version %d", header[0])
+	}
+	host, port, err := readAddress(conn)
+	return header[1], host, port, err
+}
+
+// readAddress reads a SOCKS5 address (type, address and port).
+func readAddress(r io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case atypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", 0, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", 0, err
+		}
+		host = string(domain)
+	case atypIPv6:
+		// consume the address so that the reply can be written cleanly
+		io.ReadFull(r, make([]byte, 16+2))
+		return "", 0, errAddressType
+	default:
+		return "", 0, errAddressType
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// appendAddress appends the SOCKS5 encoding of an IPv4 address and port.
+func appendAddress(b []byte, ip net.IP, port int) []byte {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		ip4 = net.IPv4zero.To4()
+	}
+	b = append(b, atypIPv4)
+	b = append(b, ip4...)
+	return append(b, byte(port>>8), byte(port))
+}
+
+func writeReply(conn io.Writer, reply byte, bound net.Addr) error {
+	b := []byte{socksVersion, reply, 0}
+	switch addr := bound.(type) {
+	case *net.TCPAddr:
+		b = appendAddress(b, addr.IP, addr.Port)
+	case *net.UDPAddr:
+		b = appendAddress(b, addr.IP, addr.Port)
+	default:
+		b = appendAddress(b, nil, 0)
+	}
+	_, err := conn.Write(b)
+	return err
+}
+
+func (s *Server) connect(conn net.Conn, addr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.ConnectTimeout)
+	origin, err := s.stack.dialTCP(ctx, addr)
+	cancel()
+	if err != nil {
+		s.log.Debugf("Unable to connect to %v: %v", addr, err)
+		reply := byte(replyHostUnreachable)
+		if _, ok := err.(*net.DNSError); !ok && ctx.Err() == nil {
+			reply = replyConnectionRefused
+		}
+		writeReply(conn, reply, nil)
+		return
+	}
+	defer origin.Close()
+	if err := writeReply(conn, replySucceeded, origin.LocalAddr()); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(origin, conn)
+		origin.(*tcpConn).CloseWrite()
+	}()
+	io.Copy(conn, origin)
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+	wg.Wait()
+}
+
+// associate handles a UDP ASSOCIATE request. The association lasts until the
+// control connection closes.
+func (s *Server) associate(conn net.Conn) {
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		s.log.Errorf("Unable to listen for UDP: %v", err)
+		writeReply(conn, replyGeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+	origin, err := s.stack.listenUDP()
+	if err != nil {
+		s.log.Errorf("Unable to open UDP port: %v", err)
+		writeReply(conn, replyGeneralFailure, nil)
+		return
+	}
+	defer origin.Close()
+	if err := writeReply(conn, replySucceeded, relay.LocalAddr()); err != nil {
+		return
+	}
+
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	var clientAddr *net.UDPAddr
+	var clientAddrMx sync.Mutex
+	go func() {
+		// client to origin
+		b := make([]byte, maxUDPPacketSize)
+		for {
+			n, from, err := relay.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			if !from.IP.Equal(clientIP) {
+				continue
+			}
+			clientAddrMx.Lock()
+			clientAddr = from
+			clientAddrMx.Unlock()
+			dst, payload, err := s.parseUDPRequest(b[:n])
+			if err != nil {
+				s.log.Debugf("Dropping UDP packet from %v: %v", from, err)
+				continue
+			}
+			origin.WriteTo(payload, dst)
+		}
+	}()
+	go func() {
+		// origin to client
+		b := make([]byte, maxUDPPacketSize)
+		for {
+			n, from, err := origin.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			clientAddrMx.Lock()
+			to := clientAddr
+			clientAddrMx.Unlock()
+			if to == nil {
+				continue
+			}
+			udpFrom := from.(*net.UDPAddr)
+			packet := appendAddress([]byte{0, 0, 0}, udpFrom.IP, udpFrom.Port)
+			relay.WriteToUDP(append(packet, b[:n]...), to)
+		}
+	}()
+
+	// wait for the control connection to close
+	io.Copy(ioutil.Discard, conn)
+}
+
+// parseUDPRequest parses a SOCKS5 UDP request header.
+func (s *Server) parseUDPRequest(b []byte) (*net.UDPAddr, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, errors.New("UDP request too short")
+	}
+	if b[2] != 0 {
+		return nil, nil, errors.New("fragmented UDP requests are not supported")
+	}
+	r := &sliceReader{b: b[3:]}
+	host, port, err := readAddress(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.ConnectTimeout)
+	ip, err := s.stack.resolve(ctx, host)
+	cancel()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, r.b, nil
+}
+
+type sliceReader struct {
+	b []byte
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+// deadline implements read and write deadlines.
+type deadline struct {
+	ch    chan struct{}
+	timer *time.Timer
+	mx    sync.Mutex
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	ch := make(chan struct{})
+	d.ch = ch
+	if t.IsZero() {
+		return
+	}
+	wait := time.Until(t)
+	if wait <= 0 {
+		close(ch)
+		return
+	}
+	d.timer = time.AfterFunc(wait, func() {
+		close(ch)
+	})
+}
+
+// expired returns a channel that's closed once the deadline expires.
+func (d *deadline) expired() <-chan struct{} {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if d.ch == nil {
+		d.ch = make(chan struct{})
+	}
+	return d.ch
+}
@@ -0,0 +1,188 @@
+package socks
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/packetforward/packet"
+)
+
+// echoNetwork stands in for the network behind packetforward. It echoes UDP
+// datagrams and data sent over TCP connections back to the sender.
+type echoNetwork struct {
+	s         *Server
+	peers     map[endpoint]*echoPeer
+	droppedMx sync.Mutex
+	dropped   bool
+	mx        sync.Mutex
+}
+
+type echoPeer struct {
+	snd uint32
+	rcv uint32
+}
+
+func (n *echoNetwork) Write(pkt []byte) (int, error) {
+	seg, ok := parse(pkt)
+	if !ok {
+		return len(pkt), nil
+	}
+	if seg.proto == protocolUDP {
+		n.s.Write(buildUDP(1, seg.dst, seg.src, append([]byte("echo:"), seg.payload...)))
+		return len(pkt), nil
+	}
+
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	reply := &segment{src: seg.dst, dst: seg.src, flags: flagACK, window: 65535}
+	peer := n.peers[seg.src]
+	switch {
+	case seg.flags&flagSYN != 0:
+		peer = &echoPeer{snd: 1000, rcv: seg.seq + 1}
+		n.peers[seg.src] = peer
+		reply.flags |= flagSYN
+		reply.seq = peer.snd
+		peer.snd++
+	case peer == nil:
+		return len(pkt), nil
+	case len(seg.payload) > 0:
+		n.droppedMx.Lock()
+		drop := !n.dropped
+		n.dropped = true
+		n.droppedMx.Unlock()
+		if drop {
+			// lose the first data segment to exercise retransmission
+			return len(pkt), nil
+		}
+		if seg.seq != peer.rcv {
+			return len(pkt), nil
+		}
+		peer.rcv += uint32(len(seg.payload))
+		reply.seq = peer.snd
+		reply.payload = seg.payload
+		peer.snd += uint32(len(seg.payload))
+	case seg.flags&flagFIN != 0 && seg.seq == peer.rcv:
+		peer.rcv++
+		reply.flags |= flagFIN
+		reply.seq = peer.snd
+		peer.snd++
+	default:
+		return len(pkt), nil
+	}
+	reply.ack = peer.rcv
+	n.s.Write(buildTCP(1, reply, 0))
+	return len(pkt), nil
+}
+
+func startServer(t *testing.T) (*Server, net.Listener) {
+	s, err := NewServer(&Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l, &echoNetwork{s: s, peers: make(map[endpoint]*echoPeer)})
+	return s, l
+}
+
+func socksRequest(t *testing.T, conn net.Conn, cmd byte, ip net.IP, port int) *net.UDPAddr {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte{socksVersion, 1, methodNoAuth})
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil || resp[1] != methodNoAuth {
+		t.Fatalf("Unable to negotiate: %v %v", resp, err)
+	}
+	conn.Write(appendAddress([]byte{socksVersion, cmd, 0}, ip, port))
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != replySucceeded {
+		t.Fatalf("Request failed with %d", reply[1])
+	}
+	return &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+}
+
+func TestConnect(t *testing.T) {
+	s, l := startServer(t)
+	defer l.Close()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bound := socksRequest(t, conn, cmdConnect, net.ParseIP("1.2.3.4"), 80)
+	if bound.IP.String() != DefaultLocalIP {
+		t.Errorf("Unexpected bound address %v", bound)
+	}
+
+	if _, err := conn.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	echoed, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(echoed) != "hello world" {
+		t.Errorf("Unexpected echo %q", echoed)
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	s, l := startServer(t)
+	defer l.Close()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	relayAddr := socksRequest(t, conn, cmdUDPAssociate, net.IPv4zero, 0)
+
+	udp, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.SetDeadline(time.Now().Add(10 * time.Second))
+	udp.Write(append(appendAddress([]byte{0, 0, 0}, net.ParseIP("5.6.7.8"), 53), "ping"...))
+
+	b := make([]byte, 100)
+	n, err := udp.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 10 || net.IP(b[4:8]).String() != "5.6.7.8" || binary.BigEndian.Uint16(b[8:]) != 53 {
+		t.Fatalf("Unexpected header in %v", b[:n])
+	}
+	if string(b[10:n]) != "echo:ping" {
+		t.Errorf("Unexpected payload %q", b[10:n])
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	pkt := buildTCP(1, &segment{
+		src:     endpoint{ip: [4]byte{10, 0, 0, 2}, port: 1234},
+		dst:     endpoint{ip: [4]byte{1, 2, 3, 4}, port: 80},
+		flags:   flagACK,
+		payload: []byte("odd"),
+	}, 0)
+	if packet.Checksum(pkt[:ipv4HeaderSize], 0) != 0 {
+		t.Error("Invalid IP checksum")
+	}
+	l4 := pkt[ipv4HeaderSize:]
+	if packet.Checksum(l4, pseudoHeaderSum(protocolTCP, endpoint{ip: [4]byte{10, 0, 0, 2}}, endpoint{ip: [4]byte{1, 2, 3, 4}}, len(l4))) != 0 {
+		t.Error("Invalid TCP checksum")
+	}
+}
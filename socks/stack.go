@@ -0,0 +1,279 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/packetforward/logging"
+)
+
+const (
+	// DefaultLocalIP is the default source address of packets generated by the stack
+	DefaultLocalIP = "10.0.0.2"
+
+	// DefaultMTU is the default maximum size of packets generated by the stack
+	DefaultMTU = 1500
+
+	// DefaultDNSServer is the default DNS server used to resolve domain names
+	DefaultDNSServer = "8.8.8.8:53"
+
+	minEphemeralPort = 32768
+	maxEphemeralPort = 60999
+
+	outboundQueueSize = 1024
+)
+
+// stack is a minimal userspace TCP/IP stack. It converts connections into IPv4
+// packets that it writes to upstream and dispatches the packets that it
+// receives from downstream to those connections.
+type stack struct {
+	ipID      uint32
+	nextPort  uint32
+	localIP   endpoint
+	mtu       int
+	outbound  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	tcpConns  map[tcpKey]*tcpConn
+	udpConns  map[uint16]*udpConn
+	mx        sync.Mutex
+	resolver  *net.Resolver
+	log       logging.Logger
+}
+
+type tcpKey struct {
+	localPort uint16
+	remote    endpoint
+}
+
+func newStack(localIP net.IP, mtu int, dnsServer string, logger logging.Logger) (*stack, error) {
+	ip := localIP.To4()
+	if ip == nil {
+		return nil, errors.New("local IP %v is not an IPv4 address", localIP)
+	}
+	s := &stack{
+		nextPort: minEphemeralPort,
+		mtu:      mtu,
+		outbound: make(chan []byte, outboundQueueSize),
+		closed:   make(chan struct{}),
+		tcpConns: make(map[tcpKey]*tcpConn),
+		udpConns: make(map[uint16]*udpConn),
+		log:      logger,
+	}
+	copy(s.localIP.ip[:], ip)
+	s.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// always use our DNS server, reached through the stack
+			switch network {
+			case "udp", "udp4":
+				return s.dialUDP(dnsServer)
+			default:
+				return s.dialTCP(ctx, dnsServer)
+			}
+		},
+	}
+	return s, nil
+}
+
+// send queues a packet for writing upstream. Like a network interface, it drops
+// packets when its queue is full rather than blocking, since connections
+// recover from loss anyway and callers may hold locks that the downstream path
+// needs.
+func (s *stack) send(pkt []byte) {
+	select {
+	case s.outbound <- pkt:
+	default:
+	}
+}
+
+// writeUpstream writes queued packets to upstream until the stack is closed.
+// The upstream writer isn't necessarily safe for concurrent use, so all writes
+// happen here.
+func (s *stack) writeUpstream(upstream io.Writer) {
+	for {
+		select {
+		case <-s.closed:
+			return
+		case pkt := <-s.outbound:
+			if _, err := upstream.Write(pkt); err != nil {
+				s.log.Debugf("Unable to write packet upstream: %v", err)
+			}
+		}
+	}
+}
+
+func (s *stack) nextID() uint16 {
+	return uint16(atomic.AddUint32(&s.ipID, 1))
+}
+
+// deliver dispatches a packet received from downstream.
+func (s *stack) deliver(pkt []byte) {
+	seg, ok := parse(pkt)
+	if !ok || seg.dst.ip != s.localIP.ip {
+		return
+	}
+	s.mx.Lock()
+	switch seg.proto {
+	case protocolTCP:
+		c := s.tcpConns[tcpKey{seg.dst.port, seg.src}]
+		s.mx.Unlock()
+		if c != nil {
+			c.handle(seg)
+		}
+	case protocolUDP:
+		c := s.udpConns[seg.dst.port]
+		s.mx.Unlock()
+		if c != nil {
+			c.handle(seg)
+		}
+	default:
+		s.mx.Unlock()
+	}
+}
+
+// allocatePort allocates an unused ephemeral port. Must be called with s.mx held.
+func (s *stack) allocatePort(inUse func(port uint16) bool) (uint16, error) {
+	for i := 0; i <= maxEphemeralPort-minEphemeralPort; i++ {
+		port := uint16(s.nextPort)
+		s.nextPort++
+		if s.nextPort > maxEphemeralPort {
+			s.nextPort = minEphemeralPort
+		}
+		if !inUse(port) {
+			return port, nil
+		}
+	}
+	return 0, errors.New("no free ports")
+}
+
+func (s *stack) resolve(ctx context.Context, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	addrs, err := s.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ip := addr.IP.To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("no IPv4 address for %v", host)
+}
+
+func (s *stack) resolveEndpoint(ctx context.Context, addr string) (endpoint, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return endpoint{}, err
+	}
+	port, err := net.LookupPort("tcp", portString)
+	if err != nil {
+		return endpoint{}, err
+	}
+	ip, err := s.resolve(ctx, host)
+	if err != nil {
+		return endpoint{}, err
+	}
+	return endpointFor(&net.UDPAddr{IP: ip, Port: port}), nil
+}
+
+func (s *stack) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	remote, err := s.resolveEndpoint(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	s.mx.Lock()
+	port, err := s.allocatePort(func(port uint16) bool {
+		_, found := s.tcpConns[tcpKey{port, remote}]
+		return found
+	})
+	if err != nil {
+		s.mx.Unlock()
+		return nil, err
+	}
+	c := newTCPConn(s, endpoint{ip: s.localIP.ip, port: port}, remote)
+	s.tcpConns[tcpKey{port, remote}] = c
+	s.mx.Unlock()
+
+	if err := c.connect(ctx); err != nil {
+		c.abort(err)
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *stack) forgetTCP(c *tcpConn) {
+	s.mx.Lock()
+	key := tcpKey{c.local.port, c.remote}
+	if s.tcpConns[key] == c {
+		delete(s.tcpConns, key)
+	}
+	s.mx.Unlock()
+}
+
+// listenUDP opens an unconnected UDP endpoint on an ephemeral port.
+func (s *stack) listenUDP() (*udpConn, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	port, err := s.allocatePort(func(port uint16) bool {
+		_, found := s.udpConns[port]
+		return found
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := newUDPConn(s, endpoint{ip: s.localIP.ip, port: port})
+	s.udpConns[port] = c
+	return c, nil
+}
+
+// dialUDP opens a UDP endpoint connected to the given address, which must be an
+// IP address and port.
+func (s *stack) dialUDP(addr string) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.listenUDP()
+	if err != nil {
+		return nil, err
+	}
+	c.connected = remote
+	return c, nil
+}
+
+func (s *stack) forgetUDP(c *udpConn) {
+	s.mx.Lock()
+	if s.udpConns[c.local.port] == c {
+		delete(s.udpConns, c.local.port)
+	}
+	s.mx.Unlock()
+}
+
+func (s *stack) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	s.mx.Lock()
+	tcpConns := make([]*tcpConn, 0, len(s.tcpConns))
+	for _, c := range s.tcpConns {
+		tcpConns = append(tcpConns, c)
+	}
+	udpConns := make([]*udpConn, 0, len(s.udpConns))
+	for _, c := range s.udpConns {
+		udpConns = append(udpConns, c)
+	}
+	s.mx.Unlock()
+	for _, c := range tcpConns {
+		c.abort(errClosed)
+	}
+	for _, c := range udpConns {
+		c.Close()
+	}
+}
@@ -0,0 +1,524 @@
+package socks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	tcpRecvBufferSize = 65535
+	tcpSendBufferSize = 256 * 1024
+
+	// maxInFlight caps the amount of unacknowledged data, since the stack doesn't
+	// implement congestion control
+	maxInFlight = 64 * 1024
+
+	initialRTO     = 1 * time.Second
+	maxRTO         = 60 * time.Second
+	maxRetransmits = 10
+	maxSYNRetries  = 5
+
+	// lingerTime is how long a closed connection waits for the peer to finish
+	// closing before it's forgotten
+	lingerTime = 30 * time.Second
+)
+
+type tcpState int
+
+const (
+	stateSynSent tcpState = iota
+	stateEstablished
+	stateClosed
+)
+
+// tcpConn is an actively opened TCP connection on the stack. It implements
+// net.Conn. It supports retransmission and flow control but not congestion
+// control, selective acknowledgements or window scaling.
+type tcpConn struct {
+	s      *stack
+	local  endpoint
+	remote endpoint
+	mss    int
+
+	mx          sync.Mutex
+	changed     chan struct{}
+	state       tcpState
+	err         error
+	iss         uint32
+	sndUna      uint32
+	sndNxt      uint32
+	sndMax      uint32
+	sndWnd      uint32
+	sendBuf     []byte
+	finQueued   bool
+	finSent     bool
+	finAcked    bool
+	rcvNxt      uint32
+	recvBuf     []byte
+	peerFin     bool
+	closedLocal bool
+	advertised  int
+	rto         time.Duration
+	retransmits int
+	timer       *time.Timer
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newTCPConn(s *stack, local, remote endpoint) *tcpConn {
+	var iss [4]byte
+	rand.Read(iss[:])
+	return &tcpConn{
+		s:       s,
+		local:   local,
+		remote:  remote,
+		mss:     s.mtu - ipv4HeaderSize - tcpHeaderSize,
+		changed: make(chan struct{}),
+		state:   stateSynSent,
+		iss:     binary.BigEndian.Uint32(iss[:]),
+		rto:     initialRTO,
+	}
+}
+
+// seqLT compares sequence numbers, accounting for wraparound
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqLTE(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+func (c *tcpConn) connect(ctx context.Context) error {
+	c.mx.Lock()
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.sndMax = c.sndNxt
+	c.sendSYN()
+	c.armTimer()
+	for c.state == stateSynSent {
+		changed := c.changed
+		c.mx.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		c.mx.Lock()
+	}
+	err := c.err
+	c.mx.Unlock()
+	return err
+}
+
+// notify wakes up everything waiting for the connection's state to change. Must
+// be called with c.mx held.
+func (c *tcpConn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait waits for the connection's state to change or the deadline to expire.
+// Must be called with c.mx held.
+func (c *tcpConn) wait(d *deadline) error {
+	changed := c.changed
+	c.mx.Unlock()
+	defer c.mx.Lock()
+	select {
+	case <-changed:
+		return nil
+	case <-d.expired():
+		return errTimeout
+	}
+}
+
+func (c *tcpConn) window() int {
+	w := tcpRecvBufferSize - len(c.recvBuf)
+	if w < 0 {
+		w = 0
+	}
+	return w
+}
+
+func (c *tcpConn) sendSegment(flags byte, seq uint32, payload []byte, mss uint16) {
+	c.advertised = c.window()
+	c.s.send(buildTCP(c.s.nextID(), &segment{
+		src:     c.local,
+		dst:     c.remote,
+		seq:     seq,
+		ack:     c.rcvNxt,
+		flags:   flags,
+		window:  uint16(c.advertised),
+		payload: payload,
+	}, mss))
+}
+
+func (c *tcpConn) sendSYN() {
+	c.sendSegment(flagSYN, c.iss, nil, uint16(c.mss))
+}
+
+func (c *tcpConn) sendACK() {
+	c.sendSegment(flagACK, c.sndNxt, nil, 0)
+}
+
+// output sends as much pending data as the peer's window allows, followed by a
+// FIN if the connection has been closed. If probe is true, at least one segment
+// is sent even if the window is closed. Must be called with c.mx held.
+func (c *tcpConn) output(probe bool) {
+	if c.state != stateEstablished {
+		return
+	}
+	for !c.finSent {
+		sent := int(c.sndNxt - c.sndUna)
+		unsent := c.sendBuf[sent:]
+		window := int(c.sndWnd)
+		if window > maxInFlight {
+			window = maxInFlight
+		}
+		n := window - sent
+		if probe && n < 1 {
+			n = 1
+		}
+		if n > len(unsent) {
+			n = len(unsent)
+		}
+		if n > c.mss {
+			n = c.mss
+		}
+		if n <= 0 {
+			break
+		}
+		c.sendSegment(flagACK|flagPSH, c.sndNxt, unsent[:n], 0)
+		c.sndNxt += uint32(n)
+		probe = false
+	}
+	if c.finQueued && !c.finSent && int(c.sndNxt-c.sndUna) == len(c.sendBuf) {
+		c.sendSegment(flagFIN|flagACK, c.sndNxt, nil, 0)
+		c.sndNxt++
+		c.finSent = true
+	}
+	if seqLT(c.sndMax, c.sndNxt) {
+		c.sndMax = c.sndNxt
+	}
+	if c.sndNxt != c.sndUna || len(c.sendBuf) > 0 {
+		c.armTimer()
+	}
+}
+
+func (c *tcpConn) armTimer() {
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.rto, c.onTimeout)
+	}
+}
+
+func (c *tcpConn) stopTimer() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+func (c *tcpConn) onTimeout() {
+	c.mx.Lock()
+	c.timer = nil
+	switch c.state {
+	case stateClosed:
+		c.mx.Unlock()
+		return
+	case stateSynSent:
+		if c.retransmits >= maxSYNRetries {
+			c.mx.Unlock()
+			c.abort(errors.New("timed out connecting to %v", c.remote.tcpAddr()))
+			return
+		}
+		c.sendSYN()
+	default:
+		if c.sndNxt == c.sndUna && len(c.sendBuf) == 0 {
+			c.mx.Unlock()
+			return
+		}
+		if c.retransmits >= maxRetransmits {
+			c.mx.Unlock()
+			c.abort(errors.New("connection to %v timed out", c.remote.tcpAddr()))
+			return
+		}
+		// go back and resend everything that's unacknowledged, probing a closed window
+		c.sndNxt = c.sndUna
+		c.finSent = false
+		c.output(true)
+	}
+	c.retransmits++
+	c.rto *= 2
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+	c.stopTimer()
+	c.armTimer()
+	c.mx.Unlock()
+}
+
+// handle processes a segment received from the peer.
+func (c *tcpConn) handle(seg *segment) {
+	c.mx.Lock()
+	switch c.state {
+	case stateClosed:
+		c.mx.Unlock()
+		return
+	case stateSynSent:
+		if seg.flags&flagACK == 0 || seg.ack != c.iss+1 {
+			c.mx.Unlock()
+			return
+		}
+		if seg.flags&flagRST != 0 {
+			c.mx.Unlock()
+			c.abort(errors.New("connection to %v refused", c.remote.tcpAddr()))
+			return
+		}
+		if seg.flags&flagSYN == 0 {
+			c.mx.Unlock()
+			return
+		}
+		if seg.mss > 0 && int(seg.mss) < c.mss {
+			c.mss = int(seg.mss)
+		}
+		c.rcvNxt = seg.seq + 1
+		c.sndUna = seg.ack
+		c.sndNxt = seg.ack
+		c.sndMax = seg.ack
+		c.sndWnd = uint32(seg.window)
+		c.state = stateEstablished
+		c.retransmits = 0
+		c.rto = initialRTO
+		c.stopTimer()
+		c.sendACK()
+		c.notify()
+		c.mx.Unlock()
+		return
+	}
+
+	if seg.flags&flagRST != 0 {
+		c.mx.Unlock()
+		c.abort(errors.New("connection to %v reset by peer", c.remote.tcpAddr()))
+		return
+	}
+	if seg.flags&flagSYN != 0 {
+		// our ACK of the SYN-ACK got lost
+		c.sendACK()
+		c.mx.Unlock()
+		return
+	}
+
+	if seg.flags&flagACK != 0 {
+		// after a retransmission timeout, acks may cover more than what we've
+		// resent so far, so accept anything up to the highest sequence sent
+		if seqLT(c.sndUna, seg.ack) && seqLTE(seg.ack, c.sndMax) {
+			acked := int(seg.ack - c.sndUna)
+			if acked > len(c.sendBuf) {
+				// our FIN got acked
+				c.finSent = true
+				c.finAcked = true
+				acked = len(c.sendBuf)
+			}
+			c.sendBuf = c.sendBuf[acked:]
+			c.sndUna = seg.ack
+			if seqLT(c.sndNxt, seg.ack) {
+				c.sndNxt = seg.ack
+			}
+			c.retransmits = 0
+			c.rto = initialRTO
+			c.stopTimer()
+			c.notify()
+		}
+		if seqLTE(c.sndUna, seg.ack) {
+			c.sndWnd = uint32(seg.window)
+		}
+	}
+
+	if len(seg.payload) > 0 {
+		if seg.seq == c.rcvNxt && !c.peerFin {
+			n := len(seg.payload)
+			if space := c.window(); n > space {
+				n = space
+			}
+			c.recvBuf = append(c.recvBuf, seg.payload[:n]...)
+			c.rcvNxt += uint32(n)
+			if n > 0 {
+				c.notify()
+			}
+		}
+		// acknowledge everything, out of order segments yield a duplicate ACK
+		c.sendACK()
+	}
+
+	if seg.flags&flagFIN != 0 && !c.peerFin && seg.seq+uint32(len(seg.payload)) == c.rcvNxt {
+		c.rcvNxt++
+		c.peerFin = true
+		c.sendACK()
+		c.notify()
+	}
+
+	c.output(false)
+	done := c.peerFin && c.finAcked
+	c.mx.Unlock()
+	if done {
+		c.abort(nil)
+	}
+}
+
+// abort closes the connection immediately. err, if not nil, is returned from
+// subsequent reads and writes.
+func (c *tcpConn) abort(err error) {
+	c.mx.Lock()
+	if c.state == stateClosed {
+		c.mx.Unlock()
+		return
+	}
+	if c.state != stateSynSent && err != nil && !c.peerFin {
+		// let the peer know that we're gone
+		c.sendSegment(flagRST|flagACK, c.sndNxt, nil, 0)
+	}
+	c.state = stateClosed
+	if c.err == nil {
+		c.err = err
+	}
+	c.stopTimer()
+	c.notify()
+	c.mx.Unlock()
+	c.s.forgetTCP(c)
+}
+
+func (c *tcpConn) Read(b []byte) (int, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for {
+		if c.closedLocal {
+			return 0, errClosed
+		}
+		if len(c.recvBuf) > 0 {
+			n := copy(b, c.recvBuf)
+			c.recvBuf = c.recvBuf[n:]
+			if len(c.recvBuf) == 0 {
+				c.recvBuf = nil
+			}
+			if c.state == stateEstablished && c.advertised < c.mss && c.window() >= tcpRecvBufferSize/2 {
+				// let the peer know that the window opened up again
+				c.sendACK()
+			}
+			return n, nil
+		}
+		if c.peerFin {
+			return 0, io.EOF
+		}
+		if c.state == stateClosed {
+			if c.err != nil {
+				return 0, c.err
+			}
+			return 0, io.EOF
+		}
+		if err := c.wait(&c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *tcpConn) Write(b []byte) (int, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	written := 0
+	for written < len(b) {
+		if c.state == stateClosed {
+			if c.err != nil {
+				return written, c.err
+			}
+			return written, errClosed
+		}
+		if c.finQueued {
+			return written, errClosed
+		}
+		space := tcpSendBufferSize - len(c.sendBuf)
+		if space > 0 {
+			n := len(b) - written
+			if n > space {
+				n = space
+			}
+			c.sendBuf = append(c.sendBuf, b[written:written+n]...)
+			written += n
+			c.output(false)
+			continue
+		}
+		if err := c.wait(&c.writeDeadline); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// CloseWrite sends a FIN once all pending data has been sent, while still
+// allowing reads.
+func (c *tcpConn) CloseWrite() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if !c.finQueued {
+		c.finQueued = true
+		c.output(false)
+	}
+	return nil
+}
+
+// Close closes the connection. Pending data is still delivered to the peer, but
+// the connection is forgotten after lingerTime even if the peer doesn't finish
+// closing its side.
+func (c *tcpConn) Close() error {
+	c.CloseWrite()
+	c.mx.Lock()
+	alreadyClosed := c.closedLocal
+	c.closedLocal = true
+	c.notify()
+	c.mx.Unlock()
+	if !alreadyClosed {
+		time.AfterFunc(lingerTime, func() {
+			c.abort(nil)
+		})
+	}
+	return nil
+}
+
+// MSS returns the maximum segment size of the connection, which is the smaller
+// of the stack's and the one that the peer advertised.
+func (c *tcpConn) MSS() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.mss
+}
+
+func (c *tcpConn) LocalAddr() net.Addr {
+	return c.local.tcpAddr()
+}
+
+func (c *tcpConn) RemoteAddr() net.Addr {
+	return c.remote.tcpAddr()
+}
+
+func (c *tcpConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *tcpConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *tcpConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
@@ -0,0 +1,122 @@
+package socks
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	udpQueueSize = 100
+)
+
+type datagram struct {
+	from    endpoint
+	payload []byte
+}
+
+// udpConn is a UDP endpoint on the stack. It implements net.PacketConn and, if
+// connected, net.Conn.
+type udpConn struct {
+	s         *stack
+	local     endpoint
+	connected *net.UDPAddr
+	incoming  chan *datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+	deadline  deadline
+}
+
+func newUDPConn(s *stack, local endpoint) *udpConn {
+	return &udpConn{
+		s:        s,
+		local:    local,
+		incoming: make(chan *datagram, udpQueueSize),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (c *udpConn) handle(seg *segment) {
+	if c.connected != nil && endpointFor(c.connected) != seg.src {
+		return
+	}
+	d := &datagram{from: seg.src, payload: append([]byte{}, seg.payload...)}
+	select {
+	case c.incoming <- d:
+	default:
+		// queue full, drop
+	}
+}
+
+func (c *udpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-c.incoming:
+		return copy(b, d.payload), d.from.udpAddr(), nil
+	case <-c.closed:
+		return 0, nil, errClosed
+	case <-c.deadline.expired():
+		return 0, nil, errTimeout
+	}
+}
+
+func (c *udpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || udpAddr.IP.To4() == nil {
+		return 0, errors.New("unsupported address %v", addr)
+	}
+	select {
+	case <-c.closed:
+		return 0, errClosed
+	default:
+	}
+	c.s.send(buildUDP(c.s.nextID(), c.local, endpointFor(udpAddr), b))
+	return len(b), nil
+}
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	if c.connected == nil {
+		return 0, errors.New("not connected")
+	}
+	return c.WriteTo(b, c.connected)
+}
+
+func (c *udpConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.s.forgetUDP(c)
+	})
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.local.udpAddr()
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	if c.connected == nil {
+		return nil
+	}
+	return c.connected
+}
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	// writes never block
+	return nil
+}
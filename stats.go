@@ -0,0 +1,184 @@
+package packetforward
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Forwarder is a packetforward client.
+type Forwarder interface {
+	io.WriteCloser
+
+	// Stats returns a snapshot of the client's statistics.
+	Stats() *Stats
+
+	// Traffic returns a snapshot of the client's traffic breakdown, or nil if
+	// Opts.TrafficBreakdown wasn't set.
+	Traffic() *Traffic
+}
+
+// Stats describes a client's traffic and the health of its connection to the
+// server. Upstream counters count packets written to the client, downstream
+// counters count packets delivered to the downstream Writer.
+type Stats struct {
+	// SessionID is the client's ID
+	SessionID string
+
+	// ServerAddr is the address of the server to which the client is currently connected, or
+	// empty if it isn't connected
+	ServerAddr string
+
+	PacketsUp   int64
+	BytesUp     int64
+	PacketsDown int64
+	BytesDown   int64
+
+	// DialAttempts and DialFailures count attempts to connect to the server, including the
+	// handshake
+	DialAttempts int64
+	DialFailures int64
+
+	// Reconnects counts successful connections after the first
+	Reconnects int64
+
+	// Outage is the cumulative time during which the client was unable to reach the server,
+	// measured from a failed write or dial, or the server closing the connection, until the
+	// next successful connection
+	Outage time.Duration
+
+	// SinceLastDownstream is the time since the last packet was delivered downstream, or 0 if
+	// none has been
+	SinceLastDownstream time.Duration
+
+	// DroppedPackets counts upstream packets that Write failed to send and packets from the
+	// server that couldn't be decoded or delivered downstream
+	DroppedPackets int64
+
+	// Evictions counts how often the server ended the client's session by closing the
+	// connection. The client starts a new session when it next has packets to send.
+	Evictions int64
+
+	// LastEviction is an ErrSessionEvicted describing the most recent eviction, or nil if
+	// there hasn't been one
+	LastEviction error
+}
+
+// clientStats tracks a forwarder's statistics. It's the first field of
+// forwarder so that its 64 bit counters are aligned for atomic access on 32
+// bit platforms.
+type clientStats struct {
+	packetsUp      int64
+	bytesUp        int64
+	packetsDown    int64
+	bytesDown      int64
+	dialAttempts   int64
+	dialFailures   int64
+	dropped        int64
+	lastDownstream int64
+	connects       int64
+	serverAddr     string
+	evictions      int64
+	lastEviction   error
+	outage         time.Duration
+	outageStarted  time.Time
+	mx             sync.Mutex
+}
+
+func (s *clientStats) wroteUpstream(n int) {
+	atomic.AddInt64(&s.packetsUp, 1)
+	atomic.AddInt64(&s.bytesUp, int64(n))
+}
+
+func (s *clientStats) wroteDownstream(n int) {
+	atomic.AddInt64(&s.packetsDown, 1)
+	atomic.AddInt64(&s.bytesDown, int64(n))
+	atomic.StoreInt64(&s.lastDownstream, time.Now().UnixNano())
+}
+
+func (s *clientStats) droppedPacket() {
+	atomic.AddInt64(&s.dropped, 1)
+}
+
+func (s *clientStats) dialing() {
+	atomic.AddInt64(&s.dialAttempts, 1)
+}
+
+func (s *clientStats) dialFailed() {
+	atomic.AddInt64(&s.dialFailures, 1)
+	s.outageBegan()
+}
+
+// outageBegan marks the beginning of an outage, unless one is already under way.
+func (s *clientStats) outageBegan() {
+	s.mx.Lock()
+	if s.outageStarted.IsZero() {
+		s.outageStarted = time.Now()
+	}
+	s.mx.Unlock()
+}
+
+func (s *clientStats) connected(serverAddr string) {
+	s.mx.Lock()
+	s.connects++
+	s.serverAddr = serverAddr
+	if !s.outageStarted.IsZero() {
+		s.outage += time.Since(s.outageStarted)
+		s.outageStarted = time.Time{}
+	}
+	s.mx.Unlock()
+}
+
+func (s *clientStats) disconnected() {
+	s.mx.Lock()
+	s.serverAddr = ""
+	s.mx.Unlock()
+}
+
+func (s *clientStats) evicted(err error) {
+	s.mx.Lock()
+	s.evictions++
+	s.lastEviction = err
+	s.mx.Unlock()
+}
+
+func (s *clientStats) snapshot(id string) *Stats {
+	stats := &Stats{
+		SessionID:      id,
+		PacketsUp:      atomic.LoadInt64(&s.packetsUp),
+		BytesUp:        atomic.LoadInt64(&s.bytesUp),
+		PacketsDown:    atomic.LoadInt64(&s.packetsDown),
+		BytesDown:      atomic.LoadInt64(&s.bytesDown),
+		DialAttempts:   atomic.LoadInt64(&s.dialAttempts),
+		DialFailures:   atomic.LoadInt64(&s.dialFailures),
+		DroppedPackets: atomic.LoadInt64(&s.dropped),
+	}
+	if lastDownstream := atomic.LoadInt64(&s.lastDownstream); lastDownstream > 0 {
+		stats.SinceLastDownstream = time.Duration(time.Now().UnixNano() - lastDownstream)
+	}
+	s.mx.Lock()
+	stats.ServerAddr = s.serverAddr
+	if s.connects > 1 {
+		stats.Reconnects = s.connects - 1
+	}
+	stats.Evictions = s.evictions
+	stats.LastEviction = s.lastEviction
+	stats.Outage = s.outage
+	if !s.outageStarted.IsZero() {
+		stats.Outage += time.Since(s.outageStarted)
+	}
+	s.mx.Unlock()
+	return stats
+}
+
+func (f *forwarder) Stats() *Stats {
+	return f.stats.snapshot(f.id)
+}
+
+func (f *forwarder) Traffic() *Traffic {
+	if f.traffic == nil {
+		return nil
+	}
+	return f.traffic.snapshot()
+}
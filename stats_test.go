@@ -0,0 +1,138 @@
+package packetforward
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/framed"
+	"github.com/getlantern/packetforward/protocol"
+)
+
+type channelWriter chan []byte
+
+func (w channelWriter) Write(b []byte) (int, error) {
+	w <- append([]byte{}, b...)
+	return len(b), nil
+}
+
+func TestStats(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rwc := framed.NewReadWriteCloser(conn)
+		rwc.EnableBigFrames()
+		b := make([]byte, protocol.MaxHelloSize)
+		// skip hello, then echo
+		if _, err := rwc.Read(b); err != nil {
+			return
+		}
+		for {
+			n, err := rwc.Read(b)
+			if err != nil {
+				return
+			}
+			rwc.Write(b[:n])
+		}
+	}()
+
+	downstream := make(channelWriter, 1)
+	failDial := true
+	c := NewClient(downstream, &Opts{
+		IdleTimeout: time.Second,
+		DialServer: func(ctx context.Context) (net.Conn, error) {
+			if failDial {
+				failDial = false
+				return nil, errors.New("first dial fails")
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", l.Addr().String())
+		},
+	})
+	defer c.Close()
+
+	if _, err := c.Write([]byte("packet")); err != nil {
+		t.Fatal(err)
+	}
+	<-downstream
+
+	stats := c.Stats()
+	if stats.SessionID == "" || stats.ServerAddr != l.Addr().String() {
+		t.Errorf("Wrong session or server: %v / %v", stats.SessionID, stats.ServerAddr)
+	}
+	if stats.PacketsUp != 1 || stats.BytesUp != 6 || stats.PacketsDown != 1 || stats.BytesDown != 6 {
+		t.Errorf("Wrong traffic counts: %+v", stats)
+	}
+	if stats.DialAttempts != 2 || stats.DialFailures != 1 || stats.Reconnects != 0 {
+		t.Errorf("Wrong dial counts: %+v", stats)
+	}
+	if stats.Outage <= 0 {
+		t.Error("Failed dial should have caused an outage")
+	}
+	if stats.DroppedPackets != 0 {
+		t.Errorf("Nothing should have been dropped, got %d", stats.DroppedPackets)
+	}
+	if stats.SinceLastDownstream <= 0 || stats.SinceLastDownstream > time.Second {
+		t.Errorf("Wrong time since last downstream packet: %v", stats.SinceLastDownstream)
+	}
+
+	c.Close()
+	c.Write([]byte("packet"))
+	if stats := c.Stats(); stats.DroppedPackets != 1 || stats.ServerAddr != "" {
+		t.Errorf("Write after close should drop packet and leave client disconnected: %+v", stats)
+	}
+}
+
+func TestOutageWhenServerCloses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		rwc := framed.NewReadWriteCloser(conn)
+		rwc.EnableBigFrames()
+		b := make([]byte, protocol.MaxHelloSize)
+		rwc.Read(b)
+		rwc.Read(b)
+		conn.Close()
+	}()
+
+	c := NewClient(ioutil.Discard, &Opts{
+		IdleTimeout: time.Second,
+		DialServer: func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", l.Addr().String())
+		},
+	})
+	defer c.Close()
+	if _, err := c.Write([]byte("packet")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().ServerAddr != "" {
+		if time.Now().After(deadline) {
+			t.Fatal("Server closing the connection not noticed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if stats := c.Stats(); stats.Outage <= 0 {
+		t.Error("Server closing the connection should have caused an outage")
+	}
+}
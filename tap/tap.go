@@ -0,0 +1,8 @@
+// tap provides access to Linux TAP devices, which carry Ethernet frames, and
+// to Linux bridges to which such devices can be attached.
+package tap
+
+const (
+	// EthernetHeaderSize is the size of an Ethernet header without VLAN tags
+	EthernetHeaderSize = 14
+)
@@ -0,0 +1,161 @@
+package tap
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	ifNameSize = 16
+
+	// SIOCBRADDIF and SIOCBRDELIF from linux/sockios.h
+	siocBRADDIF = 0x89a2
+	siocBRDELIF = 0x89a3
+)
+
+// ifReq mirrors struct ifreq from linux/if.h for requests that take flags.
+type ifReq struct {
+	Name  [ifNameSize]byte
+	Flags uint16
+	_     [22]byte
+}
+
+// ifReqIndex mirrors struct ifreq from linux/if.h for requests that take an
+// interface index.
+type ifReqIndex struct {
+	Name  [ifNameSize]byte
+	Index int32
+	_     [20]byte
+}
+
+// newIfReq builds an ifReq for the named interface. Names that don't fit are
+// truncated, leaving room for the terminating NUL.
+func newIfReq(name string, flags uint16) *ifReq {
+	req := &ifReq{Flags: flags}
+	copy(req.Name[:ifNameSize-1], name)
+	return req
+}
+
+// newIfReqIndex builds an ifReqIndex for the named interface.
+func newIfReqIndex(name string, index int32) *ifReqIndex {
+	req := &ifReqIndex{Index: index}
+	copy(req.Name[:ifNameSize-1], name)
+	return req
+}
+
+// Device is an open TAP device.
+type Device struct {
+	*os.File
+	name string
+}
+
+// Name returns the name of the device.
+func (d *Device) Name() string {
+	return d.name
+}
+
+// Open opens (creating if necessary) the TAP device with the given name and
+// brings it up. The name may contain a %d, in which case the kernel picks the
+// next free number. If mtu is greater than 0, the device's MTU is set to it.
+func Open(name string, mtu int) (*Device, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.New("unable to open /dev/net/tun: %v", err)
+	}
+	req := newIfReq(name, syscall.IFF_TAP|syscall.IFF_NO_PI)
+	if err := ioctl(uintptr(fd), syscall.TUNSETIFF, unsafe.Pointer(req)); err != nil {
+		syscall.Close(fd)
+		return nil, errors.New("unable to create TAP device %v: %v", name, err)
+	}
+	// use non-blocking mode so that the runtime poller can interrupt reads on Close
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, errors.New("unable to set TAP device %v to non-blocking: %v", name, err)
+	}
+	d := &Device{
+		File: os.NewFile(uintptr(fd), "/dev/net/tun"),
+		name: string(bytes.TrimRight(req.Name[:], "\x00")),
+	}
+	if mtu > 0 {
+		if err := setMTU(d.name, mtu); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	if err := setUp(d.name); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// AddToBridge attaches the named interface to the named bridge.
+func AddToBridge(bridge string, ifName string) error {
+	return bridgeIoctl(bridge, ifName, siocBRADDIF)
+}
+
+// RemoveFromBridge detaches the named interface from the named bridge.
+func RemoveFromBridge(bridge string, ifName string) error {
+	return bridgeIoctl(bridge, ifName, siocBRDELIF)
+}
+
+func bridgeIoctl(bridge string, ifName string, request uintptr) error {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return errors.New("unable to find interface %v: %v", ifName, err)
+	}
+	return withSocket(func(fd uintptr) error {
+		req := newIfReqIndex(bridge, int32(iface.Index))
+		if err := ioctl(fd, request, unsafe.Pointer(req)); err != nil {
+			return errors.New("unable to update bridge %v with %v: %v", bridge, ifName, err)
+		}
+		return nil
+	})
+}
+
+func setUp(name string) error {
+	return withSocket(func(fd uintptr) error {
+		req := newIfReq(name, 0)
+		if err := ioctl(fd, syscall.SIOCGIFFLAGS, unsafe.Pointer(req)); err != nil {
+			return errors.New("unable to get flags for %v: %v", name, err)
+		}
+		req.Flags |= syscall.IFF_UP
+		if err := ioctl(fd, syscall.SIOCSIFFLAGS, unsafe.Pointer(req)); err != nil {
+			return errors.New("unable to bring up %v: %v", name, err)
+		}
+		return nil
+	})
+}
+
+func setMTU(name string, mtu int) error {
+	return withSocket(func(fd uintptr) error {
+		// the MTU occupies the same position in struct ifreq as the index
+		req := newIfReqIndex(name, int32(mtu))
+		if err := ioctl(fd, syscall.SIOCSIFMTU, unsafe.Pointer(req)); err != nil {
+			return errors.New("unable to set MTU for %v: %v", name, err)
+		}
+		return nil
+	})
+}
+
+func withSocket(fn func(fd uintptr) error) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return errors.New("unable to open control socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	return fn(uintptr(fd))
+}
+
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package tap
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// sizeofIfReq is sizeof(struct ifreq) on Linux
+const sizeofIfReq = 40
+
+func TestIfReqEncoding(t *testing.T) {
+	if size := unsafe.Sizeof(ifReq{}); size != sizeofIfReq {
+		t.Errorf("ifReq is %d bytes, struct ifreq is %d", size, sizeofIfReq)
+	}
+	if size := unsafe.Sizeof(ifReqIndex{}); size != sizeofIfReq {
+		t.Errorf("ifReqIndex is %d bytes, struct ifreq is %d", size, sizeofIfReq)
+	}
+
+	req := newIfReq("pf%d", 0x1002)
+	b := (*[sizeofIfReq]byte)(unsafe.Pointer(req))[:]
+	if string(b[:5]) != "pf%d\x00" {
+		t.Errorf("Wrong name %q", b[:ifNameSize])
+	}
+	if flags := binary.LittleEndian.Uint16(b[ifNameSize:]); flags != 0x1002 {
+		t.Errorf("Wrong flags %#x", flags)
+	}
+
+	reqIndex := newIfReqIndex("br0", 1500)
+	b = (*[sizeofIfReq]byte)(unsafe.Pointer(reqIndex))[:]
+	if index := binary.LittleEndian.Uint32(b[ifNameSize:]); index != 1500 {
+		t.Errorf("Wrong index %d", index)
+	}
+
+	long := newIfReq(strings.Repeat("x", 2*ifNameSize), 0)
+	if long.Name[ifNameSize-1] != 0 || long.Name[ifNameSize-2] != 'x' {
+		t.Errorf("Long names should be truncated and NUL terminated, got %q", long.Name)
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+package tap
+
+import (
+	"os"
+
+	"github.com/getlantern/errors"
+)
+
+var errUnsupported = errors.New("unsupported platform (currently TAP devices are only supported on linux)")
+
+// Device is an open TAP device.
+type Device struct {
+	*os.File
+	name string
+}
+
+// Name returns the name of the device.
+func (d *Device) Name() string {
+	return d.name
+}
+
+// Open opens a TAP device. On non-linux platforms, this always fails.
+func Open(name string, mtu int) (*Device, error) {
+	return nil, errUnsupported
+}
+
+// AddToBridge attaches an interface to a bridge. On non-linux platforms, this
+// always fails.
+func AddToBridge(bridge string, ifName string) error {
+	return errUnsupported
+}
+
+// RemoveFromBridge detaches an interface from a bridge. On non-linux
+// platforms, this always fails.
+func RemoveFromBridge(bridge string, ifName string) error {
+	return errUnsupported
+}
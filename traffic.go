@@ -0,0 +1,344 @@
+package packetforward
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/packetforward/packet"
+)
+
+const (
+	// trackingFactor determines how many more entries than requested the
+	// traffic tables track, which keeps the top entries accurate while less
+	// used ones come and go.
+	trackingFactor = 4
+
+	// maxDNSLabels bounds the number of names learned from DNS responses
+	maxDNSLabels = 4096
+)
+
+// TrafficEntry is the traffic for one destination, port or protocol.
+// Upstream traffic is traffic from the client towards the destination,
+// downstream traffic is traffic from the destination back to the client.
+type TrafficEntry struct {
+	// Key identifies the entry, for example "203.0.113.1", "tcp/443" or "udp"
+	Key string
+
+	// Label, if known, is a name for a destination learned from DNS responses
+	Label string
+
+	BytesUp     int64
+	BytesDown   int64
+	PacketsUp   int64
+	PacketsDown int64
+}
+
+// Bytes is the total traffic in both directions
+func (e *TrafficEntry) Bytes() int64 {
+	return e.BytesUp + e.BytesDown
+}
+
+// Traffic breaks down the client's traffic by destination IP, destination
+// port and protocol, with the heaviest entries first. Entries that fell out
+// of and later reentered the tables undercount their traffic.
+type Traffic struct {
+	Destinations []*TrafficEntry
+	Ports        []*TrafficEntry
+	Protocols    []*TrafficEntry
+}
+
+// trafficTracker keeps bounded tables of the traffic passing through a client.
+type trafficTracker struct {
+	n            int
+	ethernet     bool
+	reverseDNS   bool
+	destinations *topTable
+	ports        *topTable
+	protocols    *topTable
+	labels       map[string]string
+	mx           sync.Mutex
+}
+
+func newTrafficTracker(n int, ethernet bool, reverseDNS bool) *trafficTracker {
+	return &trafficTracker{
+		n:            n,
+		ethernet:     ethernet,
+		reverseDNS:   reverseDNS,
+		destinations: newTopTable(n * trackingFactor),
+		ports:        newTopTable(n * trackingFactor),
+		protocols:    newTopTable(n * trackingFactor),
+		labels:       make(map[string]string),
+	}
+}
+
+// upstream records a packet written to the client
+func (t *trafficTracker) upstream(pkt []byte) {
+	t.track(pkt, true)
+}
+
+// downstream records a packet received from the server
+func (t *trafficTracker) downstream(pkt []byte) {
+	t.track(pkt, false)
+}
+
+func (t *trafficTracker) track(pkt []byte, up bool) {
+	size := len(pkt)
+	if t.ethernet {
+		var ok bool
+		if pkt, ok = packet.FromEthernet(pkt); !ok {
+			return
+		}
+	}
+	ip, err := packet.ParseIP(pkt)
+	if err != nil {
+		return
+	}
+	remote := ip.Dst()
+	if !up {
+		remote = ip.Src()
+	}
+	proto, transport := ip.Transport()
+	protoName := protocolName(proto)
+	port := -1
+	if srcPort, dstPort, ok := packet.Ports(proto, transport); ok {
+		port = int(dstPort)
+		if !up {
+			port = int(srcPort)
+		}
+	}
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.destinations.add(remote.String(), size, up)
+	if port >= 0 {
+		t.ports.add(protoName+"/"+strconv.Itoa(port), size, up)
+	}
+	t.protocols.add(protoName, size, up)
+	if t.reverseDNS && !up && proto == packet.ProtocolUDP && port == 53 {
+		if udp, err := packet.ParseUDP(transport); err == nil {
+			t.learnLabels(udp.Payload())
+		}
+	}
+}
+
+// learnLabels remembers the names of the addresses in a DNS response
+func (t *trafficTracker) learnLabels(msg []byte) {
+	name, addrs := parseDNSResponse(msg)
+	if name == "" {
+		return
+	}
+	for _, addr := range addrs {
+		key := addr.String()
+		if _, known := t.labels[key]; !known && len(t.labels) >= maxDNSLabels {
+			// make room by forgetting an arbitrary name
+			for evict := range t.labels {
+				delete(t.labels, evict)
+				break
+			}
+		}
+		t.labels[key] = name
+	}
+}
+
+func (t *trafficTracker) snapshot() *Traffic {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	traffic := &Traffic{
+		Destinations: t.destinations.top(t.n),
+		Ports:        t.ports.top(t.n),
+		Protocols:    t.protocols.top(t.n),
+	}
+	for _, entry := range traffic.Destinations {
+		entry.Label = t.labels[entry.Key]
+	}
+	return traffic
+}
+
+func protocolName(proto byte) string {
+	switch proto {
+	case packet.ProtocolTCP:
+		return "tcp"
+	case packet.ProtocolUDP:
+		return "udp"
+	case packet.ProtocolICMP, packet.ProtocolICMPv6:
+		return "icmp"
+	default:
+		return "ip/" + strconv.Itoa(int(proto))
+	}
+}
+
+// topTable tracks traffic for a bounded number of keys using the Space-Saving
+// algorithm. When it's full, a new key replaces the key with the lowest weight
+// and inherits that weight, so that newcomers aren't immediately evicted by
+// each other. Weights only rank keys for eviction, entries report their own
+// traffic.
+type topTable struct {
+	capacity int
+	entries  map[string]*topEntry
+	heap     topHeap
+}
+
+type topEntry struct {
+	TrafficEntry
+	// weight is the entry's traffic plus the weight it inherited
+	weight int64
+	index  int
+}
+
+// topHeap is a min-heap of entries ordered by weight
+type topHeap []*topEntry
+
+func (h topHeap) Len() int           { return len(h) }
+func (h topHeap) Less(i, j int) bool { return h[i].weight < h[j].weight }
+func (h topHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topHeap) Push(x interface{}) {
+	entry := x.(*topEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *topHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+func newTopTable(capacity int) *topTable {
+	return &topTable{
+		capacity: capacity,
+		entries:  make(map[string]*topEntry, capacity),
+		heap:     make(topHeap, 0, capacity),
+	}
+}
+
+func (t *topTable) add(key string, size int, up bool) {
+	entry := t.entries[key]
+	if entry == nil {
+		entry = &topEntry{TrafficEntry: TrafficEntry{Key: key}}
+		if len(t.heap) < t.capacity {
+			heap.Push(&t.heap, entry)
+		} else {
+			// replace the lightest entry in place
+			lightest := t.heap[0]
+			delete(t.entries, lightest.Key)
+			entry.weight = lightest.weight
+			entry.index = 0
+			t.heap[0] = entry
+		}
+		t.entries[key] = entry
+	}
+	if up {
+		entry.BytesUp += int64(size)
+		entry.PacketsUp++
+	} else {
+		entry.BytesDown += int64(size)
+		entry.PacketsDown++
+	}
+	entry.weight += int64(size)
+	heap.Fix(&t.heap, entry.index)
+}
+
+// top returns copies of the n entries with the most traffic
+func (t *topTable) top(n int) []*TrafficEntry {
+	result := make([]*TrafficEntry, 0, len(t.entries))
+	for _, entry := range t.entries {
+		e := entry.TrafficEntry
+		result = append(result, &e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Bytes() == result[j].Bytes() {
+			return result[i].Key < result[j].Key
+		}
+		return result[i].Bytes() > result[j].Bytes()
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// parseDNSResponse returns the queried name and the A and AAAA addresses in a
+// DNS response. It returns an empty name if msg isn't a DNS response.
+func parseDNSResponse(msg []byte) (string, []net.IP) {
+	if len(msg) < 12 || msg[2]&0x80 == 0 {
+		return "", nil
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:6]))
+	answers := int(binary.BigEndian.Uint16(msg[6:8]))
+	if questions != 1 {
+		return "", nil
+	}
+	name, offset := readDNSName(msg, 12)
+	if name == "" || offset+4 > len(msg) {
+		return "", nil
+	}
+	offset += 4 // type and class
+
+	var addrs []net.IP
+	for i := 0; i < answers; i++ {
+		_, offset = readDNSName(msg, offset)
+		if offset < 0 || offset+10 > len(msg) {
+			break
+		}
+		rrType := binary.BigEndian.Uint16(msg[offset:])
+		rdLength := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+rdLength > len(msg) {
+			break
+		}
+		rdata := msg[offset : offset+rdLength]
+		if rrType == 1 && rdLength == net.IPv4len || rrType == 28 && rdLength == net.IPv6len {
+			addrs = append(addrs, net.IP(append([]byte{}, rdata...)))
+		}
+		offset += rdLength
+	}
+	return name, addrs
+}
+
+// readDNSName reads a possibly compressed name starting at offset and returns
+// it along with the offset following it. The offset is negative if the name
+// is invalid.
+func readDNSName(msg []byte, offset int) (string, int) {
+	var labels []string
+	next := -1
+	for jumps := 0; jumps < 16; {
+		if offset >= len(msg) {
+			return "", -1
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) {
+				return "", -1
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+			jumps++
+		default:
+			if offset+1+length > len(msg) {
+				return "", -1
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+	return "", -1
+}
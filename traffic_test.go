@@ -0,0 +1,145 @@
+package packetforward
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/getlantern/packetforward/packet"
+)
+
+var (
+	clientIP = net.ParseIP("10.0.0.2").To4()
+	dnsIP    = net.ParseIP("8.8.8.8").To4()
+	webIP    = net.ParseIP("203.0.113.7").To4()
+)
+
+// ipv4Packet builds an IPv4 packet with a TCP or UDP header followed by payload
+func ipv4Packet(proto byte, src, dst net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	transportLength := 8
+	if proto == packet.ProtocolTCP {
+		transportLength = 20
+	}
+	pkt := make([]byte, 20+transportLength+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = proto
+	copy(pkt[12:], src)
+	copy(pkt[16:], dst)
+	binary.BigEndian.PutUint16(pkt[20:], srcPort)
+	binary.BigEndian.PutUint16(pkt[22:], dstPort)
+	if proto == packet.ProtocolUDP {
+		binary.BigEndian.PutUint16(pkt[24:], uint16(transportLength+len(payload)))
+	}
+	copy(pkt[20+transportLength:], payload)
+	return pkt
+}
+
+// dnsResponse builds a response to an A query for name with the given answers,
+// using a compression pointer to the question for each answer's name
+func dnsResponse(name string, answers ...net.IP) []byte {
+	msg := []byte{0x12, 0x34, 0x81, 0x80, 0, 1, 0, byte(len(answers)), 0, 0, 0, 0}
+	for _, label := range splitLabels(name) {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, 1, 0, 1)
+	for _, answer := range answers {
+		msg = append(msg, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		msg = append(msg, answer.To4()...)
+	}
+	return msg
+}
+
+func splitLabels(name string) []string {
+	var labels []string
+	start := 0
+	for i := 0; i <= len(name); i++ {
+		if i == len(name) || name[i] == '.' {
+			labels = append(labels, name[start:i])
+			start = i + 1
+		}
+	}
+	return labels
+}
+
+func TestTraffic(t *testing.T) {
+	tracker := newTrafficTracker(2, false, true)
+	tracker.upstream(ipv4Packet(packet.ProtocolUDP, clientIP, dnsIP, 40000, 53, make([]byte, 30)))
+	tracker.downstream(ipv4Packet(packet.ProtocolUDP, dnsIP, clientIP, 53, 40000, dnsResponse("www.example.com", webIP)))
+	for i := 0; i < 3; i++ {
+		tracker.upstream(ipv4Packet(packet.ProtocolTCP, clientIP, webIP, 50000, 443, nil))
+		tracker.downstream(ipv4Packet(packet.ProtocolTCP, webIP, clientIP, 443, 50000, make([]byte, 1000)))
+	}
+	tracker.upstream(ipv4Packet(packet.ProtocolTCP, clientIP, net.ParseIP("198.51.100.1"), 50001, 80, nil))
+
+	traffic := tracker.snapshot()
+	if len(traffic.Destinations) != 2 {
+		t.Fatalf("Expected top 2 destinations, got %d", len(traffic.Destinations))
+	}
+	top := traffic.Destinations[0]
+	if top.Key != webIP.String() || top.Label != "www.example.com" {
+		t.Errorf("Wrong top destination: %+v", top)
+	}
+	if top.PacketsUp != 3 || top.PacketsDown != 3 || top.BytesUp != 3*40 || top.BytesDown != 3*1040 {
+		t.Errorf("Wrong counts for top destination: %+v", top)
+	}
+	if traffic.Destinations[1].Key != dnsIP.String() {
+		t.Errorf("Wrong second destination: %+v", traffic.Destinations[1])
+	}
+	if traffic.Ports[0].Key != "tcp/443" || traffic.Ports[1].Key != "udp/53" {
+		t.Errorf("Wrong top ports: %v, %v", traffic.Ports[0].Key, traffic.Ports[1].Key)
+	}
+	if len(traffic.Protocols) != 2 || traffic.Protocols[0].Key != "tcp" || traffic.Protocols[1].Key != "udp" {
+		t.Errorf("Wrong protocols: %+v", traffic.Protocols)
+	}
+}
+
+func TestTopTableEviction(t *testing.T) {
+	table := newTopTable(2)
+	table.add("big", 1000, true)
+	table.add("small", 10, true)
+	table.add("new", 100, false)
+	top := table.top(10)
+	if len(top) != 2 || top[0].Key != "big" || top[1].Key != "new" {
+		t.Errorf("Smallest entry should have been evicted: %+v", top)
+	}
+
+	// a returning key replaces the lightest entry and inherits its weight
+	table.add("small", 50, true)
+	top = table.top(10)
+	if len(top) != 2 || top[0].Key != "big" || top[1].Key != "small" {
+		t.Fatalf("Lightest entry should have been replaced: %+v", top)
+	}
+	if top[1].Bytes() != 50 || top[1].PacketsUp != 1 {
+		t.Errorf("Inherited weight shouldn't be reported as traffic: %+v", top[1])
+	}
+	table.add("other", 10, true)
+	if _, found := table.entries["big"]; !found {
+		t.Error("Heaviest entry should remain")
+	}
+	if table.entries["other"].weight != 170 {
+		t.Errorf("Newcomer should inherit the evicted weight, got %d", table.entries["other"].weight)
+	}
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	name, addrs := parseDNSResponse(dnsResponse("example.com", webIP, dnsIP))
+	if name != "example.com" || len(addrs) != 2 || !addrs[0].Equal(webIP) || !addrs[1].Equal(dnsIP) {
+		t.Errorf("Wrong parse: %v %v", name, addrs)
+	}
+	query := dnsResponse("example.com")
+	query[2] = 0x01
+	if name, _ := parseDNSResponse(query); name != "" {
+		t.Error("Queries should be ignored")
+	}
+	// pointer loop
+	loop := []byte{0, 0, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 12}
+	if name, _ := parseDNSResponse(loop); name != "" {
+		t.Error("Compression loops should be rejected")
+	}
+	for i := range dnsResponse("example.com", webIP) {
+		parseDNSResponse(dnsResponse("example.com", webIP)[:i])
+	}
+}